@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "conference-server/conference"
+)
+
+// --- Registered nicknames ---
+
+// Any free name can be used without an account, but a name can also be
+// registered with a password through Register, which reserves it on the
+// whole server. Its owner logs in with Login and joins with the token it
+// returns as "account-token" metadata; without it a registered name is
+// turned away with UNAUTHENTICATED and an "account-required" trailer. A
+// guest who is already using the name when its owner joins, NickServ-style,
+// is disconnected from every room to make way. A guest who registers or logs
+// in mid-session keeps its stream by sending the token in an IDENTIFY
+// command. Passwords are kept as bcrypt hashes, in memory or, with
+// -account-store, on disk as <dir>/<hex of the name>.json; tokens are
+// forgotten on restart, so clients log in again.
+
+const (
+	minPasswordLen = 8
+	maxPasswordLen = 72 // bcrypt ignores anything longer
+)
+
+type accountStore struct {
+	dir string // empty keeps the accounts in memory only; set before serving
+
+	mu       sync.Mutex
+	accounts map[string]*pb.Account // map[username]
+	names    map[string]string      // map[skeleton]username, see usernames.go
+	tokens   map[string]string      // map[username]token, one per account while the server runs
+}
+
+func newAccountStore() *accountStore {
+	return &accountStore{accounts: make(map[string]*pb.Account), names: make(map[string]string), tokens: make(map[string]string)}
+}
+
+// load reads the accounts kept in dir and saves new ones there from now on.
+func (st *accountStore) load(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		acct := &pb.Account{}
+		if err := protojson.Unmarshal(data, acct); err != nil || acct.Username == "" || acct.PasswordBcrypt == "" {
+			log.Printf("Skipping unreadable account %s: %v", path, err)
+			continue
+		}
+		st.names[usernameSkeleton(acct.Username)] = acct.Username
+		st.accounts[acct.Username] = acct
+	}
+	st.dir = dir
+	log.Printf("Account store at %s holds %d registered names", dir, len(st.accounts))
+	return nil
+}
+
+// save writes acct to disk if there is a store there. st.mu must be held.
+func (st *accountStore) save(acct *pb.Account) error {
+	if st.dir == "" {
+		return nil
+	}
+	data, err := protojson.Marshal(acct)
+	if err != nil {
+		return err
+	}
+	// Written aside and renamed, so a crash can't leave half an account
+	path := filepath.Join(st.dir, hex.EncodeToString([]byte(acct.Username))+".json")
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// session returns the account's token, making one on first use. st.mu must
+// be held.
+func (st *accountStore) session(acct *pb.Account) *pb.AccountSession {
+	token, ok := st.tokens[acct.Username]
+	if !ok {
+		token = newSessionToken()
+		st.tokens[acct.Username] = token
+	}
+	return &pb.AccountSession{Username: acct.Username, Token: token, RegisteredAt: acct.RegisteredAt}
+}
+
+// check reports whether token is the login token of name's account. An
+// error means name is registered and token isn't its own, or that name looks
+// like a registered name and can't be used at all.
+func (st *accountStore) check(name, token string) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if owner, ok := st.names[usernameSkeleton(name)]; ok && owner != name {
+		return false, status.Errorf(codes.AlreadyExists, "the name '%s' is too close to the registered name '%s'", name, owner)
+	}
+	if _, ok := st.accounts[name]; !ok {
+		return false, nil
+	}
+	if token == "" || st.tokens[name] != token {
+		return false, status.Errorf(codes.Unauthenticated, "the name '%s' is registered; log in to use it", name)
+	}
+	return true, nil
+}
+
+// exists reports whether name is registered.
+func (st *accountStore) exists(name string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, ok := st.accounts[name]
+	return ok
+}
+
+func accountTokenFromMetadata(md metadata.MD) string {
+	if vals := md.Get("account-token"); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+func (s *server) Register(ctx context.Context, req *pb.AccountRequest) (*pb.AccountSession, error) {
+	if err := checkUsername(req.Username); err != nil {
+		return nil, err
+	}
+	if len(req.Password) < minPasswordLen || len(req.Password) > maxPasswordLen {
+		return nil, status.Errorf(codes.InvalidArgument, "the password must be %d to %d bytes long", minPasswordLen, maxPasswordLen)
+	}
+	if reason, banned := s.bans.Check(req.Username, hostOf(peerAddr(ctx))); banned {
+		return nil, status.Errorf(codes.PermissionDenied, "you are banned from this server: %s", reason)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not hash the password: %v", err)
+	}
+
+	st := s.accounts
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	skeleton := usernameSkeleton(req.Username)
+	if owner, taken := st.names[skeleton]; taken {
+		if owner != req.Username {
+			return nil, status.Errorf(codes.AlreadyExists, "the name '%s' is too close to the registered name '%s'", req.Username, owner)
+		}
+		return nil, status.Errorf(codes.AlreadyExists, "the name '%s' is already registered", req.Username)
+	}
+	acct := &pb.Account{Username: req.Username, PasswordBcrypt: string(hash), RegisteredAt: time.Now().Unix()}
+	if err := st.save(acct); err != nil {
+		log.Printf("Could not save the account of '%s': %v", req.Username, err)
+		return nil, status.Error(codes.Internal, "could not save the account")
+	}
+	st.accounts[acct.Username] = acct
+	st.names[skeleton] = acct.Username
+	log.Printf("Name '%s' registered from %s", req.Username, peerAddr(ctx))
+	return st.session(acct), nil
+}
+
+func (s *server) Login(ctx context.Context, req *pb.AccountRequest) (*pb.AccountSession, error) {
+	st := s.accounts
+	st.mu.Lock()
+	acct, ok := st.accounts[req.Username]
+	st.mu.Unlock()
+	// Unknown names and wrong passwords look the same from outside
+	denied := status.Error(codes.Unauthenticated, "wrong name or password")
+	if !ok {
+		return nil, denied
+	}
+	if bcrypt.CompareHashAndPassword([]byte(acct.PasswordBcrypt), []byte(req.Password)) != nil {
+		log.Printf("Failed login for '%s' from %s", req.Username, peerAddr(ctx))
+		return nil, denied
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.session(acct), nil
+}
+
+// displaceGuests disconnects everyone using name, or one that looks like it,
+// without being logged in to its account, so its owner can join. They leave
+// at once; their handlers only wind down the stream.
+func (s *server) displaceGuests(name string) {
+	skeleton := usernameSkeleton(name)
+	s.rooms.Range(func(room *Room) bool {
+		v, ok := room.names.Load(skeleton)
+		if !ok || v.(*Client).registered.Load() {
+			return true
+		}
+		guest := v.(*Client)
+		if !room.RemoveClient(guest) {
+			return true
+		}
+		room.releaseOwner(guest)
+		room.endShare(guest.id)
+		room.lowerHand(guest.id)
+		room.dropE2EKey(guest.id)
+		log.Printf("Guest '%s' (%s) displaced from room '%s' by the owner of the name '%s'", guest.id, guest.addr, room.id, name)
+		room.Broadcast(serverCommand(room.id, serverSender, &pb.Command{Type: "USER_LEFT", Value: guest.id}), "")
+		guest.Kick(fmt.Sprintf("the name '%s' is registered and its owner has logged in", name))
+		return true
+	})
+}
+
+// handleIdentifyCommand logs c in to the account of its name with the token
+// in an IDENTIFY command, reporting whether cmd was one. It lets a guest who
+// registered or logged in mid-session keep its stream.
+func (s *server) handleIdentifyCommand(r *Room, c *Client, cmd *pb.Command) bool {
+	if cmd.Type != "IDENTIFY" {
+		return false
+	}
+	registered, err := s.accounts.check(c.id, cmd.Value)
+	if !registered {
+		msg := fmt.Sprintf("the name '%s' is not registered", c.id)
+		if err != nil {
+			msg = status.Convert(err).Message()
+		}
+		reply(c, r, &pb.Command{Type: "ACCOUNT_DENIED", Value: msg})
+		return true
+	}
+	c.registered.Store(true)
+	log.Printf("'%s' identified in room '%s'", c.id, r.id)
+	s.displaceGuests(c.id)
+	reply(c, r, &pb.Command{Type: "IDENTIFIED", Value: c.id})
+	s.sendInbox(r, c)
+	return true
+}
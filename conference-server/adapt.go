@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "conference-server/conference"
+)
+
+// --- Adaptive media quality ---
+
+// A receiver whose queues keep backing up is stepped down through quality
+// levels rather than left shedding media until it is disconnected, so a
+// member on a slow WAN link can share a room with LAN users. At each level
+// audio is downsampled further, and video switches to a lighter simulcast
+// layer when the sender publishes one, or is thinned when it doesn't. A
+// receiver whose queues stay empty climbs back up one level at a time.
+const (
+	maxQualityLevel = 2
+	congestedAfter  = 25  // deliveries onto a half-full queue (~0.6 s of audio) before stepping down
+	recoveredAfter  = 500 // deliveries onto an empty queue (~12 s) before stepping back up
+
+	// simulcastTimeout is how long a layer counts as published after its
+	// last frame; long enough for a 1 fps screen share.
+	simulcastTimeout = 3 * time.Second
+)
+
+// qualityAudioRates is the highest sample rate forwarded at each level
+// (0 = as sent). Downsampled audio is also mixed down to mono.
+var qualityAudioRates = [maxQualityLevel + 1]int{0, 16000, 8000}
+
+type mediaQuality struct {
+	level      atomic.Int32
+	pressure   atomic.Int32 // >0: deliveries onto a backed-up queue in a row, <0: onto an empty one
+	videoLayer sync.Map     // map[videoTrack]uint32, the layer being forwarded
+	videoSkip  sync.Map     // map[videoTrack]*atomic.Uint32, frames seen while thinning
+}
+
+// videoTrack identifies one of a sender's video streams: a member may send
+// camera and screen at once, each with its own layers.
+type videoTrack struct {
+	sender string
+	source pb.VideoSource
+}
+
+// publishedLayers records when each simulcast layer of a track last carried
+// a frame (Unix ms).
+type publishedLayers [maxQualityLevel + 1]atomic.Int64
+
+// observeQueue moves c's quality level according to the depth of the queue
+// a message was just delivered to.
+func (c *Client) observeQueue(depth, capacity int) {
+	q := &c.quality
+	switch {
+	case depth*2 >= capacity:
+		if p := q.pressure.Add(1); p <= 0 {
+			q.pressure.Store(1)
+		} else if p >= congestedAfter {
+			q.pressure.Store(0)
+			if level := q.level.Load(); level < maxQualityLevel && q.level.CompareAndSwap(level, level+1) {
+				c.audioDrops.Store(0) // a fresh chance at the lower quality
+				log.Printf("Client '%s' is congested, lowering media quality to level %d", c.id, level+1)
+			}
+		}
+	case depth == 0:
+		if p := q.pressure.Add(-1); p >= 0 {
+			q.pressure.Store(-1)
+		} else if p <= -recoveredAfter {
+			q.pressure.Store(0)
+			if level := q.level.Load(); level > 0 && q.level.CompareAndSwap(level, level-1) {
+				log.Printf("Client '%s' caught up, raising media quality to level %d", c.id, level-1)
+			}
+		}
+	}
+}
+
+// QualityLevel returns c's current media quality level, 0 being full quality.
+func (c *Client) QualityLevel() int {
+	return int(c.quality.level.Load())
+}
+
+// adaptAudio returns msg as c should receive it at its quality level: as
+// is, or a copy downsampled to the level's rate. msg itself is shared with
+// the rest of the room and is never modified.
+func (c *Client) adaptAudio(msg *pb.ConferenceData) *pb.ConferenceData {
+	limit := qualityAudioRates[c.quality.level.Load()]
+	chunk := msg.GetAudioChunk()
+	rate, channels := int(chunk.SampleRate), int(chunk.Channels)
+	if rate == 0 {
+		rate = 44100
+	}
+	if channels == 0 {
+		channels = 1
+	}
+	if limit == 0 || rate <= limit {
+		return msg
+	}
+	return &pb.ConferenceData{
+		Sender: msg.Sender, RoomId: msg.RoomId, Timestamp: msg.Timestamp, MessageId: msg.MessageId,
+		Payload: &pb.ConferenceData_AudioChunk{AudioChunk: &pb.AudioChunk{
+			Data:          downsamplePCM(chunk.Data, rate, channels, limit),
+			Sender:        chunk.Sender,
+			RoomId:        chunk.RoomId,
+			SampleRate:    int32(limit),
+			Channels:      1,
+			Seq:           chunk.Seq,
+			CaptureTimeMs: chunk.CaptureTimeMs,
+		}},
+	}
+}
+
+// downsamplePCM converts 16-bit little-endian PCM to mono at toRate,
+// averaging the source samples each output sample covers (a crude but
+// adequate low-pass). data comes back unchanged unless rate, channels and
+// toRate are positive and toRate is below rate.
+func downsamplePCM(data []byte, rate, channels, toRate int) []byte {
+	if rate <= 0 || channels <= 0 || toRate <= 0 || toRate >= rate {
+		return data
+	}
+	frames := len(data) / (2 * channels)
+	mono := make([]int32, frames)
+	for f := 0; f < frames; f++ {
+		for ch := 0; ch < channels; ch++ {
+			mono[f] += int32(int16(binary.LittleEndian.Uint16(data[(f*channels+ch)*2:])))
+		}
+		mono[f] /= int32(channels)
+	}
+	out := make([]byte, 2*(frames*toRate/rate))
+	for i := 0; i < len(out)/2; i++ {
+		start, end := i*rate/toRate, max((i+1)*rate/toRate, i*rate/toRate+1)
+		var sum int32
+		for _, v := range mono[start:min(end, frames)] {
+			sum += v
+		}
+		binary.LittleEndian.PutUint16(out[2*i:], uint16(int16(sum/int32(max(1, min(end, frames)-start)))))
+	}
+	return out
+}
+
+// notePublished records that frame's simulcast layer is being sent.
+func (r *Room) notePublished(frame *pb.VideoFrame) {
+	if frame.Layer > maxQualityLevel {
+		return
+	}
+	v, _ := r.videoLayers.LoadOrStore(videoTrack{frame.Sender, frame.Source}, new(publishedLayers))
+	v.(*publishedLayers)[frame.Layer].Store(time.Now().UnixMilli())
+}
+
+// layerFor returns the lightest layer of track, up to level, that the
+// sender is currently publishing.
+func (r *Room) layerFor(track videoTrack, level uint32) uint32 {
+	v, ok := r.videoLayers.Load(track)
+	if !ok {
+		return 0
+	}
+	cutoff := time.Now().Add(-simulcastTimeout).UnixMilli()
+	for l := level; l > 0; l-- {
+		if v.(*publishedLayers)[l].Load() >= cutoff {
+			return l
+		}
+	}
+	return 0
+}
+
+// wantsFrame reports whether c should get frame at its quality level: only
+// frames of the layer chosen for it, and when even the lightest layer is
+// heavier than c's level calls for, only one frame in 2, 4... A layer switch
+// or a skipped frame leaves c waiting for a keyframe, as after a drop.
+func (c *Client) wantsFrame(room *Room, frame *pb.VideoFrame) bool {
+	track := videoTrack{frame.Sender, frame.Source}
+	level := uint32(c.quality.level.Load())
+	layer := room.layerFor(track, level)
+	if frame.Layer != layer {
+		return false
+	}
+	if prev, loaded := c.quality.videoLayer.Swap(track, layer); loaded && prev.(uint32) != layer && !frame.Keyframe {
+		if _, waiting := c.videoNeedsKey.LoadOrStore(frame.Sender, true); !waiting {
+			requestKeyframe(c, frame.Sender)
+		}
+		return false
+	}
+	excess := level - layer
+	if excess == 0 {
+		return true
+	}
+	if frame.Keyframe {
+		if _, waiting := c.videoNeedsKey.Load(frame.Sender); waiting {
+			return true
+		}
+	}
+	v, _ := c.quality.videoSkip.LoadOrStore(track, new(atomic.Uint32))
+	if v.(*atomic.Uint32).Add(1)%(1<<excess) == 0 {
+		return true
+	}
+	if !frame.Keyframe {
+		// Later frames depend on this one; wait for the sender's next regular
+		// keyframe rather than asking for one, which would defeat the purpose.
+		c.videoNeedsKey.Store(frame.Sender, true)
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// pcm16 encodes samples as 16-bit little-endian PCM.
+func pcm16(samples ...int16) []byte {
+	out := make([]byte, 2*len(samples))
+	for i, v := range samples {
+		binary.LittleEndian.PutUint16(out[2*i:], uint16(v))
+	}
+	return out
+}
+
+func TestDownsamplePCM(t *testing.T) {
+	tests := []struct {
+		name                   string
+		data                   []byte
+		rate, channels, toRate int
+		want                   []byte
+	}{
+		{"halves mono", pcm16(100, 300, -100, -300), 16000, 1, 8000, pcm16(200, -200)},
+		{"averages a third", pcm16(3, 6, 9, 30, 60, 90), 48000, 1, 16000, pcm16(6, 60)},
+		{"mixes stereo to mono", pcm16(100, 300, 500, 700), 16000, 2, 8000, pcm16(400)},
+		{"keeps the sign", pcm16(-32768, -32768), 16000, 1, 8000, pcm16(-32768)},
+		{"drops a partial frame", append(pcm16(10, 20, 30, 40), 0xff), 16000, 1, 8000, pcm16(15, 35)},
+		{"empty", nil, 16000, 1, 8000, []byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := downsamplePCM(tt.data, tt.rate, tt.channels, tt.toRate); !slices.Equal(got, tt.want) {
+				t.Errorf("downsamplePCM(%v, %d, %d, %d) = %v, want %v", tt.data, tt.rate, tt.channels, tt.toRate, got, tt.want)
+			}
+		})
+	}
+}
+
+// Rates and channel counts come from clients; the ones it can't use must
+// leave the data alone rather than panic.
+func TestDownsamplePCMUnchanged(t *testing.T) {
+	data := pcm16(1, 2, 3, 4)
+	tests := []struct {
+		name                   string
+		rate, channels, toRate int
+	}{
+		{"negative channels", 16000, -2, 8000},
+		{"zero channels", 16000, 0, 8000},
+		{"negative rate", -16000, 1, 8000},
+		{"zero rate", 0, 1, 8000},
+		{"zero target", 16000, 1, 0},
+		{"same rate", 16000, 1, 16000},
+		{"higher target", 8000, 1, 16000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := downsamplePCM(data, tt.rate, tt.channels, tt.toRate); !slices.Equal(got, data) {
+				t.Errorf("downsamplePCM(%d, %d, %d) = %v, want the input", tt.rate, tt.channels, tt.toRate, got)
+			}
+		})
+	}
+}
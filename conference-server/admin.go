@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "conference-server/conference"
+)
+
+// --- Admin auth ---
+
+// requireAdmin checks the "admin-token" metadata against the configured token.
+// Admin RPCs are disabled entirely when the server runs without one.
+func (s *server) requireAdmin(ctx context.Context) error {
+	if s.adminToken == "" {
+		return status.Error(codes.Unavailable, "admin RPCs are disabled (start the server with -admin-token)")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	vals := md.Get("admin-token")
+	if len(vals) == 0 || subtle.ConstantTimeCompare([]byte(vals[0]), []byte(s.adminToken)) != 1 {
+		return status.Error(codes.PermissionDenied, "invalid admin token")
+	}
+	return nil
+}
+
+// --- Ban list ---
+
+type banList struct {
+	mu    sync.RWMutex
+	names map[string]string // map[skeleton]reason, see usernames.go
+	ips   map[string]string // map[ip]reason
+}
+
+func newBanList() *banList {
+	return &banList{names: make(map[string]string), ips: make(map[string]string)}
+}
+
+// Check returns the ban reason if name or ip is banned.
+func (b *banList) Check(name, ip string) (string, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if reason, ok := b.names[usernameSkeleton(name)]; ok {
+		return reason, true
+	}
+	if reason, ok := b.ips[ip]; ok {
+		return reason, true
+	}
+	return "", false
+}
+
+// Add bans every name and ip in one step, after validating all of them, so a
+// bad entry in a ban file leaves the list untouched.
+func (b *banList) Add(names, ips []string, reason string) error {
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("empty username in ban list")
+		}
+	}
+	for _, ip := range ips {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid IP address '%s'", ip)
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, name := range names {
+		b.names[usernameSkeleton(canonicalUsername(name))] = reason
+	}
+	for _, ip := range ips {
+		b.ips[net.ParseIP(ip).String()] = reason
+	}
+	return nil
+}
+
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// --- Room selection ---
+
+// adminRooms returns the named room, or every room when roomID is empty.
+func (s *server) adminRooms(roomID string) ([]*Room, error) {
+	if roomID != "" {
+		r, ok := s.rooms.Load(roomID)
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "room '%s' not found", roomID)
+		}
+		return []*Room{r}, nil
+	}
+	var rooms []*Room
+	s.rooms.Range(func(r *Room) bool {
+		rooms = append(rooms, r)
+		return true
+	})
+	return rooms, nil
+}
+
+// --- Moderation RPCs ---
+
+func (s *server) KickUsers(ctx context.Context, req *pb.KickUsersRequest) (*pb.ModerationResult, error) {
+	if !req.All && len(req.Usernames) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "usernames or all must be provided")
+	}
+	rooms, err := s.adminRooms(req.RoomId)
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[string]bool)
+	for _, name := range req.Usernames {
+		targets[name] = true
+	}
+	result := &pb.ModerationResult{}
+	for _, room := range rooms {
+		room.clients.Range(func(_, value interface{}) bool {
+			client := value.(*Client)
+			if req.All || targets[client.id] {
+				client.Kick("kicked by an administrator: " + req.Reason)
+				result.Affected++
+				result.Details = append(result.Details, fmt.Sprintf("%s@%s", client.id, room.id))
+			}
+			return true
+		})
+	}
+	audit(ctx, "kick", req.RoomId, "all=%v users=%v reason=%q affected=%d", req.All, req.Usernames, req.Reason, result.Affected)
+	return result, nil
+}
+
+func (s *server) PurgeMessages(ctx context.Context, req *pb.PurgeMessagesRequest) (*pb.ModerationResult, error) {
+	if req.Sender == "" {
+		return nil, status.Error(codes.InvalidArgument, "sender must be provided")
+	}
+	until := req.Until
+	if until == 0 {
+		until = time.Now().Unix()
+	}
+	if req.Since > until {
+		return nil, status.Error(codes.InvalidArgument, "since must not be after until")
+	}
+	rooms, err := s.adminRooms(req.RoomId)
+	if err != nil {
+		return nil, err
+	}
+	result := &pb.ModerationResult{}
+	for _, room := range rooms {
+		room.history.Purge(req.Sender, req.Since, until)
+		if n := room.events.Purge(req.Sender, req.Since, until); n > 0 {
+			result.Affected += int32(n)
+			result.Details = append(result.Details, fmt.Sprintf("%s: %d", room.id, n))
+		}
+	}
+	audit(ctx, "purge", req.RoomId, "sender=%q since=%d until=%d affected=%d", req.Sender, req.Since, until, result.Affected)
+	return result, nil
+}
+
+func (s *server) BanUsers(ctx context.Context, req *pb.BanRequest) (*pb.ModerationResult, error) {
+	if len(req.Usernames) == 0 && len(req.Ips) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "usernames or ips must be provided")
+	}
+	if err := s.bans.Add(req.Usernames, req.Ips, req.Reason); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// Banned users that are currently connected are kicked right away
+	result := &pb.ModerationResult{}
+	rooms, _ := s.adminRooms("")
+	for _, room := range rooms {
+		room.clients.Range(func(_, value interface{}) bool {
+			client := value.(*Client)
+			if reason, banned := s.bans.Check(client.id, hostOf(client.addr)); banned {
+				client.Kick("banned by an administrator: " + reason)
+				result.Affected++
+				result.Details = append(result.Details, fmt.Sprintf("%s@%s", client.id, room.id))
+			}
+			return true
+		})
+	}
+	audit(ctx, "ban", "", "users=%v ips=%v reason=%q kicked=%d", req.Usernames, req.Ips, req.Reason, result.Affected)
+	return result, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "conference-server/conference"
+)
+
+// --- Operator announcements ---
+
+// An announcement is an important text message from the server to one room
+// or to every room, for maintenance notices and deadlines. It is recorded
+// in each room's history like any message, so those who join a bit later
+// still see it. A scheduled one waits in memory until its time and goes to
+// the rooms that exist then; it is lost if the server restarts.
+type scheduledAnnouncements struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer // map[announcementID]timer
+}
+
+// announce sends text to roomID, or to every room if roomID is empty, and
+// returns the rooms it reached.
+func (s *server) announce(roomID, text string) ([]string, error) {
+	rooms, err := s.adminRooms(roomID)
+	if err != nil {
+		return nil, err
+	}
+	var reached []string
+	for _, room := range rooms {
+		msg := seal(&pb.ConferenceData{Payload: &pb.ConferenceData_TextMessage{TextMessage: &pb.ChatMessage{
+			Sender: serverSender, RoomId: room.id, Content: text, Timestamp: time.Now().Unix(), Important: true,
+		}}}, room.id, serverSender)
+		room.history.Record(msg)
+		room.Broadcast(msg, "")
+		reached = append(reached, room.id)
+	}
+	return reached, nil
+}
+
+// schedule sends the announcement at when and returns its ID.
+func (a *scheduledAnnouncements) schedule(when time.Time, send func()) string {
+	id := newSessionToken()[:12]
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.timers == nil {
+		a.timers = make(map[string]*time.Timer)
+	}
+	a.timers[id] = time.AfterFunc(time.Until(when), func() {
+		defer recoverPanic("announcement "+id, nil)
+		a.mu.Lock()
+		_, pending := a.timers[id]
+		delete(a.timers, id)
+		a.mu.Unlock()
+		if pending {
+			send()
+		}
+	})
+	return id
+}
+
+// cancel drops a scheduled announcement, reporting whether it was pending.
+func (a *scheduledAnnouncements) cancel(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t, ok := a.timers[id]
+	if ok {
+		t.Stop()
+		delete(a.timers, id)
+	}
+	return ok
+}
+
+// --- Admin RPC ---
+
+func (s *server) BroadcastAnnouncement(ctx context.Context, req *pb.AnnouncementRequest) (*pb.ModerationResult, error) {
+	if req.CancelId != "" {
+		if !s.announcements.cancel(req.CancelId) {
+			return nil, status.Errorf(codes.NotFound, "no scheduled announcement '%s'", req.CancelId)
+		}
+		audit(ctx, "unannounce", "", "id=%q", req.CancelId)
+		return &pb.ModerationResult{Affected: 1, Details: []string{req.CancelId}}, nil
+	}
+	if req.Text == "" {
+		return nil, status.Error(codes.InvalidArgument, "text must be provided")
+	}
+
+	if when := time.Unix(req.At, 0); req.At != 0 && when.After(time.Now()) {
+		if req.RoomId != "" {
+			if _, err := s.adminRooms(req.RoomId); err != nil {
+				return nil, err
+			}
+		}
+		id := s.announcements.schedule(when, func() {
+			reached, err := s.announce(req.RoomId, req.Text)
+			if err != nil {
+				log.Printf("Scheduled announcement not sent: %v", err)
+				return
+			}
+			log.Printf("Scheduled announcement sent to %d rooms", len(reached))
+		})
+		audit(ctx, "announce", req.RoomId, "id=%q at=%s text=%q", id, when.Format(time.RFC3339), req.Text)
+		return &pb.ModerationResult{Details: []string{fmt.Sprintf("%s scheduled for %s", id, when.Format(time.RFC3339))}}, nil
+	}
+
+	reached, err := s.announce(req.RoomId, req.Text)
+	if err != nil {
+		return nil, err
+	}
+	audit(ctx, "announce", req.RoomId, "text=%q rooms=%d", req.Text, len(reached))
+	return &pb.ModerationResult{Affected: int32(len(reached)), Details: reached}, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	pb "conference-server/conference"
+)
+
+// nullChunk is what the Java client's null audio backend (FileAudioBackend
+// with no input file) captures: 20 ms of silence at 16 kHz mono, paced to
+// real time.
+const (
+	nullChunkBytes = 640
+	nullChunkEvery = 20 * time.Millisecond
+)
+
+// TestAudioOverUnixSocket streams a null-backend microphone between two
+// clients connected over a unix:// listener. Every chunk must reach the other
+// client stamped with its speaker and in order, and GetAudioStats must count
+// them without loss.
+func TestAudioOverUnixSocket(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	sock := filepath.Join(t.TempDir(), "conference.sock")
+	listeners, err := openListeners([]string{"unix://" + sock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer()
+	gs := grpc.NewServer(srv.serverOptions()...)
+	pb.RegisterConferenceServiceServer(gs, srv)
+	go gs.Serve(listeners[0])
+	defer gs.Stop()
+	if _, err := openListeners([]string{"unix://" + sock}); err == nil {
+		t.Fatal("a second server could take over a socket in use")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	join := func(name string) (*grpc.ClientConn, pb.ConferenceService_JoinConferenceClient, string) {
+		conn, err := grpc.NewClient("unix://"+sock, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		stream, err := pb.NewConferenceServiceClient(conn).JoinConference(ctx)
+		if err == nil {
+			err = stream.Send(&pb.ConferenceData{RoomId: "audio", Sender: name,
+				Payload: &pb.ConferenceData_Command{Command: &pb.Command{Type: "JOIN"}}})
+		}
+		for err == nil {
+			var msg *pb.ConferenceData
+			if msg, err = stream.Recv(); err == nil && msg.GetCommand().GetType() == "SESSION" {
+				return conn, stream, msg.GetCommand().GetValue()
+			}
+		}
+		t.Fatalf("%s couldn't join: %v", name, err)
+		return nil, nil, ""
+	}
+	_, speaker, _ := join("ana")
+	conn, listener, token := join("beto")
+
+	const chunks = 25
+	sent := make(chan error, 1)
+	go func() {
+		next := time.Now()
+		for seq := uint32(1); seq <= chunks; seq++ {
+			time.Sleep(time.Until(next))
+			next = next.Add(nullChunkEvery)
+			err := speaker.Send(&pb.ConferenceData{RoomId: "audio", Sender: "ana", Payload: &pb.ConferenceData_AudioChunk{
+				AudioChunk: &pb.AudioChunk{Data: make([]byte, nullChunkBytes), SampleRate: 16000, Channels: 1, Seq: seq, CaptureTimeMs: time.Now().UnixMilli()}}})
+			if err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- nil
+	}()
+
+	for want := uint32(1); want <= chunks; {
+		msg, err := listener.Recv()
+		if err != nil {
+			t.Fatalf("beto's stream ended after %d chunks: %v", want-1, err)
+		}
+		chunk := msg.GetAudioChunk()
+		if chunk == nil {
+			continue
+		}
+		switch {
+		case chunk.Sender != "ana" || chunk.RoomId != "audio":
+			t.Fatalf("chunk %d came as from '%s' in '%s', want 'ana' in 'audio'", want, chunk.Sender, chunk.RoomId)
+		case chunk.Seq != want:
+			t.Fatalf("got chunk %d, want %d", chunk.Seq, want)
+		case len(chunk.Data) != nullChunkBytes || chunk.SampleRate != 16000 || chunk.Channels != 1:
+			t.Fatalf("chunk %d has %d bytes at %d Hz, %d channels; want %d at 16000 Hz, mono", want, len(chunk.Data), chunk.SampleRate, chunk.Channels, nullChunkBytes)
+		}
+		for _, b := range chunk.Data {
+			if b != 0 {
+				t.Fatalf("chunk %d isn't silent", want)
+			}
+		}
+		want++
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("ana's stream failed: %v", err)
+	}
+
+	stats, err := pb.NewConferenceServiceClient(conn).GetAudioStats(metadata.AppendToOutgoingContext(ctx, "session-token", token), &pb.AudioStatsRequest{RoomId: "audio", Username: "ana"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := stats.Clients[0]; s.PacketsSent != chunks || s.PacketsLost != 0 {
+		t.Errorf("ana's stats say %d sent and %d lost, want %d and none", s.PacketsSent, s.PacketsLost, chunks)
+	}
+}
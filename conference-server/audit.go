@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "conference-server/conference"
+)
+
+// --- Audit log ---
+
+// Joins and leaves, kicks, bans, file transfers, their scan verdicts and
+// admin actions are kept as AuditEntry records, for accountability on
+// servers several groups share. Each is also written to the server log with
+// an AUDIT prefix. With -audit-log the records are appended to that file as
+// JSON Lines, which the server only ever appends to; without it the last
+// maxAuditMemory are kept in memory. Admins read them back with
+// QueryAuditLog.
+
+const (
+	maxAuditMemory    = 10000
+	defaultAuditLimit = 1000
+	maxAuditLine      = 1 << 20
+)
+
+type auditLog struct {
+	mu     sync.Mutex
+	seq    uint64
+	file   *os.File         // nil keeps the records in memory only
+	recent []*pb.AuditEntry // the last maxAuditMemory, when there's no file
+}
+
+// auditTrail is the server's audit log. Rooms record to it too, so it isn't
+// tied to a server.
+var auditTrail = &auditLog{}
+
+// open appends records to path from now on, numbering them after the last
+// one already there.
+func (a *auditLog) open(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	var last uint64
+	n := 0
+	if err := scanAudit(f, func(e *pb.AuditEntry) { last = e.Seq; n++ }); err != nil {
+		f.Close()
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.file, a.seq, a.recent = f, last, nil
+	log.Printf("Audit log at %s holds %d records", path, n)
+	return nil
+}
+
+func (a *auditLog) onDisk() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file != nil
+}
+
+// count returns how many records were kept so far, including those already
+// in the file when the server started.
+func (a *auditLog) count() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.seq
+}
+
+// record stamps e with the next sequence number and the time and keeps it.
+func (a *auditLog) record(e *pb.AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.seq++
+	e.Seq = a.seq
+	e.Timestamp = time.Now().Unix()
+	log.Printf("AUDIT %s", describeAudit(e))
+	if a.file == nil {
+		if len(a.recent) == maxAuditMemory {
+			a.recent = a.recent[1:]
+		}
+		a.recent = append(a.recent, e)
+		return
+	}
+	data, err := protojson.Marshal(e)
+	if err == nil {
+		_, err = a.file.Write(append(data, '\n'))
+	}
+	if err != nil {
+		log.Printf("Could not write audit record %d: %v", e.Seq, err)
+	}
+}
+
+// query returns the last q.Limit records matching q, oldest first.
+func (a *auditLog) query(q *pb.AuditQuery) ([]*pb.AuditEntry, error) {
+	limit := int(q.Limit)
+	if limit == 0 {
+		limit = defaultAuditLimit
+	}
+	var matches []*pb.AuditEntry
+	keep := func(e *pb.AuditEntry) {
+		if !auditMatches(e, q) {
+			return
+		}
+		if len(matches) == limit {
+			matches = matches[1:]
+		}
+		matches = append(matches, e)
+	}
+
+	a.mu.Lock()
+	if a.file == nil {
+		for _, e := range a.recent {
+			keep(e)
+		}
+		a.mu.Unlock()
+		return matches, nil
+	}
+	// Only what was written so far, so a record being appended meanwhile
+	// can't be read half-way
+	end, err := a.file.Seek(0, io.SeekEnd)
+	name := a.file.Name()
+	a.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return matches, scanAudit(io.LimitReader(f, end), keep)
+}
+
+// scanAudit calls fn with every record in r, skipping lines that aren't one.
+func scanAudit(r io.Reader, fn func(*pb.AuditEntry)) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxAuditLine)
+	for sc.Scan() {
+		e := &pb.AuditEntry{}
+		if protojson.Unmarshal(sc.Bytes(), e) != nil {
+			continue
+		}
+		fn(e)
+	}
+	return sc.Err()
+}
+
+func auditMatches(e *pb.AuditEntry, q *pb.AuditQuery) bool {
+	switch {
+	case q.Since != 0 && e.Timestamp < q.Since,
+		q.Until != 0 && e.Timestamp > q.Until,
+		q.Action != "" && e.Action != q.Action,
+		q.RoomId != "" && e.RoomId != q.RoomId,
+		q.User != "" && e.Actor != q.User && e.Target != q.User:
+		return false
+	}
+	return true
+}
+
+// describeAudit formats e for the server log, leaving out empty fields.
+func describeAudit(e *pb.AuditEntry) string {
+	parts := []string{fmt.Sprintf("#%d action=%s", e.Seq, e.Action)}
+	add := func(key, val string) {
+		if val != "" {
+			parts = append(parts, fmt.Sprintf("%s=%q", key, val))
+		}
+	}
+	add("actor", e.Actor)
+	add("addr", e.Addr)
+	add("room", e.RoomId)
+	add("target", e.Target)
+	if e.Size != 0 {
+		parts = append(parts, fmt.Sprintf("size=%d", e.Size))
+	}
+	add("outcome", e.Outcome)
+	add("detail", e.Detail)
+	return strings.Join(parts, " ")
+}
+
+// audit records an admin action.
+func audit(ctx context.Context, action, room, format string, args ...interface{}) {
+	auditTrail.record(&pb.AuditEntry{
+		Action:  action,
+		Actor:   "admin",
+		Addr:    peerAddr(ctx),
+		RoomId:  room,
+		Outcome: "ok",
+		Detail:  fmt.Sprintf(format, args...),
+	})
+}
+
+// auditTransferEnd records how a transfer the server was relaying stopped.
+func auditTransferEnd(id string, tx transfer, reason string) {
+	e := &pb.AuditEntry{Action: "file", Outcome: "aborted", Detail: fmt.Sprintf("transfer %s: %s", id, reason)}
+	switch tx := tx.(type) {
+	case *p2pTransfer:
+		e.Actor, e.RoomId, e.Target = tx.from, tx.room, tx.filename
+	case *broadcastTransfer:
+		e.Actor, e.RoomId, e.Target = tx.announcer, tx.room, tx.filename
+	}
+	auditTrail.record(e)
+}
+
+func (s *server) QueryAuditLog(ctx context.Context, q *pb.AuditQuery) (*pb.AuditLog, error) {
+	if q.Limit < 0 || q.Limit > maxAuditMemory {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be between 0 and %d", maxAuditMemory)
+	}
+	entries, err := auditTrail.query(q)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "reading the audit log: %v", err)
+	}
+	return &pb.AuditLog{Entries: entries}, nil
+}
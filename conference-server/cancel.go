@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "conference-server/conference"
+)
+
+// --- Cancelling transfers ---
+
+// transferAbort lets the server stop a transfer mid-stream: when someone
+// cancels it or the meeting it belongs to ends. Both ends' TransferFile
+// handlers return abortErr once aborted is closed.
+type transferAbort struct {
+	aborted chan struct{}
+	once    sync.Once
+	reason  string // set before aborted is closed
+}
+
+func newTransferAbort() transferAbort {
+	return transferAbort{aborted: make(chan struct{})}
+}
+
+func (a *transferAbort) abort(reason string) {
+	a.once.Do(func() {
+		a.reason = reason
+		close(a.aborted)
+	})
+}
+
+func (a *transferAbort) abortErr() error {
+	return status.Error(codes.Aborted, a.reason)
+}
+
+// abortTransfer stops tx and forgets it.
+func (s *server) abortTransfer(id string, tx transfer, reason string) {
+	tx.abort(reason)
+	s.activeTransfers.Delete(id)
+	auditTransferEnd(id, tx, reason)
+	log.Printf("Aborted transfer '%s': %s", id, reason)
+}
+
+// CancelTransfer stops a transfer on behalf of one of its users. A 1:1
+// request nobody has answered yet is declined instead; its sender sees
+// Accepted=false. Only the two ends of a 1:1 transfer, or the announcer of a
+// room-wide one, may cancel it, on a call with their session token.
+// Receivers of a broadcast transfer just close their own download stream.
+func (s *server) CancelTransfer(ctx context.Context, req *pb.CancelTransferRequest) (*pb.CancelTransferRequest, error) {
+	if req.TransferId == "" || req.Sender == "" {
+		return nil, status.Error(codes.InvalidArgument, "transfer_id and sender must be provided")
+	}
+	reason := "cancelled by " + req.Sender
+	if req.Reason != "" {
+		reason += ": " + req.Reason
+	}
+
+	s.transferMu.Lock()
+	p, pending := s.transferResponses[req.TransferId]
+	s.transferMu.Unlock()
+	if pending {
+		if _, _, err := s.roomMember(ctx, p.room, req.Sender); err != nil {
+			return nil, err
+		}
+		if req.Sender != p.from && req.Sender != p.to {
+			return nil, status.Error(codes.PermissionDenied, "only the sender or the recipient can cancel this transfer")
+		}
+		select {
+		case p.answer <- &pb.FileTransferResponse{TransferId: req.TransferId, Accepted: false}:
+			log.Printf("Transfer request '%s' %s", req.TransferId, reason)
+		default: // answered meanwhile; it's about to become active
+		}
+		return req, nil
+	}
+
+	val, ok := s.activeTransfers.Load(req.TransferId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "transfer '%s' not found or already finished", req.TransferId)
+	}
+	switch tx := val.(type) {
+	case *p2pTransfer:
+		if _, _, err := s.roomMember(ctx, tx.room, req.Sender); err != nil {
+			return nil, err
+		}
+		if req.Sender != tx.from && req.Sender != tx.to {
+			return nil, status.Error(codes.PermissionDenied, "only the sender or the recipient can cancel this transfer")
+		}
+	case *broadcastTransfer:
+		if _, _, err := s.roomMember(ctx, tx.room, req.Sender); err != nil {
+			return nil, err
+		}
+		if req.Sender != tx.announcer {
+			return nil, status.Errorf(codes.PermissionDenied, "only '%s' can cancel this transfer for everyone", tx.announcer)
+		}
+	}
+	s.abortTransfer(req.TransferId, val.(transfer), reason)
+	return req, nil
+}
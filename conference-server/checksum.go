@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "conference-server/conference"
+)
+
+// --- Transfer verification ---
+
+// Senders put the file's SHA-256 in the FileTransferRequest (or the
+// BroadcastFileAnnouncement) and a CRC-32 in every FileChunk. The server
+// relays both untouched; the receiver checks them once the last chunk is in
+// and reports the result with CompleteTransfer, which lands on the sender's
+// main stream as a TransferComplete.
+
+// CompleteTransfer delivers a receiver's verdict on a finished transfer to
+// the user who sent the file.
+func (s *server) CompleteTransfer(ctx context.Context, tc *pb.TransferComplete) (*pb.TransferComplete, error) {
+	if tc.TransferId == "" || tc.RoomId == "" || tc.Recipient == "" {
+		return nil, status.Error(codes.InvalidArgument, "transfer_id, room_id and recipient must be provided")
+	}
+	room, ok := s.rooms.Load(tc.RoomId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "room '%s' not found", tc.RoomId)
+	}
+	val, ok := room.users.Load(tc.Recipient)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "user '%s' is not in room '%s'", tc.Recipient, tc.RoomId)
+	}
+	done := &pb.AuditEntry{Action: "file", Actor: tc.Recipient, RoomId: room.id, Outcome: "verified", Detail: "transfer " + tc.TransferId + " to " + tc.Sender}
+	if tc.Ok {
+		log.Printf("Transfer '%s' from '%s' verified by '%s'", tc.TransferId, tc.Recipient, tc.Sender)
+	} else {
+		log.Printf("Transfer '%s' from '%s' failed verification at '%s': %s", tc.TransferId, tc.Recipient, tc.Sender, tc.Error)
+		done.Outcome, done.Detail = "corrupt", done.Detail+": "+tc.Error
+	}
+	auditTrail.record(done)
+	msg := seal(&pb.ConferenceData{Payload: &pb.ConferenceData_TransferComplete{TransferComplete: tc}}, room.id, tc.Sender)
+	if !val.(*Client).Send(msg) {
+		return nil, status.Errorf(codes.Unavailable, "could not reach '%s'", tc.Recipient)
+	}
+	return tc, nil
+}
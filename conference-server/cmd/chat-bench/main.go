@@ -0,0 +1,319 @@
+// Command chat-bench loads a conference-server with synthetic clients and
+// reports how long their messages took to arrive and how many never did.
+//
+//	chat-bench [-addr host:port] [-clients N] [-rooms M] [-rate R] [-size B] [-duration D] [-drain D] [-audio]
+//
+// Client i joins room bench-<i mod M> as bench-<i>, each over a connection of
+// its own: the server tells the clients in a room apart by address. Once all
+// of them are in, each sends R text messages a second for the duration, and
+// with -audio 20 ms of synthetic PCM every 20 ms. Messages carry the time they
+// were sent, and sender and receivers share this process's clock, so the
+// latency is end to end. Every message is expected by everyone else in its
+// room; whatever has not arrived -drain after the last send counts as dropped.
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	pb "conference-server/conference"
+)
+
+const (
+	audioRate     = 16000 // Hz, mono
+	audioInterval = 20 * time.Millisecond
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:50051", "conference-server address (host:port or unix:///path)")
+	clients := flag.Int("clients", 10, "synthetic clients")
+	rooms := flag.Int("rooms", 2, "rooms the clients are spread across")
+	rate := flag.Float64("rate", 1, "text messages per second per client (0 = none)")
+	size := flag.Int("size", 64, "bytes of padding in each text message")
+	duration := flag.Duration("duration", 10*time.Second, "how long to send for")
+	drain := flag.Duration("drain", 2*time.Second, "how long to wait for stragglers after the last send")
+	audio := flag.Bool("audio", false, "also send 20 ms of synthetic audio every 20 ms per client")
+	flag.Usage = usage
+	flag.Parse()
+	if *clients < 2 || *rooms < 1 || *rate < 0 || *size < 0 || *duration <= 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	start := time.Now() // anything sent before this is history from an earlier run
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	log.Printf("Joining %d clients to %d rooms on %s", *clients, *rooms, *addr)
+	bench := make([]*benchClient, *clients)
+	var joins sync.WaitGroup
+	for i := range bench {
+		joins.Add(1)
+		go func(i int) {
+			defer joins.Done()
+			c, err := join(ctx, *addr, fmt.Sprintf("bench-%d", i), fmt.Sprintf("bench-%d", i%*rooms))
+			if err != nil {
+				log.Printf("bench-%d could not join: %v", i, err)
+				return
+			}
+			bench[i] = c
+		}(i)
+	}
+	joins.Wait()
+
+	// Only clients that made it in are senders and receivers
+	inRoom := make(map[string]int)
+	var joined []*benchClient
+	for _, c := range bench {
+		if c != nil {
+			joined = append(joined, c)
+			inRoom[c.room]++
+		}
+	}
+	if len(joined) == 0 {
+		log.Fatalf("No client could join")
+	}
+
+	var text, voice stats
+	var receivers sync.WaitGroup
+	for _, c := range joined {
+		c.peers = inRoom[c.room] - 1
+		receivers.Add(1)
+		go func(c *benchClient) {
+			defer receivers.Done()
+			c.receive(start, &text, &voice)
+		}(c)
+	}
+
+	log.Printf("%d clients in, sending for %v", len(joined), *duration)
+	deadline := time.Now().Add(*duration)
+	var senders sync.WaitGroup
+	for i, c := range joined {
+		senders.Add(1)
+		go func(c *benchClient, offset time.Duration) {
+			defer senders.Done()
+			c.send(deadline, offset, *rate, *size, *audio, &text, &voice)
+		}(c, time.Duration(i)*time.Second/time.Duration(len(joined))) // spread the first sends over a second
+	}
+	senders.Wait()
+
+	time.Sleep(*drain)
+	// Leave cleanly, or the server would hold the names for a reconnect and
+	// turn away the next run
+	for _, c := range joined {
+		c.stream.CloseSend()
+	}
+	left := make(chan struct{})
+	go func() {
+		receivers.Wait()
+		close(left)
+	}()
+	select {
+	case <-left:
+	case <-time.After(5 * time.Second):
+		log.Printf("Some clients did not leave in time")
+	}
+	cancel()
+	for _, c := range joined {
+		c.conn.Close()
+	}
+
+	fmt.Printf("%d of %d clients in %d rooms, %v\n", len(joined), *clients, *rooms, *duration)
+	text.report("text")
+	if *audio {
+		voice.report("audio")
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: chat-bench [-addr host:port] [-clients N] [-rooms M] [-rate R] [-size B] [-duration D] [-drain D] [-audio]")
+	flag.PrintDefaults()
+}
+
+// --- Clients ---
+
+type benchClient struct {
+	name, room string
+	peers      int // others in the room, who should get what this one sends
+	conn       *grpc.ClientConn
+	stream     pb.ConferenceService_JoinConferenceClient
+}
+
+// join connects as name and waits for the room's WELCOME.
+func join(ctx context.Context, addr, name, room string) (*benchClient, error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	stream, err := pb.NewConferenceServiceClient(conn).JoinConference(ctx)
+	if err == nil {
+		err = stream.Send(&pb.ConferenceData{RoomId: room, Sender: name,
+			Payload: &pb.ConferenceData_Command{Command: &pb.Command{Type: "JOIN"}}})
+	}
+	for err == nil {
+		var msg *pb.ConferenceData
+		if msg, err = stream.Recv(); err != nil {
+			break
+		}
+		switch cmd := msg.GetCommand(); cmd.GetType() {
+		case "WELCOME":
+			return &benchClient{name: name, room: room, conn: conn, stream: stream}, nil
+		case "ERROR":
+			err = fmt.Errorf("%s", cmd.GetValue())
+		}
+	}
+	conn.Close()
+	return nil, err
+}
+
+// send sends text at rate and, with audio, a chunk every audioInterval until
+// deadline. It is the only goroutine sending on the stream.
+func (c *benchClient) send(deadline time.Time, offset time.Duration, rate float64, size int, audio bool, text, voice *stats) {
+	time.Sleep(offset)
+	var textTick, audioTick <-chan time.Time
+	if rate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer t.Stop()
+		textTick = t.C
+	}
+	if audio {
+		t := time.NewTicker(audioInterval)
+		defer t.Stop()
+		audioTick = t.C
+	}
+	padding := strings.Repeat("x", size)
+	pcm := tone(audioRate * int(audioInterval/time.Millisecond) / 1000)
+	end := time.NewTimer(time.Until(deadline))
+	defer end.Stop()
+	var seq uint32
+	for {
+		var err error
+		select {
+		case <-end.C:
+			return
+		case <-textTick:
+			err = c.stream.Send(&pb.ConferenceData{RoomId: c.room, Sender: c.name,
+				Payload: &pb.ConferenceData_TextMessage{TextMessage: &pb.ChatMessage{
+					Sender: c.name, RoomId: c.room, Timestamp: time.Now().Unix(),
+					Content: fmt.Sprintf("bench %d %s", time.Now().UnixNano(), padding),
+				}}})
+			if err == nil {
+				text.sent(c.peers)
+			}
+		case <-audioTick:
+			seq++
+			err = c.stream.Send(&pb.ConferenceData{RoomId: c.room, Sender: c.name,
+				Payload: &pb.ConferenceData_AudioChunk{AudioChunk: &pb.AudioChunk{
+					Data: pcm, SampleRate: audioRate, Channels: 1, Seq: seq, CaptureTimeMs: time.Now().UnixMilli(),
+				}}})
+			if err == nil {
+				voice.sent(c.peers)
+			}
+		}
+		if err != nil {
+			log.Printf("%s stopped sending: %v", c.name, err)
+			return
+		}
+	}
+}
+
+// receive records the latency of every bench message sent since start,
+// until the server ends the stream.
+func (c *benchClient) receive(start time.Time, text, voice *stats) {
+	for {
+		msg, err := c.stream.Recv()
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		switch p := msg.Payload.(type) {
+		case *pb.ConferenceData_TextMessage:
+			rest, ok := strings.CutPrefix(p.TextMessage.Content, "bench ")
+			if !ok {
+				continue
+			}
+			stamp, _, _ := strings.Cut(rest, " ")
+			nanos, err := strconv.ParseInt(stamp, 10, 64)
+			if err != nil || nanos < start.UnixNano() {
+				continue
+			}
+			text.delivered(now.Sub(time.Unix(0, nanos)))
+		case *pb.ConferenceData_AudioChunk:
+			sent := time.UnixMilli(p.AudioChunk.CaptureTimeMs)
+			if sent.Before(start) {
+				continue
+			}
+			voice.delivered(now.Sub(sent))
+		}
+	}
+}
+
+// tone is n samples of a 440 Hz sine as 16-bit little-endian PCM, so the
+// audio is not all zeros to anything that looks at it.
+func tone(n int) []byte {
+	pcm := make([]byte, 2*n)
+	for i := 0; i < n; i++ {
+		v := int16(8000 * math.Sin(2*math.Pi*440*float64(i)/audioRate))
+		binary.LittleEndian.PutUint16(pcm[2*i:], uint16(v))
+	}
+	return pcm
+}
+
+// --- Results ---
+
+type stats struct {
+	messages  atomic.Int64
+	expected  atomic.Int64 // one per receiver of each message
+	mu        sync.Mutex
+	latencies []time.Duration // one per delivery
+}
+
+func (s *stats) sent(receivers int) {
+	s.messages.Add(1)
+	s.expected.Add(int64(receivers))
+}
+
+func (s *stats) delivered(latency time.Duration) {
+	s.mu.Lock()
+	s.latencies = append(s.latencies, latency)
+	s.mu.Unlock()
+}
+
+func (s *stats) report(kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expected, delivered := s.expected.Load(), int64(len(s.latencies))
+	dropped := max(expected-delivered, 0)
+	var share float64
+	if expected > 0 {
+		share = 100 * float64(dropped) / float64(expected)
+	}
+	fmt.Printf("%-6s sent %d, expected %d deliveries, delivered %d, dropped %d (%.2f%%)\n",
+		kind+":", s.messages.Load(), expected, delivered, dropped, share)
+	if delivered == 0 {
+		return
+	}
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	fmt.Printf("       latency p50 %v, p90 %v, p99 %v, max %v\n",
+		percentile(s.latencies, 50), percentile(s.latencies, 90), percentile(s.latencies, 99), percentile(s.latencies, 100))
+}
+
+// percentile of sorted, nearest rank
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1].Round(10 * time.Microsecond)
+}
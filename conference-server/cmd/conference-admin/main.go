@@ -0,0 +1,279 @@
+// Command conference-admin runs moderation actions against a conference-server.
+//
+//	conference-admin [-addr host:port] [-token T] kick  [-room R] [-all] [-reason TEXT] [user...]
+//	conference-admin [-addr host:port] [-token T] purge [-room R] -sender USER [-since RFC3339] [-until RFC3339]
+//	conference-admin [-addr host:port] [-token T] ban   [-file PATH] [-reason TEXT] [user-or-ip...]
+//	conference-admin [-addr host:port] [-token T] merge SOURCE TARGET
+//	conference-admin [-addr host:port] [-token T] split ROOM NEW_ROOM user...
+//	conference-admin [-addr host:port] [-token T] freeze [-for DURATION] [-reason TEXT] ROOM
+//	conference-admin [-addr host:port] [-token T] unfreeze ROOM
+//	conference-admin [-addr host:port] [-token T] announce [-room R] [-at RFC3339 | -in DURATION] TEXT...
+//	conference-admin [-addr host:port] [-token T] unannounce ID
+//	conference-admin [-addr host:port] [-token T] audit [-since RFC3339] [-until RFC3339] [-action A] [-user U] [-room R] [-limit N]
+//
+// The token defaults to $CONFERENCE_ADMIN_TOKEN.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	pb "conference-server/conference"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:50051", "conference-server address (host:port or unix:///path)")
+	token := flag.String("token", os.Getenv("CONFERENCE_ADMIN_TOKEN"), "admin token")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewConferenceServiceClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "admin-token", *token)
+
+	var result *pb.ModerationResult
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "kick":
+		result, err = kick(ctx, client, args)
+	case "purge":
+		result, err = purge(ctx, client, args)
+	case "ban":
+		result, err = ban(ctx, client, args)
+	case "merge":
+		if len(args) != 2 {
+			usage()
+			os.Exit(2)
+		}
+		result, err = client.MergeRooms(ctx, &pb.MergeRoomsRequest{SourceRoomId: args[0], TargetRoomId: args[1]})
+	case "split":
+		if len(args) < 3 {
+			usage()
+			os.Exit(2)
+		}
+		result, err = client.SplitRoom(ctx, &pb.SplitRoomRequest{RoomId: args[0], NewRoomId: args[1], Usernames: args[2:]})
+	case "freeze":
+		result, err = freeze(ctx, client, args)
+	case "unfreeze":
+		if len(args) != 1 {
+			usage()
+			os.Exit(2)
+		}
+		result, err = client.FreezeRoom(ctx, &pb.FreezeRoomRequest{RoomId: args[0], Frozen: false})
+	case "announce":
+		result, err = announce(ctx, client, args)
+	case "unannounce":
+		if len(args) != 1 {
+			usage()
+			os.Exit(2)
+		}
+		result, err = client.BroadcastAnnouncement(ctx, &pb.AnnouncementRequest{CancelId: args[0]})
+	case "audit":
+		if err := audit(ctx, client, args); err != nil {
+			log.Fatalf("audit failed: %v", err)
+		}
+		return
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %v", flag.Arg(0), err)
+	}
+	fmt.Printf("Affected: %d\n", result.Affected)
+	for _, d := range result.Details {
+		fmt.Printf("  %s\n", d)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: conference-admin [-addr host:port] [-token T] <kick|purge|ban|merge|split|freeze|unfreeze|announce|unannounce|audit> [options] [args]")
+	flag.PrintDefaults()
+}
+
+func kick(ctx context.Context, client pb.ConferenceServiceClient, args []string) (*pb.ModerationResult, error) {
+	fs := flag.NewFlagSet("kick", flag.ExitOnError)
+	room := fs.String("room", "", "room to act on (empty = all rooms)")
+	all := fs.Bool("all", false, "kick everyone in the room(s)")
+	reason := fs.String("reason", "", "reason shown to the kicked users")
+	fs.Parse(args)
+	return client.KickUsers(ctx, &pb.KickUsersRequest{RoomId: *room, Usernames: fs.Args(), All: *all, Reason: *reason})
+}
+
+func purge(ctx context.Context, client pb.ConferenceServiceClient, args []string) (*pb.ModerationResult, error) {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	room := fs.String("room", "", "room to act on (empty = all rooms)")
+	sender := fs.String("sender", "", "user whose messages are purged")
+	since := fs.String("since", "", "start of the range (RFC3339, empty = beginning)")
+	until := fs.String("until", "", "end of the range (RFC3339, empty = now)")
+	fs.Parse(args)
+
+	req := &pb.PurgeMessagesRequest{RoomId: *room, Sender: *sender}
+	var err error
+	if req.Since, err = parseTime(*since); err != nil {
+		return nil, err
+	}
+	if req.Until, err = parseTime(*until); err != nil {
+		return nil, err
+	}
+	return client.PurgeMessages(ctx, req)
+}
+
+func ban(ctx context.Context, client pb.ConferenceServiceClient, args []string) (*pb.ModerationResult, error) {
+	fs := flag.NewFlagSet("ban", flag.ExitOnError)
+	file := fs.String("file", "", "file with one username or IP per line (# starts a comment)")
+	reason := fs.String("reason", "", "reason recorded with the ban")
+	fs.Parse(args)
+
+	entries := fs.Args()
+	if *file != "" {
+		fromFile, err := readBanFile(*file)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fromFile...)
+	}
+	req := &pb.BanRequest{Reason: *reason}
+	for _, e := range entries {
+		if net.ParseIP(e) != nil {
+			req.Ips = append(req.Ips, e)
+		} else {
+			req.Usernames = append(req.Usernames, e)
+		}
+	}
+	return client.BanUsers(ctx, req)
+}
+
+func freeze(ctx context.Context, client pb.ConferenceServiceClient, args []string) (*pb.ModerationResult, error) {
+	fs := flag.NewFlagSet("freeze", flag.ExitOnError)
+	duration := fs.Duration("for", 0, "lift the freeze automatically after this long (0 = until unfreeze)")
+	reason := fs.String("reason", "", "reason shown to the room")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return nil, fmt.Errorf("exactly one room must be given")
+	}
+	return client.FreezeRoom(ctx, &pb.FreezeRoomRequest{
+		RoomId: fs.Arg(0), Frozen: true, Reason: *reason, DurationSeconds: int32(duration.Seconds()),
+	})
+}
+
+func announce(ctx context.Context, client pb.ConferenceServiceClient, args []string) (*pb.ModerationResult, error) {
+	fs := flag.NewFlagSet("announce", flag.ExitOnError)
+	room := fs.String("room", "", "room to announce to (empty = all rooms)")
+	at := fs.String("at", "", "send at this time (RFC3339) instead of now")
+	in := fs.Duration("in", 0, "send after this long instead of now")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return nil, fmt.Errorf("the announcement text must be given")
+	}
+	if *at != "" && *in != 0 {
+		return nil, fmt.Errorf("-at and -in can't be used together")
+	}
+
+	req := &pb.AnnouncementRequest{RoomId: *room, Text: strings.Join(fs.Args(), " ")}
+	var err error
+	if req.At, err = parseTime(*at); err != nil {
+		return nil, err
+	}
+	if *in > 0 {
+		req.At = time.Now().Add(*in).Unix()
+	}
+	return client.BroadcastAnnouncement(ctx, req)
+}
+
+func audit(ctx context.Context, client pb.ConferenceServiceClient, args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	since := fs.String("since", "", "start of the range (RFC3339, empty = beginning)")
+	until := fs.String("until", "", "end of the range (RFC3339, empty = now)")
+	action := fs.String("action", "", "only this action, e.g. join, leave, kick, ban, file, upload (empty = all)")
+	user := fs.String("user", "", "only records by or about this user")
+	room := fs.String("room", "", "only records about this room")
+	limit := fs.Int("limit", 0, "show the last N matching records (0 = server default)")
+	fs.Parse(args)
+
+	q := &pb.AuditQuery{Action: *action, User: *user, RoomId: *room, Limit: int32(*limit)}
+	var err error
+	if q.Since, err = parseTime(*since); err != nil {
+		return err
+	}
+	if q.Until, err = parseTime(*until); err != nil {
+		return err
+	}
+	auditLog, err := client.QueryAuditLog(ctx, q)
+	if err != nil {
+		return err
+	}
+	for _, e := range auditLog.Entries {
+		line := fmt.Sprintf("%6d %s %-9s %s", e.Seq, time.Unix(e.Timestamp, 0).Format(time.RFC3339), e.Action, e.Actor)
+		if e.Addr != "" {
+			line += " (" + e.Addr + ")"
+		}
+		if e.RoomId != "" {
+			line += " room=" + e.RoomId
+		}
+		if e.Target != "" {
+			line += fmt.Sprintf(" target=%q", e.Target)
+		}
+		if e.Size != 0 {
+			line += fmt.Sprintf(" size=%d", e.Size)
+		}
+		line += " " + e.Outcome
+		if e.Detail != "" {
+			line += ": " + e.Detail
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func readBanFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			entries = append(entries, line)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func parseTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q (want RFC3339): %v", s, err)
+	}
+	return t.Unix(), nil
+}
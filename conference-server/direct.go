@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc/peer"
+)
+
+// --- Direct 1:1 transfers ---
+
+// A sender that sets FileTransferRequest.direct lets the receiver offer a
+// direct connection: the receiver listens on a TCP port and lists the
+// addresses it can be reached at in FileTransferResponse.candidates. Those
+// are its own interface addresses, which only work on the same network, so
+// the server adds the address it sees the receiver connect from, with the
+// same port. The sender tries them in order and streams the chunks over
+// the first that connects, or falls back to TransferFile. The server relays
+// nothing for a direct transfer; the sender cancels the relay it no longer
+// needs.
+
+// withReflexiveCandidate appends the address the receiver's request came
+// from, on the port of its first candidate, unless it is already listed.
+func withReflexiveCandidate(ctx context.Context, candidates []string) []string {
+	if len(candidates) == 0 {
+		return candidates
+	}
+	_, port, err := net.SplitHostPort(candidates[0])
+	if err != nil {
+		return candidates
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return candidates
+	}
+	tcp, ok := p.Addr.(*net.TCPAddr)
+	if !ok || tcp.IP.IsLoopback() {
+		return candidates
+	}
+	reflexive := net.JoinHostPort(tcp.IP.String(), port)
+	for _, c := range candidates {
+		if c == reflexive {
+			return candidates
+		}
+	}
+	return append(candidates, reflexive)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	pb "conference-server/conference"
+)
+
+// --- End-to-end encrypted text ---
+
+// Members who turn encryption on publish an X25519 public key in an E2EKey;
+// the server keeps them in the order they came, forwards each to the whole
+// room (its owner included, so everyone sees the same order) and sends the
+// list to late joiners. The first member on it is the keeper, who makes the
+// room key and hands it to each of the others in a KeyEnvelope, which the
+// server passes on to its recipient alone. Encrypted messages are ordinary
+// ChatMessages whose text is in encrypted; the server relays and records
+// them without reading them. Everything else about the scheme lives in the
+// clients.
+
+const (
+	maxE2EKeyBytes     = 256
+	maxWrappedKeyBytes = 256
+	maxE2ENonceBytes   = 32
+	maxCiphertextBytes = 64 * 1024
+)
+
+type roomE2E struct {
+	mu   sync.Mutex
+	keys []*pb.E2EKey // in the order they were published
+}
+
+// publishE2EKey records c's key, or forgets it if the key is empty, and
+// tells the room.
+func (r *Room) publishE2EKey(c *Client, key *pb.E2EKey) {
+	if len(key.PublicKey) > maxE2EKeyBytes {
+		reply(c, r, &pb.Command{Type: "E2E_DENIED", Value: fmt.Sprintf("E2E public keys can't be longer than %d bytes", maxE2EKeyBytes)})
+		return
+	}
+	key.Owner = c.id
+	r.e2e.mu.Lock()
+	at := -1
+	for i, k := range r.e2e.keys {
+		if k.Owner == c.id {
+			at = i
+		}
+	}
+	switch {
+	case len(key.PublicKey) == 0 && at < 0:
+		r.e2e.mu.Unlock()
+		return
+	case len(key.PublicKey) == 0:
+		r.e2e.keys = append(r.e2e.keys[:at], r.e2e.keys[at+1:]...)
+	case at >= 0:
+		// A new key moves to the end: whoever holds the room key must
+		// send it again, wrapped for this one
+		r.e2e.keys = append(r.e2e.keys[:at], r.e2e.keys[at+1:]...)
+		r.e2e.keys = append(r.e2e.keys, key)
+	default:
+		r.e2e.keys = append(r.e2e.keys, key)
+	}
+	r.e2e.mu.Unlock()
+	if len(key.PublicKey) == 0 {
+		log.Printf("'%s' turned encryption off in room '%s'", c.id, r.id)
+	} else {
+		log.Printf("'%s' published an E2E key in room '%s'", c.id, r.id)
+	}
+	r.Broadcast(e2eKeyMessage(r.id, key), "")
+}
+
+// dropE2EKey forgets name's key when it leaves the room. Members learn it
+// from USER_LEFT.
+func (r *Room) dropE2EKey(name string) {
+	r.e2e.mu.Lock()
+	defer r.e2e.mu.Unlock()
+	for i, k := range r.e2e.keys {
+		if k.Owner == name {
+			r.e2e.keys = append(r.e2e.keys[:i], r.e2e.keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// sendE2EKeys sends c the keys published so far, oldest first.
+func (r *Room) sendE2EKeys(c *Client) {
+	r.e2e.mu.Lock()
+	keys := append([]*pb.E2EKey(nil), r.e2e.keys...)
+	r.e2e.mu.Unlock()
+	for _, k := range keys {
+		c.Send(e2eKeyMessage(r.id, k))
+	}
+}
+
+func e2eKeyMessage(roomID string, key *pb.E2EKey) *pb.ConferenceData {
+	return seal(&pb.ConferenceData{Payload: &pb.ConferenceData_E2EKey{E2EKey: key}}, roomID, serverSender)
+}
+
+// relayKeyEnvelope passes env from c on to its recipient only.
+func (r *Room) relayKeyEnvelope(c *Client, env *pb.KeyEnvelope) {
+	if len(env.WrappedKey) == 0 || len(env.WrappedKey) > maxWrappedKeyBytes || len(env.Nonce) > maxE2ENonceBytes {
+		reply(c, r, &pb.Command{Type: "E2E_DENIED", Value: "malformed key envelope"})
+		return
+	}
+	val, ok := r.users.Load(env.Recipient)
+	if !ok {
+		reply(c, r, &pb.Command{Type: "E2E_DENIED", Value: fmt.Sprintf("user '%s' is not in this room", env.Recipient)})
+		return
+	}
+	env.Sender = c.id
+	msg := seal(&pb.ConferenceData{Payload: &pb.ConferenceData_KeyEnvelope{KeyEnvelope: env}}, r.id, c.id)
+	if !val.(*Client).Send(msg) {
+		log.Printf("Dropped key envelope from '%s' to '%s', channel full or client gone.", c.id, env.Recipient)
+	}
+}
+
+// checkEncrypted reports why an encrypted message can't be relayed, if it
+// can't.
+func checkEncrypted(chat *pb.ChatMessage) string {
+	enc := chat.Encrypted
+	switch {
+	case chat.Content != "":
+		return "encrypted messages must not carry plain text"
+	case len(enc.Nonce) == 0 || len(enc.Nonce) > maxE2ENonceBytes:
+		return "encrypted messages need a nonce"
+	case len(enc.Ciphertext) > maxCiphertextBytes:
+		return fmt.Sprintf("encrypted messages can't be longer than %d bytes", maxCiphertextBytes)
+	}
+	return ""
+}
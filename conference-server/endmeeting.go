@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	pb "conference-server/conference"
+)
+
+// --- Ending a meeting for everyone ---
+
+// meetingEndGrace is how long members get to leave on their own after
+// MEETING_ENDED (and read it) before the server closes their streams.
+const meetingEndGrace = 2 * time.Second
+
+// handleEndMeeting applies an END_MEETING command from c, reporting whether
+// cmd was one. Only the host (or a moderator) may end a meeting.
+func (s *server) handleEndMeeting(room *Room, c *Client, cmd *pb.Command) bool {
+	if cmd.Type != "END_MEETING" {
+		return false
+	}
+	if !room.isHost(c) {
+		reply(c, room, &pb.Command{Type: "ROLE_DENIED", Value: "only the host or a moderator can end the meeting"})
+		return true
+	}
+	s.endMeeting(room, c.id)
+	return true
+}
+
+// endMeeting says goodbye to everyone in room, deletes it, aborts the
+// broadcast transfers still running in it and, after meetingEndGrace,
+// disconnects whoever hasn't left yet. Anyone joining the same room ID from
+// then on starts a new meeting.
+func (s *server) endMeeting(room *Room, by string) {
+	if !room.ended.CompareAndSwap(false, true) {
+		return
+	}
+	log.Printf("'%s' ended the meeting in room '%s'", by, room.id)
+	s.rooms.Remove(room)
+	room.Broadcast(serverCommand(room.id, by, &pb.Command{Type: "MEETING_ENDED", Value: by}), "")
+	s.abortBroadcastTransfers(room.id)
+	time.AfterFunc(meetingEndGrace, func() {
+		defer recoverPanic("end of the meeting in room '"+room.id+"'", nil)
+		for _, m := range room.members() {
+			m.Kick("the meeting was ended by " + by)
+		}
+	})
+}
+
+// abortBroadcastTransfers stops every broadcast transfer announced in the
+// room, sender and receivers alike.
+func (s *server) abortBroadcastTransfers(roomID string) {
+	s.activeTransfers.Range(func(key, value interface{}) bool {
+		if tx, ok := value.(*broadcastTransfer); ok && tx.room == roomID {
+			s.abortTransfer(key.(string), tx, "the meeting ended")
+		}
+		return true
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	pb "conference-server/conference"
+)
+
+// --- Message envelope ---
+
+// serverSender is the sender of messages the server sends on its own
+// behalf. Commands a user caused (MUTE_ALL, FLOOR_GIVEN...) carry that
+// user's name instead.
+const serverSender = "Server"
+
+// fileRequestSender is the sender of the FILE_REQUEST notifications
+// RequestFileTransfer sends the room. Only the server can use it: messages
+// from clients always carry their own client's name (see JoinConference),
+// and checkUsername turns the name away.
+const fileRequestSender = "Sistema-FileTransfer"
+
+var (
+	messageIDPrefix = newSessionToken()[:8] // keeps IDs unique across restarts
+	messageSeq      atomic.Uint64
+)
+
+// seal completes msg's envelope so clients can rely on it: the room is
+// always roomID, and the sender, timestamp (Unix seconds) and message ID
+// are filled in when missing; JoinConference overwrites the sender of what
+// clients send before sealing it. msg must not have been handed to any client
+// yet; sealing an already sealed message changes nothing.
+func seal(msg *pb.ConferenceData, roomID, sender string) *pb.ConferenceData {
+	if msg.RoomId != roomID {
+		msg.RoomId = roomID
+	}
+	if msg.Sender == "" {
+		msg.Sender = sender
+	}
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().Unix()
+	}
+	if msg.MessageId == "" {
+		msg.MessageId = fmt.Sprintf("%s-%d", messageIDPrefix, messageSeq.Add(1))
+	}
+	return msg
+}
+
+// serverCommand builds a sealed command message for roomID.
+func serverCommand(roomID, sender string, cmd *pb.Command) *pb.ConferenceData {
+	return seal(&pb.ConferenceData{Payload: &pb.ConferenceData_Command{Command: cmd}}, roomID, sender)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "conference-server/conference"
+)
+
+// maxRoomEvents bounds how much history a room keeps for SubscribeEvents replay.
+const maxRoomEvents = 1000
+
+// subscriberBuffer is how many live events a subscriber may fall behind before
+// it is dropped and has to resubscribe from its last seq.
+const subscriberBuffer = 256
+
+// --- Room event log ---
+
+type eventLog struct {
+	mu     sync.Mutex
+	seq    int64
+	events []*pb.RoomEvent // oldest first, at most maxRoomEvents
+	subs   map[chan *pb.RoomEvent]struct{}
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{subs: make(map[chan *pb.RoomEvent]struct{})}
+}
+
+// Append assigns the next seq to ev, stores it and fans it out to subscribers.
+// Subscribers that can't keep up are closed so they resubscribe instead of
+// silently missing events.
+func (l *eventLog) Append(ev *pb.RoomEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	ev.Seq = l.seq
+	if ev.Timestamp == 0 {
+		ev.Timestamp = time.Now().Unix()
+	}
+	l.events = append(l.events, ev)
+	if len(l.events) > maxRoomEvents {
+		l.events = l.events[len(l.events)-maxRoomEvents:]
+	}
+	for ch := range l.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(l.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the stored events after sinceSeq and a channel for the live
+// ones. Both are taken under the same lock so nothing falls in between.
+func (l *eventLog) Subscribe(sinceSeq int64) ([]*pb.RoomEvent, chan *pb.RoomEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var backlog []*pb.RoomEvent
+	now := time.Now().Unix()
+	for _, ev := range l.events {
+		if ev.Seq > sinceSeq && !isExpired(ev, now) {
+			backlog = append(backlog, ev)
+		}
+	}
+	ch := make(chan *pb.RoomEvent, subscriberBuffer)
+	l.subs[ch] = struct{}{}
+	return backlog, ch
+}
+
+func (l *eventLog) Unsubscribe(ch chan *pb.RoomEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.subs[ch]; ok {
+		delete(l.subs, ch)
+		close(ch)
+	}
+}
+
+// Purge removes the messages sent by sender between since and until (inclusive)
+// from the stored history and returns how many were dropped.
+func (l *eventLog) Purge(sender string, since, until int64) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.events[:0]
+	purged := 0
+	for _, ev := range l.events {
+		if msg := ev.GetMessage(); msg != nil && ev.Sender == sender && ev.Timestamp >= since && ev.Timestamp <= until {
+			purged++
+			continue
+		}
+		kept = append(kept, ev)
+	}
+	l.events = kept
+	return purged
+}
+
+// Snapshot returns a copy of the stored history.
+func (l *eventLog) Snapshot() []*pb.RoomEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]*pb.RoomEvent(nil), l.events...)
+}
+
+// Import interleaves extra into the history by timestamp. Every stored event is
+// renumbered after the current seq, so live subscribers are closed: when they
+// resubscribe from their last seq they get the merged history again rather
+// than silently skipping the imported part.
+func (l *eventLog) Import(extra []*pb.RoomEvent, roomID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	merged := make([]*pb.RoomEvent, 0, len(l.events)+len(extra))
+	for _, ev := range l.events {
+		merged = append(merged, proto.Clone(ev).(*pb.RoomEvent))
+	}
+	for _, ev := range extra {
+		merged = append(merged, proto.Clone(ev).(*pb.RoomEvent))
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Timestamp < merged[j].Timestamp })
+	if len(merged) > maxRoomEvents {
+		merged = merged[len(merged)-maxRoomEvents:]
+	}
+	for _, ev := range merged {
+		l.seq++
+		ev.Seq = l.seq
+		ev.RoomId = roomID
+	}
+	l.events = merged
+	for ch := range l.subs {
+		delete(l.subs, ch)
+		close(ch)
+	}
+}
+
+// isExpired reports whether ev carries an ephemeral message whose TTL has run out.
+func isExpired(ev *pb.RoomEvent, now int64) bool {
+	msg := ev.GetMessage()
+	if msg == nil || msg.TtlSeconds <= 0 {
+		return false
+	}
+	return msg.Timestamp+int64(msg.TtlSeconds) <= now
+}
+
+// roomEventFromData maps a broadcast ConferenceData onto a typed RoomEvent.
+// It returns nil for traffic that isn't part of the room history (audio, etc).
+func roomEventFromData(msg *pb.ConferenceData) *pb.RoomEvent {
+	ev := &pb.RoomEvent{RoomId: msg.RoomId, Sender: msg.Sender}
+	switch payload := msg.Payload.(type) {
+	case *pb.ConferenceData_TextMessage:
+		// File request notifications are recorded as typed events by RequestFileTransfer.
+		if msg.Sender == fileRequestSender {
+			return nil
+		}
+		ev.Timestamp = payload.TextMessage.Timestamp
+		ev.Event = &pb.RoomEvent_Message{Message: payload.TextMessage}
+	case *pb.ConferenceData_FileAnnouncement:
+		ev.Event = &pb.RoomEvent_FileAnnouncement{FileAnnouncement: payload.FileAnnouncement}
+	case *pb.ConferenceData_Command:
+		switch payload.Command.Type {
+		case "USER_JOINED":
+			ev.Event = &pb.RoomEvent_UserJoined{UserJoined: payload.Command.Value}
+		case "USER_LEFT":
+			ev.Event = &pb.RoomEvent_UserLeft{UserLeft: payload.Command.Value}
+		default:
+			return nil
+		}
+	default:
+		return nil
+	}
+	return ev
+}
+
+// matchesFilter applies a subscriber's MessageFilter. Only chat messages are
+// filtered; joins, leaves, files and freezes always go through.
+func matchesFilter(ev *pb.RoomEvent, filter pb.MessageFilter, username string) bool {
+	msg := ev.GetMessage()
+	if msg == nil || filter == pb.MessageFilter_FILTER_ALL {
+		return true
+	}
+	if msg.Important {
+		return true
+	}
+	if filter == pb.MessageFilter_FILTER_MENTIONS && username != "" {
+		return mentions(msg.Content, username)
+	}
+	return false
+}
+
+// mentions reports whether content contains @username as a whole word.
+func mentions(content, username string) bool {
+	needle := "@" + strings.ToLower(username)
+	lower := strings.ToLower(content)
+	for i := strings.Index(lower, needle); i >= 0; {
+		end := i + len(needle)
+		if end == len(lower) || !isNameChar(lower[end]) {
+			return true
+		}
+		next := strings.Index(lower[end:], needle)
+		if next < 0 {
+			break
+		}
+		i = end + next
+	}
+	return false
+}
+
+func isNameChar(b byte) bool {
+	return b == '_' || b == '-' || b == '.' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z'
+}
+
+// --- SubscribeEvents RPC ---
+
+// admitSubscriber applies the room's entry rules to a subscriber, who sends
+// the room password as members do and, in a registered_only room, the
+// account token of username. Moderators are let in regardless.
+func (s *server) admitSubscriber(ctx context.Context, room *Room, username string) error {
+	if s.adminToken != "" && s.requireAdmin(ctx) == nil {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	registered := false
+	if username != "" {
+		registered, _ = s.accounts.check(username, accountTokenFromMetadata(md))
+	}
+	return room.checkEntry(room.Settings(), !registered, roomPasswordFromMetadata(md))
+}
+
+func (s *server) SubscribeEvents(req *pb.SubscribeEventsRequest, stream pb.ConferenceService_SubscribeEventsServer) error {
+	roomID := req.GetRoomId()
+	if roomID == "" {
+		return status.Errorf(codes.InvalidArgument, "room_id must be provided")
+	}
+	room, ok := s.rooms.AcquireExisting(roomID)
+	if !ok {
+		return status.Errorf(codes.NotFound, "room '%s' not found", roomID)
+	}
+	if err := s.admitSubscriber(stream.Context(), room, req.GetUsername()); err != nil {
+		s.rooms.Release(room)
+		return err
+	}
+
+	backlog, ch := room.events.Subscribe(req.GetSinceSeq())
+	log.Printf("Event subscriber joined room '%s' (since seq %d, %d to replay)", roomID, req.GetSinceSeq(), len(backlog))
+	defer func() {
+		room.events.Unsubscribe(ch)
+		s.rooms.Release(room)
+	}()
+
+	lastSeq := req.GetSinceSeq()
+	for _, ev := range backlog {
+		if !matchesFilter(ev, req.GetFilter(), req.GetUsername()) {
+			continue
+		}
+		if err := stream.Send(ev); err != nil {
+			return err
+		}
+		lastSeq = ev.Seq
+	}
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return status.Errorf(codes.Unavailable, "event stream closed after seq %d, resubscribe to continue", lastSeq)
+			}
+			if !matchesFilter(ev, req.GetFilter(), req.GetUsername()) {
+				continue
+			}
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+			lastSeq = ev.Seq
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
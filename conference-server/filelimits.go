@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "conference-server/conference"
+)
+
+// --- File size, type and quota limits ---
+
+// Limits on what the server will relay, checked when a transfer is requested
+// or announced. Sizes are in MiB and 0 means unlimited. With -allow-ext set,
+// only those extensions pass; -block-ext is checked either way. The size
+// checked is the one the sender declares, so the relay holds it to that (see
+// relayCount).
+var (
+	maxFileMiB    int64
+	dailyQuotaMiB int64
+	allowedExts   = extList{}
+	blockedExts   = extList{}
+)
+
+// Reject codes sent in FileTransferResponse.reject_code and FILE_DENIED.
+const (
+	rejectTooLarge    = "too_large"
+	rejectTypeBlocked = "type_blocked"
+	rejectQuota       = "quota_exceeded"
+)
+
+// extList is a set of lowercase file extensions without the dot, set from a
+// comma-separated flag such as "exe,bat,.msi".
+type extList map[string]bool
+
+func (l extList) String() string {
+	exts := make([]string, 0, len(l))
+	for ext := range l {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return strings.Join(exts, ",")
+}
+
+func (l extList) Set(v string) error {
+	for _, ext := range strings.Split(v, ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext != "" {
+			l[ext] = true
+		}
+	}
+	return nil
+}
+
+func fileExt(filename string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+}
+
+// fileQuota counts the bytes each user has been let send today. The counts
+// start over when the (server-local) date changes.
+type fileQuota struct {
+	mu   sync.Mutex
+	day  string
+	used map[string]int64 // map[quotaOwner]bytes
+}
+
+// quotaOwner is who c's files count against: the account it is logged in
+// to or, for a guest, the host it connects from. A bare name would let a
+// guest start over by rejoining under another one, or use up someone else's
+// quota by joining as them.
+func quotaOwner(c *Client) string {
+	if c.registered.Load() {
+		return "account:" + c.id
+	}
+	host, _, err := net.SplitHostPort(c.addr)
+	if err != nil {
+		host = c.addr
+	}
+	return "host:" + host
+}
+
+func (q *fileQuota) today() {
+	if day := time.Now().Format("2006-01-02"); day != q.day {
+		q.day, q.used = day, make(map[string]int64)
+	}
+}
+
+// charge counts n bytes against user's quota if they fit in what is left of
+// it, all at once so that two files can't both fit in the same space, and
+// returns what was left before.
+func (q *fileQuota) charge(user string, n int64) (left int64, ok bool) {
+	if dailyQuotaMiB <= 0 {
+		return 0, true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.today()
+	left = dailyQuotaMiB<<20 - q.used[user]
+	if n > left {
+		return left, false
+	}
+	q.used[user] += n
+	return left, true
+}
+
+// refund gives back n bytes charged to user's quota for a file that didn't
+// go through after all.
+func (q *fileQuota) refund(user string, n int64) {
+	if dailyQuotaMiB <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.today()
+	q.used[user] = max(q.used[user]-n, 0)
+}
+
+// checkFile returns a reject code and reason if c may not send filename of
+// size bytes, or "" if it may go through, in which case size has been
+// charged to c's quota; callers refund it if the file doesn't go after all.
+func (s *server) checkFile(c *Client, filename string, size int64) (code, reason string) {
+	if maxFileMiB > 0 && size > maxFileMiB<<20 {
+		return rejectTooLarge, fmt.Sprintf("files may be at most %d MiB", maxFileMiB)
+	}
+	ext := fileExt(filename)
+	if blockedExts[ext] || (len(allowedExts) > 0 && !allowedExts[ext]) {
+		if ext == "" {
+			return rejectTypeBlocked, "files without an extension are not allowed"
+		}
+		return rejectTypeBlocked, fmt.Sprintf(".%s files are not allowed", ext)
+	}
+	if left, ok := s.fileQuota.charge(quotaOwner(c), size); !ok {
+		return rejectQuota, fmt.Sprintf("daily quota of %d MiB reached (%d KiB left)", dailyQuotaMiB, max(left, 0)>>10)
+	}
+	return "", ""
+}
+
+// relayCount holds the chunks relayed on one transfer stream to the size the
+// sender declared, which the limits above were checked against. A chunk is
+// never larger than the part of the file it carries, compressed ones being
+// smaller, so a stream that starts at offset n can't carry more than size-n
+// bytes of data.
+type relayCount struct {
+	size, left int64
+	started    bool
+}
+
+func newRelayCount(size int64) *relayCount {
+	return &relayCount{size: size}
+}
+
+// add counts chunk, returning why the stream must stop if it is past the
+// declared size.
+func (r *relayCount) add(chunk *pb.FileChunk) string {
+	if !r.started {
+		if chunk.Offset < 0 || chunk.Offset > r.size {
+			return fmt.Sprintf("a chunk at offset %d is outside the declared %d bytes", chunk.Offset, r.size)
+		}
+		r.left, r.started = r.size-chunk.Offset, true
+	}
+	if r.left -= int64(len(chunk.Data)); r.left < 0 {
+		return fmt.Sprintf("the sender sent more than the declared %d bytes", r.size)
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "conference-server/conference"
+)
+
+// --- Room freeze ---
+
+// roomFreeze makes a room read-only for everyone but moderators. A zero until
+// means the freeze lasts until an admin lifts it.
+type roomFreeze struct {
+	mu     sync.Mutex
+	frozen bool
+	reason string
+	until  time.Time
+	timer  *time.Timer // lifts a timed freeze
+	gen    int         // bumped on every change so a stale timer can't lift a newer freeze
+}
+
+// Frozen reports whether the room is read-only and why.
+func (r *Room) Frozen() (bool, string) {
+	r.freeze.mu.Lock()
+	defer r.freeze.mu.Unlock()
+	return r.freeze.frozen, r.freeze.reason
+}
+
+// SetFrozen freezes or unfreezes the room and announces the change both as a
+// typed event for subscribers and as a command to connected clients. A
+// positive d lifts the freeze automatically.
+func (r *Room) SetFrozen(frozen bool, reason string, d time.Duration) {
+	f := &r.freeze
+	f.mu.Lock()
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	f.gen++
+	f.frozen, f.reason, f.until = frozen, reason, time.Time{}
+	if frozen && d > 0 {
+		f.until = time.Now().Add(d)
+		gen := f.gen
+		f.timer = time.AfterFunc(d, func() {
+			defer recoverPanic("unfreezing room '"+r.id+"'", nil)
+			f.mu.Lock()
+			current := f.gen == gen
+			f.mu.Unlock()
+			if current {
+				r.SetFrozen(false, "", 0)
+			}
+		})
+	}
+	until := f.until
+	f.mu.Unlock()
+
+	state := &pb.RoomFreeze{Frozen: frozen, Reason: reason}
+	if !until.IsZero() {
+		state.Until = until.Unix()
+	}
+
+	r.events.Append(&pb.RoomEvent{RoomId: r.id, Sender: serverSender, Event: &pb.RoomEvent_Freeze{Freeze: state}})
+	cmd := &pb.Command{Type: "ROOM_UNFROZEN"}
+	if frozen {
+		cmd = &pb.Command{Type: "ROOM_FROZEN", Value: reason}
+	}
+	r.Broadcast(serverCommand(r.id, serverSender, cmd), "")
+	log.Printf("Room '%s' frozen=%v reason=%q until=%v", r.id, frozen, reason, until)
+}
+
+// rejectIfFrozen drops msg when the room is read-only for the client. Text,
+// files and private messages get a ROOM_FROZEN reply, audio and video are
+// dropped silently, and commands (typing, presence) still go through.
+func rejectIfFrozen(room *Room, c *Client, msg *pb.ConferenceData) bool {
+	if c.moderator {
+		return false
+	}
+	frozen, reason := room.Frozen()
+	if !frozen {
+		return false
+	}
+	switch msg.Payload.(type) {
+	case *pb.ConferenceData_Command, *pb.ConferenceData_E2EKey, *pb.ConferenceData_KeyEnvelope:
+		return false
+	case *pb.ConferenceData_AudioChunk, *pb.ConferenceData_VideoFrame:
+		return true
+	}
+	c.Send(serverCommand(room.id, serverSender, &pb.Command{Type: "ROOM_FROZEN", Value: reason}))
+	return true
+}
+
+// --- Admin RPC ---
+
+func (s *server) FreezeRoom(ctx context.Context, req *pb.FreezeRoomRequest) (*pb.ModerationResult, error) {
+	if req.RoomId == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id must be provided")
+	}
+	if req.DurationSeconds < 0 {
+		return nil, status.Error(codes.InvalidArgument, "duration_seconds must not be negative")
+	}
+	rooms, err := s.adminRooms(req.RoomId)
+	if err != nil {
+		return nil, err
+	}
+	room := rooms[0]
+	room.SetFrozen(req.Frozen, req.Reason, time.Duration(req.DurationSeconds)*time.Second)
+	audit(ctx, "freeze", room.id, "frozen=%v reason=%q duration=%ds", req.Frozen, req.Reason, req.DurationSeconds)
+	return &pb.ModerationResult{Affected: 1, Details: []string{room.id}}, nil
+}
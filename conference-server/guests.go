@@ -0,0 +1,65 @@
+package main
+
+import (
+	pb "conference-server/conference"
+)
+
+// --- Guest policies ---
+
+// A guest is a member who isn't logged in to the account of its name (see
+// accounts.go) and isn't a moderator. A room can hold its guests to less
+// than everyone else through its settings (see settings.go), changed with
+// ROOM_SET like the rest:
+//
+//	registered_only=on|off  guests can't join; those already in stay
+//	guest_files=on|off      off: guests can't send files, one-to-one or to the room's store
+//	guest_audio=on|off      off: the server drops guests' audio unless they have the floor
+//
+// The host and co-hosts are never held back, whether they have an account
+// or not.
+
+// Reject code sent in FileTransferResponse.reject_code when the room keeps
+// guests from sending files.
+const rejectGuest = "guests_not_allowed"
+
+// isGuest reports whether c has neither logged in to its name nor joined as
+// a moderator.
+func isGuest(c *Client) bool {
+	return !c.registered.Load() && !c.moderator
+}
+
+// guestPolicy returns the room's guest restrictions.
+func (r *Room) guestPolicy() (registeredOnly, noFiles, noAudio bool) {
+	r.settings.mu.Lock()
+	defer r.settings.mu.Unlock()
+	rec := r.settings.rec
+	return rec.RegisteredOnly, rec.GuestFilesOff, rec.GuestAudioOff
+}
+
+// checkGuestFile returns a reject code and reason if the room keeps guests
+// from sending files and user is one of them. Callers check that user is a
+// member first (see roomMember); anyone else is refused as a guest would be.
+func (r *Room) checkGuestFile(user string) (code, reason string) {
+	if _, noFiles, _ := r.guestPolicy(); !noFiles {
+		return "", ""
+	}
+	v, ok := r.users.Load(user)
+	if c, _ := v.(*Client); !ok || isGuest(c) && !r.canControl(c) {
+		return rejectGuest, "guests can't send files in this room; log in to a registered name first"
+	}
+	return "", ""
+}
+
+// guestSettingChange returns the change to make for a ROOM_SET of one of
+// the guest policies, or nil if key isn't one.
+func guestSettingChange(key string, on bool) func(*pb.RoomSettings) {
+	switch key {
+	case "registered_only":
+		return func(rec *pb.RoomSettings) { rec.RegisteredOnly = on }
+	case "guest_files":
+		return func(rec *pb.RoomSettings) { rec.GuestFilesOff = !on }
+	case "guest_audio":
+		return func(rec *pb.RoomSettings) { rec.GuestAudioOff = !on }
+	}
+	return nil
+}
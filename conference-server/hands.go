@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	pb "conference-server/conference"
+)
+
+// --- Raised hands and giving the floor ---
+
+// roomHands is a room's queue of raised hands, in the order they were
+// raised. Everyone sees it change through HAND_RAISED and HAND_LOWERED, and
+// members get the whole queue as HAND_QUEUE when they join.
+type roomHands struct {
+	mu    sync.Mutex
+	queue []string
+}
+
+// Hands returns the raised hands in the order they were raised.
+func (r *Room) Hands() []string {
+	r.hands.mu.Lock()
+	defer r.hands.mu.Unlock()
+	return append([]string(nil), r.hands.queue...)
+}
+
+// handleHandCommand applies a RAISE_HAND, LOWER_HAND or GIVE_FLOOR command
+// from c, reporting whether cmd was one of them. Anyone may raise or lower
+// their own hand; lowering someone else's and giving the floor (which
+// unmutes the user, even under MUTE_ALL) is up to the host, co-hosts and
+// moderators. GIVE_FLOOR without a name goes to the first hand in the queue.
+func (r *Room) handleHandCommand(c *Client, cmd *pb.Command) bool {
+	switch cmd.Type {
+	case "RAISE_HAND":
+		r.hands.mu.Lock()
+		raised := !containsName(r.hands.queue, c.id)
+		if raised {
+			r.hands.queue = append(r.hands.queue, c.id)
+		}
+		r.hands.mu.Unlock()
+		if raised {
+			r.announceHand("HAND_RAISED", c.id)
+		}
+	case "LOWER_HAND":
+		target := cmd.Value
+		if target == "" {
+			target = c.id
+		}
+		if target != c.id && !r.canControl(c) {
+			reply(c, r, &pb.Command{Type: "FLOOR_DENIED", Value: "only the host, a co-host or a moderator can lower someone else's hand"})
+			return true
+		}
+		r.lowerHand(target)
+	case "GIVE_FLOOR":
+		if !r.canControl(c) {
+			reply(c, r, &pb.Command{Type: "FLOOR_DENIED", Value: "only the host, a co-host or a moderator can give the floor"})
+			return true
+		}
+		target := cmd.Value
+		if target == "" {
+			if hands := r.Hands(); len(hands) > 0 {
+				target = hands[0]
+			} else {
+				reply(c, r, &pb.Command{Type: "FLOOR_DENIED", Value: "nobody has raised their hand"})
+				return true
+			}
+		}
+		if _, ok := r.users.Load(target); !ok {
+			reply(c, r, &pb.Command{Type: "FLOOR_DENIED", Value: "user '" + target + "' is not in this room"})
+			return true
+		}
+		r.hands.mu.Lock()
+		r.hands.queue = removeName(r.hands.queue, target)
+		r.hands.mu.Unlock()
+		r.control.mu.Lock()
+		r.control.floor = target
+		delete(r.control.muted, target)
+		r.control.mu.Unlock()
+		log.Printf("'%s' gave the floor to '%s' in room '%s'", c.id, target, r.id)
+		r.Broadcast(serverCommand(r.id, c.id, &pb.Command{Type: "FLOOR_GIVEN", Value: target}), "")
+	default:
+		return false
+	}
+	return true
+}
+
+// lowerHand takes name out of the queue, if their hand is raised.
+func (r *Room) lowerHand(name string) {
+	r.hands.mu.Lock()
+	raised := containsName(r.hands.queue, name)
+	r.hands.queue = removeName(r.hands.queue, name)
+	r.hands.mu.Unlock()
+	if raised {
+		r.announceHand("HAND_LOWERED", name)
+	}
+}
+
+// sendHands tells c, who just joined, whose hands are already raised.
+func (r *Room) sendHands(c *Client) {
+	if hands := r.Hands(); len(hands) > 0 {
+		reply(c, r, &pb.Command{Type: "HAND_QUEUE", Value: strings.Join(hands, ",")})
+	}
+}
+
+func (r *Room) announceHand(event, name string) {
+	r.Broadcast(serverCommand(r.id, serverSender, &pb.Command{Type: event, Value: name}), "")
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func removeName(names []string, name string) []string {
+	out := names[:0]
+	for _, n := range names {
+		if n != name {
+			out = append(out, n)
+		}
+	}
+	return out
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	pb "conference-server/conference"
+)
+
+// --- Protocol handshake ---
+
+// protocolVersion is the wire protocol this server speaks. Clients that open
+// with a JOIN command instead of a Hello speak version 1.
+const protocolVersion = 2
+
+// serverCodecs are the audio codecs the server can relay and adapt.
+var serverCodecs = []string{"pcm16"}
+
+// negotiate answers a client's Hello with the protocol version both sides
+// speak and the codecs and features both support. New features check
+// Client.Supports before sending anything an older client wouldn't expect.
+func (s *server) negotiate(hello *pb.Hello) *pb.Hello {
+	agreed := hello.ProtocolVersion
+	if agreed > protocolVersion || agreed == 0 {
+		agreed = protocolVersion
+	}
+	return &pb.Hello{
+		ProtocolVersion: agreed,
+		Version:         version,
+		Codecs:          intersect(serverCodecs, hello.Codecs),
+		Features:        intersect(s.serverFeatures(), hello.Features),
+	}
+}
+
+// Supports reports whether c and the server agreed on feature in the
+// handshake. Clients that joined with a plain JOIN support none of them.
+func (c *Client) Supports(feature string) bool {
+	return c.caps[feature]
+}
+
+// capSet turns the agreed features into a set for Client.caps.
+func capSet(features []string) map[string]bool {
+	caps := make(map[string]bool, len(features))
+	for _, f := range features {
+		caps[f] = true
+	}
+	return caps
+}
+
+// intersect returns the entries of ours that theirs also lists, in our order.
+func intersect(ours, theirs []string) []string {
+	var both []string
+	for _, v := range ours {
+		if containsName(theirs, v) {
+			both = append(both, v)
+		}
+	}
+	return both
+}
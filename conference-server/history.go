@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	pb "conference-server/conference"
+)
+
+// --- Late-join catch-up ---
+
+// chatHistorySize is how many recent chat messages and client commands a
+// room replays to members who join late (-history). It is capped at half a
+// client's queue so the replay can't crowd out live messages.
+var chatHistorySize = 50
+
+const maxChatHistory = clientBuffer / 2
+
+// roomHistory keeps the room's last chatHistorySize chat messages and
+// client commands, oldest first, or as many as the room's settings say.
+// Unlike the event log it stores them as sent, so a joiner can be caught up
+// on the stream it already reads.
+type roomHistory struct {
+	mu    sync.Mutex
+	limit int // the room's history setting: 0 for chatHistorySize, -1 for none
+	msgs  []*pb.ConferenceData
+}
+
+// size returns how many messages the history keeps. h.mu must be held.
+func (h *roomHistory) size() int {
+	switch {
+	case h.limit == 0:
+		return chatHistorySize
+	case h.limit < 0:
+		return 0
+	}
+	return h.limit
+}
+
+// Record stores msg, dropping the oldest entry when the history is full.
+func (h *roomHistory) Record(msg *pb.ConferenceData) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.size() == 0 {
+		return
+	}
+	h.msgs = append(h.msgs, msg)
+	h.trim()
+}
+
+// setLimit changes how many messages the history keeps (see limit).
+func (h *roomHistory) setLimit(limit int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.limit = limit
+	h.trim()
+}
+
+func (h *roomHistory) trim() {
+	if n := h.size(); len(h.msgs) > n {
+		h.msgs = h.msgs[len(h.msgs)-n:]
+	}
+}
+
+// Purge drops the chat messages sender sent between since and until, as
+// PurgeMessages does for the event log.
+func (h *roomHistory) Purge(sender string, since, until int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	kept := h.msgs[:0]
+	for _, msg := range h.msgs {
+		if text := msg.GetTextMessage(); text != nil && msg.Sender == sender && text.Timestamp >= since && text.Timestamp <= until {
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	h.msgs = kept
+}
+
+// replay returns the stored messages, leaving out ephemeral ones that have
+// expired.
+func (h *roomHistory) replay() []*pb.ConferenceData {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now().Unix()
+	var out []*pb.ConferenceData
+	for _, msg := range h.msgs {
+		if text := msg.GetTextMessage(); text != nil && text.TtlSeconds > 0 && text.Timestamp+int64(text.TtlSeconds) <= now {
+			continue
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+// sendHistory queues the room's recent messages for c, who just joined,
+// between HISTORY_BEGIN (with the count) and HISTORY_END so the client can
+// show them as history rather than act on them.
+func (r *Room) sendHistory(c *Client) {
+	msgs := r.history.replay()
+	if len(msgs) == 0 {
+		return
+	}
+	c.sendWait(serverCommand(r.id, serverSender, &pb.Command{Type: "HISTORY_BEGIN", Value: fmt.Sprint(len(msgs))}))
+	for _, msg := range msgs {
+		c.sendWait(msg)
+	}
+	c.sendWait(serverCommand(r.id, serverSender, &pb.Command{Type: "HISTORY_END"}))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+
+	pb "conference-server/conference"
+)
+
+// --- Personal inboxes ---
+
+// A RoomFile uploaded with a recipient goes to that user's inbox instead of
+// the room: it reaches them in whichever room they are in, now or the next
+// time they join one, and stays in the file store until they download it.
+// Only registered names have an inbox, and only their owner, logged in (see
+// accounts.go), hears of it or downloads from it: anyone can join as a name,
+// so the name alone would hand its files to whoever claimed it first.
+
+// inbox returns the files waiting for user, oldest first.
+func (st *fileStore) inbox(user string) []*pb.RoomFile {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var files []*pb.RoomFile
+	for _, f := range st.files {
+		if f.Recipient == user {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Timestamp < files[j].Timestamp })
+	return files
+}
+
+// remove forgets a file and deletes it from disk, reporting whether it was
+// there.
+func (st *fileStore) remove(id string) bool {
+	st.mu.Lock()
+	_, ok := st.files[id]
+	delete(st.files, id)
+	delete(st.warned, id)
+	st.mu.Unlock()
+	os.Remove(st.path(id))
+	os.Remove(st.path(id) + ".json")
+	return ok
+}
+
+// deliverInbox tells the recipient of f about it in every room they are in;
+// if they aren't connected, sendInbox does when they next join.
+func (s *server) deliverInbox(f *pb.RoomFile) {
+	delivered := false
+	s.rooms.Range(func(room *Room) bool {
+		if c, ok := room.users.Load(f.Recipient); ok && c.(*Client).registered.Load() {
+			c.(*Client).Send(inboxMessage(room, f))
+			delivered = true
+		}
+		return true
+	})
+	if !delivered {
+		log.Printf("'%s' isn't logged in anywhere; file '%s' (%s) waits in their inbox", f.Recipient, f.Filename, f.FileId)
+	}
+}
+
+// sendInbox lists what is waiting for a client that just joined or logged
+// in.
+func (s *server) sendInbox(room *Room, c *Client) {
+	if s.files == nil || !c.registered.Load() {
+		return
+	}
+	for _, f := range s.files.inbox(c.id) {
+		c.sendWait(inboxMessage(room, f))
+	}
+}
+
+func inboxMessage(room *Room, f *pb.RoomFile) *pb.ConferenceData {
+	return seal(&pb.ConferenceData{Payload: &pb.ConferenceData_RoomFile{RoomFile: f}}, room.id, f.Sender)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"runtime/debug"
+	"strings"
+
+	pb "conference-server/conference"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD)"
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// buildCommit falls back to the VCS revision the Go toolchain stamps into
+// binaries built inside a git checkout.
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				if len(s.Value) > 12 {
+					return s.Value[:12]
+				}
+				return s.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+// serverFeatures lists what clients can rely on; they hide commands for
+// anything missing here.
+func (s *server) serverFeatures() []string {
+	features := []string{
+		"audio", "file-transfer", "private-messages", "ephemeral-messages",
+		"important-messages", "event-history", "session-resume", "audio-stats",
+		"room-mute", "video", "screen-share", "adaptive-quality", "raise-hand",
+		"roles", "end-meeting", "roster", "capabilities", "file-checksum", "transfer-cancel",
+		"file-compression", "transfer-progress", "file-limits", "ping", "spam-filter", "pins", "polls",
+		"room-settings", "accounts", "e2e-text", "message-signing",
+	}
+	if scanning() {
+		features = append(features, "content-scan")
+	} else {
+		features = append(features, "direct-transfer")
+	}
+	if chatHistorySize > 0 {
+		features = append(features, "chat-history")
+	}
+	if s.adminToken != "" {
+		features = append(features, "moderation", "room-freeze", "room-migration", "audit-log")
+	}
+	if s.files != nil {
+		features = append(features, "room-files", "inbox")
+	}
+	if s.webrtcAddr != "" {
+		features = append(features, "webrtc-bridge")
+	}
+	return features
+}
+
+func (s *server) GetServerInfo(ctx context.Context, req *pb.ServerInfoRequest) (*pb.ServerInfo, error) {
+	// What is kept on disk; everything else is still in memory
+	var stored []string
+	if s.settings.dir != "" {
+		stored = append(stored, "room-settings")
+	}
+	if s.accounts.dir != "" {
+		stored = append(stored, "accounts")
+	}
+	if auditTrail.onDisk() {
+		stored = append(stored, "audit-log")
+	}
+	persistence := "memory"
+	if len(stored) > 0 {
+		persistence = strings.Join(stored, ",")
+	}
+	return &pb.ServerInfo{
+		Version:     version,
+		Commit:      buildCommit(),
+		Tls:         false,
+		Persistence: persistence,
+		Codecs:      serverCodecs,
+		E2E:         true, // text only, for clients that turn it on
+		Features:    s.serverFeatures(),
+		Limits: map[string]int64{
+			"max_room_events":          maxRoomEvents,
+			"subscriber_buffer":        subscriberBuffer,
+			"client_buffer":            clientBuffer,
+			"client_video_buffer":      clientVideoBuffer,
+			"chat_history":             int64(chatHistorySize),
+			"reservation_grace_secs":   int64(reservationGrace.Seconds()),
+			"max_message_bytes":        maxMessageBytes,
+			"transfer_rate_kib":        int64(transferRateKiB),
+			"client_transfer_rate_kib": int64(clientTransferRateKiB),
+			"transfer_ttl_secs":        int64(transferTTL.Seconds()),
+			"max_file_mib":             maxFileMiB,
+			"daily_quota_mib":          dailyQuotaMiB,
+			"scan_timeout_secs":        int64(scanTimeout.Seconds()),
+			"spam_repeats":             int64(spamRepeats),
+			"spam_window_secs":         int64(spamWindow.Seconds()),
+			"poll_duration_secs":       int64(pollDuration.Seconds()),
+			"max_poll_options":         maxPollOptions,
+			"min_password_len":         minPasswordLen,
+			"rpc_rate":                 int64(rpcRate),
+			"max_text_chars":           int64(maxTextChars),
+			"max_filename_bytes":       int64(maxFilenameBytes),
+			"max_room_id_chars":        int64(maxRoomIDChars),
+			"max_audio_chunk_bytes":    int64(maxAudioChunkBytes),
+		},
+		Counters: map[string]int64{
+			"expired_transfers": int64(s.expiredTransfers.Load()),
+			"scan_blocked":      int64(s.scanBlocked.Load()),
+			"spam_blocked":      int64(s.spamBlocked.Load()),
+			"audit_records":     int64(auditTrail.count()),
+			"signing_keys":      int64(s.signers.count()),
+			"rpc_calls":         int64(s.metrics.calls.Load()),
+			"rpc_failures":      int64(s.metrics.failures.Load()),
+			"rpc_panics":        int64(panicsRecovered.Load()),
+			"open_streams":      s.metrics.openStreams.Load(),
+		},
+	}, nil
+}
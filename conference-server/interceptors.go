@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "conference-server/conference"
+)
+
+// --- Interceptor chain ---
+
+// What every RPC needs regardless of what it does is done once, by
+// middleware wrapped around the handlers, instead of at the top of each of
+// them. The chain runs in the order of serverMiddleware, outermost first:
+//
+//	recovery   a panic in a handler fails that call with Internal instead of the process
+//	metrics    counts calls, failures and open streams, for GetServerInfo
+//	logging    logs calls that fail, with how long they took
+//	ratelimit  caps the calls each host may start per second (-rpc-rate)
+//	auth       admin RPCs need the admin token
+//	validation requests and stream messages must keep to the limits in validate.go
+//
+// Adding one means writing its unary and stream halves (either may be nil)
+// and putting it in the list. The same chain wraps the server in TestSoak.
+
+// rpcRate is how many calls, streams included, one host may start per
+// second; bursts of twice that are let through. 0 means unlimited.
+var rpcRate = 0
+
+type middleware struct {
+	unary  grpc.UnaryServerInterceptor
+	stream grpc.StreamServerInterceptor
+}
+
+func (s *server) serverMiddleware() []middleware {
+	return []middleware{
+		{recoverUnary, recoverStream},       // recovery
+		{s.metrics.unary, s.metrics.stream}, // metrics
+		{logUnary, logStream},               // logging
+		{s.limiter.unary, s.limiter.stream}, // ratelimit
+		{s.authUnary, nil},                  // auth
+		{validateUnary, validateStream},     // validation
+	}
+}
+
+// serverOptions returns the options every gRPC server of s is made with.
+func (s *server) serverOptions() []grpc.ServerOption {
+	var unary []grpc.UnaryServerInterceptor
+	var stream []grpc.StreamServerInterceptor
+	for _, m := range s.serverMiddleware() {
+		if m.unary != nil {
+			unary = append(unary, m.unary)
+		}
+		if m.stream != nil {
+			stream = append(stream, m.stream)
+		}
+	}
+	return []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(maxMessageBytes),
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	}
+}
+
+// --- Recovery ---
+
+// See panics.go.
+func recoverUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer recoverPanic(info.FullMethod+" from "+peerAddr(ctx), func(e error) { err = e })
+	return handler(ctx, req)
+}
+
+func recoverStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer recoverPanic(info.FullMethod+" from "+peerAddr(ss.Context()), func(e error) { err = e })
+	return handler(srv, ss)
+}
+
+// --- Metrics ---
+
+type rpcMetrics struct {
+	calls       atomic.Uint64 // unary calls and streams started
+	failures    atomic.Uint64 // ended with an error
+	openStreams atomic.Int64
+}
+
+func (m *rpcMetrics) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	m.calls.Add(1)
+	resp, err := handler(ctx, req)
+	if err != nil {
+		m.failures.Add(1)
+	}
+	return resp, err
+}
+
+func (m *rpcMetrics) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	m.calls.Add(1)
+	m.openStreams.Add(1)
+	defer m.openStreams.Add(-1)
+	err := handler(srv, ss)
+	if err != nil {
+		m.failures.Add(1)
+	}
+	return err
+}
+
+// --- Logging ---
+
+// Only failures: the handlers log what went right in their own words.
+func logUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	if err != nil {
+		logFailure(info.FullMethod, peerAddr(ctx), err, time.Since(start))
+	}
+	return resp, err
+}
+
+func logStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	if err != nil {
+		logFailure(info.FullMethod, peerAddr(ss.Context()), err, time.Since(start))
+	}
+	return err
+}
+
+func logFailure(method, addr string, err error, took time.Duration) {
+	st := status.Convert(err)
+	log.Printf("RPC %s from %s failed after %v: %s: %s", method, addr, took.Round(time.Millisecond), st.Code(), st.Message())
+}
+
+// --- Rate limit ---
+
+const limiterIdle = time.Minute // hosts quiet this long are forgotten
+
+// rpcLimiter gives each host a token bucket holding up to twice rate calls
+// and refilled at rate per second. A nil limiter lets everything through.
+type rpcLimiter struct {
+	rate float64
+
+	mu      sync.Mutex
+	buckets map[string]*rpcBucket // by host
+	swept   time.Time
+}
+
+type rpcBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRPCLimiter(rate int) *rpcLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rpcLimiter{rate: float64(rate), buckets: make(map[string]*rpcBucket)}
+}
+
+// allow takes a token from the bucket of addr's host, if there is one.
+// Unix socket peers are gateways on the same machine and aren't limited.
+func (l *rpcLimiter) allow(addr string) bool {
+	if l == nil || strings.HasPrefix(addr, "unix:") {
+		return true
+	}
+	host := hostOf(addr)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) > limiterIdle {
+		for h, b := range l.buckets {
+			if now.Sub(b.last) > limiterIdle {
+				delete(l.buckets, h)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[host]
+	if !ok {
+		b = &rpcBucket{tokens: 2 * l.rate, last: now}
+		l.buckets[host] = b
+	}
+	b.tokens = min(2*l.rate, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *rpcLimiter) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !l.allow(peerAddr(ctx)) {
+		return nil, status.Error(codes.ResourceExhausted, "too many calls from your address; slow down")
+	}
+	return handler(ctx, req)
+}
+
+func (l *rpcLimiter) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !l.allow(peerAddr(ss.Context())) {
+		return status.Error(codes.ResourceExhausted, "too many calls from your address; slow down")
+	}
+	return handler(srv, ss)
+}
+
+// --- Auth ---
+
+// adminMethods are the RPCs only an admin may call; see requireAdmin.
+var adminMethods = map[string]bool{
+	pb.ConferenceService_KickUsers_FullMethodName:             true,
+	pb.ConferenceService_PurgeMessages_FullMethodName:         true,
+	pb.ConferenceService_BanUsers_FullMethodName:              true,
+	pb.ConferenceService_MergeRooms_FullMethodName:            true,
+	pb.ConferenceService_SplitRoom_FullMethodName:             true,
+	pb.ConferenceService_FreezeRoom_FullMethodName:            true,
+	pb.ConferenceService_BroadcastAnnouncement_FullMethodName: true,
+	pb.ConferenceService_QueryAuditLog_FullMethodName:         true,
+}
+
+func (s *server) authUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if adminMethods[info.FullMethod] {
+		if err := s.requireAdmin(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return handler(ctx, req)
+}
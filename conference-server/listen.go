@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc/peer"
+)
+
+// listenAddrs is a repeatable -listen flag. Each value is "host:port" (dual
+// stack where the OS allows it) or carries an explicit network prefix:
+// "tcp4://0.0.0.0:50051", "tcp6://[::]:50051", or "unix:///run/conference.sock"
+// for gateways running on the same host.
+type listenAddrs []string
+
+func (l *listenAddrs) String() string { return strings.Join(*l, ",") }
+
+func (l *listenAddrs) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// defaultListenAddr honours GRPC_PORT from the environment (see .env.example).
+func defaultListenAddr() string {
+	if port := os.Getenv("GRPC_PORT"); port != "" {
+		return ":" + port
+	}
+	return ":50051"
+}
+
+// parseListenAddr splits a -listen value into the network and address
+// expected by net.Listen.
+func parseListenAddr(spec string) (network, addr string, err error) {
+	network, addr = "tcp", spec
+	if i := strings.Index(spec, "://"); i >= 0 {
+		network, addr = spec[:i], spec[i+3:]
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "unix":
+		if addr == "" {
+			return "", "", fmt.Errorf("missing socket path in listen address %q", spec)
+		}
+		return network, addr, nil
+	default:
+		return "", "", fmt.Errorf("unsupported network %q in listen address %q", network, spec)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("invalid listen address %q: %v", spec, err)
+	}
+	return network, addr, nil
+}
+
+// openListeners opens every configured address, closing the ones already
+// opened if any of them fails.
+func openListeners(specs []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, spec := range specs {
+		network, addr, err := parseListenAddr(spec)
+		if err == nil && network == "unix" {
+			err = removeStaleSocket(addr)
+		}
+		if err == nil {
+			var lis net.Listener
+			if lis, err = net.Listen(network, addr); err == nil {
+				listeners = append(listeners, lis)
+				continue
+			}
+		}
+		for _, lis := range listeners {
+			lis.Close()
+		}
+		return nil, err
+	}
+	return listeners, nil
+}
+
+// removeStaleSocket deletes a socket file left behind by a previous run that
+// did not shut down cleanly, refusing to touch anything that isn't a socket or
+// that still has a server accepting on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another server", path)
+	}
+	return os.Remove(path)
+}
+
+var unixConnSeq atomic.Uint64
+
+// peerAddr identifies the remote end of a stream. Clients and transfer
+// receivers are keyed by it, but every Unix socket peer reports the same
+// (usually empty) address, so those get a per-stream suffix to stay
+// distinct.
+func peerAddr(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	if p.Addr.Network() == "unix" {
+		return fmt.Sprintf("unix:%s#%d", p.LocalAddr, unixConnSeq.Add(1))
+	}
+	return p.Addr.String()
+}
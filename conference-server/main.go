@@ -2,87 +2,233 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
-	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 
 	pb "conference-server/conference"
 )
 
+// clientBuffer is how many outgoing messages a client may have queued before
+// broadcasts to it start being dropped.
+const clientBuffer = 100
+
+// maxMessageBytes is the largest message the server accepts (gRPC's default).
+const maxMessageBytes = 4 << 20
+
 // --- Structs for managing state ---
 
 type Client struct {
 	id     string // sender ID / username
 	addr   string
+	token  string // session token, lets the client reclaim its name after a drop
 	ch     chan *pb.ConferenceData
 	stream pb.ConferenceService_JoinConferenceServer
+	kicked chan string // receives the reason when an admin removes the client
+	done   chan struct{} // closed when the client's sender goroutine stops; nil for synthetic users
+	room   atomic.Pointer[Room] // current room; changes when the client is migrated
+
+	// Audio has its own bounded queue that sheds the oldest chunks, so a slow
+	// receiver falls behind on audio without holding up the room's relay.
+	audio      chan *pb.ConferenceData
+	audioDrops atomic.Uint32 // chunks shed since the client last caught up
+	stats      audioStats
+
+	// Video gets the same treatment, but frames depend on earlier ones, so a
+	// receiver that lost one waits for the sender's next keyframe.
+	video         chan *pb.ConferenceData
+	videoNeedsKey sync.Map // map[senderID]bool
+
+	quality mediaQuality // steps media down while the client's queues back up
+
+	moderator  bool        // joined with a valid admin token; exempt from room freezes
+	registered atomic.Bool // logged in to the account of its name, see accounts.go
+	joinRole  string // role asked for in the JOIN command or Hello, see roles.go
+	caps      map[string]bool // features agreed in the Hello handshake, see hello.go
+
+	signingKey []byte           // sent in the Hello, pinned to the name; nil if the client doesn't sign, see signing.go
+	signingPub *ecdsa.PublicKey // signingKey, parsed
+}
+
+// Room returns the room the client is currently in.
+func (c *Client) Room() *Room {
+	return c.room.Load()
+}
+
+// Send queues msg for the client without blocking, reporting whether it was
+// queued. ch is never closed, so writers racing with the client's departure
+// are safe; once the sender has stopped, messages are simply refused.
+func (c *Client) Send(msg *pb.ConferenceData) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.ch <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendWait queues msg for the client, waiting for room in its queue unless
+// its sender stops first. Only the client's own handler uses it, for the
+// join sequence, which must not be dropped.
+func (c *Client) sendWait(msg *pb.ConferenceData) {
+	select {
+	case c.ch <- msg:
+	case <-c.done:
+	}
+}
+
+// Kick asks the client's stream handler to disconnect it.
+func (c *Client) Kick(reason string) {
+	select {
+	case c.kicked <- reason:
+	default: // already being kicked
+	}
 }
 
 type Room struct {
-	id      string
-	clients *sync.Map // map[clientAddr]*Client
-	users   *sync.Map // map[senderID]*Client
+	id       string
+	clients  *sync.Map // map[clientAddr]*Client
+	users    *sync.Map // map[senderID]*Client
+	names    sync.Map  // map[skeleton]*Client, see usernames.go
+	events   *eventLog // history + live feed for SubscribeEvents
+	presence *presenceCoalescer
+	audio    *mediaRelay
+	video    *mediaRelay
+	freeze   roomFreeze
+	control  roomControl
+	share    roomShare
+	hands    roomHands
+	history  roomHistory
+	spam     roomSpam
+	pins     roomPins
+	polls    roomPolls
+	e2e      roomE2E
+	settings *roomSettings // shared with the settings store, see settings.go
+	ended    atomic.Bool // END_MEETING was sent; nobody may join any more
+	holds    atomic.Int32 // see roomManager; only changed on its goroutine
+
+	videoLayers sync.Map // map[videoTrack]*publishedLayers
+
+	resMu        sync.Mutex
+	reservations map[string]reservation // map[skeleton]reservation, names held after unclean disconnects
 }
 
-func NewRoom(id string) *Room {
-	return &Room{
-		id:      id,
-		clients: &sync.Map{},
-		users:   &sync.Map{},
+func NewRoom(id string, settings *roomSettings) *Room {
+	r := &Room{
+		id:       id,
+		clients:  &sync.Map{},
+		users:    &sync.Map{},
+		events:   newEventLog(),
+		audio:    newMediaRelay("audio", deliverAudio),
+		video:    newMediaRelay("video", deliverVideo),
+		settings: settings,
+
+		reservations: make(map[string]reservation),
 	}
+	r.presence = newPresenceCoalescer(r)
+	return r
 }
 
 // AddClient adds a client to the room, checking for username uniqueness.
 func (r *Room) AddClient(c *Client) error {
+	if r.ended.Load() {
+		return fmt.Errorf("the meeting in room '%s' has ended", r.id)
+	}
 	// Check if username is already taken
 	if _, ok := r.users.Load(c.id); ok {
 		return fmt.Errorf("username '%s' is already taken", c.id)
 	}
+	if !c.registered.Load() && !r.checkReservation(c.id, c.token) {
+		return fmt.Errorf("username '%s' is reserved for a reconnecting user, try again later", c.id)
+	}
+	// Or one that looks like it
+	if v, taken := r.names.LoadOrStore(usernameSkeleton(c.id), c); taken {
+		return fmt.Errorf("username '%s' is too close to '%s', who is already in the room", c.id, v.(*Client).id)
+	}
 	r.clients.Store(c.addr, c)
 	r.users.Store(c.id, c)
+	c.room.Store(r)
 	return nil
 }
 
-// RemoveClient removes a client from the room.
-func (r *Room) RemoveClient(c *Client) {
-	r.clients.Delete(c.addr)
-	r.users.Delete(c.id)
+// RemoveClient removes a client from the room, reporting whether it was
+// still there: a guest displaced by the owner of its name no longer is.
+func (r *Room) RemoveClient(c *Client) bool {
+	r.clients.CompareAndDelete(c.addr, c)
+	r.names.CompareAndDelete(usernameSkeleton(c.id), c)
+	return r.users.CompareAndDelete(c.id, c)
 }
 
 // server implements the conference.ConferenceServiceServer interface.
 type server struct {
 	pb.UnimplementedConferenceServiceServer
-	rooms sync.Map // map[roomID]*Room
+	rooms *roomManager
 
 	// File transfer state
-	transferResponses map[string]chan *pb.FileTransferResponse
+	transferResponses map[string]*pendingTransfer
 	transferMu        sync.Mutex
 	activeTransfers   sync.Map // map[transferID]transfer (p2pTransfer or broadcastTransfer)
+	clientPacers      sync.Map // map[senderID]*pacer, see ratelimit.go
+	expiredTransfers  atomic.Uint64 // reaped before they started, see stale.go
+	scanBlocked       atomic.Uint64 // refused by the content scanner, see scan.go
+	spamBlocked       atomic.Uint64 // repeated messages held back, see spam.go
+	fileQuota         fileQuota     // see filelimits.go
+	files             *fileStore    // nil unless -file-store is set, see roomfiles.go
+	settings          *settingsStore
+	accounts          *accountStore // registered names, see accounts.go
+	signers           *signerPins   // signing keys pinned to names in use, see signing.go
+	metrics           rpcMetrics    // see interceptors.go
+	limiter           *rpcLimiter   // nil unless -rpc-rate is set
+
+	// Moderation
+	adminToken    string                 // empty disables admin RPCs
+	bans          *banList
+	migrationMu   sync.Mutex             // serializes room merges/splits
+	announcements scheduledAnnouncements // see announce.go
+
+	webrtcAddr string // empty unless the WebRTC browser bridge is on
 }
 
 func newServer() *server {
+	settings := newSettingsStore()
 	return &server{
-		transferResponses: make(map[string]chan *pb.FileTransferResponse),
+		rooms:             newRoomManager(settings),
+		transferResponses: make(map[string]*pendingTransfer),
+		bans:              newBanList(),
+		settings:          settings,
+		accounts:          newAccountStore(),
+		signers:           newSignerPins(),
 	}
 }
 
 // --- JoinConference: Main communication stream ---
 
 func (s *server) JoinConference(stream pb.ConferenceService_JoinConferenceServer) error {
-	p, _ := peer.FromContext(stream.Context())
-	clientAddr := p.Addr.String()
+	clientAddr := peerAddr(stream.Context())
 
 	initialMsg, err := stream.Recv()
 	if err != nil {
+		if status.Code(err) == codes.InvalidArgument {
+			return err // refused by the validation middleware, which says why
+		}
 		return status.Errorf(codes.InvalidArgument, "Failed to receive initial message: %v", err)
 	}
 	roomID := initialMsg.GetRoomId()
@@ -90,60 +236,222 @@ func (s *server) JoinConference(stream pb.ConferenceService_JoinConferenceServer
 	if roomID == "" || senderID == "" {
 		return status.Errorf(codes.InvalidArgument, "room_id and sender must be provided")
 	}
+	if err := checkUsername(senderID); err != nil {
+		return err
+	}
+	// New clients open with a Hello, older ones with a JOIN command
+	hello := initialMsg.GetHello()
+	requestedRole := initialMsg.GetCommand().GetValue()
+	var agreed *pb.Hello
+	if hello != nil {
+		requestedRole = hello.Role
+		agreed = s.negotiate(hello)
+	}
+	joinRole, err := parseJoinRole(requestedRole)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	var signingPub *ecdsa.PublicKey
+	if len(hello.GetSigningKey()) > 0 {
+		if signingPub, err = parseSigningKey(hello.SigningKey); err != nil {
+			return status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+	auditJoin := func(outcome, detail string) {
+		auditTrail.record(&pb.AuditEntry{Action: "join", Actor: senderID, Addr: clientAddr, RoomId: roomID, Outcome: outcome, Detail: detail})
+	}
+
+	if reason, banned := s.bans.Check(senderID, hostOf(clientAddr)); banned {
+		log.Printf("Rejected banned client '%s' (%s): %s", senderID, clientAddr, reason)
+		auditJoin("rejected", "banned: "+reason)
+		return status.Errorf(codes.PermissionDenied, "you are banned from this server: %s", reason)
+	}
+
+	// Registered names need their account's token
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	registered, err := s.accounts.check(senderID, accountTokenFromMetadata(md))
+	if err != nil {
+		log.Printf("Rejected '%s' (%s): %v", senderID, clientAddr, err)
+		auditJoin("rejected", status.Convert(err).Message())
+		if status.Code(err) == codes.Unauthenticated {
+			stream.SetTrailer(metadata.Pairs("account-required", senderID))
+		}
+		return err
+	}
 
-	// Get or create room
-	r, _ := s.rooms.LoadOrStore(roomID, NewRoom(roomID))
-	room := r.(*Room)
+	// Get or create room; the hold is released when the client leaves
+	room, _ := s.rooms.Acquire(roomID)
+
+	// Reconnecting clients present the token they got on their previous join
+	token := sessionTokenFromMetadata(md)
+	if token == "" {
+		token = newSessionToken()
+	}
 
 	// Create and add client
 	client := &Client{
 		id:     senderID,
 		addr:   clientAddr,
-		ch:     make(chan *pb.ConferenceData, 100),
+		token:  token,
+		ch:     make(chan *pb.ConferenceData, clientBuffer),
 		stream: stream,
+		kicked: make(chan string, 1),
+		done:   make(chan struct{}),
+		audio:  make(chan *pb.ConferenceData, clientAudioBuffer),
+		video:  make(chan *pb.ConferenceData, clientVideoBuffer),
+
+		moderator: s.adminToken != "" && s.requireAdmin(stream.Context()) == nil,
+		joinRole:  joinRole,
+		caps:      capSet(agreed.GetFeatures()),
+	}
+	if signingPub != nil {
+		client.signingKey, client.signingPub = hello.SigningKey, signingPub
+	}
+	if registered {
+		client.registered.Store(true)
+		s.displaceGuests(senderID)
+	}
+	if err := s.signers.pin(client); err != nil {
+		log.Printf("Rejected '%s' (%s): %v", senderID, clientAddr, err)
+		auditJoin("rejected", err.Error())
+		s.rooms.Release(room)
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err := room.admit(client, roomPasswordFromMetadata(md)); err != nil {
+		log.Printf("Client '%s' turned away from room '%s': %v", senderID, roomID, err)
+		auditJoin("rejected", status.Convert(err).Message())
+		s.signers.unpin(client)
+		s.rooms.Release(room)
+		stream.Send(serverCommand(roomID, serverSender, &pb.Command{Type: "ERROR", Value: status.Convert(err).Message()}))
+		return err
 	}
 	if err := room.AddClient(client); err != nil {
 		log.Printf("Client '%s' failed to join room '%s': %v", senderID, roomID, err)
+		auditJoin("rejected", err.Error())
+		s.signers.unpin(client)
+		s.rooms.Release(room)
 		// Send error back to client before closing
-		stream.Send(&pb.ConferenceData{
-			Payload: &pb.ConferenceData_Command{Command: &pb.Command{Type: "ERROR", Value: err.Error()}},
-		})
+		stream.Send(serverCommand(roomID, serverSender, &pb.Command{Type: "ERROR", Value: err.Error()}))
 		return status.Error(codes.AlreadyExists, err.Error())
 	}
 	log.Printf("Client '%s' (%s) joined room '%s'", senderID, clientAddr, roomID)
+	switch {
+	case client.moderator:
+		auditJoin("ok", "moderator")
+	case registered:
+		auditJoin("ok", "registered")
+	default:
+		auditJoin("ok", "guest")
+	}
+
+	// The sender is the only goroutine writing to the stream. It stops when
+	// the handler returns or when a Send fails; either way it closes
+	// client.done, which ends the handler too and turns away new messages.
+	sendCtx, stopSender := context.WithCancel(stream.Context())
+	defer stopSender()
+	go func() {
+		defer close(client.done)
+		defer recoverPanic("sender for '"+senderID+"'", nil)
+		for {
+			var msg *pb.ConferenceData
+			select {
+			case <-sendCtx.Done():
+				return
+			case msg = <-client.ch:
+			case msg = <-client.audio:
+				if len(client.audio) == 0 {
+					client.audioDrops.Store(0) // caught up
+				}
+				client.stats.recordReceived()
+			case msg = <-client.video:
+			}
+			if err := client.stream.Send(msg); err != nil {
+				log.Printf("Error sending to client %s: %v. Stopping sender.", client.id, err)
+				return
+			}
+		}
+	}()
+
+	if agreed != nil {
+		client.sendWait(seal(&pb.ConferenceData{Payload: &pb.ConferenceData_Hello{Hello: agreed}}, roomID, serverSender))
+		log.Printf("Client '%s' (version %q) speaks protocol v%d, features: %v", senderID, hello.Version, agreed.ProtocolVersion, agreed.Features)
+	}
+	room.claimOwner(client)
+	room.grantJoinRole(client)
+	room.sendRoles(client)
+	room.sendHands(client)
 
+	cleanExit := false
+	kickReason := ""
 	defer func() {
-		room.RemoveClient(client)
-		close(client.ch)
-		log.Printf("Client '%s' left room '%s'", senderID, roomID)
-		if room.IsEmpty() {
-			s.rooms.Delete(roomID)
-			log.Printf("Room '%s' is empty and deleted.", roomID)
+		room := client.Room() // may differ from the joined room after a migration
+		present := room.RemoveClient(client) // not if the owner of its name displaced it
+		if present {
+			room.releaseOwner(client)
+			room.endShare(client.id)
+			room.lowerHand(client.id)
+			room.dropE2EKey(client.id)
+		}
+		log.Printf("Client '%s' left room '%s'", senderID, room.id)
+		left := &pb.AuditEntry{Action: "leave", Actor: senderID, Addr: clientAddr, RoomId: room.id, Outcome: "dropped"}
+		switch {
+		case kickReason != "":
+			left.Outcome, left.Detail = "kicked", kickReason
+		case cleanExit:
+			left.Outcome = "ok"
+		}
+		auditTrail.record(left)
+		deleted := false
+		if cleanExit {
+			deleted = s.rooms.Release(room)
+			s.signers.unpin(client)
 		} else {
-			room.Broadcast(&pb.ConferenceData{
-				Sender: "Server", RoomId: roomID,
-				Payload: &pb.ConferenceData_Command{Command: &pb.Command{Type: "USER_LEFT", Value: senderID}},
-			}, "")
+			// The reservation keeps the client's hold, and its key's pin,
+			// until it runs out
+			room.Reserve(senderID, client.token)
+			time.AfterFunc(reservationGrace, func() {
+				defer recoverPanic("reservation of '"+senderID+"'", nil)
+				s.rooms.Release(room)
+				s.signers.unpin(client)
+			})
+			log.Printf("Name '%s' reserved in room '%s' for %v after unclean disconnect", senderID, room.id, reservationGrace)
+		}
+		if !deleted && present {
+			room.Broadcast(serverCommand(room.id, serverSender, &pb.Command{Type: "USER_LEFT", Value: senderID}), "")
 		}
 	}()
 	
 	// Announce new user
-	room.Broadcast(&pb.ConferenceData{
-		Sender: "Server", RoomId: roomID,
-		Payload: &pb.ConferenceData_Command{Command: &pb.Command{Type: "USER_JOINED", Value: senderID}},
-	}, "")
+	room.Broadcast(serverCommand(roomID, serverSender, &pb.Command{Type: "USER_JOINED", Value: senderID}), "")
+	room.announceSigningKey(client)
 	
 	// Welcome message to the user
-	client.ch <- &pb.ConferenceData{
-		Payload: &pb.ConferenceData_Command{Command: &pb.Command{Type: "WELCOME", Value: fmt.Sprintf("Welcome to room '%s'", roomID)}},
-	}
-
-	// Goroutine to send messages from channel to the client's stream
+	client.sendWait(serverCommand(roomID, serverSender, &pb.Command{Type: "WELCOME", Value: fmt.Sprintf("Welcome to room '%s'", roomID)}))
+	room.sendSigningKeys(client) // before the history, so its signatures can be checked
+	room.sendHistory(client)
+	client.sendWait(serverCommand(roomID, serverSender, &pb.Command{Type: "SESSION", Value: client.token}))
+	room.sendRoster(client)
+	room.sendPins(client)
+	room.sendPolls(client)
+	room.sendSettings(client)
+	room.sendE2EKeys(client)
+	s.sendInbox(room, client)
+
+	// Receive in its own goroutine so the main loop can also react to kicks.
+	// Returning from the handler cancels the stream, which unblocks Recv.
+	incoming := make(chan *pb.ConferenceData)
+	recvErr := make(chan error, 1)
 	go func() {
-		for msg := range client.ch {
-			if err := client.stream.Send(msg); err != nil {
-				log.Printf("Error sending to client %s: %v. Closing channel.", client.id, err)
-				// The main loop will detect the stream error and clean up.
+		defer recoverPanic("receiver for '"+senderID+"'", func(err error) { recvErr <- err })
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case incoming <- msg:
+			case <-stream.Context().Done():
 				return
 			}
 		}
@@ -151,17 +459,105 @@ func (s *server) JoinConference(stream pb.ConferenceService_JoinConferenceServer
 
 	// Main loop to process incoming messages from this client
 	for {
-		msg, err := stream.Recv()
-		if err == io.EOF { return nil }
-		if err != nil { return err }
+		var msg *pb.ConferenceData
+		select {
+		case msg = <-incoming:
+		case err := <-recvErr:
+			if err == io.EOF { cleanExit = true; return nil }
+			return err
+		case reason := <-client.kicked:
+			cleanExit = true
+			kickReason = reason
+			log.Printf("Client '%s' kicked from room '%s': %s", senderID, client.Room().id, reason)
+			return status.Errorf(codes.PermissionDenied, "%s", reason)
+		case <-client.done:
+			return status.Error(codes.Unavailable, "failed to send to client")
+		}
 
+		room := client.Room()
+		msg.Sender = client.id // whatever the client put there
+		seal(msg, room.id, client.id)
+		if rejectIfFrozen(room, client, msg) {
+			continue
+		}
 		switch payload := msg.Payload.(type) {
 		case *pb.ConferenceData_PrivateMessage:
 			s.handlePrivateMessage(room, client, payload.PrivateMessage)
 		case *pb.ConferenceData_FileAnnouncement:
+			if !room.canControl(client) {
+				reply(client, room, &pb.Command{Type: "ROLE_DENIED", Value: "only the host, a co-host or a moderator can share files with the whole room"})
+				continue
+			}
+			announce := payload.FileAnnouncement
+			announce.SenderRegistered = client.registered.Load()
+			auditAnnounce := func(outcome, detail string) {
+				auditTrail.record(&pb.AuditEntry{Action: "file", Actor: client.id, Addr: client.addr, RoomId: room.id, Target: announce.Filename, Size: announce.FileSize, Outcome: outcome, Detail: "to the room" + detail})
+			}
+			if code, reason := s.checkFile(client, announce.Filename, announce.FileSize); code != "" {
+				auditAnnounce("refused", ": "+code)
+				reply(client, room, &pb.Command{Type: "FILE_DENIED", Value: announce.TransferId + ":" + code + ":" + reason})
+				continue
+			}
+			auditAnnounce("announced", "")
 			log.Printf("File announcement from '%s' in room '%s' for '%s'", msg.Sender, msg.RoomId, payload.FileAnnouncement.Filename)
-			s.activeTransfers.Store(payload.FileAnnouncement.TransferId, &broadcastTransfer{})
+			s.activeTransfers.Store(payload.FileAnnouncement.TransferId, &broadcastTransfer{room: room.id, announcer: client.id, filename: payload.FileAnnouncement.Filename, size: payload.FileAnnouncement.FileSize, created: time.Now(), pace: newPacer(transferRateKiB), transferAbort: newTransferAbort()})
+			room.Broadcast(msg, client.addr)
+		case *pb.ConferenceData_TextMessage:
+			if reason := checkSignature(client, room, payload.TextMessage); reason != "" {
+				reply(client, room, &pb.Command{Type: "SIGNATURE_DENIED", Value: reason})
+				continue
+			}
+			if payload.TextMessage.Encrypted != nil {
+				// Ciphertext can't be compared, so it skips the spam filter
+				if reason := checkEncrypted(payload.TextMessage); reason != "" {
+					reply(client, room, &pb.Command{Type: "E2E_DENIED", Value: reason})
+					continue
+				}
+			} else if s.rejectSpam(room, client, payload.TextMessage.Content) {
+				continue
+			}
+			if payload.TextMessage.Sender != "" {
+				payload.TextMessage.Sender = client.id // signed ones were checked to be already
+			}
+			if payload.TextMessage.Important && !client.moderator {
+				payload.TextMessage.Important = false // only moderators may flag messages
+			}
+			room.history.Record(msg)
 			room.Broadcast(msg, client.addr)
+		case *pb.ConferenceData_AudioChunk:
+			// Stamp the authenticated sender so listeners can mix/mute per speaker
+			payload.AudioChunk.Sender = client.id
+			payload.AudioChunk.RoomId = room.id
+			client.stats.recordSent(payload.AudioChunk, time.Now())
+			if room.AudioMuted(client) {
+				continue
+			}
+			room.RelayAudio(msg, client.addr)
+		case *pb.ConferenceData_VideoFrame:
+			payload.VideoFrame.Sender = client.id
+			payload.VideoFrame.RoomId = room.id
+			if !room.acceptsFrame(client, payload.VideoFrame) {
+				continue
+			}
+			room.RelayVideo(msg, client.addr)
+		case *pb.ConferenceData_E2EKey:
+			room.publishE2EKey(client, payload.E2EKey)
+		case *pb.ConferenceData_KeyEnvelope:
+			room.relayKeyEnvelope(client, payload.KeyEnvelope)
+		case *pb.ConferenceData_Command:
+			if room.handleRoleCommand(client, payload.Command) || s.handleEndMeeting(room, client, payload.Command) || room.handleMuteCommand(client, payload.Command) ||
+				room.handleShareCommand(client, payload.Command) || room.handleHandCommand(client, payload.Command) ||
+				room.handleRosterCommand(client, payload.Command) || room.handleSpamCommand(client, payload.Command) ||
+				room.handlePinCommand(client, payload.Command) || room.handleSettingsCommand(client, payload.Command) ||
+				s.handleIdentifyCommand(room, client, payload.Command) {
+				continue
+			}
+			if isCoalescedCommand(msg) {
+				room.presence.Submit(msg, client.addr)
+			} else {
+				room.history.Record(msg)
+				room.Broadcast(msg, client.addr)
+			}
 		default:
 			room.Broadcast(msg, client.addr)
 		}
@@ -172,6 +568,10 @@ func (s *server) JoinConference(stream pb.ConferenceService_JoinConferenceServer
 
 func (r *Room) Broadcast(msg *pb.ConferenceData, senderAddr string) {
 	log.Printf("Broadcasting message from sender with address: %s", senderAddr)
+	seal(msg, r.id, serverSender)
+	if ev := roomEventFromData(msg); ev != nil {
+		r.events.Append(ev)
+	}
 	r.clients.Range(func(key, value interface{}) bool {
 		clientAddr := key.(string)
 		client := value.(*Client)
@@ -182,10 +582,8 @@ func (r *Room) Broadcast(msg *pb.ConferenceData, senderAddr string) {
 		}
 
 		log.Printf("Sending broadcast to %s (%s)", client.id, clientAddr)
-		select {
-		case client.ch <- msg:
-		default:
-			log.Printf("Dropped message for client %s, channel full.", client.id)
+		if !client.Send(msg) {
+			log.Printf("Dropped message for client %s, channel full or client gone.", client.id)
 		}
 		return true
 	})
@@ -198,9 +596,7 @@ func (s *server) handlePrivateMessage(room *Room, sender *Client, pm *pb.Private
 		
 		// Format the private message as a standard ChatMessage for the recipient
 		privateContent := fmt.Sprintf("(private from %s) %s", sender.id, pm.Content)
-		fwdMsg := &pb.ConferenceData{
-			RoomId: room.id,
-			Sender: sender.id,
+		fwdMsg := seal(&pb.ConferenceData{
 			Payload: &pb.ConferenceData_TextMessage{
 				TextMessage: &pb.ChatMessage{
 					Sender: sender.id,
@@ -209,73 +605,146 @@ func (s *server) handlePrivateMessage(room *Room, sender *Client, pm *pb.Private
 					Timestamp: time.Now().Unix(),
 				},
 			},
+		}, room.id, sender.id)
+		if !recipient.Send(fwdMsg) {
+			log.Printf("Dropped private message from '%s' to '%s', channel full or client gone.", sender.id, recipient.id)
+			return
 		}
-		recipient.ch <- fwdMsg
 		log.Printf("Relayed private message from '%s' to '%s'", sender.id, recipient.id)
 	} else {
 		// Send "user not found" error back to the sender
-		notFoundMsg := &pb.ConferenceData{
-			Sender: "Server",
-			Payload: &pb.ConferenceData_Command{
-				Command: &pb.Command{Type: "ERROR", Value: fmt.Sprintf("User '%s' not found in this room.", recipientID)},
-			},
-		}
-		sender.ch <- notFoundMsg
+		sender.Send(serverCommand(room.id, serverSender, &pb.Command{Type: "ERROR", Value: fmt.Sprintf("User '%s' not found in this room.", recipientID)}))
 		log.Printf("Failed to send private message from '%s': user '%s' not found.", sender.id, recipientID)
 	}
 }
 
-// --- Room Helpers ---
-func (r *Room) IsEmpty() bool {
-	count := 0
-	r.clients.Range(func(_, _ interface{}) bool {
-		count++
-		return false // Stop after finding one
-	})
-	return count == 0
-}
-
 
 // --- File Transfer (Unchanged from previous step, but placed here for completeness) ---
 
-type transfer interface { isTransfer() }
-type p2pTransfer struct { sender pb.ConferenceService_TransferFileServer; receiver pb.ConferenceService_TransferFileServer; mu sync.Mutex }
+type transfer interface { isTransfer(); abort(reason string) }
+// pendingTransfer is a 1:1 request waiting for its recipient's answer.
+type pendingTransfer struct {
+	answer   chan *pb.FileTransferResponse
+	room     string
+	from, to string // the users on either end, who may cancel it
+}
+type p2pTransfer struct {
+	mu         sync.Mutex
+	leg        *p2pLeg // the current attempt at relaying it, see newP2PTransfer
+	resumes    int     // legs started after an interruption
+	from, to   string // the users on either end, who may cancel it
+	filename   string
+	size       int64 // declared in the request
+	room       string
+	created    time.Time
+	pace       *pacer     // -transfer-rate
+	spool      *scanSpool // nil unless scanning, see scan.go
+	finished   chan struct{}
+	transferAbort
+}
 func (t *p2pTransfer) isTransfer() {}
-type broadcastTransfer struct { sender pb.ConferenceService_TransferFileServer; receivers sync.Map; mu sync.Mutex }
+type broadcastTransfer struct {
+	sender    pb.ConferenceService_TransferFileServer
+	receivers sync.Map
+	mu        sync.Mutex
+	room      string
+	announcer string // the only user who may cancel it
+	filename  string
+	size      int64 // declared in the announcement
+	created   time.Time
+	pace      *pacer // -transfer-rate
+	transferAbort
+}
 func (t *broadcastTransfer) isTransfer() {}
 
 func (s *server) RequestFileTransfer(ctx context.Context, req *pb.FileTransferRequest) (*pb.FileTransferResponse, error) {
 	log.Printf("P2P file request from '%s' to '%s' for file '%s'", req.Sender, req.Recipient, req.Filename)
+	auditRequest := func(outcome, detail string) {
+		auditTrail.record(&pb.AuditEntry{Action: "file", Actor: req.Sender, Addr: peerAddr(ctx), RoomId: req.RoomId, Target: req.Filename, Size: req.FileSize, Outcome: outcome, Detail: "to " + req.Recipient + detail})
+	}
+	room, caller, err := s.roomMember(ctx, req.RoomId, req.Sender)
+	if err != nil {
+		auditRequest("refused", ": "+status.Convert(err).Message())
+		return nil, err
+	}
+	if frozen, reason := room.Frozen(); frozen && !caller.moderator {
+		auditRequest("refused", ": frozen")
+		return nil, status.Errorf(codes.FailedPrecondition, "room '%s' is read-only: %s", room.id, reason)
+	}
+	code, reason := room.checkGuestFile(req.Sender)
+	if code == "" {
+		code, reason = s.checkFile(caller, req.Filename, req.FileSize)
+	}
+	if code != "" {
+		log.Printf("Refused file '%s' from '%s': %s", req.Filename, req.Sender, reason)
+		auditRequest("refused", ": "+code)
+		return &pb.FileTransferResponse{TransferId: req.TransferId, Accepted: false, RejectCode: code, RejectReason: reason}, nil
+	}
+	if scanning() {
+		req.Direct = false // the scanner must see it
+	}
 	respChan := make(chan *pb.FileTransferResponse, 1)
 	s.transferMu.Lock()
-	s.transferResponses[req.TransferId] = respChan
+	s.transferResponses[req.TransferId] = &pendingTransfer{answer: respChan, room: req.RoomId, from: req.Sender, to: req.Recipient}
 	s.transferMu.Unlock()
 	defer func() { s.transferMu.Lock(); delete(s.transferResponses, req.TransferId); s.transferMu.Unlock() }()
 	notificationMsg := &pb.ConferenceData{
-		RoomId: req.RoomId, Sender: "Sistema-FileTransfer",
-		Payload: &pb.ConferenceData_TextMessage{ TextMessage: &pb.ChatMessage{ Content: fmt.Sprintf("FILE_REQUEST:%s:%s:%s:%d:%d", req.TransferId, req.Sender, req.Filename, req.FileSize, req.Timestamp) } },
+		RoomId: req.RoomId, Sender: fileRequestSender,
+		Payload: &pb.ConferenceData_TextMessage{ TextMessage: &pb.ChatMessage{ Content: fmt.Sprintf("FILE_REQUEST:%s:%s:%s:%d:%d:%s:%s:%t:%s:%t", req.TransferId, req.Sender, req.Filename, req.FileSize, req.Timestamp, req.Sha256, strings.Join(req.Compression, ","), req.Direct, req.Recipient, caller.registered.Load()) } },
 	}
-	if r, ok := s.rooms.Load(req.RoomId); ok { r.(*Room).Broadcast(notificationMsg, "") }
+	room.events.Append(&pb.RoomEvent{RoomId: req.RoomId, Sender: req.Sender, Event: &pb.RoomEvent_FileRequest{FileRequest: req}})
+	room.Broadcast(notificationMsg, "")
 	select {
 	case resp := <-respChan:
-		if resp.Accepted { s.activeTransfers.Store(req.TransferId, &p2pTransfer{}) }
+		if resp.Accepted {
+			s.activeTransfers.Store(req.TransferId, newP2PTransfer(req.RoomId, req.Sender, req.Recipient, req.Filename, req.FileSize))
+			auditRequest("accepted", "")
+		} else {
+			s.fileQuota.refund(quotaOwner(caller), req.FileSize)
+			auditRequest("declined", "")
+		}
 		return resp, nil
+	case <-ctx.Done(): // the sender gave up or went away
+		s.fileQuota.refund(quotaOwner(caller), req.FileSize)
+		auditRequest("abandoned", "")
+		return nil, ctx.Err()
 	case <-time.After(60 * time.Second):
+		s.fileQuota.refund(quotaOwner(caller), req.FileSize)
+		auditRequest("unanswered", "")
 		return &pb.FileTransferResponse{TransferId: req.TransferId, Accepted: false}, nil
 	}
 }
 func (s *server) RespondFileTransfer(ctx context.Context, resp *pb.FileTransferResponse) (*pb.FileTransferResponse, error) {
 	s.transferMu.Lock()
-	respChan, ok := s.transferResponses[resp.TransferId]
+	p, ok := s.transferResponses[resp.TransferId]
 	s.transferMu.Unlock()
 	if !ok { return nil, fmt.Errorf("invalid transfer ID") }
-	respChan <- resp
+	if _, _, err := s.roomMember(ctx, p.room, resp.Sender); err != nil {
+		return nil, err
+	}
+	if resp.Sender != p.to {
+		return nil, status.Error(codes.PermissionDenied, "only the recipient can answer this request")
+	}
+	if scanning() {
+		resp.Candidates = nil
+	} else {
+		resp.Candidates = withReflexiveCandidate(ctx, resp.Candidates)
+	}
+	select {
+	case p.answer <- resp:
+	default: // already answered, or cancelled by the sender
+		return nil, status.Error(codes.FailedPrecondition, "transfer already answered or cancelled")
+	}
 	return resp, nil
 }
 func (s *server) TransferFile(stream pb.ConferenceService_TransferFileServer) error {
 	md, _ := metadata.FromIncomingContext(stream.Context())
-	tID := md.Get("transfer-id")[0]; role := md.Get("role")[0]
-	p, _ := peer.FromContext(stream.Context()); clientAddr := p.Addr.String()
+	ids, roles := md.Get("transfer-id"), md.Get("role")
+	if len(ids) == 0 || len(roles) == 0 {
+		return status.Error(codes.InvalidArgument, "transfer-id and role metadata must be provided")
+	}
+	tID, role := ids[0], roles[0]
+	clientAddr := peerAddr(stream.Context())
 	val, ok := s.activeTransfers.Load(tID)
 	if !ok { return fmt.Errorf("transfer not initiated") }
 	switch tx := val.(type) {
@@ -284,43 +753,67 @@ func (s *server) TransferFile(stream pb.ConferenceService_TransferFileServer) er
 	default: return fmt.Errorf("unknown transfer type")
 	}
 }
-func (s *server) handleP2PTransfer(tx *p2pTransfer, stream pb.ConferenceService_TransferFileServer, role, tID string) error {
-	if role == "sender" {
-		tx.mu.Lock(); tx.sender = stream; receiver := tx.receiver; tx.mu.Unlock()
-		if receiver != nil { go s.proxyP2PChunks(tx.sender, receiver, tID) }
-	} else if role == "receiver" {
-		tx.mu.Lock(); tx.receiver = stream; sender := tx.sender; tx.mu.Unlock()
-		if sender != nil { go s.proxyP2PChunks(sender, tx.receiver, tID) }
-	}
-	<-stream.Context().Done()
-	return nil
-}
 func (s *server) handleBroadcastTransfer(tx *broadcastTransfer, stream pb.ConferenceService_TransferFileServer, role, clientAddr, tID string) error {
+	// Only the announcer's session may stream the file, and only members' receive it
+	var err error
+	switch role {
+	case "sender":
+		_, _, err = s.roomMember(stream.Context(), tx.room, tx.announcer)
+	case "receiver":
+		_, _, err = s.sessionMember(stream.Context(), tx.room)
+	default:
+		err = status.Errorf(codes.InvalidArgument, "unknown role '%s'", role)
+	}
+	if err != nil {
+		return err
+	}
 	if role == "sender" {
 		tx.mu.Lock()
 		if tx.sender != nil { tx.mu.Unlock(); return fmt.Errorf("broadcast sender for '%s' already exists", tID) }
 		tx.sender = stream
 		tx.mu.Unlock()
-		s.proxyBroadcastChunks(tx, tID)
+		proxied := make(chan struct{})
+		go func() {
+			defer close(proxied)
+			defer recoverPanic("transfer '"+tID+"'", func(error) { s.abortTransfer(tID, tx, "internal server error") })
+			s.proxyBroadcastChunks(tx, tID)
+		}()
+		select {
+		case <-proxied:
+		case <-tx.aborted:
+			return tx.abortErr()
+		}
 	} else if role == "receiver" {
 		tx.receivers.Store(clientAddr, stream)
 		defer tx.receivers.Delete(clientAddr)
 	}
-	<-stream.Context().Done()
-	return nil
-}
-func (s *server) proxyP2PChunks(sender pb.ConferenceService_TransferFileServer, receiver pb.ConferenceService_TransferFileServer, tID string) {
-	for {
-		chunk, err := sender.Recv()
-		if err != nil { return }
-		if err := receiver.Send(chunk); err != nil { return }
+	select {
+	case <-stream.Context().Done():
+	case <-tx.aborted:
+		return tx.abortErr()
 	}
+	return nil
 }
 func (s *server) proxyBroadcastChunks(tx *broadcastTransfer, tID string) {
 	defer s.activeTransfers.Delete(tID)
+	spool := newScanSpool(tx.size)
+	defer spool.remove()
+	count := newRelayCount(tx.size)
 	for {
 		chunk, err := tx.sender.Recv()
 		if err != nil { return }
+		if reason := count.add(chunk); reason != "" {
+			s.abortTransfer(tID, tx, reason)
+			return
+		}
+		if err := s.paceChunk(tx.sender.Context(), tx.pace, tx.announcer, len(chunk.Data)); err != nil { return }
+		spool.add(chunk)
+		if chunk.GetIsLast() {
+			if reason := spool.check(s, tx.sender.Context(), tID, tx.room, tx.announcer, tx.filename); reason != "" {
+				s.abortTransfer(tID, tx, reason)
+				return
+			}
+		}
 		tx.receivers.Range(func(key, value interface{}) bool {
 			receiverStream := value.(pb.ConferenceService_TransferFileServer)
 			if err := receiverStream.Send(chunk); err != nil { tx.receivers.Delete(key) }
@@ -332,10 +825,104 @@ func (s *server) proxyBroadcastChunks(tx *broadcastTransfer, tID string) {
 
 // --- Main ---
 func main() {
-	lis, err := net.Listen("tcp", ":50051")
+	var listen listenAddrs
+	flag.Var(&listen, "listen", "address to listen on, repeatable (host:port, tcp4://host:port, tcp6://[host]:port, unix:///path)")
+	adminToken := flag.String("admin-token", os.Getenv("CONFERENCE_ADMIN_TOKEN"), "token required by admin RPCs (empty disables them)")
+	replayFile := flag.String("replay", "", "session file (JSON Lines) to replay into a room as synthetic users")
+	replayRoom := flag.String("replay-room", "demo", "room the -replay session is played into")
+	replayLoop := flag.Bool("replay-loop", false, "restart the -replay session when it ends")
+	fileStore := flag.String("file-store", "", "directory where files uploaded to rooms are kept (empty disables UploadToRoom)")
+	roomStore := flag.String("room-store", "", "directory where room settings are kept across restarts (empty keeps them in memory)")
+	accountStore := flag.String("account-store", "", "directory where registered names are kept across restarts (empty keeps them in memory)")
+	auditFile := flag.String("audit-log", "", "file joins, leaves, kicks, bans, file transfers and admin actions are appended to, as JSON Lines (empty keeps the last 10000 in memory)")
+	webrtcAddr := flag.String("webrtc-addr", "", "HTTP address for the WebRTC browser bridge, e.g. :8080 (needs -tags webrtc)")
+	flag.IntVar(&transferRateKiB, "transfer-rate", transferRateKiB, "max KiB/s relayed per file transfer (0 = unlimited)")
+	flag.IntVar(&clientTransferRateKiB, "client-transfer-rate", clientTransferRateKiB, "max KiB/s relayed for all of one user's file transfers together (0 = unlimited)")
+	flag.DurationVar(&transferTTL, "transfer-ttl", transferTTL, "how long an accepted or announced file transfer may wait for its streams before it is dropped")
+	flag.Int64Var(&roomFilesMiB, "room-files-mb", roomFilesMiB, "MiB of uploaded files each room keeps, oldest dropped first (0 = unlimited; owners can change it per room)")
+	flag.DurationVar(&roomFilesAge, "room-files-age", roomFilesAge, "how long uploaded files are kept, e.g. 168h (0 = forever; owners can change it per room)")
+	flag.Int64Var(&maxFileMiB, "max-file-size", maxFileMiB, "largest file, in MiB, the server relays (0 = unlimited)")
+	flag.Int64Var(&dailyQuotaMiB, "daily-quota", dailyQuotaMiB, "MiB each user may send per day (0 = unlimited)")
+	flag.Var(allowedExts, "allow-ext", "comma-separated file extensions to allow; if set, all others are refused")
+	flag.Var(blockedExts, "block-ext", "comma-separated file extensions to refuse, e.g. exe,bat")
+	flag.StringVar(&scanCmd, "scan-cmd", "", "scanner run on every relayed or stored file, with its path appended; exit status 1 refuses it (e.g. \"clamdscan --no-summary\")")
+	flag.StringVar(&scanICAP, "scan-icap", "", "ICAP service every relayed or stored file is sent to, e.g. icap://localhost:1344/avscan")
+	flag.DurationVar(&scanTimeout, "scan-timeout", scanTimeout, "how long a file scan may take before the file is refused")
+	flag.IntVar(&spamRepeats, "spam-repeats", spamRepeats, "identical text messages a user may send within -spam-window before the rest are held back (0 disables; hosts can change it per room)")
+	flag.DurationVar(&spamWindow, "spam-window", spamWindow, "window for -spam-repeats")
+	flag.IntVar(&maxTextChars, "max-text", maxTextChars, "longest text message, in characters")
+	flag.IntVar(&maxFilenameBytes, "max-filename", maxFilenameBytes, "longest file name, in bytes")
+	flag.IntVar(&maxRoomIDChars, "max-room-id", maxRoomIDChars, "longest room ID, in characters")
+	flag.IntVar(&maxAudioChunkBytes, "max-audio-chunk", maxAudioChunkBytes, "largest audio chunk, in bytes")
+	flag.IntVar(&rpcRate, "rpc-rate", rpcRate, "calls (streams included) each host may start per second, with bursts of twice that (0 = unlimited)")
+	flag.DurationVar(&pollDuration, "poll-duration", pollDuration, "how long a poll stays open when its creator doesn't say")
+	flag.IntVar(&chatHistorySize, "history", chatHistorySize, fmt.Sprintf("recent messages and commands replayed to late joiners, 0-%d (0 disables)", maxChatHistory))
+	flag.Parse()
+	if chatHistorySize < 0 || chatHistorySize > maxChatHistory {
+		log.Fatalf("-history must be between 0 and %d", maxChatHistory)
+	}
+	if transferTTL <= 0 {
+		log.Fatalf("-transfer-ttl must be positive")
+	}
+	if spamRepeats < 0 || spamWindow <= 0 {
+		log.Fatalf("-spam-repeats must not be negative and -spam-window must be positive")
+	}
+	if pollDuration <= 0 || pollDuration > maxPollDuration {
+		log.Fatalf("-poll-duration must be between 1s and %v", maxPollDuration)
+	}
+	if rpcRate < 0 {
+		log.Fatalf("-rpc-rate must not be negative")
+	}
+	if roomFilesMiB < 0 || roomFilesAge < 0 {
+		log.Fatalf("-room-files-mb and -room-files-age must not be negative")
+	}
+	if err := checkLimitFlags(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := checkScanFlags(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if len(listen) == 0 {
+		listen = listenAddrs{defaultListenAddr()}
+	}
+
+	listeners, err := openListeners(listen)
 	if err != nil { log.Fatalf("Failed to listen: %v", err) }
-	s := grpc.NewServer()
-	pb.RegisterConferenceServiceServer(s, newServer())
-	log.Printf("Server listening at %v", lis.Addr())
-	if err := s.Serve(lis); err != nil { log.Fatalf("Failed to serve: %v", err) }
+	srv := newServer()
+	srv.adminToken = *adminToken
+	srv.limiter = newRPCLimiter(rpcRate)
+	s := grpc.NewServer(srv.serverOptions()...)
+	srv.webrtcAddr = *webrtcAddr
+	go srv.reapTransfers(transferTTL / 4)
+	if *fileStore != "" {
+		if srv.files, err = openFileStore(*fileStore); err != nil { log.Fatalf("Failed to open file store: %v", err) }
+		go srv.cleanFiles(fileCleanInterval)
+	}
+	if *roomStore != "" {
+		if err := srv.settings.load(*roomStore); err != nil { log.Fatalf("Failed to open room store: %v", err) }
+	}
+	if *accountStore != "" {
+		if err := srv.accounts.load(*accountStore); err != nil { log.Fatalf("Failed to open account store: %v", err) }
+	}
+	if *auditFile != "" {
+		if err := auditTrail.open(*auditFile); err != nil { log.Fatalf("Failed to open audit log: %v", err) }
+	}
+	pb.RegisterConferenceServiceServer(s, srv)
+
+	if *replayFile != "" {
+		events, err := loadSession(*replayFile)
+		if err != nil { log.Fatalf("Failed to load replay session: %v", err) }
+		go srv.replaySession(context.Background(), *replayRoom, events, *replayLoop)
+	}
+
+	if *webrtcAddr != "" {
+		go func() { log.Fatalf("WebRTC bridge: %v", srv.startWebRTC(*webrtcAddr)) }()
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, lis := range listeners {
+		log.Printf("Server listening at %v (%s)", lis.Addr(), lis.Addr().Network())
+		go func(lis net.Listener) { errs <- s.Serve(lis) }(lis)
+	}
+	if err := <-errs; err != nil { log.Fatalf("Failed to serve: %v", err) }
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "conference-server/conference"
+)
+
+// --- Live session migration ---
+
+// moveClient moves a connected client into another room without touching its
+// stream: the handler picks up the new room on its next message, and the
+// client is told via a ROOM_CHANGED command so it can update its own state.
+// The client's hold on the room moves with it.
+func (s *server) moveClient(c *Client, from, to *Room) error {
+	s.rooms.Retain(to)
+	if err := to.AddClient(c); err != nil {
+		s.rooms.Release(to)
+		return err
+	}
+	from.RemoveClient(c)
+	s.rooms.Release(from)
+	from.releaseOwner(c)
+	from.endShare(c.id)
+	from.lowerHand(c.id)
+	from.dropE2EKey(c.id)
+
+	from.Broadcast(serverCommand(from.id, serverSender, &pb.Command{Type: "USER_LEFT", Value: c.id}), "")
+	to.Broadcast(serverCommand(to.id, serverSender, &pb.Command{Type: "USER_JOINED", Value: c.id}), c.addr)
+	to.announceSigningKey(c)
+
+	if !c.Send(serverCommand(to.id, serverSender, &pb.Command{Type: "ROOM_CHANGED", Value: to.id})) {
+		log.Printf("Dropped ROOM_CHANGED for client %s, channel full.", c.id)
+	}
+	to.claimOwner(c)
+	to.sendRoles(c)
+	to.sendHands(c)
+	to.sendRoster(c)
+	to.sendPins(c)
+	to.sendPolls(c)
+	to.sendSettings(c)
+	to.sendE2EKeys(c)
+	to.sendSigningKeys(c)
+	log.Printf("Client '%s' migrated from room '%s' to '%s'", c.id, from.id, to.id)
+	return nil
+}
+
+func (r *Room) members() []*Client {
+	var members []*Client
+	r.clients.Range(func(_, value interface{}) bool {
+		members = append(members, value.(*Client))
+		return true
+	})
+	return members
+}
+
+// nameConflicts lists the clients whose names, or names that look like
+// them, are already used in dst.
+func nameConflicts(clients []*Client, dst *Room) []string {
+	var conflicts []string
+	for _, c := range clients {
+		if _, ok := dst.names.Load(usernameSkeleton(c.id)); ok {
+			conflicts = append(conflicts, c.id)
+		}
+	}
+	return conflicts
+}
+
+// --- Admin RPCs ---
+
+func (s *server) MergeRooms(ctx context.Context, req *pb.MergeRoomsRequest) (*pb.ModerationResult, error) {
+	if req.SourceRoomId == "" || req.TargetRoomId == "" || req.SourceRoomId == req.TargetRoomId {
+		return nil, status.Error(codes.InvalidArgument, "source and target rooms must be given and differ")
+	}
+	s.migrationMu.Lock()
+	defer s.migrationMu.Unlock()
+
+	src, err := s.adminRooms(req.SourceRoomId)
+	if err != nil {
+		return nil, err
+	}
+	source := src[0]
+	target, _ := s.rooms.Acquire(req.TargetRoomId)
+	defer s.rooms.Release(target)
+
+	// All-or-nothing: refuse before moving anyone if a name would clash
+	members := source.members()
+	if conflicts := nameConflicts(members, target); len(conflicts) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "usernames present in both rooms: %s", strings.Join(conflicts, ", "))
+	}
+
+	target.events.Import(source.events.Snapshot(), target.id)
+	result := &pb.ModerationResult{}
+	for _, c := range members {
+		if err := s.moveClient(c, source, target); err != nil {
+			result.Details = append(result.Details, fmt.Sprintf("%s: %v", c.id, err))
+			continue
+		}
+		result.Affected++
+		result.Details = append(result.Details, c.id)
+	}
+	audit(ctx, "merge", source.id, "target=%q moved=%d", target.id, result.Affected)
+	return result, nil
+}
+
+func (s *server) SplitRoom(ctx context.Context, req *pb.SplitRoomRequest) (*pb.ModerationResult, error) {
+	if req.RoomId == "" || req.NewRoomId == "" || req.RoomId == req.NewRoomId || len(req.Usernames) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "room_id, a different new_room_id and usernames must be provided")
+	}
+	s.migrationMu.Lock()
+	defer s.migrationMu.Unlock()
+
+	src, err := s.adminRooms(req.RoomId)
+	if err != nil {
+		return nil, err
+	}
+	source := src[0]
+
+	var movers []*Client
+	var missing []string
+	for _, name := range req.Usernames {
+		if val, ok := source.users.Load(name); ok {
+			movers = append(movers, val.(*Client))
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, status.Errorf(codes.NotFound, "not in room '%s': %s", source.id, strings.Join(missing, ", "))
+	}
+
+	target, created := s.rooms.Acquire(req.NewRoomId)
+	defer s.rooms.Release(target)
+	if conflicts := nameConflicts(movers, target); len(conflicts) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "usernames already in room '%s': %s", target.id, strings.Join(conflicts, ", "))
+	}
+	if created {
+		// A fresh room starts with the shared context of the original one
+		target.events.Import(source.events.Snapshot(), target.id)
+	}
+
+	result := &pb.ModerationResult{}
+	for _, c := range movers {
+		if err := s.moveClient(c, source, target); err != nil {
+			result.Details = append(result.Details, fmt.Sprintf("%s: %v", c.id, err))
+			continue
+		}
+		result.Affected++
+		result.Details = append(result.Details, c.id)
+	}
+	audit(ctx, "split", source.id, "new_room=%q moved=%d", target.id, result.Affected)
+	return result, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	pb "conference-server/conference"
+)
+
+// --- Room owner and server-side audio mutes ---
+
+// roomControl holds who owns a room and whose audio the server holds back.
+// The owner is the first user to join; when they leave, ownership passes to
+// another connected member. Mutes are kept by name so leaving and rejoining
+// doesn't lift them.
+type roomControl struct {
+	mu      sync.Mutex
+	owner   string
+	muteAll bool            // everyone but the host, co-hosts and moderators
+	floor   string          // given the floor: exempt from muteAll until the next MUTE_ALL
+	muted   map[string]bool // map[senderID]true
+	cohosts map[string]bool // map[senderID]true, see roles.go
+}
+
+// Owner returns the name of the room's owner, or "" if it has none.
+func (r *Room) Owner() string {
+	r.control.mu.Lock()
+	defer r.control.mu.Unlock()
+	return r.control.owner
+}
+
+// claimOwner makes c the owner if the room has none, or if c is the owner
+// named in the room's settings and logged in to that name, announcing the
+// change. A host c takes over
+// from stays on as a co-host.
+func (r *Room) claimOwner(c *Client) {
+	if c.stream == nil || c.joinRole == roleAttendee { // replay users never own a room
+		return
+	}
+	saved := isSavedOwner(r.Settings(), c)
+	r.control.mu.Lock()
+	previous := r.control.owner
+	if previous != "" && !saved {
+		if _, present := r.users.Load(previous); present {
+			r.control.mu.Unlock()
+			return
+		}
+	}
+	r.control.owner = c.id
+	delete(r.control.cohosts, c.id)
+	r.control.mu.Unlock()
+	r.announceOwner(c.id)
+	if _, present := r.users.Load(previous); present && previous != c.id {
+		r.setCohost(previous, true)
+		r.announceRole(previous, roleCohost)
+	}
+}
+
+// releaseOwner hands ownership to another connected member when c, the
+// owner, leaves the room: a co-host if there is one, otherwise anyone who
+// didn't join as an attendee.
+func (r *Room) releaseOwner(c *Client) {
+	r.control.mu.Lock()
+	if r.control.owner != c.id {
+		r.control.mu.Unlock()
+		return
+	}
+	next := ""
+	for _, m := range r.members() {
+		if m.stream == nil || m == c || m.joinRole == roleAttendee && !r.control.cohosts[m.id] {
+			continue
+		}
+		if next == "" || r.control.cohosts[m.id] {
+			next = m.id
+		}
+		if r.control.cohosts[m.id] {
+			break
+		}
+	}
+	r.control.owner = next
+	delete(r.control.cohosts, next)
+	r.control.mu.Unlock()
+	if next != "" {
+		r.announceOwner(next)
+	}
+}
+
+func (r *Room) announceOwner(name string) {
+	log.Printf("'%s' is now the owner of room '%s'", name, r.id)
+	r.Broadcast(serverCommand(r.id, serverSender, &pb.Command{Type: "ROOM_OWNER", Value: name}), "")
+}
+
+// canControl reports whether c may mute others in the room.
+func (r *Room) canControl(c *Client) bool {
+	return c.moderator || r.Role(c) != roleAttendee
+}
+
+// AudioMuted reports whether the server should drop c's audio. Moderators
+// are never muted.
+func (r *Room) AudioMuted(c *Client) bool {
+	if c.moderator {
+		return false
+	}
+	_, _, noGuestAudio := r.guestPolicy()
+	r.control.mu.Lock()
+	defer r.control.mu.Unlock()
+	if r.control.muted[c.id] {
+		return true
+	}
+	return (r.control.muteAll || noGuestAudio && isGuest(c)) && r.control.owner != c.id && !r.control.cohosts[c.id] && r.control.floor != c.id
+}
+
+// handleMuteCommand applies a MUTE, UNMUTE, MUTE_ALL or UNMUTE_ALL command
+// from c, reporting whether cmd was one of them. Only the host, co-hosts and
+// moderators may use them, and MUTE and UNMUTE only on whom canActOn lets
+// them; everyone else gets a MUTE_DENIED reply.
+func (r *Room) handleMuteCommand(c *Client, cmd *pb.Command) bool {
+	var notice *pb.Command
+	var target *Client
+	switch cmd.Type {
+	case "MUTE", "UNMUTE":
+		if cmd.Value == "" {
+			reply(c, r, &pb.Command{Type: "MUTE_DENIED", Value: "a username is required"})
+			return true
+		}
+		v, ok := r.users.Load(cmd.Value)
+		if !ok {
+			reply(c, r, &pb.Command{Type: "MUTE_DENIED", Value: "user '" + cmd.Value + "' is not in this room"})
+			return true
+		}
+		target = v.(*Client)
+		notice = &pb.Command{Type: "USER_MUTED", Value: cmd.Value}
+		if cmd.Type == "UNMUTE" {
+			notice.Type = "USER_UNMUTED"
+		}
+	case "MUTE_ALL":
+		notice = &pb.Command{Type: "ROOM_MUTED", Value: c.id}
+	case "UNMUTE_ALL":
+		notice = &pb.Command{Type: "ROOM_UNMUTED", Value: c.id}
+	default:
+		return false
+	}
+	if !r.canControl(c) {
+		reply(c, r, &pb.Command{Type: "MUTE_DENIED", Value: "only the host, a co-host or a moderator can mute others"})
+		return true
+	}
+	if target != nil && !r.canActOn(c, target) {
+		reply(c, r, &pb.Command{Type: "MUTE_DENIED", Value: "you can't mute or unmute " + cmd.Value})
+		return true
+	}
+
+	r.control.mu.Lock()
+	switch cmd.Type {
+	case "MUTE":
+		if r.control.muted == nil {
+			r.control.muted = make(map[string]bool)
+		}
+		r.control.muted[cmd.Value] = true
+	case "UNMUTE":
+		delete(r.control.muted, cmd.Value)
+	case "MUTE_ALL":
+		r.control.muteAll = true
+		r.control.floor = ""
+	case "UNMUTE_ALL":
+		// Lifts individual mutes too, so the room really is open again
+		r.control.muteAll = false
+		r.control.muted = nil
+	}
+	r.control.mu.Unlock()
+
+	log.Printf("'%s' sent %s %q in room '%s'", c.id, cmd.Type, cmd.Value, r.id)
+	r.Broadcast(serverCommand(r.id, c.id, notice), "")
+	return true
+}
+
+// reply sends cmd to c alone, dropping it if c's queue is full.
+func reply(c *Client, r *Room, cmd *pb.Command) {
+	if !c.Send(serverCommand(r.id, serverSender, cmd)) {
+		log.Printf("Dropped %s for client %s, channel full.", cmd.Type, c.id)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"io"
+	"log"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "conference-server/conference"
+)
+
+// --- 1:1 file relay ---
+
+// maxTransferResumes is how many times a 1:1 relay that broke mid-stream
+// may be picked up again before the transfer is aborted.
+const maxTransferResumes = 5
+
+// p2pLeg is one attempt at relaying a 1:1 transfer. The receiver hands its
+// stream to the sender's handler over receiverCh and the sender's handler
+// relays the chunks; started is closed when the relay begins and done when
+// it ends. If either stream breaks mid-relay, broken is closed and the
+// transfer gets a fresh leg both ends can reconnect to.
+type p2pLeg struct {
+	receiverCh chan pb.ConferenceService_TransferFileServer
+	started    chan struct{}
+	broken     chan struct{}
+	done       chan struct{}
+	joined     map[string]bool // roles already connected
+	since      time.Time
+	reason     string // why it broke; set before broken is closed
+}
+
+func newP2PLeg() *p2pLeg {
+	return &p2pLeg{
+		receiverCh: make(chan pb.ConferenceService_TransferFileServer, 1),
+		started:    make(chan struct{}),
+		broken:     make(chan struct{}),
+		done:       make(chan struct{}),
+		joined:     make(map[string]bool),
+		since:      time.Now(),
+	}
+}
+
+// newP2PTransfer sets up an accepted 1:1 transfer. A relay that breaks
+// mid-stream, because one end's connection dropped, is resumed rather than
+// aborted: both ends are told to reconnect (codes.Unavailable) and the
+// sender carries on from the last chunk the receiver acknowledged; chunks
+// carry their offset, so the receiver recognises any it already has.
+// Whichever end goes away while the other waits aborts the transfer, and
+// one nobody reconnects to is reaped after -transfer-ttl (see stale.go).
+func newP2PTransfer(room, from, to, filename string, size int64) *p2pTransfer {
+	t := &p2pTransfer{
+		leg:           newP2PLeg(),
+		from:          from,
+		to:            to,
+		filename:      filename,
+		size:          size,
+		room:          room,
+		created:       time.Now(),
+		pace:          newPacer(transferRateKiB),
+		spool:         newScanSpool(size),
+		finished:      make(chan struct{}),
+		transferAbort: newTransferAbort(),
+	}
+	if t.spool != nil {
+		go func() {
+			select {
+			case <-t.finished:
+			case <-t.aborted:
+			}
+			t.spool.remove()
+		}()
+	}
+	return t
+}
+
+// join claims role on the current leg for the calling stream; each role
+// may connect once per leg. If role is taken on a leg that is relaying,
+// that leg is returned as running instead: a client only reconnects when it
+// has lost its stream, even if the server hasn't noticed yet.
+func (t *p2pTransfer) join(role string) (leg, running *p2pLeg) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.leg.joined[role] {
+		select {
+		case <-t.leg.started:
+			return nil, t.leg
+		default:
+			return nil, nil
+		}
+	}
+	t.leg.joined[role] = true
+	return t.leg, nil
+}
+
+// interrupt ends leg and starts a new one. It returns false if the
+// transfer has been resumed too often to go on; one that was aborted, or
+// whose leg was already replaced, is left alone.
+func (t *p2pTransfer) interrupt(leg *p2pLeg, reason string) (replaced, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.aborted:
+		return false, true
+	default:
+	}
+	if t.leg != leg {
+		return false, true
+	}
+	if t.resumes >= maxTransferResumes {
+		return false, false
+	}
+	t.resumes++
+	leg.reason = reason
+	close(leg.broken)
+	t.leg = newP2PLeg()
+	return true, true
+}
+
+// interruptP2P is interrupt, aborting the transfer if it may not go on.
+func (s *server) interruptP2P(tID string, tx *p2pTransfer, leg *p2pLeg, reason string) {
+	replaced, ok := tx.interrupt(leg, reason)
+	if !ok {
+		s.abortTransfer(tID, tx, reason+" (too many interruptions)")
+	} else if replaced {
+		log.Printf("Transfer '%s' interrupted (%s); waiting for both ends to reconnect", tID, reason)
+	}
+}
+
+func (s *server) handleP2PTransfer(tx *p2pTransfer, stream pb.ConferenceService_TransferFileServer, role, tID string) error {
+	if role != "sender" && role != "receiver" {
+		return status.Errorf(codes.InvalidArgument, "unknown role '%s'", role)
+	}
+	// Everyone in the room saw the transfer ID, so only the session of the
+	// end named by role may take it up, or take it over from a live leg
+	user := tx.from
+	if role == "receiver" {
+		user = tx.to
+	}
+	if _, _, err := s.roomMember(stream.Context(), tx.room, user); err != nil {
+		return err
+	}
+	leg, running := tx.join(role)
+	if running != nil {
+		s.interruptP2P(tID, tx, running, "the "+role+" reconnected")
+		leg, _ = tx.join(role)
+	}
+	if leg == nil {
+		return status.Errorf(codes.AlreadyExists, "%s for transfer '%s' already connected", role, tID)
+	}
+	ctx := stream.Context()
+	if role == "receiver" {
+		leg.receiverCh <- stream // buffered; only one receiver per leg gets here
+	} else {
+		select {
+		case receiver := <-leg.receiverCh:
+			close(leg.started)
+			go s.relayP2P(tx, leg, stream, receiver, tID)
+		case <-ctx.Done():
+			s.abortTransfer(tID, tx, "the sender disconnected")
+			return ctx.Err()
+		case <-tx.aborted:
+			return tx.abortErr()
+		}
+	}
+
+	select {
+	case <-leg.done:
+	case <-leg.broken:
+	case <-ctx.Done():
+		select {
+		case <-leg.started:
+			s.interruptP2P(tID, tx, leg, "the "+role+" disconnected")
+		default: // never started: the sender isn't coming
+			s.abortTransfer(tID, tx, "the "+role+" disconnected")
+		}
+		return ctx.Err()
+	case <-tx.aborted:
+	}
+	select {
+	case <-tx.aborted:
+		return tx.abortErr()
+	case <-leg.broken:
+		return status.Errorf(codes.Unavailable, "relay interrupted (%s); reconnect to resume", leg.reason)
+	default:
+		return nil
+	}
+}
+
+// relayP2P copies chunks from sender to receiver until the last one and
+// forgets the transfer. A failure on either stream interrupts the leg, or
+// aborts the transfer if it can't be resumed, before done is closed, so
+// both handlers see the same outcome.
+func (s *server) relayP2P(tx *p2pTransfer, leg *p2pLeg, sender, receiver pb.ConferenceService_TransferFileServer, tID string) {
+	defer close(leg.done)
+	defer recoverPanic("transfer '"+tID+"'", func(error) { s.abortTransfer(tID, tx, "internal server error") })
+	go forwardAcks(receiver, sender)
+	reason, resumable := s.proxyP2PChunks(tx, sender, receiver, tID)
+	switch {
+	case reason == "":
+		close(tx.finished)
+		s.activeTransfers.CompareAndDelete(tID, tx)
+		log.Printf("Transfer '%s' from '%s' to '%s' finished", tID, tx.from, tx.to)
+	case resumable:
+		s.interruptP2P(tID, tx, leg, reason)
+	default:
+		s.abortTransfer(tID, tx, reason)
+	}
+}
+
+// proxyP2PChunks returns why the relay failed and whether a new leg could
+// pick it up, or "" once the last chunk has been delivered. With scanning
+// on, the last chunk waits for the verdict.
+func (s *server) proxyP2PChunks(tx *p2pTransfer, sender, receiver pb.ConferenceService_TransferFileServer, tID string) (string, bool) {
+	count := newRelayCount(tx.size)
+	for {
+		chunk, err := sender.Recv()
+		if err == io.EOF {
+			return "the sender closed the stream before the last chunk", false
+		}
+		if err != nil {
+			return "the sender disconnected", true
+		}
+		if reason := count.add(chunk); reason != "" {
+			return reason, false
+		}
+		if err := s.paceChunk(sender.Context(), tx.pace, tx.from, len(chunk.Data)); err != nil {
+			return "the sender disconnected", true
+		}
+		tx.spool.add(chunk)
+		if chunk.GetIsLast() {
+			if reason := tx.spool.check(s, sender.Context(), tID, tx.room, tx.from, tx.filename); reason != "" {
+				return reason, false
+			}
+		}
+		if err := receiver.Send(chunk); err != nil {
+			return "the receiver disconnected", true
+		}
+		if chunk.GetIsLast() {
+			return "", false
+		}
+	}
+}
+
+// forwardAcks passes the receiver's delivered_bytes acks on to the sender, so
+// its progress shows what has actually been saved rather than what it has
+// read off disk, and a resumed transfer knows where to carry on. It is the
+// only writer on the sender's stream and stops when the receiver's stream
+// ends.
+func forwardAcks(receiver, sender pb.ConferenceService_TransferFileServer) {
+	defer recoverPanic("transfer acks", nil)
+	for {
+		ack, err := receiver.Recv()
+		if err != nil {
+			return
+		}
+		if ack.DeliveredBytes <= 0 {
+			continue
+		}
+		if err := sender.Send(&pb.FileChunk{TransferId: ack.TransferId, DeliveredBytes: ack.DeliveredBytes}); err != nil {
+			return
+		}
+	}
+}
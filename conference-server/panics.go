@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// --- Panic isolation ---
+
+// A bug that panics while serving one client should cost that client its
+// call, not everyone their connection. RPC handlers are covered by the
+// recovery interceptor (see interceptors.go); the goroutines they start,
+// each room's media relay and the room manager recover on their own with
+// recoverPanic, and hand the client an error where there is one to hand.
+// Every recovered panic is logged with its stack and counted in
+// rpc_panics.
+
+// panicsRecovered counts recovered panics, server-wide.
+var panicsRecovered atomic.Uint64
+
+// errInternal is what a client gets in place of whatever panicked.
+var errInternal = status.Error(codes.Internal, "internal server error")
+
+// opPanic carries a panic from the room manager's goroutine back to the
+// caller whose op it was, along with the stack where it happened.
+type opPanic struct {
+	value interface{}
+	stack []byte
+}
+
+func (p *opPanic) String() string { return fmt.Sprint(p.value) }
+
+// recoverPanic, deferred at the top of a goroutine, stops a panic there,
+// logs it as having happened in where and calls fail, if not nil, with the
+// error to give the client.
+func recoverPanic(where string, fail func(error)) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	logPanic(where, p)
+	if fail != nil {
+		fail(errInternal)
+	}
+}
+
+func logPanic(where string, p interface{}) {
+	panicsRecovered.Add(1)
+	stack := debug.Stack()
+	if op, ok := p.(*opPanic); ok {
+		stack = op.stack
+	}
+	log.Printf("PANIC in %s: %v\n%s", where, p, stack)
+}
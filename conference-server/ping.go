@@ -0,0 +1,17 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	pb "conference-server/conference"
+)
+
+// Ping echoes the client's clock so it can time the round trip. It touches no
+// room state, so clients can call it every few seconds.
+func (s *server) Ping(ctx context.Context, req *pb.PingRequest) (*pb.PingResponse, error) {
+	return &pb.PingResponse{
+		ClientTimeMs: req.GetClientTimeMs(),
+		ServerTimeMs: time.Now().UnixMilli(),
+	}, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	pb "conference-server/conference"
+)
+
+// --- Pinned messages ---
+
+// maxPins is how many messages a room keeps pinned.
+const maxPins = 20
+
+// roomPins holds the room's pinned messages, in the order they were pinned,
+// for things that should stay in sight like a meeting link. The host (or a
+// moderator) pins one of the recent messages the room keeps for late
+// joiners with PIN <message_id> and unpins it with UNPIN <message_id>.
+// Members get the whole list as a PinList when they join and whenever it
+// changes. Pins last as long as the room.
+type roomPins struct {
+	mu   sync.Mutex
+	pins []*pb.PinnedMessage
+}
+
+// find returns the recent message with the given ID, if the history still
+// has it.
+func (h *roomHistory) find(id string) *pb.ConferenceData {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.msgs) - 1; i >= 0; i-- {
+		if h.msgs[i].MessageId == id {
+			return h.msgs[i]
+		}
+	}
+	return nil
+}
+
+// handlePinCommand applies a PIN or UNPIN command from c, reporting whether
+// cmd was one of them.
+func (r *Room) handlePinCommand(c *Client, cmd *pb.Command) bool {
+	if cmd.Type != "PIN" && cmd.Type != "UNPIN" {
+		return false
+	}
+	if !r.isHost(c) {
+		reply(c, r, &pb.Command{Type: "PIN_DENIED", Value: "only the host or a moderator can pin messages"})
+		return true
+	}
+	if cmd.Value == "" {
+		reply(c, r, &pb.Command{Type: "PIN_DENIED", Value: "a message ID is required"})
+		return true
+	}
+
+	var denied string
+	r.pins.mu.Lock()
+	at := -1
+	for i, p := range r.pins.pins {
+		if p.MessageId == cmd.Value {
+			at = i
+		}
+	}
+	switch {
+	case cmd.Type == "UNPIN" && at < 0:
+		denied = "that message is not pinned"
+	case cmd.Type == "UNPIN":
+		r.pins.pins = append(r.pins.pins[:at], r.pins.pins[at+1:]...)
+	case at >= 0:
+		denied = "that message is already pinned"
+	case len(r.pins.pins) == maxPins:
+		denied = "the room already has the most pinned messages it can keep; unpin one first"
+	default:
+		msg := r.history.find(cmd.Value)
+		text := msg.GetTextMessage()
+		switch {
+		case text == nil:
+			denied = "that message is not among the room's recent messages"
+		case text.TtlSeconds > 0:
+			denied = "ephemeral messages can't be pinned"
+		default:
+			r.pins.pins = append(r.pins.pins, &pb.PinnedMessage{
+				MessageId: msg.MessageId, Sender: msg.Sender, Content: text.Content, Timestamp: text.Timestamp, PinnedBy: c.id,
+			})
+		}
+	}
+	r.pins.mu.Unlock()
+	if denied != "" {
+		reply(c, r, &pb.Command{Type: "PIN_DENIED", Value: denied})
+		return true
+	}
+
+	log.Printf("'%s' sent %s %q in room '%s'", c.id, cmd.Type, cmd.Value, r.id)
+	r.Broadcast(r.pinList(), "")
+	return true
+}
+
+// pinList builds the message carrying the room's pins.
+func (r *Room) pinList() *pb.ConferenceData {
+	r.pins.mu.Lock()
+	list := &pb.PinList{Pins: append([]*pb.PinnedMessage(nil), r.pins.pins...)} // pins never change once made
+	r.pins.mu.Unlock()
+	return seal(&pb.ConferenceData{Payload: &pb.ConferenceData_Pins{Pins: list}}, r.id, serverSender)
+}
+
+// sendPins tells c, who just joined, which messages are pinned, even if
+// none are, so the client knows that later lists are changes.
+func (r *Room) sendPins(c *Client) {
+	c.Send(r.pinList())
+}
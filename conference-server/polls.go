@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	pb "conference-server/conference"
+)
+
+// --- Room polls ---
+
+// A poll asks the room a question with a few options. Any member opens one
+// with CreatePoll and votes with Vote: one vote each, which can be changed
+// while the poll is open. Every change goes to the room as a Poll with the
+// running tally, and the poll closes by itself after its duration, when the
+// final tally goes out and is recorded in the history for late joiners.
+// Those who join while a poll is open get it, so they can vote too. Both
+// calls act for the member whose session token they carry (see roomMember),
+// and the vote is counted for that member. Polls live in memory with the
+// room. Set the default length with -poll-duration.
+var pollDuration = 5 * time.Minute
+
+const (
+	maxPollOptions  = 10
+	maxOpenPolls    = 5 // per room
+	maxPollDuration = 24 * time.Hour
+)
+
+type openPoll struct {
+	poll   *pb.Poll
+	voters map[string]int // map[senderID]option
+}
+
+type roomPolls struct {
+	mu   sync.Mutex
+	open []*openPoll // in the order they were opened
+}
+
+// find returns the open poll with the given ID. p.mu must be held.
+func (p *roomPolls) find(id string) (int, *openPoll) {
+	for i, op := range p.open {
+		if op.poll.PollId == id {
+			return i, op
+		}
+	}
+	return -1, nil
+}
+
+func (s *server) CreatePoll(ctx context.Context, req *pb.CreatePollRequest) (*pb.Poll, error) {
+	room, creator, err := s.roomMember(ctx, req.RoomId, req.Sender)
+	if err != nil {
+		return nil, err
+	}
+	question := strings.TrimSpace(req.Question)
+	var options []string
+	for _, o := range req.Options {
+		if o = strings.TrimSpace(o); o != "" {
+			options = append(options, o)
+		}
+	}
+	d := pollDuration
+	if req.DurationSeconds != 0 {
+		d = time.Duration(req.DurationSeconds) * time.Second
+	}
+	switch {
+	case question == "":
+		return nil, status.Error(codes.InvalidArgument, "a question is required")
+	case len(options) < 2 || len(options) > maxPollOptions:
+		return nil, status.Errorf(codes.InvalidArgument, "a poll needs between 2 and %d options", maxPollOptions)
+	case d <= 0 || d > maxPollDuration:
+		return nil, status.Errorf(codes.InvalidArgument, "a poll must last between 1 second and %v", maxPollDuration)
+	}
+	if frozen, reason := room.Frozen(); frozen {
+		return nil, status.Errorf(codes.FailedPrecondition, "room '%s' is read-only: %s", room.id, reason)
+	}
+
+	p := &pb.Poll{
+		PollId:   newFileID(),
+		RoomId:   room.id,
+		Creator:  creator.id,
+		Question: question,
+		Options:  options,
+		Votes:    make([]int32, len(options)),
+		ClosesAt: time.Now().Add(d).Unix(),
+	}
+	room.polls.mu.Lock()
+	if len(room.polls.open) == maxOpenPolls {
+		room.polls.mu.Unlock()
+		return nil, status.Errorf(codes.ResourceExhausted, "room '%s' already has %d open polls; wait for one to close", room.id, maxOpenPolls)
+	}
+	room.polls.open = append(room.polls.open, &openPoll{poll: p, voters: make(map[string]int)})
+	snapshot := proto.Clone(p).(*pb.Poll)
+	room.polls.mu.Unlock()
+	time.AfterFunc(d, func() {
+		defer recoverPanic("closing poll "+p.PollId, nil)
+		room.closePoll(p.PollId)
+	})
+
+	log.Printf("'%s' opened poll %s in room '%s' for %v: %q", creator.id, p.PollId, room.id, d, question)
+	room.Broadcast(pollMessage(snapshot), "")
+	return snapshot, nil
+}
+
+func (s *server) Vote(ctx context.Context, req *pb.VoteRequest) (*pb.Poll, error) {
+	room, voter, err := s.roomMember(ctx, req.RoomId, req.Sender)
+	if err != nil {
+		return nil, err
+	}
+	if frozen, reason := room.Frozen(); frozen {
+		return nil, status.Errorf(codes.FailedPrecondition, "room '%s' is read-only: %s", room.id, reason)
+	}
+	room.polls.mu.Lock()
+	_, op := room.polls.find(req.PollId)
+	if op == nil {
+		room.polls.mu.Unlock()
+		return nil, status.Errorf(codes.NotFound, "no open poll '%s' in room '%s'", req.PollId, room.id)
+	}
+	if req.Option < 0 || int(req.Option) >= len(op.poll.Options) {
+		room.polls.mu.Unlock()
+		return nil, status.Errorf(codes.InvalidArgument, "option must be between 0 and %d", len(op.poll.Options)-1)
+	}
+	prev, voted := op.voters[voter.id]
+	changed := !voted || prev != int(req.Option)
+	if changed {
+		if voted {
+			op.poll.Votes[prev]--
+		}
+		op.voters[voter.id] = int(req.Option)
+		op.poll.Votes[req.Option]++
+	}
+	snapshot := proto.Clone(op.poll).(*pb.Poll)
+	room.polls.mu.Unlock()
+
+	if changed {
+		room.Broadcast(pollMessage(snapshot), "")
+	}
+	return snapshot, nil
+}
+
+// closePoll closes an open poll and sends the final tally to the room.
+func (r *Room) closePoll(id string) {
+	r.polls.mu.Lock()
+	i, op := r.polls.find(id)
+	if op == nil {
+		r.polls.mu.Unlock()
+		return
+	}
+	r.polls.open = append(r.polls.open[:i], r.polls.open[i+1:]...)
+	op.poll.Closed = true
+	r.polls.mu.Unlock()
+
+	log.Printf("Poll %s in room '%s' closed with %v", id, r.id, op.poll.Votes)
+	msg := pollMessage(op.poll)
+	r.history.Record(msg)
+	r.Broadcast(msg, "")
+}
+
+// sendPolls sends c, who just joined, the room's open polls.
+func (r *Room) sendPolls(c *Client) {
+	r.polls.mu.Lock()
+	var open []*pb.Poll
+	for _, op := range r.polls.open {
+		open = append(open, proto.Clone(op.poll).(*pb.Poll))
+	}
+	r.polls.mu.Unlock()
+	for _, p := range open {
+		c.Send(pollMessage(p))
+	}
+}
+
+func pollMessage(p *pb.Poll) *pb.ConferenceData {
+	return seal(&pb.ConferenceData{Payload: &pb.ConferenceData_Poll{Poll: p}}, p.RoomId, serverSender)
+}
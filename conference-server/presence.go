@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	pb "conference-server/conference"
+)
+
+// presenceInterval is how often coalesced presence/typing/speaking state is
+// fanned out to the room.
+const presenceInterval = 500 * time.Millisecond
+
+// coalescedCommands are the high-frequency state commands where only the
+// latest value per user matters.
+var coalescedCommands = map[string]bool{
+	"TYPING":   true,
+	"PRESENCE": true,
+	"SPEAKING": true,
+}
+
+func isCoalescedCommand(msg *pb.ConferenceData) bool {
+	cmd := msg.GetCommand()
+	return cmd != nil && coalescedCommands[cmd.Type]
+}
+
+type pendingState struct {
+	msg        *pb.ConferenceData
+	senderAddr string
+}
+
+// presenceCoalescer keeps the latest state command per (user, type) and
+// broadcasts the batch once per interval, so a chatty client costs the room at
+// most one message per interval for each kind of state.
+type presenceCoalescer struct {
+	mu        sync.Mutex
+	room      *Room
+	pending   map[string]pendingState
+	order     []string
+	scheduled bool
+}
+
+func newPresenceCoalescer(room *Room) *presenceCoalescer {
+	return &presenceCoalescer{room: room, pending: make(map[string]pendingState)}
+}
+
+// Submit records msg as the latest state for its sender and command type. The
+// flush timer is armed lazily so idle rooms don't hold a goroutine.
+func (c *presenceCoalescer) Submit(msg *pb.ConferenceData, senderAddr string) {
+	key := msg.Sender + "/" + msg.GetCommand().Type
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.pending[key]; !ok {
+		c.order = append(c.order, key)
+	}
+	c.pending[key] = pendingState{msg: msg, senderAddr: senderAddr}
+	if !c.scheduled {
+		c.scheduled = true
+		time.AfterFunc(presenceInterval, c.flush)
+	}
+}
+
+func (c *presenceCoalescer) flush() {
+	defer recoverPanic("presence updates for room '"+c.room.id+"'", nil)
+	c.mu.Lock()
+	batch := make([]pendingState, 0, len(c.order))
+	for _, key := range c.order {
+		batch = append(batch, c.pending[key])
+	}
+	c.pending = make(map[string]pendingState)
+	c.order = nil
+	c.scheduled = false
+	c.mu.Unlock()
+
+	for _, st := range batch {
+		c.room.Broadcast(st.msg, st.senderAddr)
+	}
+}
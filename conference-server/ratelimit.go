@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// --- Transfer bandwidth limits ---
+
+// File chunks share the connection with audio and video, so a large
+// transfer relayed at full speed can starve them. The server paces the relay
+// of every transfer (-transfer-rate) and of all transfers one user is
+// sending (-client-transfer-rate); gRPC flow control then slows the sender
+// down. Both are in KiB/s, and 0 means unlimited.
+var (
+	transferRateKiB       = 0
+	clientTransferRateKiB = 0
+)
+
+// pacer spaces out writes to stay under rate bytes per second. A nil pacer
+// never waits.
+type pacer struct {
+	rate int64
+
+	mu   sync.Mutex
+	next time.Time // when the bytes reserved so far will have gone out
+}
+
+func newPacer(kib int) *pacer {
+	if kib <= 0 {
+		return nil
+	}
+	return &pacer{rate: int64(kib) * 1024}
+}
+
+// wait blocks until n more bytes fit under the rate, or ctx is done.
+func (p *pacer) wait(ctx context.Context, n int) error {
+	if p == nil || n == 0 {
+		return nil
+	}
+	p.mu.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	start := p.next
+	p.next = p.next.Add(time.Duration(int64(n) * int64(time.Second) / p.rate))
+	p.mu.Unlock()
+
+	if d := time.Until(start); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// idle reports whether the pacer has had nothing to send since before t.
+func (p *pacer) idle(t time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.next.Before(t)
+}
+
+// pacerIdle is how long a user's pacer is kept after their last chunk. A
+// pacer with nothing pending behaves just like a new one, so dropping it
+// only costs an allocation when they send again.
+const pacerIdle = time.Minute
+
+// clientPacer returns the pacer shared by every transfer name is sending.
+func (s *server) clientPacer(name string) *pacer {
+	if clientTransferRateKiB <= 0 {
+		return nil
+	}
+	p, _ := s.clientPacers.LoadOrStore(name, newPacer(clientTransferRateKiB))
+	return p.(*pacer)
+}
+
+// paceChunk waits until a chunk of n bytes from user may be relayed under
+// both the transfer's and the user's limit.
+func (s *server) paceChunk(ctx context.Context, transfer *pacer, user string, n int) error {
+	if err := transfer.wait(ctx, n); err != nil {
+		return err
+	}
+	return s.clientPacer(user).wait(ctx, n)
+}
+
+// prunePacers forgets the users' pacers that have been idle for pacerIdle,
+// so that the map only holds the users sending files.
+func (s *server) prunePacers(now time.Time) {
+	s.clientPacers.Range(func(name, p interface{}) bool {
+		if p.(*pacer).idle(now.Add(-pacerIdle)) {
+			s.clientPacers.CompareAndDelete(name, p)
+		}
+		return true
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	pb "conference-server/conference"
+)
+
+// --- Per-room media relay ---
+
+// mediaRelayBuffer is how many chunks or frames a room's relay may fall
+// behind before new ones are dropped; relayIdleTimeout is how long the relay
+// goroutine lingers without media before exiting.
+const (
+	mediaRelayBuffer = 64
+	relayIdleTimeout = 30 * time.Second
+)
+
+// clientAudioBuffer bounds each receiver's audio queue (~0.75 s at 44.1 kHz
+// with 512-frame chunks); slowReceiverDrops is how many chunks a receiver may
+// shed without ever catching up (~12 s) before it is disconnected.
+const (
+	clientAudioBuffer = 32
+	slowReceiverDrops = 500
+)
+
+type relayItem struct {
+	msg        *pb.ConferenceData
+	senderAddr string
+}
+
+// mediaRelay fans a room's audio (or video) out to its members from a
+// goroutine of its own, so a speaker's handler only enqueues and never walks
+// the member list, and a busy room can't hold up any other. The goroutine is
+// started on demand and exits when the room goes quiet, so rooms that never
+// carry media (or are discarded by LoadOrStore) cost nothing.
+type mediaRelay struct {
+	kind    string // "audio" or "video", for logs
+	deliver func(c *Client, msg *pb.ConferenceData)
+	ch      chan relayItem
+	running atomic.Bool
+	dropped atomic.Uint64
+}
+
+func newMediaRelay(kind string, deliver func(*Client, *pb.ConferenceData)) *mediaRelay {
+	return &mediaRelay{kind: kind, deliver: deliver, ch: make(chan relayItem, mediaRelayBuffer)}
+}
+
+// RelayAudio queues an audio chunk for every member except the sender.
+func (r *Room) RelayAudio(msg *pb.ConferenceData, senderAddr string) {
+	r.relay(r.audio, msg, senderAddr)
+}
+
+func (r *Room) relay(m *mediaRelay, msg *pb.ConferenceData, senderAddr string) {
+	select {
+	case m.ch <- relayItem{msg, senderAddr}:
+	default:
+		if n := m.dropped.Add(1); n%100 == 1 {
+			log.Printf("%s relay for room '%s' is behind, %d dropped so far", m.kind, r.id, n)
+		}
+	}
+	if m.running.CompareAndSwap(false, true) {
+		go r.runRelay(m)
+	}
+}
+
+func (r *Room) runRelay(m *mediaRelay) {
+	idle := time.NewTimer(relayIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case item := <-m.ch:
+			r.fanOutSafely(m, item)
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(relayIdleTimeout)
+		case <-idle.C:
+			m.running.Store(false)
+			// A chunk queued between the timeout and the Store above would
+			// otherwise sit until the next one arrives.
+			if len(m.ch) == 0 || !m.running.CompareAndSwap(false, true) {
+				return
+			}
+			idle.Reset(relayIdleTimeout)
+		}
+	}
+}
+
+// fanOutSafely is fanOut, keeping a panic from stopping the relay: the item
+// is lost and the next one goes out as usual.
+func (r *Room) fanOutSafely(m *mediaRelay, item relayItem) {
+	defer recoverPanic(m.kind+" relay for room '"+r.id+"'", nil)
+	r.fanOut(m, item.msg, item.senderAddr)
+}
+
+// fanOut is Broadcast without the event log and per-message logging, which
+// media doesn't need and can't afford at ~40 chunks per second.
+func (r *Room) fanOut(m *mediaRelay, msg *pb.ConferenceData, senderAddr string) {
+	r.clients.Range(func(key, value interface{}) bool {
+		if senderAddr != "" && key.(string) == senderAddr {
+			return true
+		}
+		m.deliver(value.(*Client), msg)
+		return true
+	})
+}
+
+// deliverAudio queues msg for c at c's quality level, dropping the oldest
+// queued chunk when the queue is full: late audio is useless, and the newest
+// chunk is the one worth playing. A receiver that keeps shedding even at the
+// lowest quality is kicked.
+func deliverAudio(c *Client, msg *pb.ConferenceData) {
+	msg = c.adaptAudio(msg)
+	for {
+		select {
+		case c.audio <- msg:
+			c.observeQueue(len(c.audio), cap(c.audio))
+			return
+		default:
+		}
+		select {
+		case <-c.audio:
+			c.stats.recordDropped()
+			if c.audioDrops.Add(1) == slowReceiverDrops && c.QualityLevel() == maxQualityLevel {
+				log.Printf("Client '%s' can't keep up with audio, disconnecting", c.id)
+				c.Kick("connection too slow for audio")
+			}
+		default:
+		}
+	}
+}
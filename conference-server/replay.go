@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	pb "conference-server/conference"
+)
+
+// --- Scripted demo/replay mode ---
+
+// replayEvent is one line of a session file (JSON Lines). at_ms is the offset
+// from the start of the session; audio is base64 PCM (44.1 kHz, 16-bit mono).
+//
+//	{"at_ms": 0, "type": "join", "sender": "ana"}
+//	{"at_ms": 1500, "type": "message", "sender": "ana", "content": "hola"}
+//	{"at_ms": 2000, "type": "command", "sender": "ana", "command": "TYPING", "content": "ana"}
+//	{"at_ms": 2500, "type": "audio", "sender": "ana", "audio": "AAABAAIA..."}
+//	{"at_ms": 9000, "type": "leave", "sender": "ana"}
+type replayEvent struct {
+	AtMs    int64  `json:"at_ms"`
+	Type    string `json:"type"`
+	Sender  string `json:"sender"`
+	Content string `json:"content,omitempty"`
+	Command string `json:"command,omitempty"`
+	Audio   []byte `json:"audio,omitempty"`
+}
+
+// loadSession reads a session file, skipping blank lines and # comments, and
+// returns its events ordered by offset (ties keep file order).
+func loadSession(path string) ([]replayEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []replayEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024) // audio lines can be long
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var ev replayEvent
+		if err := json.Unmarshal([]byte(text), &ev); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		switch ev.Type {
+		case "join", "leave", "message", "command", "audio":
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown event type %q", path, line, ev.Type)
+		}
+		if ev.Sender == "" || ev.AtMs < 0 {
+			return nil, fmt.Errorf("%s:%d: sender and a non-negative at_ms are required", path, line)
+		}
+		events = append(events, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].AtMs < events[j].AtMs })
+	return events, nil
+}
+
+// replaySession plays events into roomID as synthetic users, looping until ctx
+// is cancelled if loop is set.
+func (s *server) replaySession(ctx context.Context, roomID string, events []replayEvent, loop bool) {
+	for {
+		s.replayOnce(ctx, roomID, events)
+		if !loop || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (s *server) replayOnce(ctx context.Context, roomID string, events []replayEvent) {
+	room, _ := s.rooms.Acquire(roomID)
+	bots := make(map[string]*Client)
+	defer func() {
+		for _, c := range bots {
+			s.leaveSynthetic(c)
+			c.Kick("") // stops the drain goroutine
+		}
+		s.rooms.Release(room)
+	}()
+
+	log.Printf("Replaying %d events into room '%s'", len(events), roomID)
+	start := time.Now()
+	for _, ev := range events {
+		timer := time.NewTimer(time.Until(start.Add(time.Duration(ev.AtMs) * time.Millisecond)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		c, joined := bots[ev.Sender]
+		if joined && c.Room() == nil {
+			// Kicked by an admin; don't bring the bot back
+			continue
+		}
+		if !joined {
+			var err error
+			if c, err = s.joinReplay(room, ev.Sender); err != nil {
+				log.Printf("Replay: skipping '%s': %v", ev.Sender, err)
+				bots[ev.Sender] = &Client{id: ev.Sender} // never in a room, so its events are skipped
+				continue
+			}
+			bots[ev.Sender] = c
+		}
+
+		r := c.Room()
+		msg := seal(&pb.ConferenceData{}, r.id, c.id)
+		switch ev.Type {
+		case "join":
+			continue // handled above
+		case "leave":
+			s.leaveSynthetic(c)
+			c.Kick("")
+			delete(bots, ev.Sender)
+			continue
+		case "message":
+			msg.Payload = &pb.ConferenceData_TextMessage{TextMessage: &pb.ChatMessage{
+				Sender: c.id, Content: ev.Content, RoomId: r.id, Timestamp: time.Now().Unix(),
+			}}
+		case "command":
+			msg.Payload = &pb.ConferenceData_Command{Command: &pb.Command{Type: ev.Command, Value: ev.Content}}
+		case "audio":
+			msg.Payload = &pb.ConferenceData_AudioChunk{AudioChunk: &pb.AudioChunk{Data: ev.Audio, Sender: c.id, RoomId: r.id}}
+			r.RelayAudio(msg, c.addr)
+			continue
+		}
+		r.Broadcast(msg, c.addr)
+	}
+}
+
+// joinReplay adds a synthetic user to the room. Its outgoing channel is
+// drained so broadcasts never back up until the client is kicked, either by
+// an admin or by the replay itself once the user is done.
+func (s *server) joinReplay(room *Room, name string) (*Client, error) {
+	c := &Client{
+		id:     name,
+		addr:   "replay:" + name,
+		ch:     make(chan *pb.ConferenceData, clientBuffer),
+		kicked: make(chan string, 1),
+		audio:  make(chan *pb.ConferenceData, clientAudioBuffer),
+		video:  make(chan *pb.ConferenceData, clientVideoBuffer),
+	}
+	s.rooms.Retain(room)
+	if err := room.AddClient(c); err != nil {
+		s.rooms.Release(room)
+		return nil, err
+	}
+	go func() {
+		for {
+			select {
+			case <-c.ch:
+			case <-c.audio:
+			case <-c.video:
+			case reason := <-c.kicked:
+				if s.leaveSynthetic(c) {
+					log.Printf("Replay user '%s' kicked: %s", c.id, reason)
+				}
+				return
+			}
+		}
+	}()
+	room.Broadcast(serverCommand(room.id, serverSender, &pb.Command{Type: "USER_JOINED", Value: c.id}), c.addr)
+	return c, nil
+}
+
+// leaveSynthetic removes a synthetic user (replay or WebRTC bridge) from
+// whatever room it is in and releases its hold on the room, reporting
+// whether it was still in one. It is safe to call more than once.
+func (s *server) leaveSynthetic(c *Client) bool {
+	r := c.room.Swap(nil)
+	if r == nil {
+		return false
+	}
+	r.RemoveClient(c)
+	if s.rooms.Release(r) {
+		return true
+	}
+	r.Broadcast(serverCommand(r.id, serverSender, &pb.Command{Type: "USER_LEFT", Value: c.id}), "")
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// reservationGrace is how long a nickname stays reserved for its session after
+// an unclean disconnect.
+const reservationGrace = 60 * time.Second
+
+type reservation struct {
+	token   string
+	expires time.Time
+}
+
+func newSessionToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sessionTokenFromMetadata returns the "session-token" header sent by a
+// reconnecting client, or "" if there is none.
+func sessionTokenFromMetadata(md metadata.MD) string {
+	if vals := md.Get("session-token"); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+// Reserve holds name for token until the grace period runs out.
+func (r *Room) Reserve(name, token string) {
+	r.resMu.Lock()
+	defer r.resMu.Unlock()
+	r.reservations[usernameSkeleton(name)] = reservation{token: token, expires: time.Now().Add(reservationGrace)}
+}
+
+// checkReservation reports whether token may take name, or one that looks
+// like it, dropping the reservation if it has expired or is being reclaimed
+// by its owner.
+func (r *Room) checkReservation(name, token string) bool {
+	r.resMu.Lock()
+	defer r.resMu.Unlock()
+	name = usernameSkeleton(name)
+	res, ok := r.reservations[name]
+	if !ok {
+		return true
+	}
+	if time.Now().After(res.expires) || res.token == token {
+		delete(r.reservations, name)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	pb "conference-server/conference"
+)
+
+// --- Room file retention ---
+
+// Files uploaded with UploadToRoom don't stay forever. Each room keeps at
+// most -room-files-mb MiB of them, each for at most -room-files-age, and its
+// owner may change either with ROOM_SET:
+//
+//	files_mb=<n|default|off>          MiB the room keeps; the oldest files go first
+//	files_age=<duration|default|off>  how long each file is kept, e.g. 72h
+//
+// The cleaner goes over the store every fileCleanInterval, and right after
+// each upload. Before a file gets too old its room is told with a
+// FILE_EXPIRING command, "<file_id>:<unix time it goes>", and once it is
+// deleted, for either limit, with FILE_EXPIRED and the file ID. Inbox files
+// (see inbox.go) belong to no room: they only go by -room-files-age, and it
+// is their recipient, wherever they are logged in, who is told.
+
+var (
+	roomFilesMiB int64         // -room-files-mb, 0 = unlimited
+	roomFilesAge time.Duration // -room-files-age, 0 = forever
+)
+
+const fileCleanInterval = time.Minute
+
+// expiryNotice is how long before a file gets too old its room is warned;
+// files kept for less than twice that are announced halfway through.
+const expiryNotice = 24 * time.Hour
+
+// retentionSettingChange returns the change to make for a ROOM_SET of
+// files_mb or files_age.
+func retentionSettingChange(key, value string) (func(*pb.RoomSettings), error) {
+	if key == "files_mb" {
+		n := int64(0)
+		switch value {
+		case "default":
+		case "off":
+			n = -1
+		default:
+			var err error
+			if n, err = strconv.ParseInt(value, 10, 32); err != nil || n < 1 {
+				return nil, fmt.Errorf("files_mb must be a number of MiB, default or off")
+			}
+		}
+		return func(rec *pb.RoomSettings) { rec.FilesMb = int32(n) }, nil
+	}
+	secs := int64(0)
+	switch value {
+	case "default":
+	case "off":
+		secs = -1
+	default:
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Minute {
+			return nil, fmt.Errorf("files_age must be a duration of at least 1m, like 72h, default or off")
+		}
+		secs = int64(d / time.Second)
+	}
+	return func(rec *pb.RoomSettings) { rec.FilesMaxAge = secs }, nil
+}
+
+// fileLimits returns how many bytes of files the room called id keeps and
+// for how long, 0 meaning no limit.
+func (s *server) fileLimits(id string) (maxBytes int64, maxAge time.Duration) {
+	rs := s.settings.room(id)
+	rs.mu.Lock()
+	mb, age := rs.rec.FilesMb, rs.rec.FilesMaxAge
+	rs.mu.Unlock()
+	maxBytes, maxAge = roomFilesMiB<<20, roomFilesAge
+	if mb != 0 {
+		maxBytes = max(int64(mb), 0) << 20
+	}
+	if age != 0 {
+		maxAge = time.Duration(max(age, 0)) * time.Second
+	}
+	return maxBytes, maxAge
+}
+
+// oldestFirst returns every stored file, oldest first.
+func (st *fileStore) oldestFirst() []*pb.RoomFile {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	files := make([]*pb.RoomFile, 0, len(st.files))
+	for _, f := range st.files {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Timestamp < files[j].Timestamp })
+	return files
+}
+
+// warn reports whether the file called id is yet to be announced as
+// expiring, and marks it as announced.
+func (st *fileStore) warn(id string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.files[id]; !ok || st.warned[id] {
+		return false
+	}
+	st.warned[id] = true
+	return true
+}
+
+// cleanFiles expires stored files every tick, for the life of the process.
+func (s *server) cleanFiles(every time.Duration) {
+	for now := range time.Tick(every) {
+		func() {
+			defer recoverPanic("file cleaner", nil)
+			s.expireFiles(now)
+		}()
+	}
+}
+
+// expireFiles deletes the files past their room's limits, oldest first, and
+// warns of the ones that will soon be too old.
+func (s *server) expireFiles(now time.Time) {
+	files := s.files.oldestFirst()
+	stored := make(map[string]int64) // map[roomID]bytes
+	for _, f := range files {
+		if f.Recipient == "" {
+			stored[f.RoomId] += f.FileSize
+		}
+	}
+	for _, f := range files {
+		maxBytes, maxAge := int64(0), roomFilesAge
+		if f.Recipient == "" {
+			maxBytes, maxAge = s.fileLimits(f.RoomId)
+		}
+		age := now.Sub(time.Unix(f.Timestamp, 0))
+		var why string
+		switch {
+		case maxAge > 0 && age >= maxAge:
+			why = "kept for " + maxAge.String()
+		case maxBytes > 0 && stored[f.RoomId] > maxBytes && f.Recipient == "":
+			why = fmt.Sprintf("room over %d MiB", maxBytes>>20)
+		default:
+			if maxAge > 0 && maxAge-age <= min(expiryNotice, maxAge/2) && s.files.warn(f.FileId) {
+				goes := time.Unix(f.Timestamp, 0).Add(maxAge).Unix()
+				s.announceExpiry(f, &pb.Command{Type: "FILE_EXPIRING", Value: fmt.Sprintf("%s:%d", f.FileId, goes)})
+			}
+			continue
+		}
+		if f.Recipient == "" {
+			stored[f.RoomId] -= f.FileSize
+		}
+		if !s.files.remove(f.FileId) {
+			continue // downloaded from an inbox, or expired by an upload, meanwhile
+		}
+		log.Printf("Expired stored file '%s' (%s) of room '%s': %s", f.Filename, f.FileId, f.RoomId, why)
+		auditTrail.record(&pb.AuditEntry{Action: "upload", Actor: serverSender, RoomId: f.RoomId, Target: f.Filename, Size: f.FileSize, Outcome: "expired", Detail: f.FileId + ": " + why})
+		s.announceExpiry(f, &pb.Command{Type: "FILE_EXPIRED", Value: f.FileId})
+	}
+}
+
+// announceExpiry tells the room f was uploaded to about it, or, for an
+// inbox file, its recipient in every room they are logged in.
+func (s *server) announceExpiry(f *pb.RoomFile, cmd *pb.Command) {
+	if f.Recipient == "" {
+		if room, ok := s.rooms.Load(f.RoomId); ok {
+			room.Broadcast(serverCommand(room.id, serverSender, cmd), "")
+		}
+		return
+	}
+	s.rooms.Range(func(room *Room) bool {
+		if c, ok := room.users.Load(f.Recipient); ok && c.(*Client).registered.Load() {
+			reply(c.(*Client), room, cmd)
+		}
+		return true
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	pb "conference-server/conference"
+)
+
+// --- Participant roles ---
+
+// Every member of a room is its host, a co-host or an attendee. The host is
+// the room's owner; co-hosts are named by the host and, like moderators, may
+// use the privileged commands: muting others, giving the floor, stopping
+// someone else's share, kicking and starting broadcast file transfers. Only
+// the host (or a moderator) names co-hosts, hands the room over and ends the
+// meeting (see endmeeting.go). Co-hosts are kept by name, like mutes.
+const (
+	roleHost     = "host"
+	roleCohost   = "cohost"
+	roleAttendee = "attendee"
+)
+
+// clientCommands are the command types a client may send: those the room
+// acts on (roles, mute, share, hands, roster, spam filter, pins, settings,
+// IDENTIFY and END_MEETING), and RECORDING, which is passed on to everyone.
+// The state commands in presence.go are passed on too. Anything else is
+// refused: clients used to be able to broadcast any command, so an attendee
+// could fake a ROOM_OWNER or USER_MUTED notice, and a list of what only the
+// server sends missed every notice added since.
+var clientCommands = map[string]bool{
+	"SET_ROLE": true, "KICK": true, "END_MEETING": true,
+	"MUTE": true, "UNMUTE": true, "MUTE_ALL": true, "UNMUTE_ALL": true,
+	"START_SHARE": true, "STOP_SHARE": true,
+	"RAISE_HAND": true, "LOWER_HAND": true, "GIVE_FLOOR": true,
+	"GET_ROSTER": true, "SPAM_FILTER": true, "PIN": true, "UNPIN": true,
+	"ROOM_SET": true, "IDENTIFY": true, "RECORDING": true,
+}
+
+// parseJoinRole validates the role requested in the JOIN command's value.
+// "" and "host" both mean "host if the room has none yet".
+func parseJoinRole(value string) (string, error) {
+	switch value {
+	case "", roleHost:
+		return roleHost, nil
+	case roleCohost, roleAttendee:
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown role %q (use host, cohost or attendee)", value)
+}
+
+// Role returns c's role in the room.
+func (r *Room) Role(c *Client) string {
+	r.control.mu.Lock()
+	defer r.control.mu.Unlock()
+	switch {
+	case r.control.owner == c.id:
+		return roleHost
+	case r.control.cohosts[c.id]:
+		return roleCohost
+	}
+	return roleAttendee
+}
+
+// isHost reports whether c may name co-hosts and end the meeting.
+func (r *Room) isHost(c *Client) bool {
+	return c.moderator || r.Owner() == c.id
+}
+
+// canActOn reports whether c may mute or remove target: moderators answer
+// only to moderators, and the host and co-hosts to the host, so a co-host
+// can only act on attendees.
+func (r *Room) canActOn(c, target *Client) bool {
+	switch {
+	case target.moderator:
+		return c.moderator
+	case r.isHost(c):
+		return true
+	}
+	return r.Role(target) == roleAttendee
+}
+
+// grantJoinRole gives c the co-host role it asked for when joining, which
+// only moderators get. Everyone else joins as an attendee (or host, through
+// claimOwner).
+func (r *Room) grantJoinRole(c *Client) {
+	if c.joinRole != roleCohost {
+		return
+	}
+	if !c.moderator {
+		reply(c, r, &pb.Command{Type: "ROLE_DENIED", Value: "only moderators can join as co-host; joined as attendee"})
+		return
+	}
+	r.setCohost(c.id, true)
+	r.announceRole(c.id, roleCohost)
+}
+
+func (r *Room) setCohost(name string, cohost bool) {
+	r.control.mu.Lock()
+	defer r.control.mu.Unlock()
+	if !cohost {
+		delete(r.control.cohosts, name)
+		return
+	}
+	if r.control.cohosts == nil {
+		r.control.cohosts = make(map[string]bool)
+	}
+	r.control.cohosts[name] = true
+}
+
+// sendRoles tells c, who just joined, who the host and co-hosts are, as
+// "name:role" pairs.
+func (r *Room) sendRoles(c *Client) {
+	r.control.mu.Lock()
+	var roles []string
+	for name := range r.control.cohosts {
+		if name != r.control.owner {
+			roles = append(roles, name+":"+roleCohost)
+		}
+	}
+	sort.Strings(roles)
+	if r.control.owner != "" {
+		roles = append([]string{r.control.owner + ":" + roleHost}, roles...)
+	}
+	r.control.mu.Unlock()
+	if len(roles) > 0 {
+		reply(c, r, &pb.Command{Type: "ROLES", Value: strings.Join(roles, ",")})
+	}
+}
+
+func (r *Room) announceRole(name, role string) {
+	log.Printf("'%s' is now %s of room '%s'", name, role, r.id)
+	r.Broadcast(serverCommand(r.id, serverSender, &pb.Command{Type: "ROLE_CHANGED", Value: name + ":" + role}), "")
+}
+
+// handleRoleCommand applies a SET_ROLE or KICK command from c, or refuses
+// one clients may not send, reporting whether cmd was one of them.
+// SET_ROLE takes "name:role"; giving someone the host role hands the room
+// over and leaves the previous host as a co-host.
+func (r *Room) handleRoleCommand(c *Client, cmd *pb.Command) bool {
+	if !clientCommands[cmd.Type] && !coalescedCommands[cmd.Type] {
+		reply(c, r, &pb.Command{Type: "ROLE_DENIED", Value: "clients can't send " + cmd.Type})
+		return true
+	}
+	switch cmd.Type {
+	case "SET_ROLE":
+		i := strings.LastIndex(cmd.Value, ":")
+		if i <= 0 {
+			reply(c, r, &pb.Command{Type: "ROLE_DENIED", Value: "expected name:role"})
+			return true
+		}
+		name, role := cmd.Value[:i], cmd.Value[i+1:]
+		if !r.isHost(c) {
+			reply(c, r, &pb.Command{Type: "ROLE_DENIED", Value: "only the host or a moderator can change roles"})
+			return true
+		}
+		target, ok := r.users.Load(name)
+		if !ok {
+			reply(c, r, &pb.Command{Type: "ROLE_DENIED", Value: "user '" + name + "' is not in this room"})
+			return true
+		}
+		r.setRole(c, target.(*Client), role)
+	case "KICK":
+		target, ok := r.users.Load(cmd.Value)
+		switch {
+		case !r.canControl(c):
+			reply(c, r, &pb.Command{Type: "ROLE_DENIED", Value: "only the host, a co-host or a moderator can remove users"})
+		case !ok:
+			reply(c, r, &pb.Command{Type: "ROLE_DENIED", Value: "user '" + cmd.Value + "' is not in this room"})
+		case !r.canActOn(c, target.(*Client)):
+			reply(c, r, &pb.Command{Type: "ROLE_DENIED", Value: "you can't remove " + cmd.Value})
+		default:
+			log.Printf("'%s' removed '%s' from room '%s'", c.id, cmd.Value, r.id)
+			auditTrail.record(&pb.AuditEntry{Action: "kick", Actor: c.id, Addr: c.addr, RoomId: r.id, Target: cmd.Value, Outcome: "ok"})
+			target.(*Client).Kick("removed from the room by " + c.id)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+func (r *Room) setRole(by, target *Client, role string) {
+	switch role {
+	case roleHost:
+		if target.stream == nil { // replay and browser users never own a room
+			reply(by, r, &pb.Command{Type: "ROLE_DENIED", Value: target.id + " can't be the host"})
+			return
+		}
+		r.control.mu.Lock()
+		previous := r.control.owner
+		r.control.owner = target.id
+		delete(r.control.cohosts, target.id)
+		r.control.mu.Unlock()
+		r.announceOwner(target.id)
+		if previous != "" && previous != target.id {
+			r.setCohost(previous, true)
+			r.announceRole(previous, roleCohost)
+		}
+	case roleCohost, roleAttendee:
+		if r.Role(target) == roleHost {
+			reply(by, r, &pb.Command{Type: "ROLE_DENIED", Value: "give someone else the host role first"})
+			return
+		}
+		r.setCohost(target.id, role == roleCohost)
+		r.announceRole(target.id, role)
+	default:
+		reply(by, r, &pb.Command{Type: "ROLE_DENIED", Value: "unknown role '" + role + "'"})
+	}
+}
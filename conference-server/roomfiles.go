@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "conference-server/conference"
+)
+
+// --- Server-hosted room files ---
+
+// roomFileChunk is the chunk size DownloadFile sends, the same the Java
+// client uses for transfers.
+const roomFileChunk = 64 << 10
+
+// fileStore keeps the files uploaded with UploadToRoom under dir (-file-store):
+// the contents as <id> and the RoomFile describing them as <id>.json, which
+// is how the index is rebuilt after a restart. Stored names never come from
+// the client, so a filename can't point outside dir.
+type fileStore struct {
+	dir string
+
+	mu     sync.Mutex
+	files  map[string]*pb.RoomFile // map[fileID]
+	warned map[string]bool         // files announced as expiring, see retention.go
+}
+
+func openFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	st := &fileStore{dir: dir, files: make(map[string]*pb.RoomFile), warned: make(map[string]bool)}
+	metas, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range metas {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		f := &pb.RoomFile{}
+		if err := protojson.Unmarshal(data, f); err != nil {
+			log.Printf("Skipping unreadable file index %s: %v", path, err)
+			continue
+		}
+		st.files[f.FileId] = f
+	}
+	log.Printf("File store at %s holds %d files", dir, len(st.files))
+	return st, nil
+}
+
+func (st *fileStore) path(id string) string {
+	return filepath.Join(st.dir, id)
+}
+
+func (st *fileStore) get(id string) (*pb.RoomFile, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	f, ok := st.files[id]
+	return f, ok
+}
+
+// add records f, whose contents are already at st.path(f.FileId).
+func (st *fileStore) add(f *pb.RoomFile) error {
+	data, err := protojson.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(st.path(f.FileId)+".json", data, 0o644); err != nil {
+		return err
+	}
+	st.mu.Lock()
+	st.files[f.FileId] = f
+	st.mu.Unlock()
+	return nil
+}
+
+func newFileID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// roomMember returns the room, and user's client in it, if user is in it
+// and the call in ctx comes from that client: a name alone doesn't say who
+// is calling, so the call must carry the token the client got in its
+// SESSION command as "session-token" metadata.
+func (s *server) roomMember(ctx context.Context, roomID, user string) (*Room, *Client, error) {
+	room, ok := s.rooms.Load(roomID)
+	if !ok {
+		return nil, nil, status.Errorf(codes.NotFound, "room '%s' not found", roomID)
+	}
+	v, ok := room.users.Load(user)
+	if !ok {
+		return nil, nil, status.Errorf(codes.PermissionDenied, "'%s' is not in room '%s'", user, roomID)
+	}
+	c := v.(*Client)
+	md, _ := metadata.FromIncomingContext(ctx)
+	if token := sessionTokenFromMetadata(md); token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) != 1 {
+		return nil, nil, status.Errorf(codes.Unauthenticated, "calls on behalf of '%s' must carry its session token", user)
+	}
+	return room, c, nil
+}
+
+// sessionMember returns the room and the client in it whose session token
+// the call in ctx carries, for calls that don't say on whose behalf they are
+// made.
+func (s *server) sessionMember(ctx context.Context, roomID string) (*Room, *Client, error) {
+	room, ok := s.rooms.Load(roomID)
+	if !ok {
+		return nil, nil, status.Errorf(codes.NotFound, "room '%s' not found", roomID)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	token := sessionTokenFromMetadata(md)
+	if token == "" {
+		return nil, nil, status.Errorf(codes.Unauthenticated, "calls for room '%s' must carry a member's session token", roomID)
+	}
+	var member *Client
+	room.users.Range(func(_, v interface{}) bool {
+		if c := v.(*Client); subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) == 1 {
+			member = c
+			return false
+		}
+		return true
+	})
+	if member == nil {
+		return nil, nil, status.Errorf(codes.PermissionDenied, "the session token isn't one of room '%s'", roomID)
+	}
+	return room, member, nil
+}
+
+// UploadToRoom stores a file on the server and announces it to the room as
+// a RoomFile; members fetch it later with DownloadFile. With a recipient it
+// goes to that user's inbox instead (see inbox.go).
+func (s *server) UploadToRoom(stream pb.ConferenceService_UploadToRoomServer) error {
+	if s.files == nil {
+		return status.Error(codes.Unimplemented, "this server does not store files (see -file-store)")
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	info := first.GetInfo()
+	if info == nil || info.RoomId == "" || info.Sender == "" || info.Filename == "" {
+		return status.Error(codes.InvalidArgument, "the first message must be a RoomFile with room_id, sender and filename")
+	}
+	room, uploader, err := s.roomMember(stream.Context(), info.RoomId, info.Sender)
+	if err != nil {
+		return err
+	}
+	auditUpload := func(outcome, detail string) {
+		if info.Recipient != "" {
+			detail = "to " + info.Recipient + ": " + detail
+		}
+		auditTrail.record(&pb.AuditEntry{Action: "upload", Actor: info.Sender, Addr: peerAddr(stream.Context()), RoomId: room.id, Target: info.Filename, Size: info.FileSize, Outcome: outcome, Detail: detail})
+	}
+	if frozen, reason := room.Frozen(); frozen && !uploader.moderator {
+		auditUpload("refused", "frozen")
+		return status.Errorf(codes.FailedPrecondition, "room '%s' is read-only: %s", room.id, reason)
+	}
+	code, reason := room.checkGuestFile(info.Sender)
+	if code == "" {
+		code, reason = s.checkFile(uploader, info.Filename, info.FileSize)
+	}
+	if code != "" {
+		auditUpload("refused", code)
+		return status.Errorf(codes.FailedPrecondition, "%s: %s", code, reason)
+	}
+	stored := false
+	defer func() {
+		if !stored {
+			s.fileQuota.refund(quotaOwner(uploader), info.FileSize)
+		}
+	}()
+	if maxBytes, _ := s.fileLimits(room.id); info.Recipient == "" && maxBytes > 0 && info.FileSize > maxBytes {
+		auditUpload("refused", "too_large")
+		return status.Errorf(codes.FailedPrecondition, "too_large: room '%s' keeps at most %d MiB of files", room.id, maxBytes>>20)
+	}
+	if info.Recipient != "" && !s.accounts.exists(info.Recipient) {
+		auditUpload("refused", "no account")
+		return status.Errorf(codes.FailedPrecondition, "'%s' isn't a registered name; only registered names have an inbox", info.Recipient)
+	}
+
+	f := &pb.RoomFile{
+		FileId:    newFileID(),
+		RoomId:    room.id,
+		Sender:    info.Sender,
+		Filename:  filepath.Base(info.Filename),
+		FileSize:  info.FileSize,
+		Timestamp: time.Now().Unix(),
+		Recipient: info.Recipient,
+	}
+	sum, err := s.receiveRoomFile(stream, f, info.Sha256)
+	if err != nil {
+		os.Remove(s.files.path(f.FileId))
+		return err
+	}
+	f.Sha256 = sum
+	if scanning() {
+		if reason := s.screen(stream.Context(), f.FileId, f.RoomId, f.Sender, f.Filename, s.files.path(f.FileId)); reason != "" {
+			os.Remove(s.files.path(f.FileId))
+			auditUpload("refused", reason)
+			return status.Error(codes.FailedPrecondition, reason)
+		}
+	}
+	if err := s.files.add(f); err != nil {
+		os.Remove(s.files.path(f.FileId))
+		return status.Errorf(codes.Internal, "storing '%s': %v", f.Filename, err)
+	}
+	stored = true
+	auditUpload("stored", f.FileId)
+	if f.Recipient != "" {
+		log.Printf("Stored file '%s' (%s, %d bytes) from '%s' in the inbox of '%s'", f.Filename, f.FileId, f.FileSize, f.Sender, f.Recipient)
+		s.deliverInbox(f)
+		return stream.SendAndClose(f)
+	}
+	log.Printf("Stored file '%s' (%s, %d bytes) from '%s' for room '%s'", f.Filename, f.FileId, f.FileSize, f.Sender, f.RoomId)
+
+	msg := seal(&pb.ConferenceData{Payload: &pb.ConferenceData_RoomFile{RoomFile: f}}, room.id, f.Sender)
+	room.history.Record(msg)
+	room.Broadcast(msg, "")
+	s.expireFiles(time.Now()) // the room may be over its limit now
+	return stream.SendAndClose(f)
+}
+
+// receiveRoomFile writes the uploaded chunks to the store, checking each
+// chunk's CRC when the client sent a SHA-256 (as it does for transfers),
+// and returns the file's SHA-256.
+func (s *server) receiveRoomFile(stream pb.ConferenceService_UploadToRoomServer, f *pb.RoomFile, wantSum string) (string, error) {
+	out, err := os.Create(s.files.path(f.FileId))
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "storing '%s': %v", f.Filename, err)
+	}
+	defer out.Close()
+	hash := sha256.New()
+	var size int64
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		chunk := msg.GetChunk()
+		if chunk == nil {
+			return "", status.Error(codes.InvalidArgument, "only file chunks may follow the RoomFile")
+		}
+		if chunk.Compressed {
+			return "", status.Error(codes.InvalidArgument, "uploads must not be compressed")
+		}
+		if wantSum != "" && crc32.ChecksumIEEE(chunk.Data) != chunk.Crc32 {
+			return "", status.Errorf(codes.DataLoss, "bad CRC in chunk %d", chunk.ChunkNumber)
+		}
+		if size += int64(len(chunk.Data)); size > f.FileSize {
+			return "", status.Errorf(codes.InvalidArgument, "more than the announced %d bytes", f.FileSize)
+		}
+		if err := s.paceChunk(stream.Context(), nil, f.Sender, len(chunk.Data)); err != nil {
+			return "", err
+		}
+		hash.Write(chunk.Data)
+		if _, err := out.Write(chunk.Data); err != nil {
+			return "", status.Errorf(codes.Internal, "storing '%s': %v", f.Filename, err)
+		}
+		if chunk.IsLast {
+			break
+		}
+	}
+	if size != f.FileSize {
+		return "", status.Errorf(codes.DataLoss, "got %d of the announced %d bytes", size, f.FileSize)
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if wantSum != "" && !strings.EqualFold(sum, wantSum) {
+		return "", status.Error(codes.DataLoss, "SHA-256 does not match")
+	}
+	if err := out.Close(); err != nil {
+		return "", status.Errorf(codes.Internal, "storing '%s': %v", f.Filename, err)
+	}
+	return sum, nil
+}
+
+// DownloadFile streams a stored file to a member of its room, or an inbox
+// file to its recipient, wherever they are; the inbox copy is then deleted.
+func (s *server) DownloadFile(req *pb.DownloadFileRequest, stream pb.ConferenceService_DownloadFileServer) error {
+	if s.files == nil {
+		return status.Error(codes.Unimplemented, "this server does not store files (see -file-store)")
+	}
+	f, ok := s.files.get(req.FileId)
+	switch {
+	case ok && f.Recipient != "":
+		if req.Requester != f.Recipient {
+			return status.Errorf(codes.NotFound, "file '%s' not found in your inbox", req.FileId)
+		}
+		// Only the owner of the name, logged in to it, gets its inbox
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		if registered, _ := s.accounts.check(f.Recipient, accountTokenFromMetadata(md)); !registered {
+			return status.Errorf(codes.Unauthenticated, "log in to '%s' to download its inbox", f.Recipient)
+		}
+	case !ok || f.RoomId != req.RoomId:
+		return status.Errorf(codes.NotFound, "file '%s' not found in room '%s'", req.FileId, req.RoomId)
+	default:
+		if _, _, err := s.roomMember(stream.Context(), req.RoomId, req.Requester); err != nil {
+			return err
+		}
+	}
+	in, err := os.Open(s.files.path(f.FileId))
+	if err != nil {
+		return status.Errorf(codes.Internal, "reading '%s': %v", f.Filename, err)
+	}
+	defer in.Close()
+
+	pace := newPacer(transferRateKiB)
+	buf := make([]byte, roomFileChunk)
+	for n := int32(0); ; n++ {
+		read, err := io.ReadFull(in, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return status.Errorf(codes.Internal, "reading '%s': %v", f.Filename, err)
+		}
+		if read > 0 {
+			if err := s.paceChunk(stream.Context(), pace, req.Requester, read); err != nil {
+				return err
+			}
+			data := buf[:read]
+			if err := stream.Send(&pb.FileChunk{TransferId: f.FileId, Data: data, ChunkNumber: n, Crc32: crc32.ChecksumIEEE(data)}); err != nil {
+				return err
+			}
+		}
+		if err != nil { // EOF: nothing more to read
+			log.Printf("'%s' downloaded stored file '%s' (%s)", req.Requester, f.Filename, f.FileId)
+			if err := stream.Send(&pb.FileChunk{TransferId: f.FileId, ChunkNumber: n + 1, IsLast: true}); err != nil {
+				return err
+			}
+			if f.Recipient != "" {
+				in.Close()
+				s.files.remove(f.FileId)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// --- Room lifecycle ---
+
+// roomManager owns the room map. Rooms are created, held, released and
+// deleted only on its goroutine, so a room can no longer be deleted between
+// a joiner finding it and joining it, as the old IsEmpty-then-delete check
+// allowed. Every room counts its holds: members (synthetic users included),
+// event subscribers, name reservations and admin RPCs working on it. The
+// room is deleted when the last hold is released.
+type roomManager struct {
+	rooms    sync.Map // map[roomID]*Room; written only on the manager goroutine
+	ops      chan func()
+	settings *settingsStore // where new rooms find their settings
+}
+
+func newRoomManager(settings *settingsStore) *roomManager {
+	m := &roomManager{ops: make(chan func()), settings: settings}
+	go m.run()
+	return m
+}
+
+func (m *roomManager) run() {
+	for op := range m.ops {
+		op()
+	}
+}
+
+// do runs op on the manager goroutine and waits for it to finish. If op
+// panics, the manager carries on and the panic is raised again in the
+// caller, whose own recovery turns it into an error for its client.
+func (m *roomManager) do(op func()) {
+	done := make(chan *opPanic, 1)
+	m.ops <- func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- &opPanic{value: p, stack: debug.Stack()}
+				return
+			}
+			done <- nil
+		}()
+		op()
+	}
+	if p := <-done; p != nil {
+		panic(p)
+	}
+}
+
+// Acquire returns the room called id, creating it if needed, with a hold
+// the caller must Release. created reports whether the room is new.
+func (m *roomManager) Acquire(id string) (room *Room, created bool) {
+	m.do(func() {
+		v, ok := m.rooms.Load(id)
+		if !ok {
+			r := NewRoom(id, m.settings.room(id))
+			r.applySettings()
+			v = r
+			m.rooms.Store(id, v)
+		}
+		room, created = v.(*Room), !ok
+		room.holds.Add(1)
+	})
+	return room, created
+}
+
+// AcquireExisting is Acquire for callers that must not create the room: it
+// takes a hold on the room called id only if there is one.
+func (m *roomManager) AcquireExisting(id string) (room *Room, ok bool) {
+	m.do(func() {
+		v, found := m.rooms.Load(id)
+		if !found {
+			return
+		}
+		room, ok = v.(*Room), true
+		room.holds.Add(1)
+	})
+	return room, ok
+}
+
+// Retain adds a hold on a room the caller already holds, e.g. when one of
+// its holds becomes two.
+func (m *roomManager) Retain(r *Room) {
+	m.do(func() { r.holds.Add(1) })
+}
+
+// Release drops a hold on r, deleting r if it was the last one. It reports
+// whether r is gone.
+func (m *roomManager) Release(r *Room) (deleted bool) {
+	m.do(func() {
+		if r.holds.Add(-1) > 0 {
+			return
+		}
+		deleted = true
+		if m.rooms.CompareAndDelete(r.id, r) {
+			log.Printf("Room '%s' is empty and deleted.", r.id)
+		}
+	})
+	return deleted
+}
+
+// Remove takes r out of the map at once, however many holds it has left;
+// joining the same ID afterwards creates a new room.
+func (m *roomManager) Remove(r *Room) {
+	m.do(func() { m.rooms.CompareAndDelete(r.id, r) })
+}
+
+// Load returns the room called id, if it exists. It takes no hold.
+func (m *roomManager) Load(id string) (*Room, bool) {
+	v, ok := m.rooms.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return v.(*Room), true
+}
+
+// Range calls f for every room until f returns false.
+func (m *roomManager) Range(f func(*Room) bool) {
+	m.rooms.Range(func(_, v interface{}) bool { return f(v.(*Room)) })
+}
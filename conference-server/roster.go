@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	pb "conference-server/conference"
+)
+
+// --- Participant roster ---
+
+// USER_JOINED and USER_LEFT only reach members who are already in the room,
+// so a client that joins late or reconnects can't tell who else is there.
+// ROSTER carries the whole member list, comma-joined and sorted; members get
+// it when they join or are moved into the room, and whenever they send
+// GET_ROSTER.
+
+// Roster returns the names of the room's members, sorted.
+func (r *Room) Roster() []string {
+	var names []string
+	r.users.Range(func(key, _ interface{}) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
+func (r *Room) sendRoster(c *Client) {
+	reply(c, r, &pb.Command{Type: "ROSTER", Value: strings.Join(r.Roster(), ",")})
+}
+
+// handleRosterCommand answers a GET_ROSTER command from c, reporting whether
+// cmd was one.
+func (r *Room) handleRosterCommand(c *Client, cmd *pb.Command) bool {
+	if cmd.Type != "GET_ROSTER" {
+		return false
+	}
+	r.sendRoster(c)
+	return true
+}
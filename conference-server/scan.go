@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	pb "conference-server/conference"
+)
+
+// --- Content scanning ---
+
+// With -scan-cmd or -scan-icap set, every file the server relays or stores
+// is checked before it is delivered. Relays copy the chunks to a temporary
+// file as they pass and hold back the last one until the scan is done, so a
+// receiver never gets a complete file the scanner refused: the transfer is
+// aborted instead and the receiver drops what it has. Room uploads are
+// checked before they are announced. Direct 1:1 transfers would bypass the
+// server, so they are turned off while scanning. A scanner that fails or
+// times out refuses the file. Every verdict goes to the audit log (see
+// audit.go) as a "scan" entry: "clean", "blocked" with the finding, or
+// "error".
+var (
+	scanCmd     string // program and arguments; the file's path is appended
+	scanICAP    string // icap://host[:port]/service, sent a RESPMOD request
+	scanTimeout = time.Minute
+)
+
+func scanning() bool {
+	return scanCmd != "" || scanICAP != ""
+}
+
+func checkScanFlags() error {
+	if scanTimeout <= 0 {
+		return errors.New("-scan-timeout must be positive")
+	}
+	if scanICAP != "" {
+		if u, err := url.Parse(scanICAP); err != nil || u.Scheme != "icap" || u.Host == "" {
+			return errors.New("-scan-icap must look like icap://host[:port]/service")
+		}
+	}
+	return nil
+}
+
+// scanFile returns what the scanner found in path, "" if it is clean, or an
+// error if it could not tell.
+func scanFile(ctx context.Context, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, scanTimeout)
+	defer cancel()
+	if scanCmd != "" {
+		if finding, err := scanWithCommand(ctx, path); finding != "" || err != nil {
+			return finding, err
+		}
+	}
+	if scanICAP != "" {
+		return scanWithICAP(ctx, path)
+	}
+	return "", nil
+}
+
+// scanWithCommand follows the clamscan convention: exit status 0 is clean,
+// 1 is a finding (described by the first line of output) and anything else
+// is an error.
+func scanWithCommand(ctx context.Context, path string) (string, error) {
+	args := strings.Fields(scanCmd)
+	out, err := exec.CommandContext(ctx, args[0], append(args[1:], path)...).CombinedOutput()
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.As(err, &exit) && exit.ExitCode() == 1:
+		line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		if line = strings.TrimPrefix(line, path+": "); line == "" {
+			line = "flagged by " + filepath.Base(args[0])
+		}
+		return line, nil
+	default:
+		return "", fmt.Errorf("%s: %v", filepath.Base(args[0]), err)
+	}
+}
+
+// scanWithICAP sends the file as the body of an HTTP response in an ICAP
+// RESPMOD request (RFC 3507). 204 means the service left it alone; 200 means
+// it would have changed it, which antivirus services do to infected files.
+func scanWithICAP(ctx context.Context, path string) (string, error) {
+	u, err := url.Parse(scanICAP)
+	if err != nil {
+		return "", err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "1344")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	resHdr := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n", info.Size())
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "RESPMOD %s ICAP/1.0\r\nHost: %s\r\nAllow: 204\r\nEncapsulated: res-hdr=0, res-body=%d\r\n\r\n%s",
+		scanICAP, u.Host, len(resHdr), resHdr)
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	r := textproto.NewReader(bufio.NewReader(conn))
+	line, err := r.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	hdr, err := r.ReadMIMEHeader()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", fmt.Errorf("bad ICAP status line %q", line)
+	}
+	switch fields[1] {
+	case "204":
+		return "", nil
+	case "200":
+		for _, h := range []string{"X-Infection-Found", "X-Virus-Id", "X-Violations-Found"} {
+			if v := hdr.Get(h); v != "" {
+				return v, nil
+			}
+		}
+		return "flagged by the ICAP service", nil
+	default:
+		return "", fmt.Errorf("ICAP service answered %q", line)
+	}
+}
+
+// screen scans a finished file and returns why it must not be delivered,
+// or "" if it may.
+func (s *server) screen(ctx context.Context, id, room, from, filename, path string) string {
+	finding, err := scanFile(ctx, path)
+	switch {
+	case err != nil:
+		s.scanBlocked.Add(1)
+		auditScan(ctx, id, room, from, filename, "error", err.Error())
+		return "the content scanner could not check the file"
+	case finding != "":
+		s.scanBlocked.Add(1)
+		auditScan(ctx, id, room, from, filename, "blocked", finding)
+		return "blocked by the content scanner: " + finding
+	}
+	auditScan(ctx, id, room, from, filename, "clean", "")
+	return ""
+}
+
+// auditScan records the verdict on the file of transfer or upload id, sent
+// by from on the call in ctx.
+func auditScan(ctx context.Context, id, room, from, filename, outcome, detail string) {
+	if detail != "" {
+		detail = ": " + detail
+	}
+	auditTrail.record(&pb.AuditEntry{Action: "scan", Actor: from, Addr: peerAddr(ctx), RoomId: room, Target: filename, Outcome: outcome, Detail: id + detail})
+}
+
+// scanSpool collects a relayed file's contents for screen. A nil spool,
+// which newScanSpool returns when scanning is off, ignores everything.
+type scanSpool struct {
+	f    *os.File
+	size int64 // declared by the sender; nothing is written past it
+	next int64 // where a chunk without an offset goes
+	err  error
+}
+
+// newScanSpool returns a spool for a file of size bytes.
+func newScanSpool(size int64) *scanSpool {
+	if !scanning() {
+		return nil
+	}
+	f, err := os.CreateTemp("", "conference-scan-*")
+	return &scanSpool{f: f, size: size, err: err}
+}
+
+// add writes a chunk's data, decompressed, where the receiver will save it.
+// Chunks resent after a 1:1 transfer resumes land on what is already there.
+// A chunk that would go past the declared size, once decompressed, fails
+// the spool, and only a byte more than would fit is ever decompressed.
+func (sp *scanSpool) add(chunk *pb.FileChunk) {
+	if sp == nil || sp.err != nil {
+		return
+	}
+	at := chunk.Offset
+	if at == 0 && chunk.ChunkNumber > 0 { // a sender that predates offsets
+		at = sp.next
+	}
+	if at < 0 || at > sp.size {
+		sp.err = fmt.Errorf("a chunk at offset %d is outside the declared %d bytes", at, sp.size)
+		return
+	}
+	data := chunk.Data
+	if chunk.Compressed {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			sp.err = err
+			return
+		}
+		if data, sp.err = io.ReadAll(io.LimitReader(zr, sp.size-at+1)); sp.err != nil {
+			return
+		}
+	}
+	if at+int64(len(data)) > sp.size {
+		sp.err = fmt.Errorf("the file is larger than the declared %d bytes", sp.size)
+		return
+	}
+	_, sp.err = sp.f.WriteAt(data, at)
+	sp.next = at + int64(len(data))
+}
+
+// check screens what was collected; see (*server).screen.
+func (sp *scanSpool) check(s *server, ctx context.Context, id, room, from, filename string) string {
+	if sp == nil {
+		return ""
+	}
+	if sp.err == nil {
+		sp.err = sp.f.Sync()
+	}
+	if sp.err != nil {
+		auditScan(ctx, id, room, from, filename, "error", sp.err.Error())
+		s.scanBlocked.Add(1)
+		return "the content scanner could not check the file"
+	}
+	return s.screen(ctx, id, room, from, filename, sp.f.Name())
+}
+
+func (sp *scanSpool) remove() {
+	if sp == nil || sp.f == nil {
+		return
+	}
+	sp.f.Close()
+	os.Remove(sp.f.Name())
+}
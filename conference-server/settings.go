@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pb "conference-server/conference"
+)
+
+// --- Room settings ---
+
+// Every room has a settings record with its topic, password, capacity,
+// history depth, spam filter and owner. A room used to be just a name that
+// vanished with its last member; the record outlives it in memory and, with
+// -room-store, on disk as <dir>/<hex of the room ID>.json, so it survives
+// restarts too. The owner changes it with ROOM_SET "key=value":
+//
+//	topic=<text>             shown to everyone who joins; empty clears it
+//	password=<secret>        needed to join, as room-password metadata; empty removes it
+//	capacity=<n>             most members at once, not counting the owner; 0 for no limit
+//	history=<n|default|off>  messages replayed to late joiners
+//	owner=<name>             host whenever present and logged in to the name; empty lets the first to join host
+//
+// the guest policies in guests.go and the file limits in retention.go.
+// Until a room has an owner its host may change the settings; moderators
+// always may, and always get in. The spam filter is still set with
+// SPAM_FILTER (see spam.go) and saved here. Members get the record, without
+// the password, as RoomSettings when they join and whenever it changes;
+// refusals come back as SETTINGS_DENIED. The password is kept as a bcrypt
+// hash, like account passwords; records saved before keep a salted SHA-256
+// until the next member gets in with it. The owner is only recognized once
+// logged in to the account of its name (see accounts.go): anyone can join
+// as a name that isn't registered, so a bare name would hand the room to
+// whoever turned up with it first after a restart.
+
+// maxTopic is the longest topic, in characters.
+const maxTopic = 200
+
+type settingsStore struct {
+	dir string // empty keeps the records in memory only; set before serving
+
+	mu    sync.Mutex
+	rooms map[string]*roomSettings // map[roomID], only rooms whose settings were changed
+}
+
+type roomSettings struct {
+	store *settingsStore
+	mu    sync.Mutex
+	rec   *pb.RoomSettings
+}
+
+func newSettingsStore() *settingsStore {
+	return &settingsStore{rooms: make(map[string]*roomSettings)}
+}
+
+// load reads the records kept in dir and saves every change there from now
+// on.
+func (st *settingsStore) load(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rec := &pb.RoomSettings{}
+		if err := protojson.Unmarshal(data, rec); err != nil || rec.RoomId == "" {
+			log.Printf("Skipping unreadable room settings %s: %v", path, err)
+			continue
+		}
+		st.rooms[rec.RoomId] = &roomSettings{store: st, rec: rec}
+	}
+	st.dir = dir
+	log.Printf("Room store at %s holds the settings of %d rooms", dir, len(st.rooms))
+	return nil
+}
+
+// room returns the settings of the room called id, empty if they were never
+// changed.
+func (st *settingsStore) room(id string) *roomSettings {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if rs, ok := st.rooms[id]; ok {
+		return rs
+	}
+	return &roomSettings{store: st, rec: &pb.RoomSettings{RoomId: id}}
+}
+
+// save keeps rs, writing it to disk if there is a store there. rs.mu must be
+// held.
+func (st *settingsStore) save(rs *roomSettings) error {
+	st.mu.Lock()
+	st.rooms[rs.rec.RoomId] = rs
+	dir := st.dir
+	st.mu.Unlock()
+	if dir == "" {
+		return nil
+	}
+	data, err := protojson.Marshal(rs.rec)
+	if err != nil {
+		return err
+	}
+	// Written aside and renamed, so a crash can't leave half a record
+	path := filepath.Join(dir, hex.EncodeToString([]byte(rs.rec.RoomId))+".json")
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Settings returns a copy of the room's record.
+func (r *Room) Settings() *pb.RoomSettings {
+	r.settings.mu.Lock()
+	defer r.settings.mu.Unlock()
+	return proto.Clone(r.settings.rec).(*pb.RoomSettings)
+}
+
+// updateSettings applies change to the room's record and saves it.
+func (r *Room) updateSettings(change func(*pb.RoomSettings)) {
+	rs := r.settings
+	rs.mu.Lock()
+	change(rs.rec)
+	err := rs.store.save(rs)
+	rs.mu.Unlock()
+	if err != nil {
+		log.Printf("Could not save the settings of room '%s': %v", r.id, err)
+	}
+}
+
+// applySettings puts the saved history depth and spam filter into effect in
+// a room that was just created.
+func (r *Room) applySettings() {
+	rec := r.Settings()
+	r.history.setLimit(int(rec.History))
+	if own, repeats, window, err := parseSpamSetting(rec.SpamFilter); err == nil {
+		r.spam.mu.Lock()
+		r.spam.own, r.spam.repeats, r.spam.window = own, repeats, window
+		r.spam.mu.Unlock()
+	}
+}
+
+func roomPasswordFromMetadata(md metadata.MD) string {
+	if vals := md.Get("room-password"); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+// admit checks the room's password, guest policy and capacity for c, who is
+// about to join. Moderators are let in regardless, and the owner however full the
+// room is. The capacity is checked before joining, so two joiners arriving
+// together may both get the last place.
+func (r *Room) admit(c *Client, password string) error {
+	if c.moderator {
+		return nil
+	}
+	rec := r.Settings()
+	if err := r.checkEntry(rec, isGuest(c), password); err != nil {
+		return err
+	}
+	if rec.Capacity > 0 && !isSavedOwner(rec, c) && len(r.members()) >= int(rec.Capacity) {
+		return status.Errorf(codes.ResourceExhausted, "room '%s' is full (%d participants)", r.id, rec.Capacity)
+	}
+	return nil
+}
+
+// checkEntry checks the room's password and registered_only policy, the
+// rules for whoever would read the room: members joining it and
+// SubscribeEvents subscribers alike.
+func (r *Room) checkEntry(rec *pb.RoomSettings, guest bool, password string) error {
+	if !r.passwordMatches(rec, password) {
+		if password == "" {
+			return status.Errorf(codes.Unauthenticated, "room '%s' needs a password", r.id)
+		}
+		return status.Errorf(codes.Unauthenticated, "wrong password for room '%s'", r.id)
+	}
+	if rec.RegisteredOnly && guest {
+		return status.Errorf(codes.PermissionDenied, "room '%s' only admits users logged in to a registered name", r.id)
+	}
+	return nil
+}
+
+// passwordMatches reports whether password opens the room, if it has one.
+func (r *Room) passwordMatches(rec *pb.RoomSettings, password string) bool {
+	return rec.PasswordBcrypt == "" || bcrypt.CompareHashAndPassword([]byte(rec.PasswordBcrypt), []byte(password)) == nil
+}
+
+// isSavedOwner reports whether c is the owner named in rec, logged in to
+// that name.
+func isSavedOwner(rec *pb.RoomSettings, c *Client) bool {
+	return rec.Owner != "" && rec.Owner == c.id && c.registered.Load()
+}
+
+// canConfigure reports whether c may change the room's settings: its owner,
+// its host while it has no owner, or a moderator.
+func (r *Room) canConfigure(c *Client) bool {
+	rec := r.Settings()
+	return c.moderator || isSavedOwner(rec, c) || rec.Owner == "" && r.Owner() == c.id
+}
+
+// handleSettingsCommand applies a ROOM_SET command from c, reporting whether
+// cmd was one.
+func (r *Room) handleSettingsCommand(c *Client, cmd *pb.Command) bool {
+	if cmd.Type != "ROOM_SET" {
+		return false
+	}
+	if !r.canConfigure(c) {
+		reply(c, r, &pb.Command{Type: "SETTINGS_DENIED", Value: "only the room's owner (or its host, while it has none) or a moderator can change its settings"})
+		return true
+	}
+	key, value, _ := strings.Cut(cmd.Value, "=")
+	change, err := parseRoomSetting(r.id, key, value)
+	if err != nil {
+		reply(c, r, &pb.Command{Type: "SETTINGS_DENIED", Value: err.Error()})
+		return true
+	}
+	r.updateSettings(change)
+	rec := r.Settings()
+	if key == "password" {
+		value = "***"
+	}
+	log.Printf("'%s' set %s=%q in room '%s'", c.id, key, value, r.id)
+
+	switch key {
+	case "history":
+		r.history.setLimit(int(rec.History))
+	case "owner":
+		if target, ok := r.users.Load(rec.Owner); ok && isSavedOwner(rec, target.(*Client)) && r.Owner() != rec.Owner {
+			r.setRole(c, target.(*Client), roleHost)
+		}
+	}
+	r.Broadcast(r.settingsMessage(c.id), "")
+	return true
+}
+
+// parseRoomSetting checks a ROOM_SET key and value and returns the change
+// to make.
+func parseRoomSetting(roomID, key, value string) (func(*pb.RoomSettings), error) {
+	value = strings.TrimSpace(value)
+	switch key {
+	case "topic":
+		if utf8.RuneCountInString(value) > maxTopic {
+			return nil, fmt.Errorf("the topic can't be longer than %d characters", maxTopic)
+		}
+		return func(rec *pb.RoomSettings) { rec.Topic = value }, nil
+	case "password":
+		hash := ""
+		if value != "" {
+			if len(value) > maxPasswordLen {
+				return nil, fmt.Errorf("the password can't be longer than %d bytes", maxPasswordLen)
+			}
+			b, err := bcrypt.GenerateFromPassword([]byte(value), bcrypt.DefaultCost)
+			if err != nil {
+				return nil, fmt.Errorf("could not hash the password: %v", err)
+			}
+			hash = string(b)
+		}
+		return func(rec *pb.RoomSettings) { rec.PasswordBcrypt = hash }, nil
+	case "capacity":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("capacity must be a number of participants, or 0 for no limit")
+		}
+		return func(rec *pb.RoomSettings) { rec.Capacity = int32(n) }, nil
+	case "history":
+		n, err := 0, error(nil)
+		switch value {
+		case "default":
+		case "off":
+			n = -1
+		default:
+			n, err = strconv.Atoi(value)
+			if err != nil || n < 1 || n > maxChatHistory {
+				return nil, fmt.Errorf("history must be 1-%d, default or off", maxChatHistory)
+			}
+		}
+		return func(rec *pb.RoomSettings) { rec.History = int32(n) }, nil
+	case "owner":
+		return func(rec *pb.RoomSettings) { rec.Owner = value }, nil
+	case "registered_only", "guest_files", "guest_audio":
+		if value != "on" && value != "off" {
+			return nil, fmt.Errorf("%s must be on or off", key)
+		}
+		return guestSettingChange(key, value == "on"), nil
+	case "files_mb", "files_age":
+		return retentionSettingChange(key, value)
+	}
+	return nil, fmt.Errorf("unknown setting '%s' (topic, password, capacity, history, owner, registered_only, guest_files, guest_audio, files_mb or files_age)", key)
+}
+
+// settingsMessage builds the message carrying the room's settings, leaving
+// the password out.
+func (r *Room) settingsMessage(sender string) *pb.ConferenceData {
+	rec := r.Settings()
+	rec.HasPassword = rec.PasswordBcrypt != ""
+	rec.PasswordBcrypt = ""
+	return seal(&pb.ConferenceData{Payload: &pb.ConferenceData_Settings{Settings: rec}}, r.id, sender)
+}
+
+// sendSettings tells c, who just joined, the room's settings.
+func (r *Room) sendSettings(c *Client) {
+	c.Send(r.settingsMessage(serverSender))
+}
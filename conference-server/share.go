@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	pb "conference-server/conference"
+)
+
+// --- Screen sharing ---
+
+// roomShare tracks the one screen share a room may have at a time. Screen
+// frames travel as VideoFrames with source VIDEO_SCREEN and are only relayed
+// from the current sharer.
+type roomShare struct {
+	mu     sync.Mutex
+	sharer string // "" when nobody is sharing
+}
+
+// Sharer returns who is sharing their screen in the room, or "".
+func (r *Room) Sharer() string {
+	r.share.mu.Lock()
+	defer r.share.mu.Unlock()
+	return r.share.sharer
+}
+
+// handleShareCommand applies a START_SHARE or STOP_SHARE command from c,
+// reporting whether cmd was one of them. A share is granted when nobody else
+// is sharing; the host, co-hosts and moderators may take over a running share or stop
+// someone else's (STOP_SHARE with their name as value).
+func (r *Room) handleShareCommand(c *Client, cmd *pb.Command) bool {
+	switch cmd.Type {
+	case "START_SHARE":
+		r.share.mu.Lock()
+		previous := r.share.sharer
+		if previous != "" && previous != c.id && !r.canControl(c) {
+			r.share.mu.Unlock()
+			reply(c, r, &pb.Command{Type: "SHARE_DENIED", Value: previous + " is already sharing their screen"})
+			return true
+		}
+		r.share.sharer = c.id
+		r.share.mu.Unlock()
+		if previous != "" && previous != c.id {
+			r.announceShare("SHARE_STOPPED", previous)
+		}
+		if previous != c.id {
+			r.announceShare("SHARE_STARTED", c.id)
+		}
+	case "STOP_SHARE":
+		target := cmd.Value
+		if target == "" {
+			target = c.id
+		}
+		if target != c.id && !r.canControl(c) {
+			reply(c, r, &pb.Command{Type: "SHARE_DENIED", Value: "only the host, a co-host or a moderator can stop someone else's share"})
+			return true
+		}
+		r.endShare(target)
+	default:
+		return false
+	}
+	return true
+}
+
+// endShare stops name's share, if they are the one sharing.
+func (r *Room) endShare(name string) {
+	r.share.mu.Lock()
+	sharing := r.share.sharer == name
+	if sharing {
+		r.share.sharer = ""
+	}
+	r.share.mu.Unlock()
+	if sharing {
+		r.announceShare("SHARE_STOPPED", name)
+	}
+}
+
+func (r *Room) announceShare(event, name string) {
+	log.Printf("Room '%s': %s %s", r.id, event, name)
+	r.Broadcast(serverCommand(r.id, serverSender, &pb.Command{Type: event, Value: name}), "")
+}
+
+// acceptsFrame reports whether a video frame from c may be relayed: camera
+// video always, screen frames only from the current sharer.
+func (r *Room) acceptsFrame(c *Client, frame *pb.VideoFrame) bool {
+	return frame.Source != pb.VideoSource_VIDEO_SCREEN || r.Sharer() == c.id
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	pb "conference-server/conference"
+)
+
+// --- Message signing ---
+
+// Clients that sign their text send an ECDSA P-256 public key in the Hello.
+// The key is pinned to the name for as long as anyone uses it, in any room:
+// joining with the same name and another key is refused, unless the joiner
+// is logged in to the name's account, in which case its key replaces the
+// pin. Signed messages whose signature doesn't match the sender's key are
+// refused with SIGNATURE_DENIED; unsigned ones still go through, for clients
+// that don't sign. Each room is sent the key of whoever joins it, and
+// joiners the keys of those present, so clients can check signatures
+// without trusting the server's word on who sent what.
+
+const (
+	maxSigningKeyBytes = 256
+	maxSignatureBytes  = 128 // a DER P-256 signature takes at most 72
+)
+
+var signedTextPrefix = []byte("conference signed text v1")
+
+type signerPins struct {
+	mu   sync.Mutex
+	pins map[string]*signerPin
+}
+
+type signerPin struct {
+	key     []byte
+	holders map[*Client]bool
+}
+
+func newSignerPins() *signerPins {
+	return &signerPins{pins: make(map[string]*signerPin)}
+}
+
+// pin ties c's signing key to its name, failing if someone else holds the
+// name with a different key and c can't prove it owns the name.
+func (p *signerPins) pin(c *Client) error {
+	if c.signingKey == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pin, ok := p.pins[c.id]
+	switch {
+	case !ok:
+		p.pins[c.id] = &signerPin{key: c.signingKey, holders: map[*Client]bool{c: true}}
+	case bytes.Equal(pin.key, c.signingKey):
+		pin.holders[c] = true
+	case c.registered.Load():
+		// The owner's guests are being displaced; a second device of its
+		// own keeps verifying against the key it joined with
+		p.pins[c.id] = &signerPin{key: c.signingKey, holders: map[*Client]bool{c: true}}
+	default:
+		return fmt.Errorf("the name '%s' is in use with another signing key", c.id)
+	}
+	return nil
+}
+
+// unpin lets go of c's hold on its name's key; the pin goes with the last
+// holder.
+func (p *signerPins) unpin(c *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pin, ok := p.pins[c.id]
+	if !ok || !pin.holders[c] {
+		return
+	}
+	delete(pin.holders, c)
+	if len(pin.holders) == 0 {
+		delete(p.pins, c.id)
+	}
+}
+
+func (p *signerPins) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pins)
+}
+
+// parseSigningKey decodes a public key sent in a Hello.
+func parseSigningKey(der []byte) (*ecdsa.PublicKey, error) {
+	if len(der) > maxSigningKeyBytes {
+		return nil, fmt.Errorf("signing keys can't be longer than %d bytes", maxSigningKeyBytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("malformed signing key: %v", err)
+	}
+	pub, ok := key.(*ecdsa.PublicKey)
+	if !ok || pub.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("signing keys must be ECDSA P-256")
+	}
+	return pub, nil
+}
+
+// signedBytes returns what the sender of chat signs, as conference.proto
+// lays it out.
+func signedBytes(chat *pb.ChatMessage) []byte {
+	body := []byte(chat.Content)
+	if chat.Encrypted != nil {
+		body = chat.Encrypted.Ciphertext
+	}
+	buf := append([]byte(nil), signedTextPrefix...)
+	for _, field := range [][]byte{[]byte(chat.RoomId), []byte(chat.Sender), []byte(chat.TraceId), body} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(field)))
+		buf = append(buf, field...)
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(chat.Timestamp))
+	return binary.BigEndian.AppendUint32(buf, uint32(chat.TtlSeconds))
+}
+
+// checkSignature reports why a signed message from c can't be relayed in
+// r, if it can't.
+func checkSignature(c *Client, r *Room, chat *pb.ChatMessage) string {
+	switch {
+	case len(chat.Signature) == 0:
+		return ""
+	case c.signingPub == nil:
+		return "send your signing key in the Hello before signing messages"
+	case len(chat.Signature) > maxSignatureBytes:
+		return "malformed signature"
+	case chat.Sender != c.id || chat.RoomId != r.id:
+		return "signed messages must name their sender and room"
+	}
+	digest := sha256.Sum256(signedBytes(chat))
+	if !ecdsa.VerifyASN1(c.signingPub, digest[:], chat.Signature) {
+		return "the signature doesn't match your signing key"
+	}
+	return ""
+}
+
+func signingKeyMessage(roomID string, c *Client) *pb.ConferenceData {
+	key := &pb.SigningKey{Owner: c.id, PublicKey: c.signingKey}
+	return seal(&pb.ConferenceData{Payload: &pb.ConferenceData_SigningKey{SigningKey: key}}, roomID, serverSender)
+}
+
+// announceSigningKey tells the room c's key, if it has one.
+func (r *Room) announceSigningKey(c *Client) {
+	if c.signingKey != nil {
+		r.Broadcast(signingKeyMessage(r.id, c), c.addr)
+	}
+}
+
+// sendSigningKeys sends c the keys of everyone in the room who signs, its
+// own included.
+func (r *Room) sendSigningKeys(c *Client) {
+	for _, m := range r.members() {
+		if m.signingKey != nil {
+			c.Send(signingKeyMessage(r.id, m))
+		}
+	}
+}
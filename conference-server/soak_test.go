@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	pb "conference-server/conference"
+)
+
+// --- Soak test ---
+
+// TestSoak runs the server against itself for a while, over a loopback
+// listener: synthetic clients join and leave rooms, chat, send audio and
+// start 1:1 and room-wide file transfers, and streams and whole connections
+// are dropped at random, many of them mid-transfer. When time is up everyone
+// goes away and the server must wind down on its own: no transfer left in
+// activeTransfers or waiting for an answer, no room with members, and no
+// more goroutines than before the first client came. What is left over after
+// soakSettle is logged, goroutines grouped by stack, and the test fails.
+//
+// It takes minutes, so it only runs when CONFERENCE_SOAK says for how long;
+// CONFERENCE_SOAK_CLIENTS sets the number of clients (20) and
+// CONFERENCE_SOAK_SEED replays the same sequence of choices, though
+// scheduling still varies between runs:
+//
+//	CONFERENCE_SOAK=1m CONFERENCE_SOAK_CLIENTS=50 go test -run TestSoak -v
+
+const (
+	soakTransferTTL = 2 * time.Second // instead of -transfer-ttl, so interrupted transfers are reaped during the run
+	soakChunk       = 16 * 1024
+	soakMaxChunks   = 64
+)
+
+// soakSettle is how long the server gets to wind down: long enough for idle
+// media relays to stop and for stale transfers to be reaped.
+var soakSettle = relayIdleTimeout + 2*soakTransferTTL + 5*time.Second
+
+type soakCounts struct {
+	joins, joinsRefused, leaves, droppedStreams, droppedConns atomic.Int64
+	messages, audio                                           atomic.Int64
+	p2pRequested, p2pAccepted, p2pFinished, p2pCut            atomic.Int64
+	announced, broadcastStreamed, broadcastReceivers          atomic.Int64
+}
+
+type soakRun struct {
+	addr   string
+	rooms  int
+	counts soakCounts
+	wg     sync.WaitGroup // transfers started from receive loops
+
+	mu      sync.Mutex
+	members map[string]map[*soakClient]bool // by room, for picking transfer partners
+}
+
+type soakClient struct {
+	name, room string
+	token      string // from the SESSION command, for unary calls
+	conn       *grpc.ClientConn
+	stream     pb.ConferenceService_JoinConferenceClient
+	cancel     context.CancelFunc
+	gone       chan struct{} // closed when the receive loop ends
+	rng        *rand.Rand    // the receive loop's own
+}
+
+func TestSoak(t *testing.T) {
+	d, _ := time.ParseDuration(os.Getenv("CONFERENCE_SOAK"))
+	if d <= 0 || testing.Short() {
+		t.Skip("set CONFERENCE_SOAK to how long to run, e.g. 1m")
+	}
+	n, seed := 20, time.Now().UnixNano()
+	if v, err := strconv.Atoi(os.Getenv("CONFERENCE_SOAK_CLIENTS")); err == nil && v > 0 {
+		n = v
+	}
+	if v, err := strconv.ParseInt(os.Getenv("CONFERENCE_SOAK_SEED"), 10, 64); err == nil && v != 0 {
+		seed = v
+	}
+	t.Logf("Soak: %d clients, %v, seed %d", n, d, seed)
+	log.SetOutput(io.Discard) // the server logs every broadcast
+	defer log.SetOutput(os.Stderr)
+	defer func(ttl time.Duration) { transferTTL = ttl }(transferTTL)
+	transferTTL = soakTransferTTL
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := &soakRun{addr: lis.Addr().String(), rooms: max(n/5, 1), members: make(map[string]map[*soakClient]bool)}
+	srv := newServer()
+	gs := grpc.NewServer(srv.serverOptions()...)
+	pb.RegisterConferenceServiceServer(gs, srv)
+	go gs.Serve(lis)
+	defer gs.Stop()
+	go srv.reapTransfers(transferTTL / 4)
+	time.Sleep(100 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+
+	deadline := time.Now().Add(d)
+	var workers sync.WaitGroup
+	for i := 0; i < n; i++ {
+		workers.Add(1)
+		go func(i int) {
+			defer workers.Done()
+			run.churn(i, rand.New(rand.NewSource(seed+int64(i))), deadline)
+		}(i)
+	}
+	workers.Wait()
+	run.wg.Wait()
+
+	c := &run.counts
+	t.Logf("Joins %d (%d refused), left %d, dropped %d streams and %d connections",
+		c.joins.Load(), c.joinsRefused.Load(), c.leaves.Load(), c.droppedStreams.Load(), c.droppedConns.Load())
+	t.Logf("Messages %d, audio chunks %d", c.messages.Load(), c.audio.Load())
+	t.Logf("1:1 transfers %d requested, %d accepted, %d finished, %d cut short",
+		c.p2pRequested.Load(), c.p2pAccepted.Load(), c.p2pFinished.Load(), c.p2pCut.Load())
+	t.Logf("Room-wide transfers %d announced, %d streamed, %d receivers",
+		c.announced.Load(), c.broadcastStreamed.Load(), c.broadcastReceivers.Load())
+
+	start := time.Now()
+	for {
+		left := soakLeftovers(srv, baseline)
+		if len(left) == 0 {
+			t.Logf("Settled in %v", time.Since(start).Round(time.Millisecond))
+			return
+		}
+		if time.Since(start) > soakSettle {
+			if runtime.NumGoroutine() > baseline {
+				var stacks strings.Builder
+				pprof.Lookup("goroutine").WriteTo(&stacks, 1)
+				t.Log(stacks.String())
+			}
+			t.Fatalf("still there after %v:\n  %s", soakSettle, strings.Join(left, "\n  "))
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// soakLeftovers describes what the server still holds that it shouldn't.
+func soakLeftovers(s *server, baseline int) []string {
+	var left []string
+	s.activeTransfers.Range(func(key, val interface{}) bool {
+		left = append(left, fmt.Sprintf("transfer '%s' (%T)", key, val))
+		return true
+	})
+	s.transferMu.Lock()
+	for id := range s.transferResponses {
+		left = append(left, fmt.Sprintf("transfer request '%s' waiting for an answer", id))
+	}
+	s.transferMu.Unlock()
+	s.rooms.Range(func(r *Room) bool {
+		r.clients.Range(func(_, v interface{}) bool {
+			left = append(left, fmt.Sprintf("'%s' in room '%s'", v.(*Client).id, r.id))
+			return true
+		})
+		return true
+	})
+	if n := runtime.NumGoroutine(); n > baseline {
+		left = append(left, fmt.Sprintf("%d goroutines, %d before the first client", n, baseline))
+	}
+	sort.Strings(left)
+	return left
+}
+
+// churn is one synthetic user: it joins a random room under a fresh name
+// (a dropped name stays reserved), does random things in it until it leaves
+// one way or another, and starts over until deadline.
+func (run *soakRun) churn(i int, rng *rand.Rand, deadline time.Time) {
+	var c *soakClient
+	defer func() {
+		if c != nil {
+			run.leave(c, rng.Intn(2) == 0)
+		}
+	}()
+	for gen := 0; time.Now().Before(deadline); gen++ {
+		time.Sleep(time.Duration(rng.Intn(50)) * time.Millisecond)
+		if c == nil {
+			var err error
+			c, err = run.join(fmt.Sprintf("soak-%d-%d", i, gen), fmt.Sprintf("soak-%d", rng.Intn(run.rooms)), rng.Int63())
+			if err != nil {
+				run.counts.joinsRefused.Add(1)
+			}
+			continue
+		}
+		switch p := rng.Intn(100); {
+		case p < 35:
+			run.say(c)
+		case p < 50:
+			run.sendAudio(c)
+		case p < 62:
+			if to := run.partner(c, rng); to != nil {
+				run.p2p(c, to, rng)
+			}
+		case p < 70:
+			run.announce(c, rng)
+		case p < 80:
+			run.leave(c, true)
+			c = nil
+		case p < 95:
+			run.leave(c, false)
+			c = nil
+		default:
+			c.conn.Close() // the stream and any transfers on the connection go with it
+			run.forget(c)
+			run.counts.droppedConns.Add(1)
+			c = nil
+		}
+	}
+}
+
+func (run *soakRun) dial() (*grpc.ClientConn, error) {
+	return grpc.NewClient(run.addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
+
+// join connects name to room over a connection of its own and waits for its
+// session token, which comes right after the WELCOME.
+func (run *soakRun) join(name, room string, seed int64) (*soakClient, error) {
+	conn, err := run.dial()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &soakClient{name: name, room: room, conn: conn, cancel: cancel, gone: make(chan struct{}), rng: rand.New(rand.NewSource(seed))}
+	c.stream, err = pb.NewConferenceServiceClient(conn).JoinConference(ctx)
+	if err == nil {
+		err = c.stream.Send(&pb.ConferenceData{RoomId: room, Sender: name,
+			Payload: &pb.ConferenceData_Command{Command: &pb.Command{Type: "JOIN"}}})
+	}
+	for err == nil {
+		var msg *pb.ConferenceData
+		if msg, err = c.stream.Recv(); err == nil && msg.GetCommand().GetType() == "SESSION" {
+			c.token = msg.GetCommand().GetValue()
+			break
+		}
+	}
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, err
+	}
+	run.counts.joins.Add(1)
+	run.mu.Lock()
+	if run.members[room] == nil {
+		run.members[room] = make(map[*soakClient]bool)
+	}
+	run.members[room][c] = true
+	run.mu.Unlock()
+	go run.receive(c)
+	return c, nil
+}
+
+// leave goes away cleanly (CloseSend) or by dropping the stream.
+func (run *soakRun) leave(c *soakClient, clean bool) {
+	run.forget(c)
+	if clean {
+		c.stream.CloseSend()
+		select {
+		case <-c.gone:
+		case <-time.After(5 * time.Second):
+		}
+		run.counts.leaves.Add(1)
+	} else {
+		run.counts.droppedStreams.Add(1)
+	}
+	c.cancel()
+	c.conn.Close()
+}
+
+func (run *soakRun) forget(c *soakClient) {
+	run.mu.Lock()
+	delete(run.members[c.room], c)
+	run.mu.Unlock()
+}
+
+// partner picks someone else in c's room, if there is anyone.
+func (run *soakRun) partner(c *soakClient, rng *rand.Rand) *soakClient {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	var others []*soakClient
+	for o := range run.members[c.room] {
+		if o != c {
+			others = append(others, o)
+		}
+	}
+	if len(others) == 0 {
+		return nil
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].name < others[j].name }) // map order isn't seeded
+	return others[rng.Intn(len(others))]
+}
+
+// receive reads c's stream until it ends, answering 1:1 requests for c and
+// downloading some of the room-wide transfers announced to it.
+func (run *soakRun) receive(c *soakClient) {
+	defer close(c.gone)
+	for {
+		msg, err := c.stream.Recv()
+		if err != nil {
+			return
+		}
+		switch p := msg.Payload.(type) {
+		case *pb.ConferenceData_TextMessage:
+			if id, ok := soakRequestFor(p.TextMessage.Content, c.name); ok {
+				accept := c.rng.Intn(5) > 0
+				run.wg.Add(1)
+				go func() {
+					defer run.wg.Done()
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					pb.NewConferenceServiceClient(c.conn).RespondFileTransfer(metadata.AppendToOutgoingContext(ctx, "session-token", c.token), &pb.FileTransferResponse{TransferId: id, Accepted: accept, Sender: c.name})
+				}()
+			}
+		case *pb.ConferenceData_FileAnnouncement:
+			if c.rng.Intn(2) == 0 {
+				cut := c.rng.Intn(2 * soakMaxChunks) // past the end half the time
+				run.wg.Add(1)
+				go func() {
+					defer run.wg.Done()
+					run.download(c, p.FileAnnouncement.TransferId, cut)
+					run.counts.broadcastReceivers.Add(1)
+				}()
+			}
+		}
+	}
+}
+
+// soakRequestFor returns the transfer ID of a FILE_REQUEST notice
+// addressed to name; the recipient is its ninth field.
+func soakRequestFor(content, name string) (string, bool) {
+	rest, ok := strings.CutPrefix(content, "FILE_REQUEST:")
+	fields := strings.Split(rest, ":")
+	if !ok || len(fields) < 9 || fields[8] != name {
+		return "", false
+	}
+	return fields[0], true
+}
+
+func (run *soakRun) say(c *soakClient) {
+	if c.stream.Send(&pb.ConferenceData{RoomId: c.room, Sender: c.name, Payload: &pb.ConferenceData_TextMessage{
+		TextMessage: &pb.ChatMessage{Sender: c.name, RoomId: c.room, Content: "soak", Timestamp: time.Now().Unix()}}}) == nil {
+		run.counts.messages.Add(1)
+	}
+}
+
+func (run *soakRun) sendAudio(c *soakClient) {
+	if c.stream.Send(&pb.ConferenceData{RoomId: c.room, Sender: c.name, Payload: &pb.ConferenceData_AudioChunk{
+		AudioChunk: &pb.AudioChunk{Data: make([]byte, 640), SampleRate: 16000, Channels: 1}}}) == nil {
+		run.counts.audio.Add(1)
+	}
+}
+
+// p2p sends a file from c to to, both ends over their own connections, and
+// often cuts it short: the sender or the receiver drops its stream, or the
+// sender stops without a last chunk.
+func (run *soakRun) p2p(c, to *soakClient, rng *rand.Rand) {
+	run.counts.p2pRequested.Add(1)
+	id := newSessionToken()
+	chunks := 1 + rng.Intn(soakMaxChunks)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := pb.NewConferenceServiceClient(c.conn).RequestFileTransfer(metadata.AppendToOutgoingContext(ctx, "session-token", c.token), &pb.FileTransferRequest{
+		TransferId: id, Sender: c.name, Recipient: to.name, RoomId: c.room,
+		Filename: "soak.bin", FileSize: int64(chunks * soakChunk), Timestamp: time.Now().Unix(),
+	})
+	if err != nil || !resp.Accepted {
+		return
+	}
+	run.counts.p2pAccepted.Add(1)
+
+	senderCut, receiverCut, early := chunks, chunks, false
+	switch rng.Intn(4) {
+	case 0:
+		senderCut = rng.Intn(chunks)
+	case 1:
+		receiverCut = rng.Intn(chunks)
+	case 2:
+		senderCut, early = rng.Intn(chunks), true
+	}
+	got := make(chan bool, 1)
+	go func() { got <- run.download(to, id, receiverCut) }()
+	run.upload(ctx, c, id, chunks, senderCut, early)
+	if <-got {
+		run.counts.p2pFinished.Add(1)
+	} else {
+		run.counts.p2pCut.Add(1)
+	}
+}
+
+// announce offers a file to c's room and streams it. Only a room's host
+// may, so most announcements are turned away.
+func (run *soakRun) announce(c *soakClient, rng *rand.Rand) {
+	id := newSessionToken()
+	chunks := 1 + rng.Intn(soakMaxChunks)
+	if c.stream.Send(&pb.ConferenceData{RoomId: c.room, Sender: c.name, Payload: &pb.ConferenceData_FileAnnouncement{
+		FileAnnouncement: &pb.BroadcastFileAnnouncement{TransferId: id, Filename: "soak.bin", FileSize: int64(chunks * soakChunk)}}}) != nil {
+		return
+	}
+	run.counts.announced.Add(1)
+	time.Sleep(50 * time.Millisecond) // for receivers to connect
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cut := chunks
+	if rng.Intn(2) == 0 {
+		cut = rng.Intn(chunks)
+	}
+	if run.upload(ctx, c, id, chunks, cut, false) {
+		run.counts.broadcastStreamed.Add(1)
+	}
+}
+
+// upload sends chunks as c, the sender of transfer id, stopping after cut
+// of them: by dropping the stream, or with early by closing it properly but
+// without a last chunk. It reports whether every chunk went out.
+func (run *soakRun) upload(ctx context.Context, c *soakClient, id string, chunks, cut int, early bool) bool {
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(ctx, "transfer-id", id, "role", "sender", "session-token", c.token))
+	defer cancel()
+	stream, err := pb.NewConferenceServiceClient(c.conn).TransferFile(ctx)
+	if err != nil {
+		return false
+	}
+	data := make([]byte, soakChunk)
+	for n := 0; n < chunks; n++ {
+		if n == cut {
+			if early {
+				stream.CloseSend()
+				stream.Recv()
+			}
+			return false
+		}
+		chunk := &pb.FileChunk{TransferId: id, Data: data, ChunkNumber: int32(n), Offset: int64(n * soakChunk), IsLast: n == chunks-1}
+		if stream.Send(chunk) != nil {
+			return false
+		}
+	}
+	// Give the relay a moment with the last chunk before hanging up;
+	// the server ends the stream itself once the relay is done
+	stream.CloseSend()
+	done := make(chan struct{})
+	go func() {
+		for {
+			if _, err := stream.Recv(); err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+	}
+	return true
+}
+
+// download receives transfer id as c until the last chunk, dropping the
+// stream after cut chunks if that comes first, and reports whether it got
+// the last.
+func (run *soakRun) download(c *soakClient, id string, cut int) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := pb.NewConferenceServiceClient(c.conn).TransferFile(metadata.AppendToOutgoingContext(ctx, "transfer-id", id, "role", "receiver", "session-token", c.token))
+	if err != nil {
+		return false
+	}
+	for n := 0; n < cut; {
+		chunk, err := stream.Recv()
+		if err != nil {
+			return false
+		}
+		if len(chunk.Data) == 0 {
+			continue // an ack
+		}
+		if chunk.IsLast {
+			return true
+		}
+		n++
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "conference-server/conference"
+)
+
+// --- Repeated message filter ---
+
+// Pasting the same line over and over floods a room without tripping any
+// transfer limit. The server lets through spamRepeats identical text
+// messages from one sender within spamWindow and holds back the rest,
+// telling the sender with SPAM_BLOCKED; held-back copies count too, so
+// spamming on keeps them held back. The host, co-hosts and moderators
+// can change this for their room with a SPAM_FILTER command: "5/1m",
+// "off", or empty for the server's setting, which is kept with the room's
+// settings (see settings.go). Moderators are never filtered.
+// Set with -spam-repeats (0 disables) and -spam-window.
+var (
+	spamRepeats = 3
+	spamWindow  = 30 * time.Second
+)
+
+// spamMemory caps how many recent messages are kept per sender.
+const spamMemory = 64
+
+type spamEntry struct {
+	text string
+	at   time.Time
+}
+
+type roomSpam struct {
+	mu      sync.Mutex
+	own     bool // the room has its own setting
+	repeats int  // 0 disables the filter
+	window  time.Duration
+	recent  map[string][]spamEntry // map[senderID]messages within the window, oldest first
+}
+
+// limits returns the room's setting, or the server's. f.mu must be held.
+func (f *roomSpam) limits() (int, time.Duration) {
+	if f.own {
+		return f.repeats, f.window
+	}
+	return spamRepeats, spamWindow
+}
+
+// recordText remembers text from sender and reports whether it is one copy
+// too many, with the setting it was judged by.
+func (r *Room) recordText(sender, text string, now time.Time) (spam bool, repeats int, window time.Duration) {
+	f := &r.spam
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	repeats, window = f.limits()
+	if repeats == 0 {
+		f.recent = nil
+		return false, 0, 0
+	}
+	// Forget everyone's messages that have left the window, so senders who
+	// went quiet don't linger
+	for name, entries := range f.recent {
+		i := 0
+		for i < len(entries) && now.Sub(entries[i].at) >= window {
+			i++
+		}
+		if i == len(entries) {
+			delete(f.recent, name)
+		} else {
+			f.recent[name] = entries[i:]
+		}
+	}
+	if f.recent == nil {
+		f.recent = make(map[string][]spamEntry)
+	}
+	text = strings.TrimSpace(text)
+	entries := f.recent[sender]
+	same := 0
+	for _, e := range entries {
+		if e.text == text {
+			same++
+		}
+	}
+	if len(entries) == spamMemory {
+		entries = entries[1:]
+	}
+	f.recent[sender] = append(entries, spamEntry{text: text, at: now})
+	return same >= repeats, repeats, window
+}
+
+// rejectSpam holds back a text message from c that repeats itself too often
+// and tells c why.
+func (s *server) rejectSpam(room *Room, c *Client, text string) bool {
+	if c.moderator {
+		return false
+	}
+	spam, repeats, window := room.recordText(c.id, text, time.Now())
+	if !spam {
+		return false
+	}
+	s.spamBlocked.Add(1)
+	log.Printf("Held back a repeated message from '%s' in room '%s'", c.id, room.id)
+	reply(c, room, &pb.Command{Type: "SPAM_BLOCKED", Value: fmt.Sprintf("message not sent: you already sent it %d times in the last %v", repeats, window)})
+	return true
+}
+
+// handleSpamCommand applies a SPAM_FILTER command from c, reporting whether
+// cmd was one. The new setting is announced to the room with
+// SPAM_FILTER_CHANGED ("3/30s" or "off").
+func (r *Room) handleSpamCommand(c *Client, cmd *pb.Command) bool {
+	if cmd.Type != "SPAM_FILTER" {
+		return false
+	}
+	if !r.canControl(c) {
+		reply(c, r, &pb.Command{Type: "SPAM_FILTER_DENIED", Value: "only the host, a co-host or a moderator can change the spam filter"})
+		return true
+	}
+	own, repeats, window, err := parseSpamSetting(cmd.Value)
+	if err != nil {
+		reply(c, r, &pb.Command{Type: "SPAM_FILTER_DENIED", Value: err.Error()})
+		return true
+	}
+	r.spam.mu.Lock()
+	r.spam.own, r.spam.repeats, r.spam.window = own, repeats, window
+	r.spam.recent = nil
+	setting := spamSetting(r.spam.limits())
+	r.spam.mu.Unlock()
+	r.updateSettings(func(rec *pb.RoomSettings) {
+		rec.SpamFilter = ""
+		if own {
+			rec.SpamFilter = spamSetting(repeats, window)
+		}
+	})
+
+	log.Printf("'%s' set the spam filter of room '%s' to %s", c.id, r.id, setting)
+	r.Broadcast(serverCommand(r.id, c.id, &pb.Command{Type: "SPAM_FILTER_CHANGED", Value: setting}), "")
+	return true
+}
+
+// parseSpamSetting reads a SPAM_FILTER value; own is false for "", which
+// goes back to the server's setting.
+func parseSpamSetting(value string) (own bool, repeats int, window time.Duration, err error) {
+	switch value = strings.TrimSpace(value); value {
+	case "":
+		return false, 0, 0, nil
+	case "off":
+		return true, 0, 0, nil
+	}
+	n, d, ok := strings.Cut(value, "/")
+	if ok {
+		repeats, err = strconv.Atoi(n)
+		if err == nil {
+			window, err = time.ParseDuration(d)
+		}
+	}
+	if !ok || err != nil || repeats < 1 || window <= 0 {
+		return false, 0, 0, fmt.Errorf("expected repeats/window, e.g. 3/30s, or off")
+	}
+	return true, repeats, window, nil
+}
+
+func spamSetting(repeats int, window time.Duration) string {
+	if repeats == 0 {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%v", repeats, window)
+}
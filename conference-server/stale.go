@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	pb "conference-server/conference"
+)
+
+// --- Stale transfer reaping ---
+
+// transferTTL is how long a transfer may wait for its streams before it is
+// dropped: an accepted 1:1 transfer for both ends to meet, a room-wide one
+// for its sender to start streaming. Set with -transfer-ttl.
+var transferTTL = 2 * time.Minute
+
+// waitingSince reports whether the current leg's relay hasn't started yet
+// and since when it has been waiting: since the transfer was accepted, or
+// since it was interrupted.
+func (t *p2pTransfer) waitingSince() (time.Time, bool) {
+	t.mu.Lock()
+	leg := t.leg
+	t.mu.Unlock()
+	select {
+	case <-leg.started:
+		return time.Time{}, false
+	default:
+		return leg.since, true
+	}
+}
+
+// waiting reports whether the announcer hasn't started streaming yet.
+func (t *broadcastTransfer) waiting() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sender == nil
+}
+
+// reapTransfers expires stale transfers, and forgets idle pacers, every
+// tick, for the life of the process.
+func (s *server) reapTransfers(every time.Duration) {
+	for now := range time.Tick(every) {
+		func() {
+			defer recoverPanic("transfer reaper", nil)
+			s.expireStaleTransfers(now)
+			s.prunePacers(now)
+		}()
+	}
+}
+
+// expireStaleTransfers aborts the transfers that have waited longer than
+// transferTTL and tells the users involved with a TRANSFER_EXPIRED command:
+// both ends of a 1:1 transfer, or the whole room for a room-wide one, since
+// everyone there got the announcement.
+func (s *server) expireStaleTransfers(now time.Time) {
+	s.activeTransfers.Range(func(key, val interface{}) bool {
+		id := key.(string)
+		switch tx := val.(type) {
+		case *p2pTransfer:
+			if since, waiting := tx.waitingSince(); !waiting || now.Sub(since) < transferTTL {
+				return true
+			}
+			s.expireTransfer(id, tx)
+			if room, ok := s.rooms.Load(tx.room); ok {
+				cmd := &pb.Command{Type: "TRANSFER_EXPIRED", Value: id}
+				for _, name := range []string{tx.from, tx.to} {
+					if c, ok := room.users.Load(name); ok {
+						reply(c.(*Client), room, cmd)
+					}
+				}
+			}
+		case *broadcastTransfer:
+			if now.Sub(tx.created) < transferTTL || !tx.waiting() {
+				return true
+			}
+			s.expireTransfer(id, tx)
+			if room, ok := s.rooms.Load(tx.room); ok {
+				room.Broadcast(serverCommand(room.id, serverSender, &pb.Command{Type: "TRANSFER_EXPIRED", Value: id}), "")
+			}
+		}
+		return true
+	})
+}
+
+func (s *server) expireTransfer(id string, tx transfer) {
+	s.expiredTransfers.Add(1)
+	s.abortTransfer(id, tx, "it expired before it started")
+	log.Printf("Transfer '%s' expired after waiting %s", id, transferTTL)
+}
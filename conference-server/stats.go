@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "conference-server/conference"
+)
+
+// --- Audio statistics ---
+
+// audioStats tracks one client's audio: what it sent (with loss and latency
+// derived from the chunks' seq and capture time) and what was delivered to it.
+type audioStats struct {
+	mu           sync.Mutex
+	sent         uint64
+	received     uint64
+	lost         uint64
+	dropped      uint64
+	lastSeq      uint32
+	latencySumMs float64
+	latencyCount uint64
+}
+
+// recordSent accounts for a chunk received from the client. Chunks from
+// clients that don't number them (seq 0) only count towards sent.
+func (st *audioStats) recordSent(chunk *pb.AudioChunk, now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.sent++
+	if chunk.Seq != 0 {
+		if st.lastSeq != 0 && chunk.Seq > st.lastSeq+1 {
+			st.lost += uint64(chunk.Seq - st.lastSeq - 1)
+		}
+		if chunk.Seq > st.lastSeq || chunk.Seq == 1 { // 1 = the client restarted its mic
+			st.lastSeq = chunk.Seq
+		}
+	}
+	if chunk.CaptureTimeMs > 0 {
+		if latency := float64(now.UnixMilli() - chunk.CaptureTimeMs); latency >= 0 {
+			st.latencySumMs += latency
+			st.latencyCount++
+		}
+	}
+}
+
+func (st *audioStats) recordReceived() {
+	st.mu.Lock()
+	st.received++
+	st.mu.Unlock()
+}
+
+func (st *audioStats) recordDropped() {
+	st.mu.Lock()
+	st.dropped++
+	st.mu.Unlock()
+}
+
+func (st *audioStats) snapshot(username string) *pb.ClientAudioStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s := &pb.ClientAudioStats{
+		Username:        username,
+		PacketsSent:     st.sent,
+		PacketsReceived: st.received,
+		PacketsLost:     st.lost,
+		PacketsDropped:  st.dropped,
+	}
+	if st.latencyCount > 0 {
+		s.AvgLatencyMs = st.latencySumMs / float64(st.latencyCount)
+	}
+	return s
+}
+
+// GetAudioStats answers members of the room, who already see who is in it,
+// and the admin; anyone else would learn who is in a room they can't enter.
+func (s *server) GetAudioStats(ctx context.Context, req *pb.AudioStatsRequest) (*pb.AudioStatsResponse, error) {
+	if req.RoomId == "" {
+		return nil, status.Error(codes.InvalidArgument, "room_id must be provided")
+	}
+	room, ok := s.rooms.Load(req.RoomId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "room '%s' not found", req.RoomId)
+	}
+	if s.adminToken == "" || s.requireAdmin(ctx) != nil {
+		if _, _, err := s.sessionMember(ctx, req.RoomId); err != nil {
+			return nil, err
+		}
+	}
+	resp := &pb.AudioStatsResponse{}
+	for _, c := range room.members() {
+		if req.Username == "" || req.Username == c.id {
+			resp.Clients = append(resp.Clients, c.stats.snapshot(c.id))
+		}
+	}
+	if req.Username != "" && len(resp.Clients) == 0 {
+		return nil, status.Errorf(codes.NotFound, "user '%s' not in room '%s'", req.Username, req.RoomId)
+	}
+	return resp, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// --- Usernames ---
+
+// Every name that comes in, through JoinConference, Register or the WebRTC
+// bridge, goes through checkUsername, and names are told apart by what they
+// look like, not by their bytes. A name must be in canonical form: NFC,
+// without spaces at either end or two in a row (clients fix this up before
+// sending, see canonicalUsername). It may have letters, digits, spaces and
+// "-_.'", must start with a letter or digit, and can't mix Latin, Greek and
+// Cyrillic letters, the usual way of faking a name. Two names whose
+// skeletons match can't be in the same room at once, nor be registered
+// both, nor can a guest use one close to a registered name: "Juan", "juan"
+// and "Juán" are one name as far as the server is concerned, and so are the
+// Latin "Pepe" and the Cyrillic "Рере". Bans and name reservations go by
+// skeleton too.
+
+const maxUsernameLen = 64 // bytes
+
+// reservedUsernames are the senders the server uses for its own messages.
+var reservedUsernames = []string{serverSender, fileRequestSender}
+
+// canonicalUsername is name as checkUsername wants it: in NFC, trimmed and
+// with runs of spaces made one.
+func canonicalUsername(name string) string {
+	return strings.Join(strings.Fields(norm.NFC.String(name)), " ")
+}
+
+// checkUsername returns an InvalidArgument error if name can't be used.
+func checkUsername(name string) error {
+	if canonical := canonicalUsername(name); canonical == "" {
+		return status.Error(codes.InvalidArgument, "the name can't be empty")
+	} else if canonical != name {
+		return status.Errorf(codes.InvalidArgument, "the name %q isn't in canonical form; use %q", name, canonical)
+	}
+	if len(name) > maxUsernameLen {
+		return status.Errorf(codes.InvalidArgument, "the name can't be longer than %d bytes", maxUsernameLen)
+	}
+	if first, _ := utf8.DecodeRuneInString(name); !unicode.IsLetter(first) && !unicode.IsDigit(first) {
+		return status.Error(codes.InvalidArgument, "the name must start with a letter or a digit")
+	}
+	var script string // of the letters seen so far, among confusableScripts
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r):
+			for s, table := range confusableScripts {
+				if !unicode.Is(table, r) {
+					continue
+				}
+				if script != "" && script != s {
+					return status.Errorf(codes.InvalidArgument, "the name mixes %s and %s letters", script, s)
+				}
+				script = s
+			}
+		case unicode.IsDigit(r), unicode.Is(unicode.Mn, r), strings.ContainsRune(" -_.'", r):
+		default:
+			return status.Errorf(codes.InvalidArgument, "the name can't have %q; only letters, digits, spaces and \"-_.'\" are allowed", r)
+		}
+	}
+	skeleton := usernameSkeleton(name)
+	for _, reserved := range reservedUsernames {
+		if skeleton == usernameSkeleton(reserved) {
+			return status.Errorf(codes.InvalidArgument, "the name '%s' is used by the server", name)
+		}
+	}
+	return nil
+}
+
+// confusableScripts are the scripts whose letters pass for each other's.
+var confusableScripts = map[string]*unicode.RangeTable{
+	"Latin":    unicode.Latin,
+	"Greek":    unicode.Greek,
+	"Cyrillic": unicode.Cyrillic,
+}
+
+// usernameSkeleton is what name looks like: compatibility forms unfolded,
+// accents dropped, lowercased, and the Greek and Cyrillic letters and the
+// digits and pairs that pass for Latin ones replaced by them. Names with the
+// same skeleton are the same name.
+func usernameSkeleton(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(name) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		r = unicode.ToLower(r)
+		if latin, ok := lookalikes[r]; ok {
+			r = latin
+		}
+		b.WriteRune(r)
+	}
+	return skeletonPairs.Replace(b.String())
+}
+
+// lookalikes maps small letters and digits to the Latin letter they, or
+// their capitals, pass for.
+var lookalikes = map[rune]rune{
+	'0': 'o', '1': 'l', 'ı': 'i',
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'ԁ': 'd', 'е': 'e', 'һ': 'h', 'н': 'h', 'і': 'i', 'ј': 'j',
+	'к': 'k', 'ӏ': 'l', 'м': 'm', 'о': 'o', 'р': 'p', 'ԛ': 'q', 'ѕ': 's', 'с': 'c',
+	'т': 't', 'у': 'y', 'ԝ': 'w', 'х': 'x',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'h', 'ι': 'i', 'κ': 'k', 'μ': 'm', 'ν': 'v',
+	'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'ϲ': 'c', 'ζ': 'z',
+}
+
+var skeletonPairs = strings.NewReplacer("rn", "m", "vv", "w")
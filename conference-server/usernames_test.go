@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUsernameSkeleton(t *testing.T) {
+	tests := []struct {
+		name, a, b string
+	}{
+		{"case", "Juan", "juan"},
+		{"accent", "Juan", "Juán"},
+		{"decomposed accent", "Juán", "Juán"},
+		{"cyrillic", "Pepe", "Рере"},
+		{"greek", "Kato", "Κατο"},
+		{"fullwidth", "Juan", "Ｊｕａｎ"},
+		{"rn for m", "Marta", "rnarta"},
+		{"vv for w", "Walter", "vvalter"},
+		{"zero for o", "Rodrigo", "R0drig0"},
+		{"one for l", "Lola", "1ola"},
+		{"dotless i", "Ivan", "ıvan"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if a, b := usernameSkeleton(tt.a), usernameSkeleton(tt.b); a != b {
+				t.Errorf("usernameSkeleton(%q) = %q, usernameSkeleton(%q) = %q; want them equal", tt.a, a, tt.b, b)
+			}
+		})
+	}
+}
+
+func TestUsernameSkeletonDistinct(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"Juan", "Juana"},
+		{"Ana", "Ann"},
+		{"Marta", "Narta"},
+		{"Rodrigo", "Rodrig"},
+		{"Pepe 1", "Pepe 2"},
+	}
+	for _, tt := range tests {
+		if usernameSkeleton(tt.a) == usernameSkeleton(tt.b) {
+			t.Errorf("%q and %q have the same skeleton %q", tt.a, tt.b, usernameSkeleton(tt.a))
+		}
+	}
+}
+
+func TestCheckUsername(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantErr string // substring of the error; "" if the name is fine
+	}{
+		{"plain", "Juan", ""},
+		{"accented", "José Pérez", ""},
+		{"punctuation", "o'higgins_2.0-b", ""},
+		{"digit first", "2pac", ""},
+		{"cyrillic only", "Рере", ""},
+		{"greek only", "Κατο", ""},
+		{"latin and digits", "Pepe 1", ""},
+		{"empty", "", "can't be empty"},
+		{"spaces only", "   ", "can't be empty"},
+		{"leading space", " Juan", "canonical form"},
+		{"double space", "Juan  Pérez", "canonical form"},
+		{"decomposed", "Juán", "canonical form"},
+		{"at the limit", strings.Repeat("a", maxUsernameLen), ""},
+		{"too long", strings.Repeat("a", maxUsernameLen+1), "longer than"},
+		{"too long in bytes", strings.Repeat("á", maxUsernameLen/2+1), "longer than"},
+		{"symbol first", "_juan", "must start with"},
+		{"latin and cyrillic", "Pеpe", "mixes"},
+		{"latin and greek", "Kαto", "mixes"},
+		{"greek and cyrillic", "Κатο", "mixes"},
+		{"emoji", "Juan 🎉", "can't have"},
+		{"at sign", "juan@host", "can't have"},
+		{"control", "juan\x00", "can't have"},
+		{"server", serverSender, "used by the server"},
+		{"server lookalike", "server", "used by the server"},
+		{"file sender lookalike", "sistema-fi1etransfer", "used by the server"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkUsername(tt.in)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("checkUsername(%q) = %v, want nil", tt.in, err)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("checkUsername(%q) = nil, want an error with %q", tt.in, tt.wantErr)
+			case err != nil && (status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("checkUsername(%q) = %v, want InvalidArgument with %q", tt.in, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "conference-server/conference"
+)
+
+// --- Payload validation ---
+
+// Everything a client sends is checked against these limits as it comes
+// in, by the validation middleware (see interceptors.go), before any handler
+// sees it. A unary call that breaks one fails with InvalidArgument; so does
+// a stream, on the first message that does, since a client that sends it is
+// broken or hostile. Clients learn the limits from GetServerInfo and can
+// stay within them. Room IDs are always made of letters, digits and "-_.",
+// so they can go in logs, file names and commands as they are. Names and
+// command types are held to maxUsernameLen and maxCommandType bytes, and
+// command values to maxTextChars, like text. Audio must say its sample rate
+// and channels, up to maxAudioSampleRate and maxAudioChannels, since they
+// size the buffers resampling it; the handlers check the rest.
+var (
+	maxTextChars       = 4000 // ChatMessage and PrivateMessage text
+	maxFilenameBytes   = 255  // what most file systems allow
+	maxRoomIDChars     = 64
+	maxAudioChunkBytes = 16 * 1024 // ~185 ms of 44.1 kHz stereo PCM16
+)
+
+const (
+	maxCommandType     = 64 // bytes
+	maxAudioSampleRate = 192000
+	maxAudioChannels   = 8
+)
+
+func invalid(format string, args ...interface{}) error {
+	return status.Errorf(codes.InvalidArgument, format, args...)
+}
+
+// checkRoomID returns an InvalidArgument error if id isn't a valid room
+// ID. Empty IDs are left to the handlers, which know whether one is needed.
+func checkRoomID(id string) error {
+	if id == "" {
+		return nil
+	}
+	if n := utf8.RuneCountInString(id); n > maxRoomIDChars {
+		return invalid("room IDs can't be longer than %d characters", maxRoomIDChars)
+	}
+	for _, r := range id {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' && r != '.' {
+			return invalid("room ID %q has %q; only letters, digits, '-', '_' and '.' are allowed", id, r)
+		}
+	}
+	return nil
+}
+
+func checkText(what, text string) error {
+	if n := utf8.RuneCountInString(text); n > maxTextChars {
+		return invalid("%s is %d characters long; the limit is %d", what, n, maxTextChars)
+	}
+	return nil
+}
+
+// checkName returns an InvalidArgument error if name, a user named in a
+// message, is too long to be one; see usernames.go for the full rules.
+func checkName(what, name string) error {
+	if len(name) > maxUsernameLen {
+		return invalid("%s can't be longer than %d bytes", what, maxUsernameLen)
+	}
+	return nil
+}
+
+func checkFilename(name string) error {
+	if len(name) > maxFilenameBytes {
+		return invalid("file names can't be longer than %d bytes", maxFilenameBytes)
+	}
+	return nil
+}
+
+// validateMessage checks a request or stream message from a client.
+func validateMessage(m interface{}) error {
+	switch m := m.(type) {
+	case *pb.ConferenceData:
+		if err := checkRoomID(m.RoomId); err != nil {
+			return err
+		}
+		if err := checkName("the sender", m.Sender); err != nil {
+			return err
+		}
+		switch p := m.Payload.(type) {
+		case *pb.ConferenceData_TextMessage:
+			if err := checkRoomID(p.TextMessage.RoomId); err != nil {
+				return err
+			}
+			return checkText("the message", p.TextMessage.Content)
+		case *pb.ConferenceData_PrivateMessage:
+			if err := checkName("the recipient", p.PrivateMessage.RecipientId); err != nil {
+				return err
+			}
+			return checkText("the private message", p.PrivateMessage.Content)
+		case *pb.ConferenceData_Command:
+			if len(p.Command.Type) > maxCommandType {
+				return invalid("command types can't be longer than %d bytes", maxCommandType)
+			}
+			return checkText("the command value", p.Command.Value)
+		case *pb.ConferenceData_AudioChunk:
+			if n := len(p.AudioChunk.Data); n > maxAudioChunkBytes {
+				return invalid("audio chunk of %d bytes; the limit is %d", n, maxAudioChunkBytes)
+			}
+			if rate := p.AudioChunk.SampleRate; rate <= 0 || rate > maxAudioSampleRate {
+				return invalid("audio sample rate of %d Hz; it must be between 1 and %d", rate, maxAudioSampleRate)
+			}
+			if n := p.AudioChunk.Channels; n <= 0 || n > maxAudioChannels {
+				return invalid("audio with %d channels; it must have between 1 and %d", n, maxAudioChannels)
+			}
+		case *pb.ConferenceData_FileAnnouncement:
+			return checkFilename(p.FileAnnouncement.Filename)
+		}
+	case *pb.FileTransferRequest:
+		if err := checkRoomID(m.RoomId); err != nil {
+			return err
+		}
+		return checkFilename(m.Filename)
+	case *pb.RoomFileUpload:
+		if info := m.GetInfo(); info != nil {
+			if err := checkRoomID(info.RoomId); err != nil {
+				return err
+			}
+			return checkFilename(info.Filename)
+		}
+	case *pb.DownloadFileRequest:
+		return checkRoomID(m.RoomId)
+	case *pb.SubscribeEventsRequest:
+		return checkRoomID(m.RoomId)
+	case *pb.CreatePollRequest:
+		return checkRoomID(m.RoomId)
+	case *pb.MergeRoomsRequest:
+		return checkRoomID(m.TargetRoomId)
+	case *pb.SplitRoomRequest:
+		return checkRoomID(m.NewRoomId)
+	}
+	return nil
+}
+
+func validateUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := validateMessage(req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func validateStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, validatingStream{ss})
+}
+
+// validatingStream checks each message as the handler receives it.
+type validatingStream struct {
+	grpc.ServerStream
+}
+
+func (s validatingStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return validateMessage(m)
+}
+
+// checkLimitFlags reports a limit set out of range on the command line.
+func checkLimitFlags() error {
+	switch {
+	case maxTextChars <= 0:
+		return fmt.Errorf("-max-text must be positive")
+	case maxFilenameBytes <= 0:
+		return fmt.Errorf("-max-filename must be positive")
+	case maxRoomIDChars <= 0:
+		return fmt.Errorf("-max-room-id must be positive")
+	case maxAudioChunkBytes <= 0 || maxAudioChunkBytes > maxMessageBytes:
+		return fmt.Errorf("-max-audio-chunk must be between 1 and %d", maxMessageBytes)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	pb "conference-server/conference"
+)
+
+// --- Video relay ---
+
+// clientVideoBuffer bounds each receiver's video queue (~0.5 s at 30 fps).
+const clientVideoBuffer = 16
+
+// RelayVideo queues an encoded frame for every member except the sender. It
+// uses the same per-room fan-out as audio, on a relay of its own so a burst
+// of large frames can't delay anyone's audio.
+func (r *Room) RelayVideo(msg *pb.ConferenceData, senderAddr string) {
+	r.notePublished(msg.GetVideoFrame())
+	r.relay(r.video, msg, senderAddr)
+}
+
+// deliverVideo queues msg for c. Unlike audio, dropping the oldest frame
+// doesn't help: later frames depend on it. So when c's queue is full the new
+// frame is dropped, and c gets nothing more from that sender until its next
+// keyframe, which the sender is asked for. Congested receivers only get the
+// frames wantsFrame picks for their quality level.
+func deliverVideo(c *Client, msg *pb.ConferenceData) {
+	frame := msg.GetVideoFrame()
+	if room := c.Room(); room != nil && !c.wantsFrame(room, frame) {
+		return
+	}
+	if frame.Keyframe {
+		c.videoNeedsKey.Delete(frame.Sender)
+	} else if _, waiting := c.videoNeedsKey.Load(frame.Sender); waiting {
+		return
+	}
+	select {
+	case c.video <- msg:
+		c.observeQueue(len(c.video), cap(c.video))
+		return
+	default:
+	}
+	if _, waiting := c.videoNeedsKey.LoadOrStore(frame.Sender, true); !waiting {
+		requestKeyframe(c, frame.Sender)
+	}
+}
+
+// requestKeyframe asks sender, via a KEYFRAME_REQUEST command naming the
+// receiver, to send a keyframe.
+func requestKeyframe(receiver *Client, sender string) {
+	room := receiver.Room()
+	if room == nil {
+		return
+	}
+	if v, ok := room.users.Load(sender); ok {
+		reply(v.(*Client), room, &pb.Command{Type: "KEYFRAME_REQUEST", Value: receiver.id})
+	}
+}
@@ -0,0 +1,345 @@
+//go:build webrtc
+
+package main
+
+import (
+	_ "embed"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/hraban/opus.v2"
+
+	pb "conference-server/conference"
+)
+
+// --- WebRTC bridge (build with -tags webrtc) ---
+
+// Browsers join a room through a plain WebRTC peer connection; the bridge
+// adds them as synthetic users, so to everyone else they look like any other
+// member. The WebRTC leg uses Opus, through libopus (cgo), which the bridge
+// decodes and encodes at 16 kHz mono; build with -tags "webrtc nolibopusfile"
+// so that opusfile, which the bridge doesn't use, isn't needed too.
+const (
+	webrtcSampleRate   = 16000
+	webrtcFrame        = 20 * time.Millisecond
+	webrtcFrameSamples = webrtcSampleRate / 50
+	webrtcMaxQueued    = 10 * webrtcFrameSamples // per speaker; older audio is dropped
+	webrtcMaxPacket    = 1275                    // bytes, the largest Opus frame
+)
+
+// opusCodec is Opus as browsers offer it: always 48 kHz stereo in the SDP,
+// whatever the rate and channels actually encoded.
+var opusCodec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}
+
+//go:embed webrtc.html
+var webrtcPage []byte
+
+// startWebRTC serves the browser page and its signaling endpoint on addr.
+func (s *server) startWebRTC(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(webrtcPage)
+	})
+	mux.HandleFunc("/offer", s.handleWebRTCOffer)
+	log.Printf("WebRTC bridge listening at %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+type webrtcOffer struct {
+	Room     string `json:"room"`
+	Name     string `json:"name"`
+	Password string `json:"password"` // for rooms that have one, see settings.go
+	SDP      string `json:"sdp"`
+}
+
+// handleWebRTCOffer takes a browser's SDP offer and answers once ICE
+// gathering is complete, so no trickle ICE endpoint is needed.
+func (s *server) handleWebRTCOffer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST an SDP offer", http.StatusMethodNotAllowed)
+		return
+	}
+	var offer webrtcOffer
+	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil || offer.Room == "" || offer.Name == "" || offer.SDP == "" {
+		http.Error(w, "room, name and sdp must be provided", http.StatusBadRequest)
+		return
+	}
+	if err := checkRoomID(offer.Room); err != nil {
+		http.Error(w, status.Convert(err).Message(), http.StatusBadRequest)
+		return
+	}
+	if err := checkUsername(offer.Name); err != nil {
+		http.Error(w, status.Convert(err).Message(), http.StatusBadRequest)
+		return
+	}
+	if reason, banned := s.bans.Check(offer.Name, hostOf(r.RemoteAddr)); banned {
+		http.Error(w, "you are banned from this server: "+reason, http.StatusForbidden)
+		return
+	}
+	// Browsers can't log in, so registered names are for the clients that can
+	if _, err := s.accounts.check(offer.Name, ""); err != nil {
+		code := http.StatusUnauthorized
+		if status.Code(err) == codes.AlreadyExists {
+			code = http.StatusConflict
+		}
+		http.Error(w, status.Convert(err).Message(), code)
+		return
+	}
+	answer, err := s.bridgeBrowser(offer, r.RemoteAddr)
+	if err != nil {
+		log.Printf("WebRTC peer '%s' (%s) failed to join room '%s': %v", offer.Name, r.RemoteAddr, offer.Room, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(answer)
+}
+
+func (s *server) bridgeBrowser(offer webrtcOffer, remoteAddr string) (*webrtc.SessionDescription, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{RTPCodecCapability: opusCodec, PayloadType: 111}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+	enc, err := opus.NewEncoder(webrtcSampleRate, 1, opus.AppVoIP)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	track, err := webrtc.NewTrackLocalStaticSample(opusCodec, "audio", "conference")
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	go func() { // RTCP has to be read for the sender to work
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	room, _ := s.rooms.Acquire(offer.Room)
+	c := &Client{
+		id:     offer.Name,
+		addr:   "webrtc:" + remoteAddr,
+		token:  newSessionToken(),
+		ch:     make(chan *pb.ConferenceData, clientBuffer),
+		kicked: make(chan string, 1),
+		audio:  make(chan *pb.ConferenceData, clientAudioBuffer),
+		video:  make(chan *pb.ConferenceData, clientVideoBuffer),
+	}
+	err = room.admit(c, offer.Password)
+	if err == nil {
+		err = room.AddClient(c)
+	}
+	if err != nil {
+		pc.Close()
+		s.rooms.Release(room)
+		return nil, errors.New(status.Convert(err).Message())
+	}
+	log.Printf("WebRTC peer '%s' (%s) joined room '%s'", c.id, remoteAddr, offer.Room)
+	room.Broadcast(serverCommand(offer.Room, serverSender, &pb.Command{Type: "USER_JOINED", Value: c.id}), c.addr)
+
+	done := make(chan struct{})
+	var left atomic.Bool // not a sync.Once: pc.Close fires the state handler, which calls leave again
+	leave := func() {
+		if !left.CompareAndSwap(false, true) {
+			return
+		}
+		close(done)
+		pc.Close()
+		room := c.Room()
+		if s.leaveSynthetic(c) {
+			log.Printf("WebRTC peer '%s' left room '%s'", c.id, room.id)
+		}
+	}
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		// Disconnected can recover on its own; Failed means ICE gave up
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			leave()
+		}
+	})
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		defer recoverPanic("WebRTC peer '"+c.id+"'", func(error) { leave() })
+		if remote.Codec().MimeType == webrtc.MimeTypeOpus {
+			bridgeFromBrowser(c, remote)
+		}
+	})
+	go func() {
+		defer recoverPanic("WebRTC peer '"+c.id+"'", func(error) { leave() })
+		bridgeToBrowser(c, track, enc, done, leave)
+	}()
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer.SDP}); err != nil {
+		leave()
+		return nil, fmt.Errorf("invalid offer: %v", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		leave()
+		return nil, err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		leave()
+		return nil, err
+	}
+	<-gathered
+	return pc.LocalDescription(), nil
+}
+
+// bridgeFromBrowser relays the browser's microphone into the room as 16 kHz
+// AudioChunks, one per RTP packet, applying the same rules as gRPC clients.
+func bridgeFromBrowser(c *Client, remote *webrtc.TrackRemote) {
+	dec, err := opus.NewDecoder(webrtcSampleRate, 1)
+	if err != nil {
+		log.Printf("WebRTC peer '%s': can't decode Opus: %v", c.id, err)
+		return
+	}
+	pcm := make([]int16, 6*webrtcFrameSamples) // 120 ms, the longest Opus packet
+	var seq uint32
+	for {
+		pkt, _, err := remote.ReadRTP()
+		if err != nil {
+			return
+		}
+		room := c.Room()
+		if room == nil {
+			return
+		}
+		n, err := dec.Decode(pkt.Payload, pcm)
+		if err != nil {
+			continue // a corrupt packet; the next one may be fine
+		}
+		data := make([]byte, 2*n)
+		for i, v := range pcm[:n] {
+			binary.LittleEndian.PutUint16(data[2*i:], uint16(v))
+		}
+		seq++
+		chunk := &pb.AudioChunk{
+			Data:          data,
+			Sender:        c.id,
+			RoomId:        room.id,
+			SampleRate:    webrtcSampleRate,
+			Channels:      1,
+			Seq:           seq,
+			CaptureTimeMs: time.Now().UnixMilli(),
+		}
+		msg := seal(&pb.ConferenceData{Payload: &pb.ConferenceData_AudioChunk{AudioChunk: chunk}}, room.id, c.id)
+		if rejectIfFrozen(room, c, msg) || room.AudioMuted(c) {
+			continue
+		}
+		c.stats.recordSent(chunk, time.Now())
+		room.RelayAudio(msg, c.addr)
+	}
+}
+
+// bridgeToBrowser mixes the room's speakers down to one 16 kHz stream and
+// sends it to the browser, encoded with enc, every 20 ms. Text and commands
+// aren't bridged.
+func bridgeToBrowser(c *Client, track *webrtc.TrackLocalStaticSample, enc *opus.Encoder, done <-chan struct{}, leave func()) {
+	queued := make(map[string][]int16) // per speaker, already at 16 kHz mono
+	tick := time.NewTicker(webrtcFrame)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case reason := <-c.kicked:
+			log.Printf("WebRTC peer '%s' kicked: %s", c.id, reason)
+			leave()
+			return
+		case <-c.ch:
+		case <-c.video:
+		case msg := <-c.audio:
+			c.stats.recordReceived()
+			chunk := msg.GetAudioChunk()
+			q := append(queued[chunk.Sender], toBridgeRate(chunk)...)
+			if len(q) > webrtcMaxQueued {
+				q = q[len(q)-webrtcMaxQueued:]
+			}
+			queued[chunk.Sender] = q
+		case <-tick.C:
+			if len(queued) == 0 {
+				continue
+			}
+			mixed := make([]int32, webrtcFrameSamples)
+			for speaker, q := range queued {
+				n := min(len(q), webrtcFrameSamples)
+				for i := 0; i < n; i++ {
+					mixed[i] += int32(q[i])
+				}
+				if n == len(q) {
+					delete(queued, speaker)
+				} else {
+					queued[speaker] = q[n:]
+				}
+			}
+			frame := make([]int16, webrtcFrameSamples)
+			for i, v := range mixed {
+				frame[i] = int16(max(-32768, min(32767, v)))
+			}
+			packet := make([]byte, webrtcMaxPacket)
+			n, err := enc.Encode(frame, packet)
+			if err != nil {
+				log.Printf("WebRTC peer '%s': can't encode Opus: %v", c.id, err)
+				leave()
+				return
+			}
+			if err := track.WriteSample(media.Sample{Data: packet[:n], Duration: webrtcFrame}); err != nil {
+				leave()
+				return
+			}
+		}
+	}
+}
+
+// toBridgeRate converts a chunk's 16-bit PCM to 16 kHz mono samples.
+func toBridgeRate(chunk *pb.AudioChunk) []int16 {
+	rate, channels := int(chunk.SampleRate), int(chunk.Channels)
+	if rate == 0 {
+		rate = 44100
+	}
+	if channels == 0 {
+		channels = 1
+	}
+	if rate <= 0 || channels <= 0 {
+		return nil
+	}
+	pcm := chunk.Data
+	if rate > webrtcSampleRate {
+		pcm, rate, channels = downsamplePCM(pcm, rate, channels, webrtcSampleRate), webrtcSampleRate, 1
+	}
+	// Mix what is left down to mono, repeating samples up to the bridge's rate
+	frames := len(pcm) / (2 * channels)
+	out := make([]int16, frames*webrtcSampleRate/rate)
+	for i := range out {
+		f := i * rate / webrtcSampleRate
+		var sum int32
+		for ch := 0; ch < channels; ch++ {
+			sum += int32(int16(binary.LittleEndian.Uint16(pcm[(f*channels+ch)*2:])))
+		}
+		out[i] = int16(sum / int32(channels))
+	}
+	return out
+}
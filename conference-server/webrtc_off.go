@@ -0,0 +1,11 @@
+//go:build !webrtc
+
+package main
+
+import "errors"
+
+// startWebRTC stands in for the WebRTC bridge in default builds, which leave
+// out pion and its dependencies.
+func (s *server) startWebRTC(addr string) error {
+	return errors.New("this server was built without WebRTC support (rebuild with make server-build-webrtc)")
+}
@@ -0,0 +1,49 @@
+package com.conference.client;
+
+import javax.sound.sampled.AudioFormat;
+import javax.sound.sampled.LineUnavailableException;
+import java.nio.file.Paths;
+import java.util.List;
+
+/**
+ * Source and sink of PCM frames used by AudioStreamer. The default backend
+ * talks to the sound card through Java Sound; the file/null backend lets the
+ * client run on machines without audio hardware (CI, servers, containers).
+ */
+public interface AudioBackend {
+
+    List<String> listInputDevices();
+
+    List<String> listOutputDevices();
+
+    /** Opens capture and playback; null device names select the system default. */
+    void open(AudioFormat format, String inputDevice, String outputDevice) throws LineUnavailableException;
+
+    /** Blocks until a frame is captured; returns the number of bytes read. */
+    int readFrame(byte[] buffer, int offset, int length);
+
+    /** Blocks until the frame has been queued for playback. */
+    void writeFrame(byte[] data, int offset, int length);
+
+    void close();
+
+    /**
+     * Builds a backend from a spec such as "javasound" (default), "null" or
+     * "file:input.wav,output.raw" (either path may be left empty).
+     */
+    static AudioBackend fromSpec(String spec) {
+        if (spec == null || spec.isBlank() || spec.equals("javasound")) {
+            return new JavaSoundBackend();
+        }
+        if (spec.equals("null")) {
+            return new FileAudioBackend(null, null);
+        }
+        if (spec.startsWith("file:")) {
+            String[] paths = spec.substring("file:".length()).split(",", 2);
+            String in = paths[0].isEmpty() ? null : paths[0];
+            String out = paths.length > 1 && !paths[1].isEmpty() ? paths[1] : null;
+            return new FileAudioBackend(in == null ? null : Paths.get(in), out == null ? null : Paths.get(out));
+        }
+        throw new IllegalArgumentException("Backend de audio desconocido: " + spec);
+    }
+}
@@ -0,0 +1,75 @@
+package com.conference.client;
+
+import javax.sound.sampled.AudioFormat;
+import javax.sound.sampled.AudioInputStream;
+import javax.sound.sampled.AudioSystem;
+import javax.sound.sampled.UnsupportedAudioFileException;
+import java.io.File;
+import java.io.IOException;
+import java.util.Arrays;
+
+/**
+ * An audio file being sent to the room (/play). The file is decoded and
+ * converted to the send format up front; the capture loop then takes it one
+ * chunk at a time, either mixed with the mic or in place of it.
+ */
+public class AudioInjection {
+
+    private final String name;
+    private final AudioFormat format;
+    private final boolean replace;
+    private final byte[] pcm;
+    private int pos = 0;
+    private volatile boolean cancelled = false;
+
+    public AudioInjection(File file, AudioFormat format, boolean replace) throws IOException, UnsupportedAudioFileException {
+        this.name = file.getName();
+        this.format = format;
+        this.replace = replace;
+        try (AudioInputStream in = AudioSystem.getAudioInputStream(file)) {
+            AudioFormat src = in.getFormat();
+            AudioFormat pcm16 = new AudioFormat(src.getSampleRate(), 16, src.getChannels(), true, false);
+            try (AudioInputStream decoded = AudioSystem.getAudioInputStream(pcm16, in)) {
+                this.pcm = PcmConverter.convert(decoded.readAllBytes(), (int) src.getSampleRate(), src.getChannels(),
+                        (int) format.getSampleRate(), format.getChannels());
+            }
+        }
+    }
+
+    public String getName() { return name; }
+    public AudioFormat getFormat() { return format; }
+    public boolean isReplace() { return replace; }
+
+    public double getDurationSeconds() {
+        return pcm.length / (double) format.getFrameSize() / format.getSampleRate();
+    }
+
+    public boolean isDone() {
+        return cancelled || pos >= pcm.length;
+    }
+
+    public void cancel() {
+        cancelled = true;
+    }
+
+    /**
+     * Adds the next length bytes of the file to buf (or overwrites buf when
+     * replacing the mic), clipping at the sample range. Past the end of the
+     * file a replacing injection yields silence.
+     */
+    public synchronized void apply(byte[] buf, int length) {
+        if (replace) {
+            Arrays.fill(buf, 0, length, (byte) 0);
+        }
+        if (isDone()) return;
+        int n = Math.min(length, pcm.length - pos) & ~1;
+        for (int i = 0; i < n; i += 2) {
+            int mixed = (short) ((buf[i] & 0xff) | (buf[i + 1] << 8))
+                    + (short) ((pcm[pos + i] & 0xff) | (pcm[pos + i + 1] << 8));
+            mixed = Math.max(Short.MIN_VALUE, Math.min(Short.MAX_VALUE, mixed));
+            buf[i] = (byte) mixed;
+            buf[i + 1] = (byte) (mixed >> 8);
+        }
+        pos += n;
+    }
+}
@@ -0,0 +1,73 @@
+package com.conference.client;
+
+import java.util.Map;
+import java.util.TreeMap;
+import java.util.concurrent.ConcurrentHashMap;
+
+/**
+ * Tracks smoothed RMS levels for the local mic and every remote speaker and
+ * renders them as small text meters.
+ */
+public class AudioLevelMeter {
+
+    public static final String MIC = "Tú";
+
+    private static final double SMOOTHING = 0.3;     // weight of the newest chunk
+    private static final long STALE_AFTER_MS = 2000;  // a speaker's level drops to zero after this
+    private static final int BAR_WIDTH = 10;
+    private static final double FLOOR_DB = -60.0;
+
+    private static class Level {
+        volatile double rms;
+        volatile long updatedMillis;
+    }
+
+    private final Map<String, Level> levels = new ConcurrentHashMap<>();
+
+    /** Feeds a PCM chunk for source and returns its raw (unsmoothed) RMS. */
+    public double update(String source, byte[] pcm, int length) {
+        double rms = VoiceActivityDetector.rms(pcm, length);
+        Level level = levels.computeIfAbsent(source, k -> new Level());
+        level.rms = level.rms * (1 - SMOOTHING) + rms * SMOOTHING;
+        level.updatedMillis = System.currentTimeMillis();
+        return rms;
+    }
+
+    public double getLevel(String source) {
+        Level level = levels.get(source);
+        if (level == null || System.currentTimeMillis() - level.updatedMillis > STALE_AFTER_MS) {
+            return 0;
+        }
+        return level.rms;
+    }
+
+    /** Renders "🎤 Tú ▇▇▇▇░░░░░░ -23 dB | 🔊 ana ..." for the mic and active speakers. */
+    public String render() {
+        StringBuilder sb = new StringBuilder();
+        sb.append("🎤 ").append(MIC).append(' ').append(bar(getLevel(MIC)));
+        Map<String, Level> sorted = new TreeMap<>(levels);
+        for (String source : sorted.keySet()) {
+            if (source.equals(MIC)) continue;
+            double rms = getLevel(source);
+            if (rms == 0) continue;
+            sb.append(" | 🔊 ").append(source).append(' ').append(bar(rms));
+        }
+        return sb.toString();
+    }
+
+    public static double toDb(double rms) {
+        if (rms <= 0) return FLOOR_DB;
+        return Math.max(FLOOR_DB, 20 * Math.log10(rms / Short.MAX_VALUE));
+    }
+
+    private static String bar(double rms) {
+        double db = toDb(rms);
+        int filled = (int) Math.round((db - FLOOR_DB) / -FLOOR_DB * BAR_WIDTH);
+        StringBuilder sb = new StringBuilder(BAR_WIDTH + 8);
+        for (int i = 0; i < BAR_WIDTH; i++) {
+            sb.append(i < filled ? '▇' : '░');
+        }
+        sb.append(String.format(" %3.0f dB", db));
+        return sb.toString();
+    }
+}
@@ -0,0 +1,134 @@
+package com.conference.client;
+
+import java.util.Arrays;
+
+/**
+ * Cleans up microphone audio before it is sent: an NLMS adaptive filter
+ * removes the speaker signal picked up by the mic (acoustic echo), and a
+ * noise-floor tracking gate attenuates steady background noise.
+ *
+ * Everything is plain Java on 16-bit little-endian mono PCM, so it works with
+ * every audio backend without native libraries. The far end (what is played
+ * on the speakers) is fed in through {@link #farEnd}.
+ */
+public class AudioProcessor {
+
+    // ~46 ms at 44.1 kHz; enough for laptop speaker-to-mic paths
+    private static final int FILTER_TAPS = 2048;
+    private static final double STEP_SIZE = 0.3;
+    private static final double REGULARIZATION = 1e3;
+    // The far-end ring holds about one second of playback
+    private static final int FAR_END_CAPACITY = 44100;
+
+    // Noise suppression: floor follows quiet frames quickly and loud ones slowly
+    private static final double FLOOR_RISE = 1.002;
+    private static final double FLOOR_FALL = 0.9;
+    private static final double MIN_GAIN = 0.1;
+    private static final double GAIN_SMOOTHING = 0.3;
+
+    private volatile boolean enabled = true;
+
+    private final double[] weights = new double[FILTER_TAPS];
+    private final double[] history = new double[FILTER_TAPS]; // recent far-end samples, circular
+    private int historyPos = 0;
+    private double historyEnergy = 0;
+
+    private final short[] farRing = new short[FAR_END_CAPACITY];
+    private int farRead = 0;
+    private int farWrite = 0;
+    private int farAvailable = 0;
+
+    private double noiseFloor = 100;
+    private double gain = 1.0;
+
+    /** Records audio that is about to be played, as the echo reference. */
+    public synchronized void farEnd(byte[] pcm, int length) {
+        if (!enabled) return;
+        for (int i = 0; i + 1 < length; i += 2) {
+            farRing[farWrite] = (short) ((pcm[i] & 0xff) | (pcm[i + 1] << 8));
+            farWrite = (farWrite + 1) % FAR_END_CAPACITY;
+            if (farAvailable == FAR_END_CAPACITY) {
+                farRead = (farRead + 1) % FAR_END_CAPACITY; // overrun: drop the oldest
+            } else {
+                farAvailable++;
+            }
+        }
+    }
+
+    /** Processes a captured chunk in place. */
+    public synchronized void process(byte[] pcm, int length) {
+        if (!enabled) return;
+        cancelEcho(pcm, length);
+        suppressNoise(pcm, length);
+    }
+
+    private void cancelEcho(byte[] pcm, int length) {
+        for (int i = 0; i + 1 < length; i += 2) {
+            double far = 0;
+            if (farAvailable > 0) {
+                far = farRing[farRead];
+                farRead = (farRead + 1) % FAR_END_CAPACITY;
+                farAvailable--;
+            }
+            double evicted = history[historyPos];
+            historyEnergy += far * far - evicted * evicted;
+            history[historyPos] = far;
+
+            // Estimated echo: the filter applied to the most recent far-end samples
+            double echo = 0;
+            for (int k = 0, j = historyPos; k < FILTER_TAPS; k++) {
+                echo += weights[k] * history[j];
+                if (--j < 0) j = FILTER_TAPS - 1;
+            }
+            short mic = (short) ((pcm[i] & 0xff) | (pcm[i + 1] << 8));
+            double error = mic - echo;
+
+            if (historyEnergy > REGULARIZATION) {
+                double mu = STEP_SIZE * error / (historyEnergy + REGULARIZATION);
+                for (int k = 0, j = historyPos; k < FILTER_TAPS; k++) {
+                    weights[k] += mu * history[j];
+                    if (--j < 0) j = FILTER_TAPS - 1;
+                }
+            }
+            historyPos = (historyPos + 1) % FILTER_TAPS;
+
+            int out = (int) Math.max(Short.MIN_VALUE, Math.min(Short.MAX_VALUE, Math.round(error)));
+            pcm[i] = (byte) out;
+            pcm[i + 1] = (byte) (out >> 8);
+        }
+    }
+
+    private void suppressNoise(byte[] pcm, int length) {
+        double rms = VoiceActivityDetector.rms(pcm, length);
+        noiseFloor = rms < noiseFloor ? Math.max(1, noiseFloor * FLOOR_FALL + rms * (1 - FLOOR_FALL)) : noiseFloor * FLOOR_RISE;
+
+        // Wiener-style gain: frames near the floor are attenuated, speech passes
+        double target = rms <= 0 ? MIN_GAIN : Math.max(MIN_GAIN, 1 - (noiseFloor * noiseFloor) / (rms * rms));
+        gain += (target - gain) * GAIN_SMOOTHING;
+        if (gain >= 0.999) return;
+        for (int i = 0; i + 1 < length; i += 2) {
+            short sample = (short) ((pcm[i] & 0xff) | (pcm[i + 1] << 8));
+            int scaled = (int) Math.round(sample * gain);
+            pcm[i] = (byte) scaled;
+            pcm[i + 1] = (byte) (scaled >> 8);
+        }
+    }
+
+    /** Forgets the learned echo path and noise floor, e.g. after a device change. */
+    public synchronized void reset() {
+        Arrays.fill(weights, 0);
+        Arrays.fill(history, 0);
+        historyPos = 0;
+        historyEnergy = 0;
+        farRead = farWrite = farAvailable = 0;
+        noiseFloor = 100;
+        gain = 1.0;
+    }
+
+    public boolean isEnabled() { return enabled; }
+
+    public void setEnabled(boolean enabled) {
+        this.enabled = enabled;
+        if (!enabled) reset();
+    }
+}
@@ -0,0 +1,61 @@
+package com.conference.client;
+
+import java.util.Map;
+import java.util.TreeMap;
+import java.util.concurrent.ConcurrentHashMap;
+import java.util.concurrent.atomic.AtomicLong;
+
+/**
+ * Client-side audio counters: chunks sent, and per speaker the chunks
+ * received, the ones lost (gaps in seq) and the average latency from capture
+ * to arrival. Latency is only meaningful if the clocks are roughly in sync.
+ */
+public class AudioStats {
+
+    public static final class SpeakerStats {
+        long received;
+        long lost;
+        long lastSeq;
+        double latencySumMs;
+        long latencyCount;
+
+        public long getReceived() { return received; }
+        public long getLost() { return lost; }
+        public double getAvgLatencyMs() { return latencyCount == 0 ? 0 : latencySumMs / latencyCount; }
+    }
+
+    private final AtomicLong sent = new AtomicLong();
+    private final Map<String, SpeakerStats> speakers = new ConcurrentHashMap<>();
+
+    public void recordSent() {
+        sent.incrementAndGet();
+    }
+
+    /** seq 0 and captureTimeMs 0 mean the sender didn't provide them. */
+    public void recordReceived(String speaker, long seq, long captureTimeMs) {
+        SpeakerStats st = speakers.computeIfAbsent(speaker, k -> new SpeakerStats());
+        synchronized (st) {
+            st.received++;
+            if (seq != 0) {
+                if (st.lastSeq != 0 && seq > st.lastSeq + 1) st.lost += seq - st.lastSeq - 1;
+                if (seq > st.lastSeq || seq == 1) st.lastSeq = seq; // 1 = the speaker restarted their mic
+            }
+            if (captureTimeMs > 0) {
+                long latency = System.currentTimeMillis() - captureTimeMs;
+                if (latency >= 0) {
+                    st.latencySumMs += latency;
+                    st.latencyCount++;
+                }
+            }
+        }
+    }
+
+    public long getSent() {
+        return sent.get();
+    }
+
+    /** Snapshot sorted by speaker name. */
+    public Map<String, SpeakerStats> getSpeakers() {
+        return new TreeMap<>(speakers);
+    }
+}
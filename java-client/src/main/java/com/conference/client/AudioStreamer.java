@@ -6,70 +6,115 @@ import com.google.protobuf.ByteString;
 import io.grpc.stub.StreamObserver;
 
 import javax.sound.sampled.*;
+import java.io.File;
+import java.io.IOException;
 import java.time.Instant;
+import java.util.ArrayList;
+import java.util.Arrays;
+import java.util.List;
+import java.util.Map;
+import java.util.Set;
 import java.util.UUID;
+import java.util.concurrent.ConcurrentHashMap;
+import java.util.concurrent.atomic.AtomicInteger;
+import java.util.function.Consumer;
+
+import static com.conference.client.I18n.tr;
 
 public class AudioStreamer {
 
     private final StreamObserver<ConferenceData> requestObserver;
     private final String sender;
-    private final String roomId;
+    private volatile String roomId;
+
+    // Capture/playback format. The preferred one comes from the config; the one
+    // actually used is the first the devices accept (see FALLBACK_FORMATS).
+    public static final int DEFAULT_SAMPLE_RATE = 44100;
+    public static final int DEFAULT_CHANNELS = 1;
+    public static final int DEFAULT_FRAMES_PER_CHUNK = 512;
+    private static final float[][] FALLBACK_FORMATS = {{48000, 1}, {44100, 1}, {16000, 1}, {48000, 2}, {44100, 2}};
 
-    private AudioFormat audioFormat;
-    private TargetDataLine microphone;
-    private SourceDataLine speakers;
+    private volatile AudioFormat preferredFormat = pcmFormat(DEFAULT_SAMPLE_RATE, DEFAULT_CHANNELS);
+    private volatile int framesPerChunk = DEFAULT_FRAMES_PER_CHUNK;
+    private volatile AudioFormat audioFormat = preferredFormat;
+    private final AudioBackend backend;
 
     private volatile boolean audioActive = false;
     private volatile boolean speakersActive = false;
     private Thread micCaptureThread;
+    private final JitterBuffer jitterBuffer;
+    private final VoiceActivityDetector vad;
+    private final AudioProcessor processor = new AudioProcessor();
+    private volatile CallRecorder recorder;
+    private final AudioStats stats = new AudioStats();
+    private final AtomicInteger seq = new AtomicInteger(); // per send session
+    private volatile AudioInjection injection; // file being sent with /play, if any
+    private Thread playbackThread; // sends the injection while the mic is off
+
+    // Per-speaker playback settings, keyed by sender
+    private final Map<String, Integer> speakerVolumes = new ConcurrentHashMap<>(); // percent, 0-200
+    private final Set<String> mutedSpeakers = ConcurrentHashMap.newKeySet();
 
-    public AudioStreamer(StreamObserver<ConferenceData> requestObserver, String sender, String roomId) {
+    // Speaking indicator: a speaker "starts talking" after this much silence
+    private static final long SPEAKING_GAP_MS = 1500;
+    private final Map<String, Long> lastHeardMillis = new ConcurrentHashMap<>();
+    private volatile Consumer<String> speakingListener = speaker -> {};
+    private volatile Consumer<String> noticeListener = System.out::println; // where status and error lines go
+    private final AudioLevelMeter levelMeter = new AudioLevelMeter();
+
+    // Selected devices by name (null = system default)
+    private volatile String inputDevice;
+    private volatile String outputDevice;
+
+    public AudioStreamer(StreamObserver<ConferenceData> requestObserver, String sender, String roomId, AudioBackend backend) {
         this.requestObserver = requestObserver;
+        this.backend = backend;
         this.sender = sender;
         this.roomId = roomId;
-        this.audioFormat = new AudioFormat(44100, 16, 1, true, false); // 44.1kHz, 16bit, Mono, Signed, Little-endian
+        this.jitterBuffer = new JitterBuffer(this::writeToSpeakers, JitterBuffer.DEFAULT_DEPTH);
+        this.vad = new VoiceActivityDetector(VoiceActivityDetector.DEFAULT_THRESHOLD, VoiceActivityDetector.DEFAULT_HANGOVER_CHUNKS);
     }
 
     public void startAudio() {
         if (audioActive) {
-            System.out.println("El audio ya está activo.");
+            noticeListener.accept(tr("audio.already_on"));
             return;
         }
         try {
-            // Init microphone
-            DataLine.Info micInfo = new DataLine.Info(TargetDataLine.class, audioFormat);
-            microphone = (TargetDataLine) AudioSystem.getLine(micInfo);
-            microphone.open(audioFormat);
-            microphone.start();
-
-            // Init speakers
-            DataLine.Info speakerInfo = new DataLine.Info(SourceDataLine.class, audioFormat);
-            speakers = (SourceDataLine) AudioSystem.getLine(speakerInfo);
-            speakers.open(audioFormat);
-            speakers.start();
-            
+            audioFormat = openBackend();
+            stopPlaybackThread(); // the capture loop sends /play audio from now on
+            AudioInjection inj = injection;
+            if (inj != null && !inj.getFormat().matches(audioFormat)) {
+                stopPlayback();
+                noticeListener.accept(tr("audio.playback_format_changed", inj.getName()));
+            }
+
             audioActive = true;
             speakersActive = true;
-            System.out.println("🎤 Micrófono y altavoces activados.");
+            jitterBuffer.start();
+            noticeListener.accept(tr("audio.mic_on"));
 
             // Start thread to capture and send audio
+            int chunkBytes = framesPerChunk * audioFormat.getFrameSize();
+            seq.set(0);
             micCaptureThread = new Thread(() -> {
-                byte[] buffer = new byte[1024];
+                byte[] buffer = new byte[chunkBytes];
                 while (audioActive) {
-                    int bytesRead = microphone.read(buffer, 0, buffer.length);
+                    int bytesRead = backend.readFrame(buffer, 0, buffer.length);
+                    boolean injecting = false;
                     if (bytesRead > 0) {
+                        processor.process(buffer, bytesRead);
+                        injecting = applyInjection(buffer, bytesRead);
+                        CallRecorder rec = recorder;
+                        if (rec != null) rec.writeOutgoing(buffer, bytesRead);
+                        levelMeter.update(AudioLevelMeter.MIC, buffer, bytesRead);
+                    }
+                    // File audio is sent even when the mic alone would be gated as silence
+                    if (bytesRead > 0 && (vad.shouldSend(buffer, bytesRead) || injecting)) {
                         try {
-                            AudioChunk audioChunk = AudioChunk.newBuilder()
-                                    .setData(ByteString.copyFrom(buffer, 0, bytesRead))
-                                    .build();
-                            ConferenceData conferenceData = ConferenceData.newBuilder()
-                                    .setSender(sender)
-                                    .setRoomId(roomId)
-                                    .setAudioChunk(audioChunk)
-                                    .build();
-                            requestObserver.onNext(conferenceData);
+                            sendChunk(buffer, bytesRead, audioFormat);
                         } catch (Exception e) {
-                            System.err.println("Error al enviar audio: " + e.getMessage());
+                            noticeListener.accept(tr("audio.send_error", e.getMessage()));
                             audioActive = false;
                         }
                     }
@@ -79,38 +124,330 @@ public class AudioStreamer {
             micCaptureThread.start();
 
         } catch (LineUnavailableException e) {
-            System.err.println("Error al acceder a dispositivo de audio: " + e.getMessage());
+            noticeListener.accept(tr("audio.device_error", e.getMessage()));
             audioActive = false;
         }
     }
 
+    private void sendChunk(byte[] buffer, int length, AudioFormat format) {
+        AudioChunk audioChunk = AudioChunk.newBuilder()
+                .setData(ByteString.copyFrom(buffer, 0, length))
+                .setSampleRate((int) format.getSampleRate())
+                .setChannels(format.getChannels())
+                .setSeq(seq.incrementAndGet())
+                .setCaptureTimeMs(System.currentTimeMillis())
+                .build();
+        ConferenceData conferenceData = ConferenceData.newBuilder()
+                .setSender(sender)
+                .setRoomId(roomId)
+                .setAudioChunk(audioChunk)
+                .build();
+        requestObserver.onNext(conferenceData);
+        stats.recordSent();
+    }
+
+    // Tries the preferred format first, then common ones the hardware is likely to support
+    private AudioFormat openBackend() throws LineUnavailableException {
+        LineUnavailableException lastError = null;
+        AudioFormat preferred = preferredFormat;
+        List<AudioFormat> candidates = new ArrayList<>();
+        candidates.add(preferred);
+        for (float[] f : FALLBACK_FORMATS) {
+            AudioFormat candidate = pcmFormat((int) f[0], (int) f[1]);
+            if (!candidate.matches(preferred)) candidates.add(candidate);
+        }
+        for (AudioFormat candidate : candidates) {
+            try {
+                backend.open(candidate, inputDevice, outputDevice);
+                if (candidate != preferred) {
+                    noticeListener.accept(tr("audio.format_unsupported", describe(preferred), describe(candidate)));
+                }
+                return candidate;
+            } catch (LineUnavailableException | IllegalArgumentException e) {
+                backend.close();
+                lastError = e instanceof LineUnavailableException
+                        ? (LineUnavailableException) e
+                        : new LineUnavailableException(e.getMessage());
+            }
+        }
+        throw lastError;
+    }
+
+    // 16-bit signed little-endian PCM, the only sample format on the wire
+    private static AudioFormat pcmFormat(int sampleRate, int channels) {
+        return new AudioFormat(sampleRate, 16, channels, true, false);
+    }
+
+    public static String describe(AudioFormat format) {
+        return String.format("%.0f Hz, %d canal(es)", format.getSampleRate(), format.getChannels());
+    }
+
     public void stopAudio() {
         if (!audioActive) {
             return;
         }
         audioActive = false;
         speakersActive = false;
+        jitterBuffer.stop();
+        stopPlayback();
 
         if (micCaptureThread != null) {
             micCaptureThread.interrupt();
         }
-        if (microphone != null && microphone.isOpen()) {
-            microphone.stop();
-            microphone.close();
+        backend.close();
+        File recording = stopRecording();
+        if (recording != null) {
+            noticeListener.accept(tr("audio.recording_saved", recording.getPath()));
         }
-        if (speakers != null && speakers.isOpen()) {
-            speakers.drain();
-            speakers.close();
-        }
-        System.out.println("🎤 Micrófono y altavoces desactivados.");
+        noticeListener.accept(tr("audio.mic_off"));
     }
     
-    public void playAudioChunk(byte[] audioData) {
-        if (speakersActive && speakers != null && speakers.isOpen()) {
-            speakers.write(audioData, 0, audioData.length);
+    /** Plays a received chunk; a sample rate/channel count of 0 means the legacy 44.1 kHz mono format. */
+    public void playAudioChunk(String speaker, AudioChunk chunk) {
+        stats.recordReceived(speaker, chunk.getSeq(), chunk.getCaptureTimeMs());
+        if (!speakersActive || mutedSpeakers.contains(speaker)) {
+            return;
+        }
+        AudioFormat local = audioFormat;
+        byte[] audioData = PcmConverter.convert(chunk.getData().toByteArray(),
+                chunk.getSampleRate() > 0 ? chunk.getSampleRate() : DEFAULT_SAMPLE_RATE,
+                chunk.getChannels() > 0 ? chunk.getChannels() : DEFAULT_CHANNELS,
+                (int) local.getSampleRate(), local.getChannels());
+        // Only chunks above the VAD threshold count as speech for the indicator
+        if (levelMeter.update(speaker, audioData, audioData.length) >= vad.getThreshold()) {
+            long now = System.currentTimeMillis();
+            Long last = lastHeardMillis.put(speaker, now);
+            if (last == null || now - last > SPEAKING_GAP_MS) {
+                speakingListener.accept(speaker);
+            }
+        }
+        int volume = speakerVolumes.getOrDefault(speaker, 100);
+        if (volume != 100) {
+            applyGain(audioData, volume / 100.0);
+        }
+        jitterBuffer.push(speaker, chunk.getSeq(), audioData);
+    }
+
+    /**
+     * Plays locally generated audio (e.g. speech) as if it came from speaker,
+     * fed to the jitter buffer one chunk at a time in real time. Blocks until
+     * it has all been queued.
+     */
+    public void playLocal(String speaker, byte[] pcm, int sampleRate, int channels) throws InterruptedException {
+        AudioFormat local = audioFormat;
+        byte[] audioData = PcmConverter.convert(pcm, sampleRate, channels, (int) local.getSampleRate(), local.getChannels());
+        int volume = speakerVolumes.getOrDefault(speaker, 100);
+        if (volume != 100) {
+            applyGain(audioData, volume / 100.0);
+        }
+        int chunkBytes = framesPerChunk * local.getFrameSize();
+        long chunkMillis = (long) (framesPerChunk * 1000L / local.getSampleRate());
+        for (int off = 0; off < audioData.length && speakersActive && !mutedSpeakers.contains(speaker); off += chunkBytes) {
+            jitterBuffer.push(Arrays.copyOfRange(audioData, off, Math.min(audioData.length, off + chunkBytes)));
+            Thread.sleep(chunkMillis);
+        }
+    }
+
+    // --- File playback into the room (/play) ---
+
+    /**
+     * Starts sending an audio file to the room. With the mic on it is mixed
+     * with (or replaces) the mic in the format in use; with the mic off it is
+     * sent on its own in the preferred format. Replaces any file already playing.
+     */
+    public synchronized AudioInjection play(File file, boolean replaceMic) throws IOException, UnsupportedAudioFileException {
+        stopPlayback();
+        AudioInjection inj = new AudioInjection(file, audioActive ? audioFormat : preferredFormat, replaceMic);
+        injection = inj;
+        if (!audioActive) {
+            playbackThread = new Thread(() -> runPlayback(inj), "audio-playback");
+            playbackThread.setDaemon(true);
+            playbackThread.start();
+        }
+        return inj;
+    }
+
+    /** Stops the file being played, if any. */
+    public synchronized void stopPlayback() {
+        AudioInjection inj = injection;
+        if (inj != null) inj.cancel();
+        injection = null;
+        stopPlaybackThread();
+    }
+
+    public AudioInjection getPlayback() {
+        return injection;
+    }
+
+    private synchronized void stopPlaybackThread() {
+        if (playbackThread != null) {
+            playbackThread.interrupt();
+            playbackThread = null;
+        }
+    }
+
+    // Mixes the current injection into a captured chunk; false if nothing is playing
+    private boolean applyInjection(byte[] buffer, int length) {
+        AudioInjection inj = injection;
+        if (inj == null) return false;
+        inj.apply(buffer, length);
+        if (inj.isDone()) {
+            finishPlayback(inj);
+        }
+        return true;
+    }
+
+    // Paces the file to real time, as the capture loop would
+    private void runPlayback(AudioInjection inj) {
+        AudioFormat format = inj.getFormat();
+        byte[] buffer = new byte[framesPerChunk * format.getFrameSize()];
+        long chunkMillis = (long) (framesPerChunk * 1000L / format.getSampleRate());
+        seq.set(0);
+        try {
+            while (!inj.isDone() && !Thread.currentThread().isInterrupted()) {
+                Arrays.fill(buffer, (byte) 0);
+                inj.apply(buffer, buffer.length);
+                sendChunk(buffer, buffer.length, format);
+                Thread.sleep(chunkMillis);
+            }
+        } catch (InterruptedException e) {
+            return; // stopped, or the mic took over
+        } catch (Exception e) {
+            noticeListener.accept(tr("audio.send_error", e.getMessage()));
+        }
+        finishPlayback(inj);
+    }
+
+    private synchronized void finishPlayback(AudioInjection inj) {
+        if (injection == inj) {
+            injection = null;
+            noticeListener.accept(tr("audio.play_finished", inj.getName()));
         }
     }
 
+    // Scales 16-bit little-endian samples in place, clipping at the sample range
+    private static void applyGain(byte[] pcm, double gain) {
+        for (int i = 0; i + 1 < pcm.length; i += 2) {
+            short sample = (short) ((pcm[i] & 0xff) | (pcm[i + 1] << 8));
+            int scaled = (int) Math.round(sample * gain);
+            scaled = Math.max(Short.MIN_VALUE, Math.min(Short.MAX_VALUE, scaled));
+            pcm[i] = (byte) scaled;
+            pcm[i + 1] = (byte) (scaled >> 8);
+        }
+    }
+
+    // --- Device selection ---
+
+    public List<String> listInputDevices() {
+        return backend.listInputDevices();
+    }
+
+    public List<String> listOutputDevices() {
+        return backend.listOutputDevices();
+    }
+
+    public String getInputDevice() { return inputDevice; }
+    public String getOutputDevice() { return outputDevice; }
+    public void setInputDevice(String device) { this.inputDevice = device; }
+    public void setOutputDevice(String device) { this.outputDevice = device; }
+
+    /** Sets the format to try first on the next /mic on; frames is the capture chunk size. */
+    public void setPreferredFormat(int sampleRate, int channels, int frames) {
+        this.preferredFormat = pcmFormat(sampleRate, channels);
+        this.framesPerChunk = frames;
+    }
+
+    public AudioFormat getPreferredFormat() { return preferredFormat; }
+    public AudioFormat getAudioFormat() { return audioFormat; }
+    public int getFramesPerChunk() { return framesPerChunk; }
+
+    public void setRoomId(String roomId) {
+        this.roomId = roomId;
+    }
+
+    public AudioLevelMeter getLevelMeter() {
+        return levelMeter;
+    }
+
+    public void setSpeakingListener(Consumer<String> listener) {
+        this.speakingListener = listener;
+    }
+
+    public void setNoticeListener(Consumer<String> listener) {
+        this.noticeListener = listener;
+    }
+
+    public void setSpeakerVolume(String speaker, int percent) {
+        int clamped = Math.max(0, Math.min(200, percent));
+        if (clamped == 100) speakerVolumes.remove(speaker);
+        else speakerVolumes.put(speaker, clamped);
+    }
+
+    public int getSpeakerVolume(String speaker) {
+        return speakerVolumes.getOrDefault(speaker, 100);
+    }
+
+    /** Toggles local muting of a speaker; returns true if the speaker is now muted. */
+    public boolean toggleSpeakerMute(String speaker) {
+        if (mutedSpeakers.remove(speaker)) {
+            return false;
+        }
+        mutedSpeakers.add(speaker);
+        return true;
+    }
+
+    // Called from the jitter buffer's playout thread
+    private void writeToSpeakers(byte[] audioData) {
+        if (speakersActive) {
+            processor.farEnd(audioData, audioData.length);
+            CallRecorder rec = recorder;
+            if (rec != null) rec.writeIncoming(audioData, audioData.length);
+            backend.writeFrame(audioData, 0, audioData.length);
+        }
+    }
+
+    public JitterBuffer getJitterBuffer() {
+        return jitterBuffer;
+    }
+
+    public VoiceActivityDetector getVad() {
+        return vad;
+    }
+
+    public AudioProcessor getProcessor() {
+        return processor;
+    }
+
+    public AudioStats getStats() {
+        return stats;
+    }
+
+    // --- Recording ---
+
+    /** Starts recording in the format currently in use; returns the file being written. */
+    public synchronized File startRecording(File dir, boolean includeMic) throws IOException {
+        if (recorder != null) return recorder.getFile();
+        recorder = new CallRecorder(dir, audioFormat, includeMic);
+        return recorder.getFile();
+    }
+
+    /** Stops recording and returns the finished file, or null if none was running. */
+    public synchronized File stopRecording() {
+        CallRecorder rec = recorder;
+        if (rec == null) return null;
+        recorder = null;
+        try {
+            rec.close();
+        } catch (IOException e) {
+            noticeListener.accept(tr("audio.recording_close_error", e.getMessage()));
+        }
+        return rec.getFile();
+    }
+
+    public boolean isRecording() {
+        return recorder != null;
+    }
+
     public boolean isAudioActive() {
         return audioActive;
     }
@@ -0,0 +1,129 @@
+package com.conference.client;
+
+import javax.sound.sampled.AudioFormat;
+import java.io.File;
+import java.io.IOException;
+import java.io.RandomAccessFile;
+import java.time.LocalDateTime;
+import java.time.format.DateTimeFormatter;
+
+import static com.conference.client.I18n.tr;
+
+/**
+ * Records a call to a local WAV file. Incoming audio is written as it is
+ * played; outgoing mic audio, when enabled, is mixed into the same timeline.
+ * The RIFF sizes are patched in when the recording is closed.
+ */
+public class CallRecorder {
+
+    private static final DateTimeFormatter FILE_TIME = DateTimeFormatter.ofPattern("yyyyMMdd-HHmmss");
+    private static final int HEADER_SIZE = 44;
+
+    private final RandomAccessFile out;
+    private final File file;
+    private final AudioFormat format;
+    private final boolean includeMic;
+
+    // Mic samples waiting to be mixed with the next incoming chunk
+    private final byte[] pendingMic;
+    private int pendingMicBytes = 0;
+    private long dataBytes = 0;
+
+    public CallRecorder(File dir, AudioFormat format, boolean includeMic) throws IOException {
+        this.format = format;
+        this.includeMic = includeMic;
+        this.file = new File(dir, "elochat-" + LocalDateTime.now().format(FILE_TIME) + ".wav");
+        this.out = new RandomAccessFile(file, "rw");
+        this.out.setLength(0);
+        writeHeader();
+        // Half a second of mic audio; if nobody else talks, it is flushed on its own
+        this.pendingMic = new byte[(int) (format.getSampleRate() / 2) * format.getFrameSize()];
+    }
+
+    public File getFile() { return file; }
+    public boolean includesMic() { return includeMic; }
+
+    public synchronized void writeIncoming(byte[] pcm, int length) {
+        if (dataBytes < 0) return; // closed
+        byte[] mixed = pcm;
+        if (pendingMicBytes > 0) {
+            mixed = new byte[length];
+            System.arraycopy(pcm, 0, mixed, 0, length);
+            int n = Math.min(length, pendingMicBytes);
+            mix(mixed, pendingMic, n);
+            System.arraycopy(pendingMic, n, pendingMic, 0, pendingMicBytes - n);
+            pendingMicBytes -= n;
+        }
+        write(mixed, length);
+    }
+
+    public synchronized void writeOutgoing(byte[] pcm, int length) {
+        if (!includeMic || dataBytes < 0) return;
+        if (pendingMicBytes + length > pendingMic.length) {
+            write(pendingMic, pendingMicBytes);
+            pendingMicBytes = 0;
+        }
+        int n = Math.min(length, pendingMic.length);
+        System.arraycopy(pcm, 0, pendingMic, pendingMicBytes, n);
+        pendingMicBytes += n;
+    }
+
+    /** Flushes pending audio and finalizes the WAV header. */
+    public synchronized void close() throws IOException {
+        if (dataBytes < 0) return;
+        write(pendingMic, pendingMicBytes);
+        pendingMicBytes = 0;
+        long total = dataBytes;
+        dataBytes = -1;
+        out.seek(4);
+        writeIntLE((int) (HEADER_SIZE - 8 + total));
+        out.seek(40);
+        writeIntLE((int) total);
+        out.close();
+    }
+
+    private void write(byte[] pcm, int length) {
+        try {
+            out.write(pcm, 0, length);
+            dataBytes += length;
+        } catch (IOException e) {
+            System.err.println(tr("audio.call_record_error", e.getMessage()));
+        }
+    }
+
+    // Adds 16-bit little-endian samples of src into dst, clipping
+    private static void mix(byte[] dst, byte[] src, int length) {
+        for (int i = 0; i + 1 < length; i += 2) {
+            int a = (short) ((dst[i] & 0xff) | (dst[i + 1] << 8));
+            int b = (short) ((src[i] & 0xff) | (src[i + 1] << 8));
+            int v = Math.max(Short.MIN_VALUE, Math.min(Short.MAX_VALUE, a + b));
+            dst[i] = (byte) v;
+            dst[i + 1] = (byte) (v >> 8);
+        }
+    }
+
+    private void writeHeader() throws IOException {
+        int channels = format.getChannels();
+        int rate = (int) format.getSampleRate();
+        out.writeBytes("RIFF");
+        writeIntLE(0); // patched on close
+        out.writeBytes("WAVEfmt ");
+        writeIntLE(16);
+        writeShortLE(1); // PCM
+        writeShortLE(channels);
+        writeIntLE(rate);
+        writeIntLE(rate * format.getFrameSize());
+        writeShortLE(format.getFrameSize());
+        writeShortLE(16);
+        out.writeBytes("data");
+        writeIntLE(0); // patched on close
+    }
+
+    private void writeIntLE(int v) throws IOException {
+        out.write(new byte[]{(byte) v, (byte) (v >> 8), (byte) (v >> 16), (byte) (v >> 24)});
+    }
+
+    private void writeShortLE(int v) throws IOException {
+        out.write(new byte[]{(byte) v, (byte) (v >> 8)});
+    }
+}
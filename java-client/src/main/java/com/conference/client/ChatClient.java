@@ -1,19 +1,61 @@
 package com.conference.client;
 
 import com.conference.grpc.*;
+import com.google.protobuf.ByteString;
+import io.grpc.CallOptions;
+import io.grpc.Channel;
+import io.grpc.ClientCall;
+import io.grpc.ClientInterceptor;
+import io.grpc.ClientInterceptors;
+import io.grpc.ForwardingClientCall;
 import io.grpc.ManagedChannel;
 import io.grpc.ManagedChannelBuilder;
+import io.grpc.Metadata;
+import io.grpc.MethodDescriptor;
+import io.grpc.Status;
+import io.grpc.StatusRuntimeException;
+import io.grpc.stub.MetadataUtils;
 import io.grpc.stub.StreamObserver;
 
+import java.io.BufferedReader;
+import java.io.File;
+import java.io.IOException;
+import java.io.InputStreamReader;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.StandardOpenOption;
+import java.security.GeneralSecurityException;
+import java.text.Normalizer;
 import java.time.Instant;
 import java.time.LocalDateTime;
-import java.time.ZoneId;
 import java.time.format.DateTimeFormatter;
+import java.time.format.DateTimeParseException;
+import java.util.ArrayDeque;
+import java.util.ArrayList;
+import java.util.Arrays;
+import java.util.Deque;
+import java.util.HashSet;
+import java.util.Iterator;
+import java.util.List;
+import java.util.Map;
 import java.util.Scanner;
+import java.util.Set;
+import java.util.TreeMap;
+import java.util.TreeSet;
 import java.util.UUID;
+import java.util.concurrent.ConcurrentHashMap;
+import java.util.concurrent.ConcurrentSkipListSet;
+import java.util.concurrent.CopyOnWriteArrayList;
 import java.util.concurrent.CountDownLatch;
+import java.util.concurrent.Executors;
+import java.util.concurrent.ScheduledExecutorService;
 import java.util.concurrent.TimeUnit;
 import java.util.concurrent.atomic.AtomicBoolean;
+import java.util.regex.Matcher;
+import java.util.regex.Pattern;
+
+import static com.conference.client.I18n.tr;
 
 public class ChatClient {
 
@@ -24,35 +66,158 @@ public class ChatClient {
         CONNECTION_ERROR
     }
 
+    private ClientConfig config = ClientConfig.load(); // main replaces it with its own once --profile is applied
+    private String downloadDirFlag; // --download-dir, overrides download.dir
     private final ManagedChannel channel;
+    private final Channel calls; // channel, with our session and account tokens on every call
     private final ConferenceServiceGrpc.ConferenceServiceStub asyncStub;
     private String sender;
-    private String roomId;
+    private volatile String roomId;
     private AudioStreamer audioStreamer;
+    private volatile TextToSpeech textToSpeech;
+    private volatile NotificationSounds notificationSounds;
+    private volatile ChatLog chatLog; // null unless log.enabled
+    private volatile Theme theme = Theme.named("dark"); // from the theme key once a session starts
+    private volatile Timestamps timestamps = Timestamps.standard(); // from the time.* keys once a session starts
+    private volatile ConnectionMonitor connection; // pings the server while in a room
+    private volatile CommandAliases aliases; // from the alias.* and macro.* keys once a session starts
+    private final RoomTabs tabs; // the session's room and the ones opened with /join
+    private ScreenShare screenShare;
+    private final ScreenViewer screenViewer = new ScreenViewer();
+    private volatile int shareFps = ScreenShare.DEFAULT_FPS; // used once the server grants the share
     private FileTransferManager fileTransferManager;
     private StreamObserver<ConferenceData> requestObserver;
-    private CountDownLatch finishLatch;
+    private volatile CountDownLatch finishLatch; // counted down when the stream ends; a new one for each reconnection
+    private volatile boolean streamBroken; // the stream ended with an error rather than the server closing it
+    private volatile int reconnectAttempt; // 0 unless the stream is being reopened
     private SessionResult sessionResult;
+    private volatile String sessionToken; // Lets us reclaim our name after an unclean disconnect
+    private volatile String messageFilter = "all"; // all | important | mentions, see /filter
+    private volatile ServerInfo serverInfo; // null until fetched, or if the server predates GetServerInfo
+    private volatile String roomOwner = ""; // announced by the server with ROOM_OWNER; the host
+    private final Set<String> cohosts = ConcurrentHashMap.newKeySet(); // announced with ROLES and ROLE_CHANGED
+    private String joinRole = ""; // asked for in the JOIN command: host, cohost, attendee or "" (automatic)
+    private volatile boolean moderator = false; // joined with an admin token
+    private String adminToken = System.getenv("CONFERENCE_ADMIN_TOKEN"); // or typed at startup with --moderator
+    private volatile String roomPassword; // sent when joining rooms that have one; asked for when the server wants it
+    private volatile boolean passwordRejected; // the last join was turned away for want of the right password
+    private volatile String accountToken; // from /register or /login; a registered name joins with it
+    private volatile String accountName; // the name accountToken logs in to
+    private volatile boolean accountRequired; // the last join was turned away because the name is registered
+    private volatile RoomKeys e2e; // our X25519 key pair and the session room's E2E keys; loaded on first use
+    private volatile boolean e2eOn; // /e2e on: our text to the session room goes out encrypted
+    private volatile MessageSigner signer; // our signing key pair and the keys we know others sign with; loaded on first use
+    private volatile RoomSettings roomSettings; // null until the room sends them; later ones are changes
+    private final Set<String> serverMuted = ConcurrentHashMap.newKeySet(); // users the room owner muted
+    private final Set<String> members = new ConcurrentSkipListSet<>(); // from ROSTER, kept up to date by USER_JOINED/USER_LEFT
+    private final List<String> raisedHands = new CopyOnWriteArrayList<>(); // in the order the server queued them
+    private final List<PinnedMessage> pins = new CopyOnWriteArrayList<>(); // in the order they were pinned
+    private volatile boolean pinsKnown = false; // the room's first PinList has come, so the next ones are changes
+    private final Deque<ConferenceData> recentMessages = new ArrayDeque<>(); // the room's last text messages, for /pin
+    private final List<Poll> openPolls = new CopyOnWriteArrayList<>(); // oldest first; /vote answers the newest
+    private volatile boolean replayingHistory = false; // between HISTORY_BEGIN and HISTORY_END
+    private final Set<String> agreedFeatures = ConcurrentHashMap.newKeySet(); // from the server's Hello; empty if it predates it
+    private final Console console = new Console(); // all output during a session goes through it
+    private volatile LineInput lineInput; // line editing on a terminal; null when input is piped in
+    private Scanner stdin; // what is read instead when there is no lineInput
+
 
 
-    private static final DateTimeFormatter TIME_FORMATTER = DateTimeFormatter.ofPattern("HH:mm");
+    // Offered in the Hello that opens the stream; the server answers with the ones it shares
+    private static final int PROTOCOL_VERSION = 2;
+    private static final List<String> CLIENT_CODECS = Arrays.asList("pcm16");
+    private static final List<String> DOWNLOAD_SORTS = List.of("none", "room", "sender");
+    private static final int RECONNECT_ATTEMPTS = 8; // about two minutes with the backoff
+    private static final String SERVER_SENDER = "Server"; // who the server's own messages come from
+    private static final int RECENT_MESSAGES = 50; // as many as the server keeps for late joiners
+    private static final Pattern ROOM_ID = Pattern.compile("[\\p{L}\\p{Nd}._-]+");
+    // Trailer on a join turned away because the name is registered to an account
+    private static final Metadata.Key<String> ACCOUNT_REQUIRED = Metadata.Key.of("account-required", Metadata.ASCII_STRING_MARSHALLER);
+    private static final List<String> CLIENT_FEATURES = Arrays.asList(
+            "audio", "file-transfer", "private-messages", "ephemeral-messages", "important-messages",
+            "session-resume", "audio-stats", "room-mute", "video", "screen-share", "adaptive-quality",
+            "raise-hand", "roles", "end-meeting", "roster", "chat-history", "capabilities", "file-checksum", "transfer-cancel",
+            "file-compression", "transfer-progress", "file-limits",
+            "room-files", "direct-transfer", "inbox", "spam-filter", "pins", "polls", "room-settings", "accounts", "e2e-text", "message-signing");
+    // What tab completes at the start of a line
+    private static final List<String> COMMANDS = List.of(
+            "/abort", "/accept", "/alias", "/audio", "/close", "/code", "/download", "/downloads", "/e2e", "/end", "/ephemeral", "/exit", "/fetch", "/filter",
+            "/floor", "/hand", "/hands", "/help", "/important", "/inbox", "/join", "/kick", "/leave", "/limit", "/log", "/login", "/mic", "/msg",
+            "/mute", "/muteall", "/overwrite", "/paste", "/pin", "/ping", "/pins", "/play", "/poll", "/preview", "/quit", "/record", "/register", "/reject", "/role", "/room", "/screen",
+            "/send", "/share", "/sound", "/spam", "/store", "/switch", "/theme", "/trust", "/tts", "/unpin", "/untrust", "/upload", "/upload-all", "/volume", "/vote", "/who");
+
+    // Fires the expiry notices of ephemeral messages
+    private final ScheduledExecutorService ttlScheduler = Executors.newSingleThreadScheduledExecutor(r -> {
+        Thread t = new Thread(r, "ttl-expiry");
+        t.setDaemon(true);
+        return t;
+    });
 
     public ChatClient(String host, int port) {
-        this.channel = ManagedChannelBuilder.forAddress(host, port)
+        // Resolve up front and race IPv6/IPv4 so dual-stack hosts connect on whichever family works
+        this(ManagedChannelBuilder.forAddress(HappyEyeballs.pickAddress(host, port), port)
                 .usePlaintext()
                 .defaultLoadBalancingPolicy("pick_first")
-                .build();
-        this.asyncStub = ConferenceServiceGrpc.newStub(channel);
+                .build());
+    }
+
+    /** Connects to a local server over a Unix domain socket, e.g. "unix:///run/conference.sock". */
+    public ChatClient(String unixTarget) {
+        // grpc-netty-shaded resolves unix: targets itself (epoll transport, Linux only)
+        this(ManagedChannelBuilder.forTarget(unixTarget)
+                .usePlaintext()
+                .build());
     }
 
-    private synchronized void printMessage(String message) {
-        System.out.print("\r\u001b[2K");
-        System.out.println(message);
+    private ChatClient(ManagedChannel channel) {
+        this.channel = channel;
+        this.calls = ClientInterceptors.intercept(channel, identityHeaders());
+        this.asyncStub = ConferenceServiceGrpc.newStub(calls);
+        this.console.setPrompt(this::promptText);
+        this.tabs = new RoomTabs(asyncStub, console, this::tabLine);
     }
 
-    private synchronized void printPrompt() {
-        System.out.print("[" + LocalDateTime.now().format(TIME_FORMATTER) + "] " + this.sender + ": ");
-        System.out.flush();
+    private void printMessage(String message) {
+        console.message(message);
+    }
+
+    private void printPrompt() {
+        console.prompt();
+    }
+
+    private String promptText() {
+        String room = tabs.sessionRoomShown() ? "" : " #" + tabs.shownRoom();
+        return "[" + timestamps.now() + connectionText() + "] " + theme.user(this.sender) + room + ": ";
+    }
+
+    // " · 23 ms" for the prompt, or what is wrong with the link
+    private String connectionText() {
+        ConnectionMonitor monitor = connection;
+        if (monitor == null) return "";
+        switch (monitor.getState()) {
+            case RECONNECTING: return " · " + tr("chat.link_reconnecting");
+            case OFFLINE: return " · " + tr("chat.link_offline");
+            default: return monitor.getLatencyMs() < 0 ? "" : " · " + monitor.getLatencyMs() + " ms";
+        }
+    }
+
+    private void onConnectionState(ConnectionMonitor.State state) {
+        switch (state) {
+            case RECONNECTING:
+                console.status("connection", tr("chat.status_reconnecting"));
+                break;
+            case OFFLINE:
+                console.status("connection", tr("chat.status_offline"));
+                printMessage(tr("chat.connection_lost"));
+                printPrompt();
+                break;
+            default:
+                console.status("connection", null);
+                ConnectionMonitor monitor = connection;
+                if (monitor == null) break; // the session just ended
+                printMessage(tr("chat.connection_restored", monitor.getLatencyMs()));
+                printPrompt();
+        }
     }
 
     public void shutdown() {
@@ -62,6 +227,9 @@ public class ChatClient {
         if (audioStreamer != null && audioStreamer.isAudioActive()) {
             audioStreamer.stopAudio();
         }
+        if (screenShare != null) screenShare.stop();
+        screenViewer.close();
+        if (lineInput != null) lineInput.close();
         try {
             channel.shutdown().awaitTermination(5, TimeUnit.SECONDS);
         } catch (InterruptedException e) {
@@ -70,61 +238,298 @@ public class ChatClient {
     }
 
     public SessionResult startChat(String sender, String roomId) throws InterruptedException {
+        return startChat(sender, roomId, "");
+    }
+
+    public SessionResult startChat(String sender, String roomId, String role) throws InterruptedException {
         this.sender = sender;
         this.roomId = roomId;
+        this.joinRole = role;
+        this.replayingHistory = false;
+        this.roomOwner = "";
+        this.cohosts.clear();
+        this.members.clear();
+        this.agreedFeatures.clear();
+        forgetPins();
+        openPolls.clear();
+        this.roomSettings = null;
+        this.passwordRejected = false;
+        this.accountRequired = false;
+        if (!sender.equals(accountName)) accountToken = null; // a token only logs in to its own name
         this.finishLatch = new CountDownLatch(1);
+        this.streamBroken = false;
+        this.tabs.reset(sender, roomId);
+        this.tabs.useAccount(accountToken);
         this.sessionResult = SessionResult.CONNECTION_ERROR; // Default to error
         final AtomicBoolean connectionSuccessful = new AtomicBoolean(false);
 
         StreamObserver<ConferenceData> responseObserver = new StreamObserver<>() {
             @Override
             public void onNext(ConferenceData data) {
-                if (data.getSender().equals(ChatClient.this.sender) && data.getPayloadCase() != ConferenceData.PayloadCase.COMMAND) {
+                if (data.getSender().equals(ChatClient.this.sender) && data.getPayloadCase() != ConferenceData.PayloadCase.COMMAND
+                        && !replayingHistory) {
                     return;
                 }
 
-                final boolean shouldPrintPrompt = data.getPayloadCase() != ConferenceData.PayloadCase.AUDIO_CHUNK;
+                final boolean shouldPrintPrompt = data.getPayloadCase() != ConferenceData.PayloadCase.AUDIO_CHUNK
+                        && data.getPayloadCase() != ConferenceData.PayloadCase.VIDEO_FRAME;
 
                 switch (data.getPayloadCase()) {
+                    case HELLO:
+                        agreedFeatures.clear();
+                        agreedFeatures.addAll(data.getHello().getFeaturesList());
+                        break;
                     case TEXT_MESSAGE:
                         ChatMessage chat = data.getTextMessage();
+                        if (chat.hasEncrypted()) {
+                            chat = decrypt(data.getSender(), chat);
+                            if (chat == null) break;
+                            data = data.toBuilder().setTextMessage(chat).build(); // so /pin finds it by its text
+                        }
                         if (data.getSender().equals("Sistema-FileTransfer") && chat.getContent().startsWith("FILE_REQUEST:")) {
                             handleP2PFileRequestNotification(chat.getContent());
                         } else {
-                            LocalDateTime dt = LocalDateTime.ofInstant(Instant.ofEpochSecond(chat.getTimestamp()), ZoneId.systemDefault());
+                            String time = timestamps.message(chat.getTimestamp());
                             String content = chat.getContent();
                             
-                            if (content.startsWith("(private)")) {
-                                printMessage(String.format("[%s] %s", dt.format(TIME_FORMATTER), content));
+                            // The server relays private messages as "(private from <sender>) <text>"
+                            if (content.startsWith("(private")) {
+                                String text = content.replaceFirst("^\\(private[^)]*\\)\\s*", "");
+                                printMessage(tr("chat.private_from", time, theme.user(data.getSender()), styled(text)));
+                                readAloud(text);
+                                logMessage(chat.getTimestamp(), data.getSender(), sender, text, false);
+                                ring(false);
+                                chime(NotificationSounds.Event.MESSAGE);
+                            } else if (!passesFilter(chat)) {
+                                rememberMessage(data); // hidden by /filter, but still pinnable
                             } else {
-                                printMessage(String.format("[%s] %s: %s", dt.format(TIME_FORMATTER), data.getSender(), content));
+                                rememberMessage(data);
+                                if (mentionsMe(chat)) ring(true);
+                                if (chat.getTtlSeconds() > 0) {
+                                    printEphemeralMessage(data.getSender(), chat, time);
+                                } else {
+                                    tabs.showSessionRoom(chatLine(data.getSender(), chat, time));
+                                }
+                                readAloud(tr("chat.says", data.getSender(), content));
+                                if (chat.getTtlSeconds() == 0) logMessage(chat.getTimestamp(), data.getSender(), "", content, chat.getImportant());
+                                chime(NotificationSounds.Event.MESSAGE);
                             }
                         }
                         break;
                     case FILE_ANNOUNCEMENT:
                         BroadcastFileAnnouncement announce = data.getFileAnnouncement();
                         String size = String.format("%.2f KiB", (double) announce.getFileSize() / 1024.0);
-                        printMessage(String.format("%s está compartiendo '%s' (%s).", data.getSender(), announce.getFilename(), size));
-                        printMessage(String.format("   Para descargar, usa: /download %s <ruta_destino>", announce.getTransferId()));
-                        fileTransferManager.registerBroadcastTransfer(announce.getTransferId(), announce.getFileSize());
+                        printMessage(tr("chat.shared_file", data.getSender(), announce.getFilename(), size));
+                        printMessage(tr("chat.shared_file_download", announce.getTransferId()));
+                        chime(NotificationSounds.Event.FILE);
+                        fileTransferManager.registerBroadcastTransfer(announce.getTransferId(), data.getSender(),
+                                announce.getFilename(), announce.getFileSize(), announce.getSha256(), announce.getCompression());
+                        if (!replayingHistory && announce.getSenderRegistered() && autoAccepts(data.getSender(), announce.getFileSize())) {
+                            printMessage(tr("chat.auto_downloading"));
+                            logAutoAccepted(data.getSender(), announce.getFilename(), announce.getFileSize());
+                            fileTransferManager.downloadBroadcastFile(announce.getTransferId(), null, roomId);
+                        }
+                        break;
+                    case TRANSFER_COMPLETE:
+                        fileTransferManager.handleTransferComplete(data.getTransferComplete());
+                        break;
+                    case E2E_KEY:
+                        handleE2EKey(data.getE2EKey());
+                        break;
+                    case SIGNING_KEY:
+                        handleSigningKey(data.getSigningKey());
+                        break;
+                    case KEY_ENVELOPE:
+                        handleKeyEnvelope(data.getKeyEnvelope());
+                        break;
+                    case PINS:
+                        handlePins(data.getPins().getPinsList());
+                        break;
+                    case POLL:
+                        handlePoll(data.getPoll());
+                        break;
+                    case SETTINGS:
+                        handleSettings(data.getSender(), data.getSettings());
+                        break;
+                    case ROOM_FILE:
+                        RoomFile stored = data.getRoomFile();
+                        if (!stored.getRecipient().isEmpty()) {
+                            printMessage(tr("chat.inbox_file", stored.getSender(), stored.getFilename(), (double) stored.getFileSize() / 1024.0));
+                            printMessage(tr("chat.stored_file_fetch", stored.getFileId()));
+                            fileTransferManager.registerRoomFile(stored);
+                            chime(NotificationSounds.Event.FILE);
+                            break;
+                        }
+                        printMessage(tr("chat.stored_file", stored.getSender(), stored.getFilename(), (double) stored.getFileSize() / 1024.0));
+                        printMessage(tr("chat.stored_file_fetch", stored.getFileId()));
+                        fileTransferManager.registerRoomFile(stored);
                         break;
                     case AUDIO_CHUNK:
                         if (audioStreamer != null && audioStreamer.isSpeakersActive()) {
-                            audioStreamer.playAudioChunk(data.getAudioChunk().getData().toByteArray());
+                            AudioChunk chunk = data.getAudioChunk();
+                            String speaker = chunk.getSender().isEmpty() ? data.getSender() : chunk.getSender();
+                            audioStreamer.playAudioChunk(speaker, chunk);
+                        }
+                        break;
+                    case VIDEO_FRAME:
+                        VideoFrame frame = data.getVideoFrame();
+                        if (frame.getSource() == VideoSource.VIDEO_SCREEN) {
+                            screenViewer.accept(data.getSender(), frame);
                         }
                         break;
                     case COMMAND:
                         com.conference.grpc.Command cmd = data.getCommand();
-                        if (cmd.getType().equals("ERROR")) {
-                            System.out.println("\r\u001b[2K Error del Servidor: " + cmd.getValue());
+                        if (cmd.getType().equals("HISTORY_BEGIN")) {
+                            replayingHistory = true;
+                            printMessage(tr("chat.history_start", cmd.getValue()));
+                        } else if (cmd.getType().equals("HISTORY_END")) {
+                            replayingHistory = false;
+                            printMessage(tr("chat.history_end"));
+                        } else if (replayingHistory) {
+                            // Old commands are only shown; acting on them would replay stale state
+                            printMessage(tr("chat.history", data.getSender(), cmd.getType(), cmd.getValue()));
+                        } else if (cmd.getType().equals("ERROR")) {
+                            printMessage(tr("chat.server_error", cmd.getValue()));
                             finishLatch.countDown();
+                        } else if (cmd.getType().equals("ROOM_CHANGED")) {
+                            ChatClient.this.roomId = cmd.getValue();
+                            audioStreamer.setRoomId(cmd.getValue());
+                            screenShare.setRoomId(cmd.getValue());
+                            raisedHands.clear(); // the new room sends its own queue, roles, roster and pins
+                            members.clear();
+                            cohosts.clear();
+                            forgetPins();
+                            openPolls.clear(); // the new room sends its open ones
+                            roomSettings = null;
+                            resetE2E(); // the new room lists its own keys
+                            announceE2E();
+                            printMessage(tr("chat.moved", cmd.getValue()));
+                        } else if (cmd.getType().equals("ROSTER")) {
+                            members.clear();
+                            for (String name : cmd.getValue().split(",")) {
+                                if (!name.isEmpty()) members.add(name);
+                            }
+                            printMessage(tr("chat.who", members.size(), String.join(", ", members)));
+                        } else if (cmd.getType().equals("USER_JOINED")) {
+                            members.add(cmd.getValue());
+                            if (!cmd.getValue().equals(sender)) printMessage(tr("chat.joined", theme.user(cmd.getValue())));
+                        } else if (cmd.getType().equals("USER_LEFT")) {
+                            members.remove(cmd.getValue());
+                            printMessage(tr("chat.left", theme.user(cmd.getValue())));
+                            e2eMemberGone(cmd.getValue());
+                        } else if (cmd.getType().equals("RECORDING")) {
+                            printMessage(cmd.getValue().equals("on")
+                                    ? tr("chat.recording_by", data.getSender())
+                                    : tr("chat.recording_stopped_by", data.getSender()));
+                        } else if (cmd.getType().equals("ROOM_OWNER")) {
+                            roomOwner = cmd.getValue();
+                            cohosts.remove(roomOwner);
+                            printMessage(roomOwner.equals(sender)
+                                    ? tr("chat.you_are_host")
+                                    : tr("chat.host", roomOwner));
+                        } else if (cmd.getType().equals("ROLES")) {
+                            cohosts.clear();
+                            for (String entry : cmd.getValue().split(",")) {
+                                int i = entry.lastIndexOf(':');
+                                if (i <= 0) continue;
+                                if (entry.substring(i + 1).equals("host")) roomOwner = entry.substring(0, i);
+                                else cohosts.add(entry.substring(0, i));
+                            }
+                            if (!cohosts.isEmpty()) printMessage(tr("chat.cohosts", String.join(", ", cohosts)));
+                        } else if (cmd.getType().equals("ROLE_CHANGED")) {
+                            int i = cmd.getValue().lastIndexOf(':');
+                            String user = cmd.getValue().substring(0, Math.max(0, i));
+                            boolean cohost = cmd.getValue().endsWith(":cohost");
+                            if (cohost) cohosts.add(user); else cohosts.remove(user);
+                            if (user.equals(sender)) printMessage(cohost ? tr("chat.you_are_cohost") : tr("chat.you_are_attendee"));
+                            else printMessage(cohost ? tr("chat.now_cohost", user) : tr("chat.now_attendee", user));
+                        } else if (cmd.getType().equals("MEETING_ENDED")) {
+                            // Leave on our own before the server closes the stream
+                            printMessage(tr("chat.meeting_ended", cmd.getValue()));
+                            sessionResult = SessionResult.NORMAL_LEAVE;
+                            requestObserver.onCompleted();
+                            return;
+                        } else if (cmd.getType().equals("FILE_DENIED")) {
+                            fileTransferManager.handleFileDenied(cmd.getValue());
+                        } else if (cmd.getType().equals("TRANSFER_EXPIRED")) {
+                            fileTransferManager.handleTransferExpired(cmd.getValue());
+                        } else if (cmd.getType().equals("FILE_EXPIRING")) {
+                            fileTransferManager.handleFileExpiring(cmd.getValue());
+                        } else if (cmd.getType().equals("FILE_EXPIRED")) {
+                            fileTransferManager.handleFileExpired(cmd.getValue());
+                        } else if (cmd.getType().equals("USER_MUTED") || cmd.getType().equals("USER_UNMUTED")) {
+                            boolean muted = cmd.getType().equals("USER_MUTED");
+                            if (muted) serverMuted.add(cmd.getValue()); else serverMuted.remove(cmd.getValue());
+                            if (cmd.getValue().equals(sender)) {
+                                printMessage(muted
+                                        ? tr("chat.you_were_muted", data.getSender())
+                                        : tr("chat.floor_returned", data.getSender()));
+                            } else {
+                                printMessage(muted ? tr("chat.user_muted_by", cmd.getValue(), data.getSender())
+                                        : tr("chat.user_unmuted_by", cmd.getValue(), data.getSender()));
+                            }
+                        } else if (cmd.getType().equals("ROOM_MUTED")) {
+                            printMessage(tr("chat.room_muted", cmd.getValue()));
+                        } else if (cmd.getType().equals("ROOM_UNMUTED")) {
+                            serverMuted.clear();
+                            printMessage(tr("chat.room_unmuted", cmd.getValue()));
+                        } else if (cmd.getType().equals("SHARE_STARTED")) {
+                            handleShareStarted(cmd.getValue());
+                        } else if (cmd.getType().equals("SHARE_STOPPED")) {
+                            if (cmd.getValue().equals(sender)) {
+                                screenShare.stop();
+                                printMessage(tr("chat.you_stopped_sharing"));
+                            } else {
+                                printMessage(tr("chat.stopped_sharing_screen", cmd.getValue()));
+                            }
+                        } else if (cmd.getType().equals("HAND_QUEUE")) {
+                            raisedHands.clear();
+                            raisedHands.addAll(Arrays.asList(cmd.getValue().split(",")));
+                            printMessage(tr("chat.raised_hands", String.join(", ", raisedHands)));
+                        } else if (cmd.getType().equals("HAND_RAISED")) {
+                            raisedHands.add(cmd.getValue());
+                            printMessage(cmd.getValue().equals(sender)
+                                    ? tr("chat.you_raised_hand", raisedHands.size())
+                                    : tr("chat.raised_hand", cmd.getValue()));
+                        } else if (cmd.getType().equals("HAND_LOWERED")) {
+                            raisedHands.remove(cmd.getValue());
+                            printMessage(cmd.getValue().equals(sender)
+                                    ? tr("chat.your_hand_lowered")
+                                    : tr("chat.lowered_hand", cmd.getValue()));
+                        } else if (cmd.getType().equals("FLOOR_GIVEN")) {
+                            raisedHands.remove(cmd.getValue());
+                            serverMuted.remove(cmd.getValue());
+                            printMessage(cmd.getValue().equals(sender)
+                                    ? tr("chat.floor_given_to_you", data.getSender())
+                                    : tr("chat.floor_given", data.getSender(), cmd.getValue()));
+                        } else if (cmd.getType().equals("SHARE_DENIED") || cmd.getType().equals("MUTE_DENIED")
+                                || cmd.getType().equals("FLOOR_DENIED") || cmd.getType().equals("ROLE_DENIED")
+                                || cmd.getType().equals("SPAM_FILTER_DENIED") || cmd.getType().equals("PIN_DENIED")
+                                || cmd.getType().equals("SETTINGS_DENIED") || cmd.getType().equals("ACCOUNT_DENIED")
+                                || cmd.getType().equals("E2E_DENIED") || cmd.getType().equals("SIGNATURE_DENIED")) {
+                            printMessage("❌ " + cmd.getValue());
+                        } else if (cmd.getType().equals("SPAM_BLOCKED")) {
+                            printMessage(tr("chat.spam_blocked"));
+                        } else if (cmd.getType().equals("SPAM_FILTER_CHANGED")) {
+                            String[] limit = cmd.getValue().split("/", 2);
+                            printMessage(limit.length == 2 ? tr("chat.spam_filter", data.getSender(), limit[0], limit[1])
+                                    : tr("chat.spam_filter_off", data.getSender()));
+                        } else if (cmd.getType().equals("ROOM_FROZEN")) {
+                            printMessage(tr("chat.room_frozen", (cmd.getValue().isEmpty() ? "." : ": " + cmd.getValue())));
+                        } else if (cmd.getType().equals("ROOM_UNFROZEN")) {
+                            printMessage(tr("chat.room_unfrozen"));
+                        } else if (cmd.getType().equals("SESSION")) {
+                            sessionToken = cmd.getValue();
+                            return;
+                        } else if (cmd.getType().equals("IDENTIFIED")) {
+                            printMessage(tr("chat.identified", cmd.getValue()));
                         } else if (cmd.getType().equals("WELCOME")) {
                             connectionSuccessful.set(true);
-                            System.out.print("\r\u001b[2K");
-                            System.out.println("Conectado exitosamente como '" + sender + "' en sala '" + roomId + "'");
-                            System.out.println("Ya puedes chatear. Escribe /help para ver todos los comandos.");
+                            if (reconnectAttempt > 0) return; // reconnect() says so
+                            printMessage(tr("chat.connected", sender, roomId));
+                            printMessage(tr("chat.ready"));
                         } else {
-                            printMessage(String.format("[SERVER] %s: %s", cmd.getType(), cmd.getValue()));
+                            printMessage(tr("chat.server", cmd.getType(), cmd.getValue()));
                         }
                         break;
                     default:
@@ -134,226 +539,2159 @@ public class ChatClient {
                     printPrompt();
                 }
             }
-            @Override public void onError(Throwable t) { System.out.println("\r\u001b[2K Error en la conexión: " + t.getMessage()); finishLatch.countDown(); }
+            @Override public void onError(Throwable t) {
+                Metadata trailers = Status.trailersFromThrowable(t);
+                accountRequired = trailers != null && trailers.containsKey(ACCOUNT_REQUIRED);
+                passwordRejected = !accountRequired && Status.fromThrowable(t).getCode() == Status.Code.UNAUTHENTICATED;
+                if (connectionSuccessful.get()) {
+                    printMessage(tr("chat.stream_dropped", t.getMessage()));
+                } else if (reconnectAttempt == 0 || accountRequired) {
+                    printMessage(tr("chat.connection_error", t.getMessage()));
+                }
+                streamBroken = !accountRequired; // retrying won't help until we log in
+                finishLatch.countDown();
+            }
             @Override public void onCompleted() {
                 // If result is not already set to QUIT, it means it's a normal leave/disconnect.
                 if (sessionResult != SessionResult.QUIT_APPLICATION) {
                     sessionResult = SessionResult.NORMAL_LEAVE;
                 }
-                System.out.println("\r\u001b[2K🔌 Desconectado de la sala.");
+                printMessage(tr("chat.disconnected"));
                 finishLatch.countDown();
             }
         };
 
-        requestObserver = asyncStub.joinConference(responseObserver);
-        this.audioStreamer = new AudioStreamer(requestObserver, sender, roomId);
-        this.fileTransferManager = new FileTransferManager(asyncStub, requestObserver, sender);
+        StreamRelay relay = new StreamRelay();
+        relay.attach(openStream(responseObserver));
+        requestObserver = relay;
+        this.audioStreamer = new AudioStreamer(requestObserver, sender, roomId, createAudioBackend());
+        this.audioStreamer.setInputDevice(config.get("audio.input", null));
+        this.audioStreamer.setOutputDevice(config.get("audio.output", null));
+        this.audioStreamer.getProcessor().setEnabled(Boolean.parseBoolean(config.get("audio.denoise", "true")));
+        try {
+            this.audioStreamer.setPreferredFormat(
+                    Integer.parseInt(config.get("audio.rate", String.valueOf(AudioStreamer.DEFAULT_SAMPLE_RATE))),
+                    Integer.parseInt(config.get("audio.channels", String.valueOf(AudioStreamer.DEFAULT_CHANNELS))),
+                    Integer.parseInt(config.get("audio.frames", String.valueOf(AudioStreamer.DEFAULT_FRAMES_PER_CHUNK))));
+        } catch (NumberFormatException e) {
+            printMessage(tr("chat.invalid_audio_format_config"));
+        }
+        this.textToSpeech = new TextToSpeech(audioStreamer, config.get("tts.engine", "auto"));
+        this.textToSpeech.setEnabled(Boolean.parseBoolean(config.get("tts.enabled", "false")));
+        applyLogConfig();
+        this.aliases = new CommandAliases(config, COMMANDS);
+        try {
+            this.theme = Theme.named(config.get("theme", "dark"));
+        } catch (IllegalArgumentException e) {
+            printMessage(tr("chat.invalid_theme_config", e.getMessage()));
+        }
+        try {
+            this.timestamps = new Timestamps(config.get("time.clock", "24h"), config.get("time.zone", ""),
+                    config.get("time.style", "absolute"), config.get("time.source", "server"));
+        } catch (IllegalArgumentException e) {
+            this.timestamps = Timestamps.standard();
+            printMessage(tr("chat.invalid_time_config", e.getMessage()));
+        }
+        this.notificationSounds = new NotificationSounds(audioStreamer);
+        this.notificationSounds.setEnabled(NotificationSounds.Event.MESSAGE, Boolean.parseBoolean(config.get("sounds.message", "false")));
+        this.notificationSounds.setEnabled(NotificationSounds.Event.FILE, Boolean.parseBoolean(config.get("sounds.file", "true")));
+        try {
+            this.notificationSounds.setQuietHours(config.get("sounds.quiet", ""));
+        } catch (DateTimeParseException e) {
+            printMessage(tr("chat.invalid_sounds_quiet_config"));
+        }
+        this.audioStreamer.setNoticeListener(notice -> {
+            printMessage(notice);
+            printPrompt();
+        });
+        this.audioStreamer.setSpeakingListener(speaker -> {
+            printMessage(tr("chat.speaking", theme.user(speaker)));
+            printPrompt();
+        });
+        this.screenShare = new ScreenShare(requestObserver, sender, roomId);
+        this.fileTransferManager = new FileTransferManager(asyncStub, requestObserver, sender, console);
+        try {
+            this.fileTransferManager.setUploadLimit(Integer.parseInt(config.get("transfer.limit", "0")));
+        } catch (NumberFormatException e) {
+            printMessage(tr("chat.invalid_transfer_limit_config"));
+        }
+        this.fileTransferManager.setOverwrite(Boolean.parseBoolean(config.get("transfer.overwrite", "false")));
+        applyPreviewConfig();
+        String downloadDir = downloadDirFlag != null ? downloadDirFlag : config.get("download.dir", "");
+        if (!downloadDir.isEmpty()) this.fileTransferManager.setDownloadDir(java.nio.file.Paths.get(downloadDir));
+        String downloadSort = config.get("download.sort", "none");
+        if (DOWNLOAD_SORTS.contains(downloadSort)) {
+            this.fileTransferManager.setDownloadSort(downloadSort);
+        } else {
+            printMessage(tr("chat.invalid_download_sort_config"));
+        }
 
         try {
-            ConferenceData joinMessage = ConferenceData.newBuilder().setSender(sender).setRoomId(roomId)
-                    .setCommand(com.conference.grpc.Command.newBuilder().setType("JOIN").build()).build();
-            requestObserver.onNext(joinMessage);
+            e2eOn = supports("e2e-text") && Boolean.parseBoolean(config.get("e2e.enabled", "false"));
+            resetE2E();
+            requestObserver.onNext(joinMessage());
+            announceE2E();
+            connection = new ConnectionMonitor(channel, this::onConnectionState);
+            try {
+                connection.start(Integer.parseInt(config.get("ping.interval", String.valueOf(ConnectionMonitor.DEFAULT_INTERVAL_SECONDS))));
+            } catch (NumberFormatException e) {
+                printMessage(tr("chat.invalid_ping_interval_config", ConnectionMonitor.DEFAULT_INTERVAL_SECONDS));
+                connection.start(ConnectionMonitor.DEFAULT_INTERVAL_SECONDS);
+            }
             Thread inputThread = new Thread(this::handleUserInput);
+            inputThread.setDaemon(true); // still reading if we give up on the server
             inputThread.start();
             finishLatch.await();
+            // A stream that broke after WELCOME is the server restarting or the network dropping: join again
+            while (streamBroken && connectionSuccessful.get() && sessionResult == SessionResult.CONNECTION_ERROR) {
+                if (!reconnect(relay, responseObserver, connectionSuccessful)) break;
+                finishLatch.await();
+            }
             inputThread.interrupt();
         } catch (RuntimeException e) {
             requestObserver.onError(e);
             throw e;
+        } finally {
+            tabs.closeAll();
+            if (connection != null) connection.stop();
+            connection = null;
+            console.status("connection", null);
         }
         return this.sessionResult;
     }
 
+    // The server only acts for a name on calls that carry its session token, and only hands a registered name's
+    // inbox to calls with its account token, so every call gets ours once we have them
+    private ClientInterceptor identityHeaders() {
+        Metadata.Key<String> sessionKey = Metadata.Key.of("session-token", Metadata.ASCII_STRING_MARSHALLER);
+        Metadata.Key<String> accountKey = Metadata.Key.of("account-token", Metadata.ASCII_STRING_MARSHALLER);
+        return new ClientInterceptor() {
+            @Override
+            public <ReqT, RespT> ClientCall<ReqT, RespT> interceptCall(MethodDescriptor<ReqT, RespT> method, CallOptions options, Channel next) {
+                return new ForwardingClientCall.SimpleForwardingClientCall<>(next.newCall(method, options)) {
+                    @Override
+                    public void start(Listener<RespT> listener, Metadata headers) {
+                        String session = sessionToken, account = accountToken;
+                        if (session != null && !headers.containsKey(sessionKey)) headers.put(sessionKey, session);
+                        if (account != null && !headers.containsKey(accountKey)) headers.put(accountKey, account);
+                        super.start(listener, headers);
+                    }
+                };
+            }
+        };
+    }
+
+    // Opens JoinConference with our session token, so the server gives us our name back after a drop
+    private StreamObserver<ConferenceData> openStream(StreamObserver<ConferenceData> responseObserver) {
+        Metadata metadata = new Metadata();
+        if (sessionToken != null) {
+            metadata.put(Metadata.Key.of("session-token", Metadata.ASCII_STRING_MARSHALLER), sessionToken);
+        }
+        if (roomPassword != null) {
+            metadata.put(Metadata.Key.of("room-password", Metadata.ASCII_STRING_MARSHALLER), roomPassword);
+        }
+        if (accountToken != null) {
+            metadata.put(Metadata.Key.of("account-token", Metadata.ASCII_STRING_MARSHALLER), accountToken);
+        }
+        // Moderators join with the admin token so they can keep talking in frozen rooms
+        if (adminToken != null && !adminToken.isEmpty()) {
+            metadata.put(Metadata.Key.of("admin-token", Metadata.ASCII_STRING_MARSHALLER), adminToken);
+            moderator = true;
+        }
+        ConferenceServiceGrpc.ConferenceServiceStub joinStub =
+                asyncStub.withInterceptors(MetadataUtils.newAttachHeadersInterceptor(metadata));
+        return joinStub.joinConference(responseObserver);
+    }
+
+    private ConferenceData joinMessage() {
+        ConferenceData.Builder joinMessage = ConferenceData.newBuilder().setSender(sender).setRoomId(roomId);
+        ServerInfo info = serverInfo;
+        if (info != null && info.getFeaturesList().contains("capabilities")) {
+            joinMessage.setHello(Hello.newBuilder().setProtocolVersion(PROTOCOL_VERSION)
+                    .setVersion(CrashReporter.CLIENT_VERSION).addAllCodecs(CLIENT_CODECS)
+                    .addAllFeatures(CLIENT_FEATURES).setRole(joinRole));
+            MessageSigner signing = messageSigner();
+            if (signing != null && info.getFeaturesList().contains("message-signing")) {
+                joinMessage.getHelloBuilder().setSigningKey(ByteString.copyFrom(signing.publicKey()));
+            }
+        } else {
+            // Servers without the handshake only understand the JOIN command
+            joinMessage.setCommand(com.conference.grpc.Command.newBuilder().setType("JOIN").setValue(joinRole));
+        }
+        return joinMessage.build();
+    }
+
+    // Joins the room again on a new stream, waiting longer after each failure. Returns true once the server
+    // welcomes us; false if the user left meanwhile, the server turned us away, or it never came back, in
+    // which case the application closes.
+    private boolean reconnect(StreamRelay relay, StreamObserver<ConferenceData> responseObserver,
+                              AtomicBoolean connected) throws InterruptedException {
+        relay.detach();
+        int attempts = RECONNECT_ATTEMPTS;
+        try {
+            attempts = Integer.parseInt(config.get("reconnect.attempts", String.valueOf(RECONNECT_ATTEMPTS)));
+        } catch (NumberFormatException e) {
+            printMessage(tr("chat.invalid_reconnect_attempts_config", RECONNECT_ATTEMPTS));
+        }
+        try {
+            for (reconnectAttempt = 1; reconnectAttempt <= attempts; reconnectAttempt++) {
+                long delay = Math.min(30, 1L << Math.min(reconnectAttempt - 1, 5));
+                console.status("reconnect", tr("chat.reconnect_waiting", delay, reconnectAttempt, attempts));
+                for (long until = System.currentTimeMillis() + delay * 1000; System.currentTimeMillis() < until; ) {
+                    if (sessionResult != SessionResult.CONNECTION_ERROR) return false; // /leave or /quit meanwhile
+                    Thread.sleep(200);
+                }
+                console.status("reconnect", tr("chat.reconnect_trying", reconnectAttempt, attempts));
+                connected.set(false);
+                streamBroken = false;
+                finishLatch = new CountDownLatch(1);
+                // The server sends the roster, roles, hands, pins and open polls again on joining
+                members.clear();
+                cohosts.clear();
+                raisedHands.clear();
+                pinsKnown = false;
+                openPolls.clear();
+                resetE2E();
+                relay.attach(openStream(responseObserver));
+                relay.onNext(joinMessage());
+                announceE2E();
+                while (!connected.get()) {
+                    if (finishLatch.await(100, TimeUnit.MILLISECONDS)) break;
+                }
+                if (connected.get()) {
+                    if (sessionResult != SessionResult.CONNECTION_ERROR) relay.onCompleted(); // left while joining
+                    printMessage(tr("chat.reconnected", roomId));
+                    printPrompt();
+                    return true;
+                }
+                relay.detach();
+                if (!streamBroken) return false; // turned away, e.g. our name was taken meanwhile
+            }
+            printMessage(tr("chat.reconnect_gave_up", attempts));
+            sessionResult = SessionResult.QUIT_APPLICATION;
+            return false;
+        } finally {
+            reconnectAttempt = 0;
+            console.status("reconnect", null);
+        }
+    }
+
     private void handleUserInput() {
-        Scanner scanner = new Scanner(System.in);
+        // Opened once and kept across rooms, so history carries over
+        if (lineInput == null) {
+            List<String> commands = new ArrayList<>(COMMANDS);
+            commands.addAll(aliases.names());
+            lineInput = LineInput.open(ClientConfig.defaultPath().resolveSibling("history"), commands, () -> members);
+            if (lineInput != null) console.attach(lineInput);
+        }
+        LineInput input = lineInput;
+        stdin = input == null ? new Scanner(System.in) : null;
         printPrompt();
         while (!Thread.currentThread().isInterrupted()) {
             try {
-                if (scanner.hasNextLine()) {
-                    String line = scanner.nextLine().trim();
+                String line = input != null ? input.readLine(promptText())
+                        : stdin.hasNextLine() ? stdin.nextLine() : null;
+                if (line != null) {
+                    line = line.trim();
                     if (line.isEmpty()) {
-                        System.out.print("\r\u001b[2K"); // Clear the line before re-printing prompt
                         printPrompt();
                         continue;
                     }
-                    if (line.startsWith("/")) {
-                        if (handleCommand(line)) break;
-                    } else {
-                        ChatMessage chat = ChatMessage.newBuilder().setSender(this.sender).setContent(line).setRoomId(this.roomId)
-                                .setTimestamp(Instant.now().getEpochSecond()).setTraceId(UUID.randomUUID().toString()).build();
-                        ConferenceData data = ConferenceData.newBuilder().setSender(this.sender).setRoomId(this.roomId)
-                                .setTextMessage(chat).build();
-                        requestObserver.onNext(data);
-                        printPrompt();
-                    }
+                    if (dispatch(line)) break;
                 } else { break; }
             } catch (Exception e) { break; }
         }
     }
 
-    private boolean handleCommand(String commandLine) {
-        String[] parts = commandLine.split(" ", 3);
-        String command = parts[0].toLowerCase();
-        boolean shouldBreakLoop = false;
-
-        switch (command) {
-            case "/help": printHelp(); printPrompt(); break;
-            case "/quit": case "/exit":
-                printMessage("Cerrando aplicación...");
-                this.sessionResult = SessionResult.QUIT_APPLICATION;
-                requestObserver.onCompleted();
-                shouldBreakLoop = true;
-                break;
-            case "/leave":
-                 printMessage("Saliendo de la sala...");
-                 this.sessionResult = SessionResult.NORMAL_LEAVE;
-                 requestObserver.onCompleted();
-                 shouldBreakLoop = true;
-                 break;
-            case "/msg":
-                if (parts.length >= 3) {
-                    PrivateMessage pvtMsg = PrivateMessage.newBuilder().setRecipientId(parts[1]).setContent(parts[2]).build();
-                    ConferenceData data = ConferenceData.newBuilder().setSender(sender).setRoomId(roomId).setPrivateMessage(pvtMsg).build();
-                    requestObserver.onNext(data);
-                } else { printMessage("Uso: /msg <usuario> <mensaje>"); }
+    // Runs a line as typed: a command, or a message to the room. Aliases and macros are expanded first, and a
+    // macro's steps run in turn until one ends the session. Returns true if it did.
+    private boolean dispatch(String line) {
+        List<String> steps = line.startsWith("/") ? aliases.expand(line) : List.of(line);
+        for (String step : steps) {
+            if (step.startsWith("/")) {
+                if (handleCommand(step)) return true;
+            } else if (!tabs.sessionRoomShown()) {
+                tabs.send(Emoji.expand(step));
                 printPrompt();
-                break;
-            default:
-                handleOtherCommands(command, parts);
-                break;
+            } else if (reconnectAttempt > 0) {
+                printMessage(tr("chat.not_sent_offline"));
+                printPrompt();
+            } else {
+                sendText(step, 0, false);
+                printPrompt();
+            }
         }
-        return shouldBreakLoop;
+        return false;
     }
 
-    private void handleOtherCommands(String command, String[] parts) {
-        switch(command) {
-            case "/mic":
-                if (parts.length > 1 && parts[1].equalsIgnoreCase("on")) audioStreamer.startAudio();
-                else if (parts.length > 1 && parts[1].equalsIgnoreCase("off")) audioStreamer.stopAudio();
-                else printMessage("Uso: /mic <on|off>");
-                printPrompt();
-                break;
-            case "/upload":
-                if (parts.length == 3) fileTransferManager.uploadFile(parts[1], parts[2], roomId);
-                else printMessage("Uso: /upload <usuario> <ruta_archivo>");
-                break;
-            case "/upload-all":
-                if (parts.length == 2) fileTransferManager.broadcastFile(parts[1], roomId);
-                else printMessage("Uso: /upload-all <ruta_archivo>");
-                break;
-            case "/download":
-                if (parts.length == 3) fileTransferManager.downloadBroadcastFile(parts[1], parts[2]);
-                else printMessage("Uso: /download <id_transferencia> <ruta_destino>");
-                break;
-            case "/accept":
-                 if (parts.length == 3) fileTransferManager.acceptFile(parts[1], parts[2], roomId);
-                 else printMessage("Uso: /accept <transferId> <ruta_destino>");
-                break;
-            case "/reject":
-                if (parts.length == 2) fileTransferManager.rejectFile(parts[1], roomId);
-                else printMessage("Uso: /reject <transferId>");
-                break;
-            default:
-                printMessage("Comando no reconocido: " + command);
-                printPrompt();
-                break;
+    private void pasteImage(String recipient) {
+        Path file;
+        try {
+            file = ClipboardImage.save();
+        } catch (IOException e) {
+            printMessage(tr("chat.clipboard_failed", e.getMessage()));
+            return;
+        }
+        if (file == null) {
+            printMessage(tr("chat.clipboard_empty"));
+            return;
         }
+        printMessage(tr("chat.clipboard_saved", file.getFileName()));
+        if (recipient.equals("*")) fileTransferManager.broadcastFile(file.toString(), roomId);
+        else fileTransferManager.uploadFile(recipient, file.toString(), roomId);
     }
-    
-    private void handleP2PFileRequestNotification(String message) {
-        String[] parts = message.split(":");
-        if (parts.length >= 6) {
-            String transferId = parts[1], fileSender = parts[2], filename = parts[3];
+
+    // /code <line> sends one line as a code block; /code alone, or with just a language, reads lines
+    // until one that is only ```
+    private void sendCode(String arg) {
+        List<String> lines = new ArrayList<>();
+        String lang = "";
+        if (arg.isEmpty() || arg.matches("[\\w+#.-]+")) {
+            lang = arg;
+            printMessage(tr("chat.code_prompt"));
+            while (true) {
+                String line = readContinuation();
+                if (line == null) {
+                    printMessage(tr("chat.code_cancelled"));
+                    return;
+                }
+                if (line.trim().equals("```")) break;
+                lines.add(line);
+            }
+        } else {
+            lines.add(arg);
+        }
+        if (lines.isEmpty()) return;
+        sendText("```" + lang + "\n" + String.join("\n", lines) + "\n```", 0, false);
+    }
+
+    // A line of a multi-line entry such as /code, typed after a "... " prompt
+    private String readContinuation() {
+        LineInput input = lineInput;
+        if (input != null) return input.readLine("... ");
+        System.out.print("... ");
+        System.out.flush();
+        return stdin.hasNextLine() ? stdin.nextLine() : null;
+    }
+
+    private void sendText(String content, int ttlSeconds, boolean important) {
+        content = Emoji.expand(content);
+        if (!fitsTextLimit(content)) return;
+        ChatMessage chat = ChatMessage.newBuilder().setSender(this.sender).setContent(content).setRoomId(this.roomId)
+                .setTimestamp(Instant.now().getEpochSecond()).setTraceId(UUID.randomUUID().toString())
+                .setTtlSeconds(ttlSeconds).setImportant(important).build();
+        // Our own ID, which the server keeps, so /pin can point at what we sent
+        ConferenceData data = ConferenceData.newBuilder().setSender(this.sender).setRoomId(this.roomId)
+                .setMessageId(UUID.randomUUID().toString()).setTextMessage(chat).build();
+        if (e2eOn) {
+            // Never falls back to plain text: better unsent than readable by the server
+            RoomKeys keys = e2e;
+            if (keys == null || !keys.hasRoomKey()) {
+                printMessage(tr("chat.e2e_no_room_key"));
+                return;
+            }
             try {
-                long fileSize = Long.parseLong(parts[4]);
-                fileTransferManager.registerPendingP2PTransfer(transferId, fileSender, fileSize);
-                printMessage("\nSolicitud de archivo 1-a-1 recibida:");
-                printMessage("  De: " + fileSender);
-                printMessage("  Archivo: " + filename + " (" + fileSize + " bytes)");
-                printMessage("  Para aceptar: /accept " + transferId + " <ruta_destino>");
-                printMessage("  Para rechazar: /reject " + transferId);
-            } catch (NumberFormatException e) {
-                printMessage("Error: Formato de tamaño de archivo inválido en la notificación.");
+                ChatMessage sealed = chat.toBuilder().clearContent().setEncrypted(keys.encrypt(roomId, content)).build();
+                requestObserver.onNext(data.toBuilder().setTextMessage(signed(sealed)).build());
+            } catch (GeneralSecurityException e) {
+                printMessage(tr("chat.e2e_encrypt_failed", e.getMessage()));
+                return;
             }
+        } else {
+            requestObserver.onNext(data.toBuilder().setTextMessage(signed(chat)).build());
         }
+        rememberMessage(data);
+        if (ttlSeconds == 0) logMessage(chat.getTimestamp(), sender, "", content, important);
     }
-    
-    private static void printWelcome() {
-        System.out.println("\n━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━");
-        System.out.println("           CHAT gRPC - Cliente Java");
-        System.out.println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n");
+
+    // Our signing key pair, loaded (or made) on first use; null if it can't be
+    private MessageSigner messageSigner() {
+        if (signer == null) {
+            try {
+                Path config = ClientConfig.defaultPath();
+                signer = MessageSigner.load(config.resolveSibling("signing-key"), config.resolveSibling("known-signers"));
+            } catch (IOException | GeneralSecurityException e) {
+                printMessage(tr("chat.signing_unavailable", e.getMessage()));
+            }
+        }
+        return signer;
     }
 
-    private static void printHelp() {
-        System.out.println("\n═══════════════════════════════════════════════════════");
-        System.out.println("                   COMANDOS DISPONIBLES");
-        System.out.println("═══════════════════════════════════════════════════════");
-        System.out.println("\n\uD83D\uDCDD Comandos de Chat y Sala:");
-        System.out.println("  /help                          - Mostrar esta ayuda");
-        System.out.println("  /msg <usuario> <mensaje>       - Enviar un mensaje privado");
-        System.out.println("  /leave                         - Salir de la sala actual para unirse a otra");
-        System.out.println("  /quit, /exit                   - Cerrar la aplicación");
-        System.out.println("\n\uD83C\uDFA4 Comandos de Audio:");
-        System.out.println("  /mic <on|off>                  - Activar o desactivar micrófono y altavoces");
-        System.out.println("\n\uD83D\uDCE4 Comandos de Archivos (1 a 1):");
-        System.out.println("  /upload <usuario> <archivo>    - Enviar un archivo a un usuario");
-        System.out.println("  /accept <id> <ruta>            - Aceptar transferencia");
-        System.out.println("  /reject <id>                   - Rechazar transferencia");
-        System.out.println("\n\uD83D\uDCE3 Comandos de Archivos (Sala Completa):");
-        System.out.println("  /upload-all <archivo>          - Compartir un archivo con la sala");
-        System.out.println("  /download <id> <ruta>          - Descargar un archivo compartido");
-        System.out.println("\n═══════════════════════════════════════════════════════\n");
+    // chat signed, if the server pinned our key when we joined; as it is otherwise
+    private ChatMessage signed(ChatMessage chat) {
+        MessageSigner signing = signer;
+        if (signing == null || !supports("message-signing")) return chat;
+        try {
+            return signing.sign(chat);
+        } catch (GeneralSecurityException e) {
+            printMessage(tr("chat.signing_failed", e.getMessage()));
+            return chat;
+        }
     }
 
-    public static void main(String[] args) {
-        printWelcome();
-        Scanner scanner = new Scanner(System.in);
-        System.out.print("Dirección del servidor [localhost]: ");
-        String host = scanner.nextLine().trim();
-        if (host.isEmpty()) host = "localhost";
-        System.out.print("Puerto del servidor [50051]: ");
-        String portStr = scanner.nextLine().trim();
-        int port = portStr.isEmpty() ? 50051 : Integer.parseInt(portStr);
-        ChatClient client = new ChatClient(host, port);
-        System.out.println("\n──────────────────────────────────────────────────");
-        System.out.println("                UNIRSE A UNA SALA");
-        System.out.println("──────────────────────────────────────────────────");
+    // The server sends the key of each member who signs: those present when we join, then newcomers
+    private void handleSigningKey(SigningKey key) {
+        MessageSigner signing = signer;
+        if (signing == null) return;
+        byte[] publicKey = key.getPublicKey().toByteArray();
+        if (!signing.learn(key.getOwner(), publicKey) && !key.getOwner().equals(sender)) {
+            printMessage(tr("chat.signing_key_changed", theme.user(key.getOwner()), RoomKeys.fingerprint(publicKey)));
+        }
+    }
 
-        while (true) {
-            
-            System.out.print("\n🏠 ID de la sala (o escribe 'quit' para salir): ");
-            String roomId = scanner.nextLine().trim();
-            if (roomId.equalsIgnoreCase("quit")) break;
+    // Our key pair, loaded (or made) on first use; null if it can't be, e.g. a Java without X25519
+    private RoomKeys roomKeys() {
+        if (e2e == null) {
+            try {
+                e2e = RoomKeys.load(ClientConfig.defaultPath().resolveSibling("e2e-key"));
+            } catch (IOException | GeneralSecurityException e) {
+                printMessage(tr("chat.e2e_unavailable", e.getMessage()));
+            }
+        }
+        return e2e;
+    }
 
-            if (roomId.isEmpty()) {
-                System.err.println("❌ ¡El ID de la sala no puede estar vacíos!");
-                continue;
+    // The server lists the room's E2E keys again on every join, so what we knew of the last one goes
+    private void resetE2E() {
+        if (supports("e2e-text") && roomKeys() != null) e2e.reset(sender);
+    }
+
+    // Publishes our key in the session room after joining it, if encryption is on
+    private void announceE2E() {
+        if (e2eOn && e2e != null && supports("e2e-text")) sendE2EKey(true);
+    }
+
+    private void sendE2EKey(boolean on) {
+        E2EKey key = E2EKey.newBuilder().setPublicKey(on ? ByteString.copyFrom(e2e.publicKey()) : ByteString.EMPTY).build();
+        requestObserver.onNext(ConferenceData.newBuilder().setSender(sender).setRoomId(roomId).setE2EKey(key).build());
+    }
+
+    // Every published key comes from the server, ours too, in the order they were published. The first
+    // member is the keeper: it makes the room key and sends it to each newcomer.
+    private void handleE2EKey(E2EKey key) {
+        RoomKeys keys = e2e;
+        if (keys == null) return;
+        String owner = key.getOwner();
+        if (key.getPublicKey().isEmpty()) {
+            if (!owner.equals(sender)) printMessage(tr("chat.e2e_member_off", theme.user(owner)));
+            e2eMemberGone(owner);
+            return;
+        }
+        try {
+            keys.addMember(owner, key.getPublicKey().toByteArray());
+        } catch (GeneralSecurityException e) {
+            printMessage(tr("chat.e2e_bad_key", owner));
+            return;
+        }
+        if (!owner.equals(sender)) {
+            String fingerprint = RoomKeys.fingerprint(key.getPublicKey().toByteArray());
+            printMessage(verifiedE2E(owner)
+                    ? tr("chat.e2e_member_on", theme.user(owner), fingerprint)
+                    : tr("chat.e2e_member_unverified", theme.user(owner), fingerprint));
+        }
+        if (!e2eOn || !keys.isKeeper()) return;
+        if (!keys.hasRoomKey()) {
+            keys.newRoomKey();
+            printMessage(tr("chat.e2e_keeper", keys.epoch()));
+            sendRoomKey(keys.members());
+        } else if (!owner.equals(sender)) {
+            sendRoomKey(List.of(owner));
+        }
+    }
+
+    // Someone left or turned encryption off: the keeper (perhaps us, now) makes a new key they won't get
+    private void e2eMemberGone(String name) {
+        RoomKeys keys = e2e;
+        if (keys == null || !keys.removeMember(name) || !e2eOn || !keys.isKeeper()) return;
+        keys.newRoomKey();
+        printMessage(tr("chat.e2e_rekeyed", keys.epoch()));
+        sendRoomKey(keys.members());
+    }
+
+    private void sendRoomKey(List<String> names) {
+        for (String name : names) {
+            if (name.equals(sender)) continue;
+            try {
+                KeyEnvelope env = e2e.wrapFor(name);
+                requestObserver.onNext(ConferenceData.newBuilder().setSender(sender).setRoomId(roomId).setKeyEnvelope(env).build());
+            } catch (GeneralSecurityException e) {
+                printMessage(tr("chat.e2e_wrap_failed", name, e.getMessage()));
             }
+        }
+    }
+
+    private void handleKeyEnvelope(KeyEnvelope env) {
+        RoomKeys keys = e2e;
+        if (keys == null || !e2eOn) return;
+        try {
+            if (keys.accept(env)) printMessage(tr("chat.e2e_key_received", theme.user(env.getSender()), env.getEpoch()));
+        } catch (GeneralSecurityException e) {
+            printMessage(tr("chat.e2e_bad_envelope", env.getSender()));
+        }
+    }
 
-            System.out.print("👤 Tu nombre de usuario: ");
-            String sender = scanner.nextLine().trim();
+    // The message with its text in content, or null (after saying so) if we can't read it
+    private ChatMessage decrypt(String from, ChatMessage chat) {
+        RoomKeys keys = e2e;
+        try {
+            if (keys == null) throw new GeneralSecurityException("no keys");
+            return chat.toBuilder().setContent(keys.decrypt(roomId, from, chat.getEncrypted())).build();
+        } catch (GeneralSecurityException e) {
+            printMessage(tr("chat.e2e_unreadable", timestamps.message(chat.getTimestamp()), theme.user(from)));
+            return null;
+        }
+    }
 
-            
+    // Fingerprints checked with /e2e verify, kept as e2e.verified=name:fingerprint,...
+    private Map<String, String> verifiedE2EKeys() {
+        Map<String, String> verified = new TreeMap<>();
+        for (String entry : config.get("e2e.verified", "").split(",")) {
+            int i = entry.lastIndexOf(':');
+            if (i > 0) verified.put(entry.substring(0, i).trim(), entry.substring(i + 1).trim());
+        }
+        return verified;
+    }
 
-            if(sender.isEmpty()){
-                System.err.println("❌ ¡El nombre de usuario no puede estar vacíos!");
-                continue;
+    private void saveVerifiedE2EKeys(Map<String, String> verified) {
+        List<String> entries = new ArrayList<>();
+        verified.forEach((name, fingerprint) -> entries.add(name + ":" + fingerprint));
+        config.set("e2e.verified", entries.isEmpty() ? null : String.join(",", entries));
+        config.save();
+    }
+
+    // Whether name's current key is the one we checked; a new key needs checking again
+    private boolean verifiedE2E(String name) {
+        RoomKeys keys = e2e;
+        byte[] key = keys == null ? null : keys.memberKey(name);
+        return key != null && RoomKeys.fingerprint(key).replace(" ", "").equals(verifiedE2EKeys().get(name));
+    }
+
+    // /e2e [on|off] and /e2e verify <user> <fingerprint>
+    private void handleE2ECommand(String[] parts) {
+        if (!supports("e2e-text")) {
+            printMessage(tr("chat.e2e_not_supported"));
+            return;
+        }
+        RoomKeys keys = roomKeys();
+        if (keys == null) return;
+        String sub = parts.length > 1 ? parts[1].toLowerCase() : "";
+        switch (sub) {
+            case "on":
+            case "off": {
+                boolean on = sub.equals("on");
+                config.set("e2e.enabled", on ? "true" : null);
+                config.save();
+                if (on != e2eOn) {
+                    e2eOn = on;
+                    sendE2EKey(on);
+                }
+                printMessage(on ? tr("chat.e2e_on", keys.ownFingerprint()) : tr("chat.e2e_off"));
+                break;
             }
-            
-            try {
-                SessionResult result = client.startChat(sender, roomId);
+            case "verify": {
+                String[] args = parts.length > 2 ? parts[2].trim().split("\\s+", 2) : new String[0];
+                if (args.length < 2) {
+                    printMessage(tr("chat.usage_e2e"));
+                    break;
+                }
+                byte[] key = keys.memberKey(args[0]);
+                if (key == null) {
+                    printMessage(tr("chat.e2e_no_member_key", args[0]));
+                    break;
+                }
+                String fingerprint = RoomKeys.fingerprint(key);
+                if (!fingerprint.replace(" ", "").equalsIgnoreCase(args[1].replace(" ", ""))) {
+                    printMessage(tr("chat.e2e_mismatch", args[0], fingerprint));
+                    break;
+                }
+                Map<String, String> verified = verifiedE2EKeys();
+                verified.put(args[0], fingerprint.replace(" ", ""));
+                saveVerifiedE2EKeys(verified);
+                printMessage(tr("chat.e2e_verified", args[0]));
+                break;
+            }
+            case "":
+                printMessage(tr(e2eOn ? "chat.e2e_status_on" : "chat.e2e_status_off", keys.ownFingerprint()));
+                if (e2eOn) {
+                    printMessage(keys.hasRoomKey()
+                            ? tr("chat.e2e_status_key", keys.epoch(), keys.keeper())
+                            : tr("chat.e2e_no_room_key"));
+                }
+                for (String name : keys.members()) {
+                    if (name.equals(sender)) continue;
+                    String fingerprint = RoomKeys.fingerprint(keys.memberKey(name));
+                    printMessage(verifiedE2E(name)
+                            ? tr("chat.e2e_member_verified", name, fingerprint)
+                            : tr("chat.e2e_member_pending", name, fingerprint));
+                }
+                break;
+            default:
+                printMessage(tr("chat.usage_e2e"));
+        }
+    }
+
+    // Keeps a message of the room so /pin can find it; the server pins by message ID
+    private void rememberMessage(ConferenceData data) {
+        synchronized (recentMessages) {
+            if (recentMessages.size() == RECENT_MESSAGES) recentMessages.removeFirst();
+            recentMessages.addLast(data);
+        }
+    }
+
+    // The newest remembered message containing text, ignoring case; ephemeral ones can't be pinned
+    private ConferenceData findRecentMessage(String text) {
+        String wanted = text.toLowerCase();
+        synchronized (recentMessages) {
+            for (Iterator<ConferenceData> it = recentMessages.descendingIterator(); it.hasNext(); ) {
+                ConferenceData data = it.next();
+                ChatMessage chat = data.getTextMessage();
+                if (chat.getTtlSeconds() == 0 && chat.getContent().toLowerCase().contains(wanted)) return data;
+            }
+        }
+        return null;
+    }
+
+    private void forgetPins() {
+        pins.clear();
+        pinsKnown = false;
+        synchronized (recentMessages) {
+            recentMessages.clear();
+        }
+    }
+
+    // The server sends every pin each time: the first list is what the room
+    // already had, and after that we say what was pinned or unpinned
+    private void handlePins(List<PinnedMessage> list) {
+        Set<String> before = new HashSet<>();
+        for (PinnedMessage pin : pins) before.add(pin.getMessageId());
+        Set<String> after = new HashSet<>();
+        for (PinnedMessage pin : list) after.add(pin.getMessageId());
+        if (!pinsKnown) {
+            if (!list.isEmpty()) printMessage(tr("chat.pins_in_room", list.size()));
+        } else {
+            for (PinnedMessage pin : list) {
+                if (!before.contains(pin.getMessageId())) {
+                    printMessage(tr("chat.pinned", pin.getPinnedBy(), pin.getSender(), pin.getContent()));
+                }
+            }
+            for (PinnedMessage pin : pins) {
+                if (!after.contains(pin.getMessageId())) printMessage(tr("chat.unpinned", pin.getSender(), pin.getContent()));
+            }
+        }
+        pins.clear();
+        pins.addAll(list);
+        pinsKnown = true;
+    }
+
+    // The server sends a poll when it opens, on every vote, and once more when it closes
+    private void handlePoll(Poll poll) {
+        int known = -1;
+        for (int i = 0; i < openPolls.size(); i++) {
+            if (openPolls.get(i).getPollId().equals(poll.getPollId())) known = i;
+        }
+        if (poll.getClosed()) {
+            if (known >= 0) openPolls.remove(known);
+            printMessage(tr("chat.poll_closed", poll.getQuestion()));
+            int total = 0;
+            for (int votes : poll.getVotesList()) total += votes;
+            for (int i = 0; i < poll.getOptionsCount(); i++) {
+                int votes = poll.getVotes(i);
+                printMessage(String.format("  %d. %s: %d (%d%%)", i + 1, poll.getOptions(i), votes, total == 0 ? 0 : 100 * votes / total));
+            }
+        } else if (known < 0) {
+            openPolls.add(poll);
+            printMessage(tr("chat.poll_opened", theme.user(poll.getCreator()), poll.getQuestion()));
+            for (int i = 0; i < poll.getOptionsCount(); i++) printMessage(String.format("  %d. %s", i + 1, poll.getOptions(i)));
+            long minutes = Math.max(1, (poll.getClosesAt() - Instant.now().getEpochSecond() + 59) / 60);
+            printMessage(tr("chat.poll_how_to_vote", minutes));
+            if (!replayingHistory) chime(NotificationSounds.Event.MESSAGE);
+        } else {
+            openPolls.set(known, poll);
+            List<String> tally = new ArrayList<>();
+            for (int i = 0; i < poll.getOptionsCount(); i++) tally.add((i + 1) + ". " + poll.getOptions(i) + ": " + poll.getVotes(i));
+            printMessage(tr("chat.poll_tally", poll.getQuestion(), String.join(" · ", tally)));
+        }
+    }
+
+    // The server sends the room's settings on joining, and again whenever its owner changes one
+    private void handleSettings(String by, RoomSettings settings) {
+        RoomSettings before = roomSettings;
+        roomSettings = settings;
+        if (before == null) {
+            if (!settings.getTopic().isEmpty()) printMessage(tr("chat.topic", settings.getTopic()));
+            if (settings.getGuestFilesOff() || settings.getGuestAudioOff()) printMessage(tr("chat.guest_policy", guestPolicyText(settings)));
+            return;
+        }
+        if (!settings.getTopic().equals(before.getTopic())) {
+            printMessage(settings.getTopic().isEmpty() ? tr("chat.topic_cleared", by) : tr("chat.topic_changed", by, settings.getTopic()));
+        }
+        if (settings.getHasPassword() != before.getHasPassword()) {
+            printMessage(tr(settings.getHasPassword() ? "chat.password_set" : "chat.password_removed", by));
+        }
+        if (settings.getCapacity() != before.getCapacity()) {
+            printMessage(settings.getCapacity() == 0 ? tr("chat.capacity_unlimited", by) : tr("chat.capacity_set", by, settings.getCapacity()));
+        }
+        if (settings.getHistory() != before.getHistory()) {
+            printMessage(tr("chat.history_changed", by, historyText(settings.getHistory())));
+        }
+        if (!settings.getOwner().equals(before.getOwner())) {
+            printMessage(settings.getOwner().isEmpty() ? tr("chat.owner_cleared", by) : tr("chat.owner_changed", by, settings.getOwner()));
+        }
+        if (!guestPolicyText(settings).equals(guestPolicyText(before))) {
+            printMessage(tr("chat.guest_policy_changed", by, guestPolicyText(settings)));
+        }
+        if (settings.getFilesMb() != before.getFilesMb() || settings.getFilesMaxAge() != before.getFilesMaxAge()) {
+            printMessage(tr("chat.files_changed", by, filesText(settings)));
+        }
+    }
+
+    // What the room keeps guests (users not logged in to a registered name) from doing
+    private String guestPolicyText(RoomSettings s) {
+        List<String> rules = new ArrayList<>();
+        if (s.getRegisteredOnly()) rules.add(tr("chat.guests_kept_out"));
+        if (s.getGuestFilesOff()) rules.add(tr("chat.guests_no_files"));
+        if (s.getGuestAudioOff()) rules.add(tr("chat.guests_muted"));
+        return rules.isEmpty() ? tr("chat.guests_unrestricted") : String.join(", ", rules);
+    }
+
+    // How much of the files uploaded to it the room keeps, and for how long
+    private String filesText(RoomSettings s) {
+        String size = s.getFilesMb() == 0 ? tr("chat.files_default") : s.getFilesMb() < 0 ? tr("chat.files_unlimited") : s.getFilesMb() + " MiB";
+        long age = s.getFilesMaxAge();
+        String kept = age == 0 ? tr("chat.files_default") : age < 0 ? tr("chat.files_forever")
+                : age % 86400 == 0 ? age / 86400 + " d" : age % 3600 == 0 ? age / 3600 + " h" : age / 60 + " min";
+        return tr("chat.files_limits", size, kept);
+    }
+
+    private String historyText(int history) {
+        if (history == 0) return tr("chat.history_default");
+        if (history < 0) return tr("chat.history_none");
+        return tr("chat.history_messages", history);
+    }
+
+    // /room shows the settings; /room <key> <value> asks the server to change one (owner only)
+    private void handleRoomCommand(String[] parts) {
+        if (parts.length == 1) {
+            RoomSettings s = roomSettings;
+            if (s == null) {
+                printMessage(tr("chat.no_room_settings"));
+                return;
+            }
+            printMessage(tr("chat.room_settings", roomId, s.getTopic().isEmpty() ? "-" : s.getTopic(),
+                    tr(s.getHasPassword() ? "chat.yes" : "chat.no"), s.getCapacity() == 0 ? "-" : String.valueOf(s.getCapacity()),
+                    historyText(s.getHistory()), s.getOwner().isEmpty() ? "-" : s.getOwner(), guestPolicyText(s), filesText(s)));
+            return;
+        }
+        String key = parts[1].toLowerCase(), value = parts.length == 3 ? parts[2].trim() : "";
+        switch (key) {
+            case "topic":
+            case "password":
+            case "owner":
+                break;
+            case "capacity":
+                if (value.equals("off")) value = "0";
+                if (!value.matches("\\d{1,4}")) {
+                    printMessage(tr("chat.usage_room"));
+                    return;
+                }
+                break;
+            case "history":
+                if (!value.matches("\\d{1,4}|default|off")) {
+                    printMessage(tr("chat.usage_room"));
+                    return;
+                }
+                break;
+            case "registered_only":
+            case "guest_files":
+            case "guest_audio":
+                if (!value.equals("on") && !value.equals("off")) {
+                    printMessage(tr("chat.usage_room"));
+                    return;
+                }
+                break;
+            case "files_mb":
+                if (!value.matches("\\d{1,6}|default|off")) {
+                    printMessage(tr("chat.usage_room"));
+                    return;
+                }
+                break;
+            case "files_age":
+                if (!value.matches("\\d{1,5}[hm]|default|off")) {
+                    printMessage(tr("chat.usage_room"));
+                    return;
+                }
+                break;
+            default:
+                printMessage(tr("chat.usage_room"));
+                return;
+        }
+        sendRoomCommand("ROOM_SET", key + "=" + value);
+    }
+
+    // Registers name with password, or logs in to it, keeping the token for joining; false if the server says no
+    private boolean account(boolean register, String name, String password) {
+        AccountRequest request = AccountRequest.newBuilder().setUsername(name).setPassword(password).build();
+        try {
+            ConferenceServiceGrpc.ConferenceServiceBlockingStub stub = ConferenceServiceGrpc.newBlockingStub(calls)
+                    .withDeadlineAfter(10, TimeUnit.SECONDS); // bcrypt is slow on purpose
+            AccountSession session = register ? stub.register(request) : stub.login(request);
+            accountToken = session.getToken();
+            accountName = session.getUsername();
+            tabs.useAccount(accountToken);
+            printMessage(tr(register ? "chat.registered" : "chat.logged_in", session.getUsername()));
+            return true;
+        } catch (StatusRuntimeException e) {
+            printMessage(tr("chat.account_failed", e.getStatus().getDescription()));
+            return false;
+        }
+    }
+
+    // Splits text into words, keeping "quoted phrases" together
+    private static List<String> quotedWords(String text) {
+        List<String> words = new ArrayList<>();
+        Matcher m = Pattern.compile("\"([^\"]*)\"|(\\S+)").matcher(text);
+        while (m.find()) words.add(m.group(1) != null ? m.group(1) : m.group(2));
+        return words;
+    }
+
+    private String pinLine(int number, PinnedMessage pin) {
+        return String.format("  %d. [%s] %s: %s", number, timestamps.message(pin.getTimestamp()),
+                theme.user(pin.getSender()), styled(pin.getContent()));
+    }
+
+    private String chatLine(String from, ChatMessage chat, String time) {
+        if (from.equals(SERVER_SENDER)) {
+            // An operator's announcement, sent to every room
+            return String.format("[%s] \u001b[1m📢 %s: %s\u001b[0m", time, tr("chat.server_name"), styled(chat.getContent()));
+        }
+        if (chat.getImportant()) {
+            return String.format("[%s] \u001b[1m❗ %s%s%s: %s\u001b[0m", time, signatureMark(from, chat), e2eMark(from, chat),
+                    theme.user(from), styled(chat.getContent()));
+        }
+        return String.format("[%s] %s%s%s: %s", time, signatureMark(from, chat), e2eMark(from, chat), theme.user(from), styled(chat.getContent()));
+    }
+
+    // A warning before the sender when its signature is wrong, can't be checked, or is missing from someone who signs
+    private String signatureMark(String from, ChatMessage chat) {
+        MessageSigner signing = signer;
+        if (signing == null || from.equals(sender)) return "";
+        switch (signing.check(from, chat)) {
+            case INVALID:
+                return "⚠️ " + tr("chat.signature_invalid_mark") + " ";
+            case UNKNOWN_SIGNER:
+                return tr("chat.signature_unknown_mark") + " ";
+            case UNSIGNED:
+                return signing.knows(from) ? tr("chat.unsigned_mark") + " " : "";
+            default:
+                return "";
+        }
+    }
+
+    // "🔒 " before the sender of an encrypted message, with a warning if we haven't checked their fingerprint
+    private String e2eMark(String from, ChatMessage chat) {
+        if (!chat.hasEncrypted()) return "";
+        return from.equals(sender) || verifiedE2E(from) ? "🔒 " : "🔒 " + tr("chat.e2e_unverified_mark") + " ";
+    }
+
+    // A message in a room opened with /join, as its tab shows it; null if /filter hides it
+    private String tabLine(ConferenceData data) {
+        ChatMessage chat = data.getTextMessage();
+        String time = timestamps.message(chat.getTimestamp());
+        if (chat.getContent().startsWith("(private")) {
+            String text = chat.getContent().replaceFirst("^\\(private[^)]*\\)\\s*", "");
+            return String.format("[%s] (private from %s) %s", time, theme.user(data.getSender()), styled(text));
+        }
+        if (chat.hasEncrypted()) return tr("chat.e2e_unreadable", time, theme.user(data.getSender())); // only the session room has keys
+        if (!passesFilter(chat)) return null;
+        if (mentionsMe(chat)) ring(true);
+        return chatLine(data.getSender(), chat, time);
+    }
+
+    // Mirrors the server's MessageFilter: important messages always pass, and
+    // "mentions" also lets through messages containing @our-name.
+    private boolean passesFilter(ChatMessage chat) {
+        if (messageFilter.equals("all") || chat.getImportant()) return true;
+        return messageFilter.equals("mentions") && mentionsMe(chat);
+    }
+
+    // A received message's text as shown: markdown rendered (unless markdown: false) and our mentions highlighted
+    private String styled(String text) {
+        if (!config.get("markdown", "true").equals("false")) text = Markdown.render(text, theme.hasColors());
+        return theme.mentions(text, sender);
+    }
+
+    private boolean mentionsMe(ChatMessage chat) {
+        Matcher m = Pattern.compile("@" + Pattern.quote(sender) + "(?![\\w.-])", Pattern.CASE_INSENSITIVE)
+                .matcher(chat.getContent());
+        return m.find();
+    }
+
+    // notify.bell rings the terminal bell for private messages ("private"), and
+    // for messages that mention us too ("mentions"); "off" by default
+    private void ring(boolean mention) {
+        String bell = config.get("notify.bell", "off");
+        if (replayingHistory || bell.equals("off") || mention && !bell.equals("mentions")) return;
+        System.out.print("\u0007");
+        System.out.flush();
+    }
+
+    // Ephemeral messages show their remaining lifetime and get an expiry notice,
+    // both computed from the message's own timestamp + ttl.
+    // Messages can arrive before the join finishes setting up audio
+    private void readAloud(String text) {
+        if (replayingHistory) return;
+        TextToSpeech tts = textToSpeech;
+        if (tts != null) tts.speak(text);
+    }
+
+    // Replayed history was logged when it first arrived, or predates us
+    private void logMessage(long epochSeconds, String from, String to, String text, boolean important) {
+        ChatLog log = chatLog;
+        if (log == null || replayingHistory) return;
+        try {
+            log.append(roomId, epochSeconds, from, to, text, important);
+        } catch (IOException e) {
+            chatLog = null;
+            printMessage(tr("chat.log_write_failed", e.getMessage()));
+        }
+    }
+
+    private void applyLogConfig() {
+        if (!Boolean.parseBoolean(config.get("log.enabled", "false"))) {
+            chatLog = null;
+            return;
+        }
+        String dir = config.get("log.dir", "");
+        try {
+            chatLog = new ChatLog(dir.isEmpty() ? ClientConfig.defaultPath().resolveSibling("logs") : java.nio.file.Paths.get(dir),
+                    config.get("log.format", "text"), Long.parseLong(config.get("log.max", "1024")) * 1024,
+                    Integer.parseInt(config.get("log.keep", "5")));
+        } catch (IllegalArgumentException e) { // includes NumberFormatException
+            chatLog = null;
+            printMessage(tr("chat.invalid_log_config", e.getMessage()));
+        }
+    }
+
+    private void chime(NotificationSounds.Event event) {
+        if (replayingHistory) return;
+        NotificationSounds sounds = notificationSounds;
+        if (sounds != null) sounds.play(event);
+    }
+
+    private void printEphemeralMessage(String from, ChatMessage chat, String time) {
+        long expiresAt = chat.getTimestamp() + chat.getTtlSeconds();
+        long remaining = expiresAt - Instant.now().getEpochSecond();
+        if (remaining <= 0) {
+            printMessage(tr("chat.message_expired", time, theme.user(from)));
+            return;
+        }
+        printMessage(String.format("[%s] %s%s%s: %s \u001b[2m⏳ %ds\u001b[0m", time, signatureMark(from, chat), e2eMark(from, chat), theme.user(from),
+                styled(chat.getContent()), remaining));
+        ttlScheduler.schedule(() -> {
+            printMessage(tr("chat.message_expired_notice", from, time));
+            printPrompt();
+        }, remaining, TimeUnit.SECONDS);
+    }
+
+    private boolean handleCommand(String commandLine) {
+        String[] parts = commandLine.split(" ", 3);
+        String command = parts[0].toLowerCase();
+        boolean shouldBreakLoop = false;
+
+        switch (command) {
+            case "/help": printHelp(); printPrompt(); break;
+            case "/quit": case "/exit":
+                printMessage(tr("chat.closing_application"));
+                this.sessionResult = SessionResult.QUIT_APPLICATION;
+                requestObserver.onCompleted();
+                shouldBreakLoop = true;
+                break;
+            case "/leave":
+                 printMessage(tr("chat.leaving_room"));
+                 this.sessionResult = SessionResult.NORMAL_LEAVE;
+                 requestObserver.onCompleted();
+                 shouldBreakLoop = true;
+                 break;
+            case "/important":
+                // The server drops the flag unless we joined as a moderator
+                if (parts.length >= 2) sendText(commandLine.substring(parts[0].length()).trim(), 0, true);
+                else printMessage(tr("chat.usage_important"));
+                printPrompt();
+                break;
+            case "/code":
+                sendCode(parts.length >= 2 ? commandLine.substring(parts[0].length()).trim() : "");
+                printPrompt();
+                break;
+            case "/filter":
+                if (parts.length == 2 && (parts[1].equals("all") || parts[1].equals("important") || parts[1].equals("mentions"))) {
+                    messageFilter = parts[1];
+                } else if (parts.length != 1) {
+                    printMessage(tr("chat.usage_filter"));
+                    printPrompt();
+                    break;
+                }
+                printMessage(tr("chat.filter_status", messageFilter));
+                printPrompt();
+                break;
+            case "/ephemeral":
+                try {
+                    if (parts.length < 3) throw new NumberFormatException();
+                    int ttl = Integer.parseInt(parts[1]);
+                    if (ttl <= 0) throw new NumberFormatException();
+                    sendText(parts[2], ttl, false);
+                } catch (NumberFormatException e) {
+                    printMessage(tr("chat.usage_ephemeral"));
+                }
+                printPrompt();
+                break;
+            case "/msg":
+                if (parts.length >= 3 && fitsTextLimit(Emoji.expand(parts[2]))) {
+                    PrivateMessage pvtMsg = PrivateMessage.newBuilder().setRecipientId(parts[1]).setContent(Emoji.expand(parts[2])).build();
+                    ConferenceData data = ConferenceData.newBuilder().setSender(sender).setRoomId(roomId).setPrivateMessage(pvtMsg).build();
+                    requestObserver.onNext(data);
+                    logMessage(Instant.now().getEpochSecond(), sender, parts[1], pvtMsg.getContent(), false);
+                } else if (parts.length < 3) { printMessage(tr("chat.usage_msg")); }
+                printPrompt();
+                break;
+            default:
+                handleOtherCommands(command, parts);
+                break;
+        }
+        return shouldBreakLoop;
+    }
+
+    private void handleOtherCommands(String command, String[] parts) {
+        switch(command) {
+            case "/mic":
+                if (parts.length > 1 && parts[1].equalsIgnoreCase("on")) {
+                    audioStreamer.startAudio();
+                } else if (parts.length > 1 && parts[1].equalsIgnoreCase("off")) {
+                    if (audioStreamer.isRecording()) sendRecordingNotice(false);
+                    audioStreamer.stopAudio();
+                } else {
+                    printMessage(tr("chat.usage_mic"));
+                }
+                printPrompt();
+                break;
+            case "/record":
+                handleRecordCommand(parts);
+                printPrompt();
+                break;
+            case "/share":
+                handleShareCommand(parts);
+                printPrompt();
+                break;
+            case "/screen":
+                handleScreenCommand(parts);
+                printPrompt();
+                break;
+            case "/play":
+                handlePlayCommand(parts);
+                printPrompt();
+                break;
+            case "/audio":
+                handleAudioCommand(parts);
+                printPrompt();
+                break;
+            case "/tts":
+                if (parts.length == 2 && (parts[1].equalsIgnoreCase("on") || parts[1].equalsIgnoreCase("off"))) {
+                    textToSpeech.setEnabled(parts[1].equalsIgnoreCase("on"));
+                    config.set("tts.enabled", String.valueOf(textToSpeech.isEnabled()));
+                    config.save();
+                } else if (parts.length != 1) {
+                    printMessage(tr("chat.usage_tts"));
+                    printPrompt();
+                    break;
+                }
+                printMessage(tr("chat.tts_status", (textToSpeech.isEnabled() ? tr("chat.tts_on") : tr("chat.tts_off")), textToSpeech.getEngine()));
+                if (textToSpeech.isEnabled() && !audioStreamer.isSpeakersActive()) {
+                    printMessage(tr("chat.tts_needs_speakers"));
+                }
+                printPrompt();
+                break;
+            case "/sound":
+                handleSoundCommand(parts);
+                printPrompt();
+                break;
+            case "/theme":
+                if (parts.length == 2 && Theme.NAMES.contains(parts[1].toLowerCase())) {
+                    theme = Theme.named(parts[1].toLowerCase());
+                    config.set("theme", parts[1].toLowerCase());
+                    config.save();
+                } else if (parts.length != 1) {
+                    printMessage(tr("chat.usage_theme"));
+                    printPrompt();
+                    break;
+                }
+                printMessage(tr("chat.theme_shown", theme.getName(), (theme.getName().equals("none") && !config.get("theme", "dark").equals("none")
+                        ? tr("chat.theme_no_color") : ""), theme.user(sender)));
+                printPrompt();
+                break;
+            case "/log":
+                if (parts.length == 2 && (parts[1].equalsIgnoreCase("on") || parts[1].equalsIgnoreCase("off"))) {
+                    config.set("log.enabled", String.valueOf(parts[1].equalsIgnoreCase("on")));
+                    config.save();
+                    applyLogConfig();
+                } else if (parts.length != 1) {
+                    printMessage(tr("chat.usage_log"));
+                    printPrompt();
+                    break;
+                }
+                ChatLog log = chatLog;
+                printMessage(log == null ? tr("chat.log_off") : tr("chat.log_on", log.file(roomId)));
+                printPrompt();
+                break;
+            case "/volume":
+                if (parts.length == 3) {
+                    try {
+                        audioStreamer.setSpeakerVolume(parts[1], Integer.parseInt(parts[2]));
+                        printMessage(tr("chat.volume", parts[1], audioStreamer.getSpeakerVolume(parts[1])));
+                    } catch (NumberFormatException e) {
+                        printMessage(tr("chat.usage_volume"));
+                    }
+                } else { printMessage(tr("chat.usage_volume")); }
+                printPrompt();
+                break;
+            case "/muteall":
+                if (parts.length == 1 || (parts.length == 2 && parts[1].equalsIgnoreCase("off"))) {
+                    sendRoomCommand(parts.length == 1 ? "MUTE_ALL" : "UNMUTE_ALL", "");
+                } else { printMessage(tr("chat.usage_muteall")); }
+                printPrompt();
+                break;
+            case "/spam":
+                if (parts.length == 2 && (parts[1].equals("off") || parts[1].equals("default") || parts[1].matches("\\d+/\\S+"))) {
+                    sendRoomCommand("SPAM_FILTER", parts[1].equals("default") ? "" : parts[1]);
+                } else { printMessage(tr("chat.usage_spam")); }
+                printPrompt();
+                break;
+            case "/mute":
+                if (parts.length == 2 && canControlRoom() && supports("room-mute")) {
+                    // The owner mutes for the whole room; the server stops relaying the user's audio
+                    sendRoomCommand(serverMuted.contains(parts[1]) ? "UNMUTE" : "MUTE", parts[1]);
+                } else if (parts.length == 2) {
+                    boolean muted = audioStreamer.toggleSpeakerMute(parts[1]);
+                    printMessage(muted ? tr("chat.muted_locally", parts[1]) : tr("chat.no_longer_muted", parts[1]));
+                } else { printMessage(tr("chat.usage_mute")); }
+                printPrompt();
+                break;
+            case "/kick":
+                if (parts.length == 2) sendRoomCommand("KICK", parts[1]);
+                else printMessage(tr("chat.usage_kick"));
+                printPrompt();
+                break;
+            case "/role":
+                if (parts.length == 3 && List.of("host", "cohost", "attendee").contains(parts[2])) {
+                    sendRoomCommand("SET_ROLE", parts[1] + ":" + parts[2]);
+                } else { printMessage(tr("chat.usage_role")); }
+                printPrompt();
+                break;
+            case "/end":
+                sendRoomCommand("END_MEETING", "");
+                printPrompt();
+                break;
+            case "/hand":
+                if (parts.length == 1) {
+                    sendRoomCommand(raisedHands.contains(sender) ? "LOWER_HAND" : "RAISE_HAND", "");
+                } else if (parts[1].equalsIgnoreCase("down")) {
+                    sendRoomCommand("LOWER_HAND", parts.length == 3 ? parts[2] : "");
+                } else { printMessage(tr("chat.usage_hand")); }
+                printPrompt();
+                break;
+            case "/join":
+                if (parts.length != 2) {
+                    printMessage(tr("chat.usage_join"));
+                } else if (!validRoomId(parts[1])) {
+                    printMessage(tr("chat.invalid_room", parts[1]));
+                } else if (!tabs.join(parts[1])) {
+                    printMessage(tr("chat.tab_already_open", parts[1], parts[1]));
+                }
+                printPrompt();
+                break;
+            case "/switch": {
+                int tab = parts.length == 2 ? tabs.find(parts[1]) : -1;
+                if (tab < 0) printMessage(tr("chat.usage_switch"));
+                else tabs.switchTo(tab);
+                printPrompt();
+                break;
+            }
+            case "/close": {
+                int tab = parts.length == 2 ? tabs.find(parts[1]) : tabs.find(tabs.shownRoom());
+                if (!tabs.close(tab)) printMessage(tr("chat.usage_close"));
+                printPrompt();
+                break;
+            }
+            case "/alias": {
+                List<String> defined = aliases.describe();
+                printMessage(defined.isEmpty()
+                        ? tr("chat.no_aliases")
+                        : tr("chat.aliases", String.join("\n  ", defined)));
+                printPrompt();
+                break;
+            }
+            case "/ping": {
+                ConnectionMonitor monitor = connection;
+                long rtt = monitor.ping();
+                if (rtt < 0) {
+                    printMessage(tr("chat.ping_no_answer", (monitor.getState() == ConnectionMonitor.State.OFFLINE
+                            ? tr("chat.link_offline") : tr("chat.link_reconnecting"))));
+                } else {
+                    printMessage(tr("chat.ping_connected", rtt));
+                }
+                printPrompt();
+                break;
+            }
+            case "/who":
+                if (supports("roster")) {
+                    sendRoomCommand("GET_ROSTER", ""); // the reply is printed when it arrives
+                } else {
+                    printMessage(tr("chat.who", members.size(), String.join(", ", members)));
+                }
+                printPrompt();
+                break;
+            case "/hands":
+                printMessage(raisedHands.isEmpty()
+                        ? tr("chat.no_raised_hands")
+                        : tr("chat.raised_hands", String.join(", ", raisedHands)));
+                printPrompt();
+                break;
+            case "/pin": {
+                // The newest message containing the text, or the last one without it
+                String text = parts.length > 1 ? String.join(" ", Arrays.copyOfRange(parts, 1, parts.length)) : "";
+                ConferenceData message = findRecentMessage(text);
+                if (message == null) printMessage(tr("chat.pin_not_found"));
+                else sendRoomCommand("PIN", message.getMessageId());
+                printPrompt();
+                break;
+            }
+            case "/unpin":
+                try {
+                    sendRoomCommand("UNPIN", pins.get(Integer.parseInt(parts[1]) - 1).getMessageId());
+                } catch (IndexOutOfBoundsException | NumberFormatException e) {
+                    printMessage(tr("chat.usage_unpin"));
+                }
+                printPrompt();
+                break;
+            case "/pins":
+                if (pins.isEmpty()) printMessage(tr("chat.no_pins"));
+                for (int i = 0; i < pins.size(); i++) printMessage(pinLine(i + 1, pins.get(i)));
+                printPrompt();
+                break;
+            case "/poll": {
+                List<String> words = quotedWords(commandLine.substring(parts[0].length()));
+                if (words.size() < 3) {
+                    printMessage(tr("chat.usage_poll"));
+                } else {
+                    try {
+                        ConferenceServiceGrpc.newBlockingStub(calls)
+                                .withDeadlineAfter(3, TimeUnit.SECONDS)
+                                .createPoll(CreatePollRequest.newBuilder().setRoomId(roomId).setSender(sender)
+                                        .setQuestion(words.get(0)).addAllOptions(words.subList(1, words.size())).build());
+                    } catch (StatusRuntimeException e) {
+                        printMessage(tr("chat.poll_failed", e.getStatus().getDescription()));
+                    }
+                }
+                printPrompt();
+                break;
+            }
+            case "/vote": {
+                Poll poll = openPolls.isEmpty() ? null : openPolls.get(openPolls.size() - 1);
+                int option = parts.length == 2 && parts[1].matches("\\d{1,2}") ? Integer.parseInt(parts[1]) : 0;
+                if (poll == null) {
+                    printMessage(tr("chat.no_open_poll"));
+                } else if (option < 1 || option > poll.getOptionsCount()) {
+                    printMessage(tr("chat.usage_vote", poll.getOptionsCount()));
+                } else {
+                    try {
+                        ConferenceServiceGrpc.newBlockingStub(calls)
+                                .withDeadlineAfter(3, TimeUnit.SECONDS)
+                                .vote(VoteRequest.newBuilder().setRoomId(roomId).setSender(sender)
+                                        .setPollId(poll.getPollId()).setOption(option - 1).build());
+                    } catch (StatusRuntimeException e) {
+                        printMessage(tr("chat.vote_failed", e.getStatus().getDescription()));
+                    }
+                }
+                printPrompt();
+                break;
+            }
+            case "/e2e":
+                handleE2ECommand(parts);
+                printPrompt();
+                break;
+            case "/room":
+                handleRoomCommand(parts);
+                printPrompt();
+                break;
+            case "/register":
+            case "/login":
+                if (parts.length < 2) {
+                    printMessage(tr(parts[0].equals("/register") ? "chat.usage_register" : "chat.usage_login"));
+                } else if (account(parts[0].equals("/register"), sender, commandLine.substring(parts[0].length()).trim())) {
+                    // Log this stream in too, so nobody can take the name from us
+                    sendRoomCommand("IDENTIFY", accountToken);
+                }
+                printPrompt();
+                break;
+            case "/floor":
+                // Without a name the server picks the first raised hand
+                sendRoomCommand("GIVE_FLOOR", parts.length >= 2 ? parts[1] : "");
+                printPrompt();
+                break;
+            case "/upload":
+                // "*" as the recipient, before or after the file, shares it with the whole room
+                if (parts.length == 3 && parts[1].equals("*")) fileTransferManager.broadcastFile(parts[2], roomId);
+                else if (parts.length == 3 && parts[2].equals("*")) fileTransferManager.broadcastFile(parts[1], roomId);
+                else if (parts.length == 3) fileTransferManager.uploadFile(parts[1], parts[2], roomId);
+                else printMessage(tr("chat.usage_upload"));
+                break;
+            case "/paste":
+                // Like /upload: to the whole room unless a user is named
+                if (parts.length <= 2) pasteImage(parts.length == 2 ? parts[1] : "*");
+                else printMessage(tr("chat.usage_paste"));
+                break;
+            case "/upload-all":
+                if (parts.length == 2) fileTransferManager.broadcastFile(parts[1], roomId);
+                else printMessage(tr("chat.usage_upload_all"));
+                break;
+            case "/download":
+                if (parts.length >= 2) fileTransferManager.downloadBroadcastFile(parts[1], parts.length == 3 ? parts[2] : null, roomId);
+                else printMessage(tr("chat.usage_download"));
+                break;
+            case "/accept":
+                 if (parts.length >= 2) fileTransferManager.acceptFile(parts[1], parts.length == 3 ? parts[2] : null, roomId);
+                 else printMessage(tr("chat.usage_accept"));
+                break;
+            case "/reject":
+                if (parts.length == 2) fileTransferManager.rejectFile(parts[1], roomId);
+                else printMessage(tr("chat.usage_reject"));
+                break;
+            case "/limit":
+                if (parts.length == 1) {
+                    int limit = fileTransferManager.getUploadLimit();
+                    printMessage(limit == 0 ? tr("chat.limit_off") : tr("chat.limit_set", limit));
+                } else {
+                    try {
+                        int limit = parts[1].equalsIgnoreCase("off") ? 0 : Integer.parseInt(parts[1]);
+                        fileTransferManager.setUploadLimit(limit);
+                        config.set("transfer.limit", String.valueOf(fileTransferManager.getUploadLimit()));
+                        config.save();
+                        printMessage(limit <= 0 ? tr("chat.limit_off") : tr("chat.limit_set", limit));
+                    } catch (NumberFormatException e) {
+                        printMessage(tr("chat.usage_limit"));
+                    }
+                }
+                break;
+            case "/overwrite":
+                if (parts.length == 2 && (parts[1].equalsIgnoreCase("on") || parts[1].equalsIgnoreCase("off"))) {
+                    fileTransferManager.setOverwrite(parts[1].equalsIgnoreCase("on"));
+                    config.set("transfer.overwrite", String.valueOf(fileTransferManager.isOverwrite()));
+                    config.save();
+                } else if (parts.length != 1) {
+                    printMessage(tr("chat.usage_overwrite"));
+                    break;
+                }
+                printMessage(fileTransferManager.isOverwrite()
+                        ? tr("chat.overwrite_on")
+                        : tr("chat.overwrite_off"));
+                break;
+            case "/preview":
+                if (parts.length == 2 && (parts[1].equalsIgnoreCase("on") || parts[1].equalsIgnoreCase("off"))) {
+                    config.set("preview.enabled", String.valueOf(parts[1].equalsIgnoreCase("on")));
+                    config.save();
+                    applyPreviewConfig();
+                } else if (parts.length != 1) {
+                    printMessage(tr("chat.usage_preview"));
+                    break;
+                }
+                printMessage(fileTransferManager.getPreviewMaxBytes() > 0
+                        ? tr("chat.preview_on", config.get("preview.max", "1024"))
+                        : tr("chat.preview_off"));
+                break;
+            case "/downloads":
+                if (parts.length == 3 && parts[1].equalsIgnoreCase("dir")) {
+                    fileTransferManager.setDownloadDir(java.nio.file.Paths.get(parts[2]));
+                    config.set("download.dir", parts[2]);
+                    config.save();
+                } else if (parts.length == 3 && parts[1].equalsIgnoreCase("sort") && DOWNLOAD_SORTS.contains(parts[2].toLowerCase())) {
+                    fileTransferManager.setDownloadSort(parts[2].toLowerCase());
+                    config.set("download.sort", parts[2].toLowerCase());
+                    config.save();
+                } else if (parts.length != 1) {
+                    printMessage(tr("chat.usage_downloads"));
+                    break;
+                }
+                String sortNote = fileTransferManager.getDownloadSort().equals("room") ? tr("chat.downloads_by_room")
+                        : fileTransferManager.getDownloadSort().equals("sender") ? tr("chat.downloads_by_sender") : "";
+                printMessage(tr("chat.downloads_status", fileTransferManager.getDownloadDir(), sortNote));
+                break;
+            case "/trust":
+            case "/untrust": {
+                Set<String> trusted = trustedSenders();
+                if (parts.length == 2) {
+                    if (command.equals("/trust")) trusted.add(parts[1]);
+                    else trusted.remove(parts[1]);
+                    saveTrustedSenders(trusted);
+                } else if (parts.length != 1) {
+                    printMessage(tr("chat.usage_user", command));
+                    break;
+                }
+                printMessage(trusted.isEmpty()
+                        ? tr("chat.no_trusted_senders")
+                        : tr("chat.trusted_senders", config.get("transfer.autoaccept.max", "50"), String.join(", ", trusted)));
+                break;
+            }
+            case "/abort":
+                if (parts.length == 2) fileTransferManager.cancelTransfer(parts[1]);
+                else printMessage(tr("chat.usage_abort"));
+                break;
+            case "/store":
+                if (parts.length == 2) fileTransferManager.uploadToRoom(parts[1], roomId);
+                else printMessage(tr("chat.usage_store"));
+                break;
+            case "/send":
+                if (parts.length == 3) fileTransferManager.uploadToRoom(parts[2], roomId, parts[1]);
+                else printMessage(tr("chat.usage_send"));
+                break;
+            case "/inbox": {
+                List<RoomFile> inbox = fileTransferManager.inboxFiles();
+                if (inbox.isEmpty()) {
+                    printMessage(tr("chat.inbox_empty"));
+                    break;
+                }
+                StringBuilder list = new StringBuilder(tr("chat.inbox_title"));
+                for (RoomFile file : inbox) {
+                    list.append("\n  ").append(tr("chat.inbox_entry", file.getFileId(), file.getFilename(),
+                            (double) file.getFileSize() / 1024.0, file.getSender()));
+                }
+                printMessage(list.append("\n  ").append(tr("chat.inbox_fetch")).toString());
+                break;
+            }
+            case "/fetch":
+                if (parts.length >= 2) fileTransferManager.fetchRoomFile(parts[1], parts.length == 3 ? parts[2] : null, roomId);
+                else printMessage(tr("chat.usage_fetch"));
+                break;
+            default:
+                printMessage(tr("chat.unknown_command", command));
+                printPrompt();
+                break;
+        }
+    }
+    
+    private void handleAudioCommand(String[] parts) {
+        String sub = parts.length > 1 ? parts[1].toLowerCase() : "";
+        switch (sub) {
+            case "buffer":
+                JitterBuffer jb = audioStreamer.getJitterBuffer();
+                if (parts.length == 3 && (parts[2].equalsIgnoreCase("conceal") || parts[2].equalsIgnoreCase("noconceal"))) {
+                    jb.setConcealment(parts[2].equalsIgnoreCase("conceal"));
+                    printMessage(tr("chat.concealment_status", (jb.isConcealment() ? tr("chat.concealment_on") : tr("chat.concealment_off"))));
+                } else if (parts.length == 3) {
+                    try {
+                        jb.setBaseDepth(Integer.parseInt(parts[2]));
+                        printMessage(tr("chat.audio_buffer_set", jb.getBaseDepth()));
+                    } catch (NumberFormatException e) {
+                        printMessage(tr("chat.usage_audio_buffer", JitterBuffer.MIN_DEPTH, JitterBuffer.MAX_DEPTH));
+                    }
+                } else {
+                    printMessage(tr("chat.audio_buffer_status", jb.getBaseDepth(), jb.getTargetDepth(), jb.getQueuedChunks(), jb.getUnderruns(), jb.getDropped()));
+                    printMessage(tr("chat.audio_sequence_stats", jb.getLost(), jb.getConcealed(), jb.getLate(), jb.isConcealment() ? tr("chat.on") : tr("chat.off")));
+                }
+                break;
+            case "vad":
+                VoiceActivityDetector vad = audioStreamer.getVad();
+                if (parts.length == 3 && (parts[2].equalsIgnoreCase("on") || parts[2].equalsIgnoreCase("off"))) {
+                    vad.setEnabled(parts[2].equalsIgnoreCase("on"));
+                } else if (parts.length == 3) {
+                    try {
+                        vad.setThreshold(Double.parseDouble(parts[2]));
+                    } catch (NumberFormatException e) {
+                        printMessage(tr("chat.usage_audio_vad"));
+                        break;
+                    }
+                }
+                printMessage(tr("chat.vad_status", vad.isEnabled() ? tr("chat.vad_on") : tr("chat.vad_off"), vad.getThreshold()));
+                break;
+            case "denoise":
+                AudioProcessor processor = audioStreamer.getProcessor();
+                if (parts.length == 3 && (parts[2].equalsIgnoreCase("on") || parts[2].equalsIgnoreCase("off"))) {
+                    processor.setEnabled(parts[2].equalsIgnoreCase("on"));
+                    config.set("audio.denoise", String.valueOf(processor.isEnabled()));
+                    config.save();
+                } else if (parts.length == 3) {
+                    printMessage(tr("chat.usage_audio_denoise"));
+                    break;
+                }
+                printMessage(tr("chat.denoise_status", (processor.isEnabled() ? tr("chat.processing_on") : tr("chat.processing_off"))));
+                break;
+            case "format":
+                if (parts.length == 3) {
+                    String[] values = parts[2].trim().split("\\s+");
+                    try {
+                        int rate = Integer.parseInt(values[0]);
+                        int channels = values.length > 1 ? Integer.parseInt(values[1]) : AudioStreamer.DEFAULT_CHANNELS;
+                        int frames = values.length > 2 ? Integer.parseInt(values[2]) : AudioStreamer.DEFAULT_FRAMES_PER_CHUNK;
+                        if (rate < 8000 || rate > 96000 || channels < 1 || channels > 2 || frames < 64 || frames > 8192) {
+                            throw new NumberFormatException();
+                        }
+                        audioStreamer.setPreferredFormat(rate, channels, frames);
+                        config.set("audio.rate", String.valueOf(rate));
+                        config.set("audio.channels", String.valueOf(channels));
+                        config.set("audio.frames", String.valueOf(frames));
+                        config.save();
+                    } catch (NumberFormatException e) {
+                        printMessage(tr("chat.usage_audio_format"));
+                        break;
+                    }
+                }
+                printMessage(tr("chat.audio_format_status", AudioStreamer.describe(audioStreamer.getPreferredFormat()),
+                        audioStreamer.getFramesPerChunk(), audioStreamer.isAudioActive()
+                                ? tr("chat.format_in_use", AudioStreamer.describe(audioStreamer.getAudioFormat())) : ""));
+                break;
+            case "stats":
+                showAudioStats();
+                break;
+            case "meter":
+                if (!audioStreamer.isAudioActive()) {
+                    printMessage(tr("chat.meter_needs_audio"));
+                    break;
+                }
+                showLevelMeter(5);
+                break;
+            case "devices":
+                printDeviceList("Entrada", audioStreamer.listInputDevices(), audioStreamer.getInputDevice());
+                printDeviceList("Salida", audioStreamer.listOutputDevices(), audioStreamer.getOutputDevice());
+                break;
+            case "input":
+            case "output":
+                boolean input = sub.equals("input");
+                List<String> devices = input ? audioStreamer.listInputDevices() : audioStreamer.listOutputDevices();
+                try {
+                    String device = devices.get(Integer.parseInt(parts[2]));
+                    if (input) audioStreamer.setInputDevice(device);
+                    else audioStreamer.setOutputDevice(device);
+                    config.set(input ? "audio.input" : "audio.output", device);
+                    config.save();
+                    printMessage(tr("chat.device_set", input ? tr("chat.device_input") : tr("chat.device_output"), device,
+                            audioStreamer.isAudioActive() ? tr("chat.device_on_restart") : ""));
+                } catch (IndexOutOfBoundsException | NumberFormatException e) {
+                    printMessage(tr("chat.usage_audio_device", sub));
+                }
+                break;
+            default:
+                printMessage(tr("chat.usage_audio"));
+                break;
+        }
+    }
+
+    private void showAudioStats() {
+        AudioStats stats = audioStreamer.getStats();
+        printMessage(tr("chat.audio_local_stats", stats.getSent()));
+        for (Map.Entry<String, AudioStats.SpeakerStats> e : stats.getSpeakers().entrySet()) {
+            AudioStats.SpeakerStats st = e.getValue();
+            double lossPct = st.getReceived() + st.getLost() == 0 ? 0 : 100.0 * st.getLost() / (st.getReceived() + st.getLost());
+            printMessage(tr("chat.audio_received_stats", Emoji.padRight(e.getKey(), 16), st.getReceived(), st.getLost(), lossPct, st.getAvgLatencyMs()));
+        }
+        if (!supports("audio-stats")) return;
+        try {
+            AudioStatsResponse resp = ConferenceServiceGrpc.newBlockingStub(calls)
+                    .withDeadlineAfter(3, TimeUnit.SECONDS)
+                    .getAudioStats(AudioStatsRequest.newBuilder().setRoomId(roomId).build());
+            printMessage(tr("chat.audio_server_stats"));
+            for (ClientAudioStats st : resp.getClientsList()) {
+                printMessage(tr("chat.audio_sent_stats", Emoji.padRight(st.getUsername(), 16), st.getPacketsSent(),
+                        st.getPacketsLost(), st.getPacketsReceived(), st.getPacketsDropped(), st.getAvgLatencyMs()));
+            }
+        } catch (StatusRuntimeException e) {
+            printMessage(tr("chat.audio_server_stats_failed", e.getStatus().getDescription()));
+        }
+    }
+
+    private void handleRecordCommand(String[] parts) {
+        String sub = parts.length > 1 ? parts[1].toLowerCase() : "";
+        if (sub.equals("on")) {
+            if (!audioStreamer.isAudioActive()) {
+                printMessage(tr("chat.record_needs_audio"));
+                return;
+            }
+            boolean includeMic = parts.length == 3 && parts[2].equalsIgnoreCase("mic");
+            try {
+                File file = audioStreamer.startRecording(new File(config.get("record.dir", ".")), includeMic);
+                sendRecordingNotice(true);
+                printMessage(tr("chat.recording_started", (includeMic ? tr("chat.recording_with_mic") : ""), file.getPath()));
+            } catch (IOException e) {
+                printMessage(tr("chat.recording_failed", e.getMessage()));
+            }
+        } else if (sub.equals("off")) {
+            File file = audioStreamer.stopRecording();
+            if (file == null) {
+                printMessage(tr("chat.not_recording"));
+                return;
+            }
+            sendRecordingNotice(false);
+            printMessage(tr("chat.recording_saved", file.getPath()));
+        } else {
+            printMessage(tr("chat.usage_record"));
+        }
+    }
+
+    // Everyone in the room is told when a call is being recorded
+    // /share on [fps] asks the server for the room's share; capture starts on SHARE_STARTED
+    private void handleShareCommand(String[] parts) {
+        if (parts.length >= 2 && parts[1].equalsIgnoreCase("on")) {
+            try {
+                shareFps = parts.length == 3 ? Integer.parseInt(parts[2]) : ScreenShare.DEFAULT_FPS;
+            } catch (NumberFormatException e) {
+                printMessage(tr("chat.usage_share_fps", ScreenShare.MAX_FPS));
+                return;
+            }
+            sendRoomCommand("START_SHARE", "");
+        } else if (parts.length >= 2 && parts[1].equalsIgnoreCase("off")) {
+            // With a name, the owner or a moderator stops someone else's share
+            sendRoomCommand("STOP_SHARE", parts.length == 3 ? parts[2] : "");
+        } else {
+            printMessage(tr("chat.usage_share"));
+        }
+    }
+
+    private void handleShareStarted(String sharer) {
+        if (!sharer.equals(sender)) {
+            printMessage(tr("chat.screen_shared_by", sharer, (screenViewer.isActive() ? "" : tr("chat.screen_hint"))));
+            return;
+        }
+        try {
+            screenShare.start(shareFps);
+            printMessage(tr("chat.sharing_screen", shareFps));
+        } catch (Exception e) {
+            // AWTException, or HeadlessException on machines without a display
+            printMessage(tr("chat.screen_capture_failed", e.getMessage()));
+            sendRoomCommand("STOP_SHARE", "");
+        }
+    }
+
+    private void handleScreenCommand(String[] parts) {
+        String sub = parts.length > 1 ? parts[1].toLowerCase() : "";
+        try {
+            if (sub.equals("save") && parts.length == 3) {
+                screenViewer.saveTo(new File(parts[2]));
+                printMessage(tr("chat.screen_saving", parts[2]));
+            } else if (sub.equals("pipe") && parts.length == 3) {
+                screenViewer.pipeTo(parts[2]);
+                printMessage(tr("chat.screen_piping", parts[2]));
+            } else if (sub.equals("off")) {
+                screenViewer.close();
+                printMessage(tr("chat.screen_off"));
+            } else {
+                printMessage(tr("chat.usage_screen_save"));
+            }
+        } catch (IOException e) {
+            printMessage("❌ " + e.getMessage());
+        }
+    }
+
+    private void handlePlayCommand(String[] parts) {
+        if (parts.length == 2 && parts[1].equalsIgnoreCase("stop")) {
+            AudioInjection playing = audioStreamer.getPlayback();
+            audioStreamer.stopPlayback();
+            printMessage(playing != null ? tr("chat.play_stopped", playing.getName()) : tr("chat.nothing_playing"));
+            return;
+        }
+        boolean replace = parts.length == 3 && parts[2].equalsIgnoreCase("replace");
+        if (parts.length < 2 || (parts.length == 3 && !replace && !parts[2].equalsIgnoreCase("mix"))) {
+            printMessage(tr("chat.usage_play"));
+            return;
+        }
+        try {
+            AudioInjection inj = audioStreamer.play(new File(parts[1]), replace);
+            String how = !audioStreamer.isAudioActive() ? "" : replace ? tr("chat.play_replacing_mic") : tr("chat.play_mixed_with_mic");
+            printMessage(tr("chat.playing", inj.getName(), inj.getDurationSeconds(), how));
+        } catch (Exception e) {
+            printMessage(tr("chat.play_failed", parts[1], e.getMessage()));
+        }
+    }
+
+    private void sendRecordingNotice(boolean recording) {
+        sendRoomCommand("RECORDING", recording ? "on" : "off");
+    }
+
+    private void sendRoomCommand(String type, String value) {
+        com.conference.grpc.Command cmd = com.conference.grpc.Command.newBuilder()
+                .setType(type).setValue(value).build();
+        requestObserver.onNext(ConferenceData.newBuilder().setSender(sender).setRoomId(roomId).setCommand(cmd).build());
+    }
+
+    private void printDeviceList(String title, List<String> devices, String selected) {
+        printMessage(title + (selected == null ? tr("chat.devices_system_default") : ":"));
+        for (int i = 0; i < devices.size(); i++) {
+            String name = devices.get(i);
+            printMessage(String.format("  [%d] %s%s", i, name, name.equals(selected) ? tr("chat.devices_selected") : ""));
+        }
+    }
+
+    // ELOCHAT_AUDIO_BACKEND overrides the config, e.g. "null" on machines without a sound card
+    // /sound [message|file <on|off>] or /sound quiet <HH:mm-HH:mm|off>; saved like /tts
+    private void handleSoundCommand(String[] parts) {
+        if (parts.length == 3 && parts[1].equalsIgnoreCase("quiet")) {
+            String window = parts[2].equalsIgnoreCase("off") ? "" : parts[2];
+            try {
+                notificationSounds.setQuietHours(window);
+            } catch (DateTimeParseException e) {
+                printMessage(tr("chat.usage_sound_quiet"));
+                return;
+            }
+            config.set("sounds.quiet", window.isEmpty() ? null : notificationSounds.getQuietHours());
+            config.save();
+        } else if (parts.length == 3 && (parts[1].equalsIgnoreCase("message") || parts[1].equalsIgnoreCase("file"))
+                && (parts[2].equalsIgnoreCase("on") || parts[2].equalsIgnoreCase("off"))) {
+            NotificationSounds.Event event = NotificationSounds.Event.valueOf(parts[1].toUpperCase());
+            notificationSounds.setEnabled(event, parts[2].equalsIgnoreCase("on"));
+            config.set("sounds." + parts[1].toLowerCase(), String.valueOf(notificationSounds.isEnabled(event)));
+            config.save();
+        } else if (parts.length != 1) {
+            printMessage(tr("chat.usage_sound"));
+            return;
+        }
+        String quiet = notificationSounds.getQuietHours();
+        printMessage(tr("chat.sounds_status",
+                tr(notificationSounds.isEnabled(NotificationSounds.Event.MESSAGE) ? "chat.yes" : "chat.no"),
+                tr(notificationSounds.isEnabled(NotificationSounds.Event.FILE) ? "chat.yes" : "chat.no"),
+                quiet.isEmpty() ? "" : tr("chat.sounds_quiet", quiet.replace("-", tr("chat.sounds_quiet_to")))));
+        if (!audioStreamer.isSpeakersActive()) {
+            printMessage(tr("chat.play_needs_speakers"));
+        }
+    }
+
+    private AudioBackend createAudioBackend() {
+        String spec = System.getenv("ELOCHAT_AUDIO_BACKEND");
+        if (spec == null) spec = config.get("audio.backend", "javasound");
+        try {
+            return AudioBackend.fromSpec(spec);
+        } catch (IllegalArgumentException e) {
+            printMessage(tr("chat.audio_backend_fallback", e.getMessage()));
+            return new JavaSoundBackend();
+        }
+    }
+
+    // Redraws a single meter line for a few seconds so users can check their mic
+    private void showLevelMeter(int seconds) {
+        AudioLevelMeter meter = audioStreamer.getLevelMeter();
+        long until = System.currentTimeMillis() + seconds * 1000L;
+        try {
+            while (System.currentTimeMillis() < until) {
+                console.status("meter", meter.render());
+                Thread.sleep(200);
+            }
+        } catch (InterruptedException e) {
+            Thread.currentThread().interrupt();
+        }
+        console.status("meter", null);
+    }
+
+    // preview.enabled turns previews on or off; preview.max is the largest file previewed, in KiB
+    private void applyPreviewConfig() {
+        long maxKiB = 1024;
+        try {
+            maxKiB = Long.parseLong(config.get("preview.max", "1024"));
+        } catch (NumberFormatException e) {
+            printMessage(tr("chat.invalid_preview_max_config"));
+        }
+        boolean enabled = Boolean.parseBoolean(config.get("preview.enabled", "true"));
+        fileTransferManager.setPreviewMaxBytes(enabled ? maxKiB * 1024 : 0);
+    }
+
+    // --- Trusted senders ---
+
+    // Files from trusted senders up to transfer.autoaccept.max MiB are taken without asking; callers first check
+    // that the server vouched for the sender being logged in to that name
+    private boolean autoAccepts(String fileSender, long fileSize) {
+        if (!trustedSenders().contains(fileSender)) return false;
+        try {
+            return fileSize <= Long.parseLong(config.get("transfer.autoaccept.max", "50")) * 1024 * 1024;
+        } catch (NumberFormatException e) {
+            return false;
+        }
+    }
+
+    private Set<String> trustedSenders() {
+        Set<String> trusted = new TreeSet<>();
+        for (String name : config.get("transfer.trusted", "").split(",")) {
+            if (!name.isBlank()) trusted.add(name.trim());
+        }
+        return trusted;
+    }
+
+    private void saveTrustedSenders(Set<String> trusted) {
+        config.set("transfer.trusted", trusted.isEmpty() ? null : String.join(",", trusted));
+        config.save();
+    }
+
+    // Keeps a record of what came in without anyone being asked
+    private void logAutoAccepted(String fileSender, String filename, long fileSize) {
+        Path log = ClientConfig.defaultPath().resolveSibling("auto-accepted.log");
+        String line = String.format("%s\t%s\t%s\t%s\t%d%n", LocalDateTime.now().format(DateTimeFormatter.ISO_LOCAL_DATE_TIME),
+                roomId, fileSender, filename, fileSize);
+        try {
+            Files.createDirectories(log.getParent());
+            Files.writeString(log, line, StandardOpenOption.CREATE, StandardOpenOption.APPEND);
+        } catch (IOException e) {
+            printMessage(tr("chat.auto_accept_log_failed", e.getMessage()));
+        }
+    }
+
+    private void handleP2PFileRequestNotification(String message) {
+        String[] parts = message.split(":");
+        if (parts.length >= 6) {
+            String transferId = parts[1], fileSender = parts[2], filename = parts[3];
+            try {
+                long fileSize = Long.parseLong(parts[4]);
+                String sha256 = parts.length >= 7 ? parts[6] : ""; // servers before checksums send six fields
+                List<String> compression = parts.length >= 8 ? Arrays.asList(parts[7].split(",")) : List.of();
+                boolean direct = parts.length >= 9 && parts[8].equals("true");
+                if (parts.length >= 10 && !parts[9].equals(sender)) return; // someone else's; older servers don't say whose
+                fileTransferManager.registerPendingP2PTransfer(transferId, fileSender, filename, fileSize, sha256, compression, direct);
+                // Only from senders the server says are logged in to their name; older servers don't say
+                boolean registered = parts.length >= 11 && parts[10].equals("true");
+                if (registered && autoAccepts(fileSender, fileSize)) {
+                    printMessage(tr("chat.auto_accepting", filename, fileSender));
+                    logAutoAccepted(fileSender, filename, fileSize);
+                    fileTransferManager.acceptFile(transferId, null, roomId);
+                    return;
+                }
+                printMessage(tr("chat.request_received"));
+                printMessage(tr("chat.request_from", fileSender));
+                printMessage(tr("chat.request_file", filename, fileSize));
+                printMessage(tr("chat.request_accept", transferId));
+                printMessage(tr("chat.request_reject", transferId));
+                chime(NotificationSounds.Event.FILE);
+            } catch (NumberFormatException e) {
+                printMessage(tr("chat.bad_file_size"));
+            }
+        }
+    }
+    
+    // --lang, then the config (a profile can have its own), then the environment
+    private static void useLanguage(String flag, ClientConfig config) {
+        String lang = flag != null ? flag : config.get("lang", "");
+        if (lang.isEmpty()) {
+            I18n.use(I18n.fromEnvironment());
+        } else if (!I18n.use(lang)) {
+            System.err.println(tr("chat.invalid_lang", lang, String.join(", ", I18n.LANGUAGES)));
+        }
+    }
+
+    private static void printWelcome() {
+        System.out.println("\n━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━");
+        System.out.println(tr("chat.banner"));
+        System.out.println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━\n");
+    }
+
+    // Commands for features the server reported as missing are left out
+    private void printHelp() {
+        console.message("\n═══════════════════════════════════════════════════════");
+        console.message(tr("chat.help_title"));
+        console.message("═══════════════════════════════════════════════════════");
+        console.message(tr("chat.help_chat"));
+        console.message(tr("chat.help_help"));
+        helpLine("private-messages", tr("chat.help_msg"));
+        console.message(tr("chat.help_code"));
+        console.message(tr("chat.help_log"));
+        console.message(tr("chat.help_theme"));
+        helpLine("ephemeral-messages", tr("chat.help_ephemeral"));
+        helpLine("important-messages", tr("chat.help_important"));
+        console.message(tr("chat.help_filter"));
+        console.message(tr("chat.help_who"));
+        console.message(tr("chat.help_join"));
+        console.message(tr("chat.help_switch"));
+        console.message(tr("chat.help_close"));
+        console.message(tr("chat.help_ping"));
+        console.message(tr("chat.help_alias"));
+        console.message(tr("chat.help_leave"));
+        console.message(tr("chat.help_quit"));
+        if (supports("audio")) console.message(tr("chat.help_audio_section"));
+        helpLine("audio", tr("chat.help_mic"));
+        helpLine("audio", tr("chat.help_record"));
+        helpLine("screen-share", tr("chat.help_share"));
+        helpLine("screen-share", tr("chat.help_screen_save"));
+        helpLine("audio", tr("chat.help_play"));
+        helpLine("audio", tr("chat.help_tts"));
+        helpLine("audio", tr("chat.help_sound"));
+        helpLine("audio", tr("chat.help_sound_quiet"));
+        helpLine("audio", tr("chat.help_audio_buffer"));
+        helpLine("audio", tr("chat.help_audio_vad"));
+        helpLine("audio", tr("chat.help_audio_denoise"));
+        helpLine("audio", tr("chat.help_audio_format"));
+        helpLine("audio-stats", tr("chat.help_audio_stats"));
+        helpLine("audio", tr("chat.help_audio_meter"));
+        helpLine("audio", tr("chat.help_audio_devices"));
+        helpLine("audio", tr("chat.help_audio_input"));
+        helpLine("audio", tr("chat.help_volume"));
+        helpLine("audio", tr("chat.help_mute"));
+        helpLine("room-mute", tr("chat.help_muteall"));
+        helpLine("spam-filter", tr("chat.help_spam"));
+        helpLine("roles", tr("chat.help_kick"));
+        helpLine("roles", tr("chat.help_role"));
+        helpLine("end-meeting", tr("chat.help_end"));
+        helpLine("raise-hand", tr("chat.help_hand"));
+        helpLine("raise-hand", tr("chat.help_hands"));
+        helpLine("raise-hand", tr("chat.help_floor"));
+        helpLine("pins", tr("chat.help_pin"));
+        helpLine("pins", tr("chat.help_unpin"));
+        helpLine("pins", tr("chat.help_pins"));
+        helpLine("polls", tr("chat.help_poll"));
+        helpLine("polls", tr("chat.help_vote"));
+        helpLine("room-settings", tr("chat.help_room"));
+        helpLine("accounts", tr("chat.help_register"));
+        helpLine("accounts", tr("chat.help_login"));
+        helpLine("e2e-text", tr("chat.help_e2e"));
+        helpLine("e2e-text", tr("chat.help_e2e_verify"));
+        if (supports("file-transfer")) console.message(tr("chat.help_files"));
+        helpLine("file-transfer", tr("chat.help_upload"));
+        helpLine("file-transfer", tr("chat.help_accept"));
+        helpLine("file-transfer", tr("chat.help_reject"));
+        if (supports("file-transfer")) console.message(tr("chat.help_room_files"));
+        helpLine("file-transfer", tr("chat.help_upload_all"));
+        helpLine("file-transfer", tr("chat.help_paste"));
+        helpLine("file-transfer", tr("chat.help_download"));
+        helpLine("file-transfer", tr("chat.help_limit"));
+        helpLine("file-transfer", tr("chat.help_downloads"));
+        helpLine("file-transfer", tr("chat.help_trust"));
+        helpLine("file-transfer", tr("chat.help_preview"));
+        helpLine("file-transfer", tr("chat.help_overwrite"));
+        helpLine("transfer-cancel", tr("chat.help_abort"));
+        helpLine("room-files", tr("chat.help_store"));
+        helpLine("room-files", tr("chat.help_fetch"));
+        helpLine("inbox", tr("chat.help_send"));
+        helpLine("inbox", tr("chat.help_inbox"));
+        console.message("\n═══════════════════════════════════════════════════════\n");
+    }
+
+    private void helpLine(String feature, String line) {
+        if (supports(feature)) console.message(line);
+    }
+
+    /** True if the server offers the feature, or if it didn't say (older servers). */
+    /** Whether the server lets us mute others: hosts, co-hosts and moderators. */
+    private boolean canControlRoom() {
+        return moderator || sender.equals(roomOwner) || cohosts.contains(sender);
+    }
+
+    private boolean supports(String feature) {
+        ServerInfo info = serverInfo;
+        return info == null || info.getFeaturesList().contains(feature);
+    }
+
+    // One of the server's limits, or fallback if it didn't say
+    private long serverLimit(String name, long fallback) {
+        ServerInfo info = serverInfo;
+        return info == null ? fallback : info.getLimitsOrDefault(name, fallback);
+    }
+
+    // The server only takes names in NFC, trimmed and with single spaces, and tells lookalikes apart itself
+    private static String canonicalName(String name) {
+        return Normalizer.normalize(name, Normalizer.Form.NFC).strip().replaceAll("(?U)\\s+", " ");
+    }
+
+    // The server turns away room IDs with anything but letters, digits and "-_." with an error
+    private boolean validRoomId(String id) {
+        return ROOM_ID.matcher(id).matches() && id.codePointCount(0, id.length()) <= serverLimit("max_room_id_chars", 64);
+    }
+
+    // Over the server's limit, the server would end our stream; says so and returns false instead
+    private boolean fitsTextLimit(String text) {
+        long max = serverLimit("max_text_chars", 0);
+        if (max > 0 && text.codePointCount(0, text.length()) > max) {
+            printMessage(tr("chat.message_too_long", text.codePointCount(0, text.length()), max));
+            return false;
+        }
+        return true;
+    }
+
+    private void fetchServerInfo() {
+        try {
+            serverInfo = ConferenceServiceGrpc.newBlockingStub(calls)
+                    .withDeadlineAfter(3, TimeUnit.SECONDS)
+                    .getServerInfo(ServerInfoRequest.getDefaultInstance());
+        } catch (StatusRuntimeException e) {
+            if (e.getStatus().getCode() != Status.Code.UNIMPLEMENTED) {
+                System.out.println(tr("chat.server_info_failed", e.getStatus().getDescription()));
+            }
+            return;
+        }
+        System.out.println(tr("chat.server_info", serverInfo.getVersion(), serverInfo.getCommit(),
+                tr(serverInfo.getTls() ? "chat.yes" : "chat.no"), tr(serverInfo.getE2E() ? "chat.yes" : "chat.no"),
+                serverInfo.getPersistence(), String.join(", ", serverInfo.getCodecsList())));
+        System.out.println(tr("chat.server_features", String.join(", ", serverInfo.getFeaturesList())));
+    }
+
+    // --message / --stdin: post to a room and exit, for scripts. The server is --server, or the
+    // configured one, or localhost; nothing is asked. Returns the exit code.
+    private static int post(ClientConfig config, String server, String room, String name, String message, boolean fromStdin) {
+        if (name == null) name = config.get("user.name", "");
+        if (room == null || room.isEmpty() || name.isEmpty()) {
+            System.err.println(tr("chat.scripted_needs_room"));
+            return 2;
+        }
+        List<String> messages = new ArrayList<>();
+        if (message != null && !message.isBlank()) messages.add(message);
+        if (fromStdin) {
+            try (BufferedReader in = new BufferedReader(new InputStreamReader(System.in, StandardCharsets.UTF_8))) {
+                for (String line; (line = in.readLine()) != null; ) {
+                    if (!line.isBlank()) messages.add(line);
+                }
+            } catch (IOException e) {
+                System.err.println(tr("chat.input_error", e.getMessage()));
+                return 1;
+            }
+        }
+        String host = config.get("server.host", "localhost");
+        String port = config.get("server.port", "50051");
+        if (server != null) {
+            int colon = server.lastIndexOf(':');
+            if (!server.startsWith("unix:") && colon > 0 && server.substring(colon + 1).matches("\\d+")) {
+                host = server.substring(0, colon);
+                port = server.substring(colon + 1);
+            } else {
+                host = server;
+            }
+        }
+        ChatClient client = host.startsWith("unix:") ? new ChatClient(host) : new ChatClient(host, Integer.parseInt(port));
+        try {
+            return ScriptedPost.run(client.asyncStub, name, room, messages);
+        } catch (InterruptedException e) {
+            return 1;
+        } finally {
+            client.channel.shutdown();
+        }
+    }
+
+    public static void main(String[] args) {
+        CrashReporter.installIfEnabled();
+        String downloadDir = null, profile = null;
+        String server = null, room = null, name = null, message = null, lang = null;
+        boolean fromStdin = false, askToken = false;
+        for (int i = 0; i < args.length; i++) {
+            if (args[i].equals("--download-dir") && i + 1 < args.length) downloadDir = args[++i];
+            else if (args[i].startsWith("--download-dir=")) downloadDir = args[i].substring("--download-dir=".length());
+            else if (args[i].equals("--profile") && i + 1 < args.length) profile = args[++i];
+            else if (args[i].startsWith("--profile=")) profile = args[i].substring("--profile=".length());
+            else if (args[i].equals("--server") && i + 1 < args.length) server = args[++i];
+            else if (args[i].startsWith("--server=")) server = args[i].substring("--server=".length());
+            else if (args[i].equals("--room") && i + 1 < args.length) room = args[++i];
+            else if (args[i].startsWith("--room=")) room = args[i].substring("--room=".length());
+            else if (args[i].equals("--name") && i + 1 < args.length) name = args[++i];
+            else if (args[i].startsWith("--name=")) name = args[i].substring("--name=".length());
+            else if (args[i].equals("--message") && i + 1 < args.length) message = args[++i];
+            else if (args[i].startsWith("--message=")) message = args[i].substring("--message=".length());
+            else if (args[i].equals("--lang") && i + 1 < args.length) lang = args[++i];
+            else if (args[i].startsWith("--lang=")) lang = args[i].substring("--lang=".length());
+            else if (args[i].equals("--stdin")) fromStdin = true;
+            else if (args[i].equals("--moderator")) askToken = true;
+        }
+        ClientConfig config = ClientConfig.load();
+        boolean profileFound = profile == null || config.useProfile(profile);
+        useLanguage(lang, config);
+        if (!profileFound) {
+            System.err.println(tr("chat.no_profile", profile, ClientConfig.defaultPath(),
+                    config.profiles().isEmpty() ? "" : tr("chat.profiles", String.join(", ", config.profiles()))));
+            return;
+        }
+        if (message != null || fromStdin) {
+            System.exit(post(config, server, room, name, message, fromStdin));
+        }
+        printWelcome();
+        Scanner scanner = new Scanner(System.in);
+        // A profile that names its server connects without asking; otherwise the saved server is the default
+        String host = config.get("server.host", "");
+        String portStr = config.get("server.port", "");
+        if (profile == null || host.isEmpty()) {
+            String defaultHost = host.isEmpty() ? "localhost" : host;
+            System.out.print(tr("chat.prompt_server", defaultHost));
+            host = scanner.nextLine().trim();
+            if (host.isEmpty()) host = defaultHost;
+            if (!host.startsWith("unix:")) {
+                String defaultPort = portStr.isEmpty() ? "50051" : portStr;
+                System.out.print(tr("chat.prompt_port", defaultPort));
+                portStr = scanner.nextLine().trim();
+                if (portStr.isEmpty()) portStr = defaultPort;
+            }
+        } else {
+            System.out.println(tr("chat.profile", profile, host, (host.startsWith("unix:") || portStr.isEmpty() ? "" : ":" + portStr)));
+        }
+        ChatClient client;
+        if (host.startsWith("unix:")) {
+            client = new ChatClient(host);
+        } else {
+            int port = portStr.isEmpty() ? 50051 : Integer.parseInt(portStr);
+            client = new ChatClient(host, port);
+        }
+        client.config = config;
+        client.downloadDirFlag = downloadDir;
+        client.fetchServerInfo();
+        if (askToken) {
+            client.adminToken = Secrets.read("CONFERENCE_ADMIN_TOKEN", tr("chat.admin_token_prompt"));
+            if (client.adminToken == null) System.out.println(tr("chat.no_admin_token"));
+        }
+        System.out.println("\n──────────────────────────────────────────────────");
+        System.out.println(tr("chat.join_title"));
+        System.out.println("──────────────────────────────────────────────────");
+
+        while (true) {
+            
+            System.out.print(tr("chat.prompt_room"));
+            String roomId = scanner.nextLine().trim();
+            if (roomId.equalsIgnoreCase("quit")) break;
+
+            if (roomId.isEmpty()) {
+                System.err.println(tr("chat.empty_room"));
+                continue;
+            }
+            if (!client.validRoomId(roomId)) {
+                System.err.println(tr("chat.invalid_room", roomId));
+                continue;
+            }
+
+            String defaultName = config.get("user.name", "");
+            System.out.print(tr("chat.prompt_name", (defaultName.isEmpty() ? "" : " [" + defaultName + "]")));
+            String sender = canonicalName(scanner.nextLine());
+            if (sender.isEmpty()) sender = canonicalName(defaultName);
+
+            
+
+            if(sender.isEmpty()){
+                System.err.println(tr("chat.empty_name"));
+                continue;
+            }
+            
+            String role = "";
+            if (client.supports("roles")) {
+                System.out.print(tr("chat.prompt_role"));
+                role = scanner.nextLine().trim().toLowerCase();
+            }
+
+            try {
+                client.roomPassword = null;
+                SessionResult result = client.startChat(sender, roomId, role);
+                // A registered name needs its password, and a room with a password its own, until we give the right ones
+                for (int tries = 0; result == SessionResult.CONNECTION_ERROR && (client.accountRequired || client.passwordRejected) && tries < 3; tries++) {
+                    if (client.accountRequired) {
+                        String password = Secrets.read("CONFERENCE_ACCOUNT_PASSWORD", tr("chat.account_password_prompt", sender));
+                        if (password == null || !client.account(false, sender, password)) break;
+                    } else {
+                        client.roomPassword = Secrets.read("CONFERENCE_ROOM_PASSWORD", tr("chat.room_password_prompt", roomId));
+                        if (client.roomPassword == null) break;
+                    }
+                    result = client.startChat(sender, roomId, role);
+                }
                 if (result == SessionResult.QUIT_APPLICATION) {
                     break;
                 }
                 // If NORMAL_LEAVE or CONNECTION_ERROR, the loop continues, allowing to join another room
             } catch (InterruptedException e) {
-                System.err.println("Chat interrumpido: " + e.getMessage());
+                System.err.println(tr("chat.interrupted", e.getMessage()));
                 break;
             }
         }
         
-        System.out.println("Cerrando conexión...");
+        System.out.println(tr("chat.closing_connection"));
         client.shutdown();
-        System.out.println("¡Adiós!");
+        System.out.println(tr("chat.goodbye"));
     }
 }
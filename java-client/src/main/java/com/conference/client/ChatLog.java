@@ -0,0 +1,98 @@
+package com.conference.client;
+
+import java.io.IOException;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.StandardCopyOption;
+import java.nio.file.StandardOpenOption;
+import java.time.Instant;
+import java.time.LocalDateTime;
+import java.time.ZoneId;
+import java.time.format.DateTimeFormatter;
+
+import static com.conference.client.I18n.tr;
+
+/**
+ * A personal record of the chat: every message sent or received goes to a
+ * file per room in dir, as plain text or as one JSON object per line. When a
+ * file passes maxBytes it is rotated to room.log.1 (then .2, ...), keeping
+ * the newest keep of them. Ephemeral messages are never written.
+ */
+public class ChatLog {
+
+    private static final DateTimeFormatter TIME = DateTimeFormatter.ofPattern("yyyy-MM-dd HH:mm:ss");
+
+    private final Path dir;
+    private final boolean jsonl;
+    private final long maxBytes;
+    private final int keep;
+
+    /** format is "text" or "jsonl"; maxBytes 0 never rotates. */
+    public ChatLog(Path dir, String format, long maxBytes, int keep) {
+        if (!format.equals("text") && !format.equals("jsonl")) {
+            throw new IllegalArgumentException(tr("log.unknown_format", format));
+        }
+        this.dir = dir;
+        this.jsonl = format.equals("jsonl");
+        this.maxBytes = maxBytes;
+        this.keep = keep;
+    }
+
+    public Path getDir() { return dir; }
+
+    /** The file the room's messages go to. */
+    public Path file(String room) {
+        return dir.resolve(room.replaceAll("[^\\w.-]", "_") + (jsonl ? ".jsonl" : ".log"));
+    }
+
+    /** Appends a message; to is the recipient of a private one, "" otherwise. */
+    public synchronized void append(String room, long epochSeconds, String from, String to, String text, boolean important)
+            throws IOException {
+        Path file = file(room);
+        Files.createDirectories(dir);
+        if (maxBytes > 0 && Files.exists(file) && Files.size(file) >= maxBytes) rotate(file);
+        Files.writeString(file, format(room, epochSeconds, from, to, text, important) + System.lineSeparator(),
+                StandardCharsets.UTF_8, StandardOpenOption.CREATE, StandardOpenOption.APPEND);
+    }
+
+    private void rotate(Path file) throws IOException {
+        Files.deleteIfExists(file.resolveSibling(file.getFileName() + "." + keep));
+        for (int i = keep - 1; i >= 1; i--) {
+            Path older = file.resolveSibling(file.getFileName() + "." + i);
+            if (Files.exists(older)) {
+                Files.move(older, file.resolveSibling(file.getFileName() + "." + (i + 1)), StandardCopyOption.REPLACE_EXISTING);
+            }
+        }
+        if (keep > 0) Files.move(file, file.resolveSibling(file.getFileName() + ".1"), StandardCopyOption.REPLACE_EXISTING);
+        else Files.delete(file);
+    }
+
+    private String format(String room, long epochSeconds, String from, String to, String text, boolean important) {
+        if (jsonl) {
+            return "{\"time\":" + epochSeconds + ",\"room\":" + quote(room) + ",\"from\":" + quote(from)
+                    + (to.isEmpty() ? "" : ",\"to\":" + quote(to))
+                    + (important ? ",\"important\":true" : "") + ",\"text\":" + quote(text) + "}";
+        }
+        String time = LocalDateTime.ofInstant(Instant.ofEpochSecond(epochSeconds), ZoneId.systemDefault()).format(TIME);
+        return "[" + time + "] " + from + (to.isEmpty() ? "" : " → " + to) + ": " + (important ? "❗ " : "")
+                + text.replace("\n", "\n    ");
+    }
+
+    private static String quote(String s) {
+        StringBuilder b = new StringBuilder("\"");
+        for (char c : s.toCharArray()) {
+            switch (c) {
+                case '"': b.append("\\\""); break;
+                case '\\': b.append("\\\\"); break;
+                case '\n': b.append("\\n"); break;
+                case '\r': b.append("\\r"); break;
+                case '\t': b.append("\\t"); break;
+                default:
+                    if (c < 0x20) b.append(String.format("\\u%04x", (int) c));
+                    else b.append(c);
+            }
+        }
+        return b.append('"').toString();
+    }
+}
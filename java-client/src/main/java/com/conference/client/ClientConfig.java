@@ -0,0 +1,130 @@
+package com.conference.client;
+
+import java.io.IOException;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.util.ArrayList;
+import java.util.LinkedHashMap;
+import java.util.LinkedHashSet;
+import java.util.List;
+import java.util.Map;
+import java.util.Set;
+
+import static com.conference.client.I18n.tr;
+
+/**
+ * Client settings stored in ~/.config/elochat/config.yaml. Only flat
+ * "key: value" lines are supported; keys use dots for grouping
+ * (e.g. "audio.input").
+ *
+ * A named profile is a set of keys under "profiles.<name>." (e.g.
+ * "profiles.lab.server.host"); once selected with useProfile they take
+ * precedence over the same keys without the prefix.
+ */
+public class ClientConfig {
+
+    private final Path path;
+    private final Map<String, String> values = new LinkedHashMap<>();
+    private String profile; // null: no profile selected
+
+    private ClientConfig(Path path) {
+        this.path = path;
+    }
+
+    public static Path defaultPath() {
+        return Paths.get(System.getProperty("user.home"), ".config", "elochat", "config.yaml");
+    }
+
+    public static ClientConfig load() {
+        return load(defaultPath());
+    }
+
+    public static ClientConfig load(Path path) {
+        ClientConfig config = new ClientConfig(path);
+        if (!Files.exists(path)) {
+            return config;
+        }
+        try {
+            for (String line : Files.readAllLines(path)) {
+                String trimmed = line.trim();
+                if (trimmed.isEmpty() || trimmed.startsWith("#")) continue;
+                int colon = trimmed.indexOf(':');
+                if (colon <= 0) continue;
+                String key = trimmed.substring(0, colon).trim();
+                String value = unquote(trimmed.substring(colon + 1).trim());
+                config.values.put(key, value);
+            }
+        } catch (IOException e) {
+            System.err.println(tr("config.read_error", path, e.getMessage()));
+        }
+        return config;
+    }
+
+    public String get(String key, String defaultValue) {
+        if (profile != null) {
+            String value = values.get("profiles." + profile + "." + key);
+            if (value != null) return value;
+        }
+        return values.getOrDefault(key, defaultValue);
+    }
+
+    /** Selects a profile; false if the file has no keys for it. */
+    public boolean useProfile(String name) {
+        String prefix = "profiles." + name + ".";
+        if (values.keySet().stream().noneMatch(k -> k.startsWith(prefix))) return false;
+        profile = name;
+        return true;
+    }
+
+    /** The names of the profiles in the file, in the order they first appear. */
+    public Set<String> profiles() {
+        Set<String> names = new LinkedHashSet<>();
+        for (String key : values.keySet()) {
+            if (!key.startsWith("profiles.")) continue;
+            int dot = key.indexOf('.', "profiles.".length());
+            if (dot > 0) names.add(key.substring("profiles.".length(), dot));
+        }
+        return names;
+    }
+
+    /** The keys starting with prefix, without it, and their values; the profile's win over the plain ones. */
+    public Map<String, String> withPrefix(String prefix) {
+        Map<String, String> found = new LinkedHashMap<>();
+        String profilePrefix = profile == null ? null : "profiles." + profile + "." + prefix;
+        for (Map.Entry<String, String> e : values.entrySet()) {
+            if (e.getKey().startsWith(prefix)) found.putIfAbsent(e.getKey().substring(prefix.length()), e.getValue());
+        }
+        for (Map.Entry<String, String> e : values.entrySet()) {
+            if (profilePrefix != null && e.getKey().startsWith(profilePrefix)) {
+                found.put(e.getKey().substring(profilePrefix.length()), e.getValue());
+            }
+        }
+        return found;
+    }
+
+    public void set(String key, String value) {
+        if (value == null) values.remove(key);
+        else values.put(key, value);
+    }
+
+    public void save() {
+        List<String> lines = new ArrayList<>();
+        for (Map.Entry<String, String> e : values.entrySet()) {
+            lines.add(e.getKey() + ": \"" + e.getValue().replace("\\", "\\\\").replace("\"", "\\\"") + "\"");
+        }
+        try {
+            Files.createDirectories(path.getParent());
+            Files.write(path, lines);
+        } catch (IOException e) {
+            System.err.println(tr("config.save_error", path, e.getMessage()));
+        }
+    }
+
+    private static String unquote(String value) {
+        if (value.length() >= 2 && (value.startsWith("\"") && value.endsWith("\"") || value.startsWith("'") && value.endsWith("'"))) {
+            return value.substring(1, value.length() - 1).replace("\\\"", "\"").replace("\\\\", "\\");
+        }
+        return value;
+    }
+}
@@ -0,0 +1,60 @@
+package com.conference.client;
+
+import javax.imageio.ImageIO;
+import java.awt.Graphics2D;
+import java.awt.HeadlessException;
+import java.awt.Image;
+import java.awt.Toolkit;
+import java.awt.datatransfer.Clipboard;
+import java.awt.datatransfer.DataFlavor;
+import java.awt.datatransfer.UnsupportedFlavorException;
+import java.awt.image.BufferedImage;
+import java.io.IOException;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.time.LocalDateTime;
+import java.time.format.DateTimeFormatter;
+
+import static com.conference.client.I18n.tr;
+
+/**
+ * The image on the system clipboard, such as a screenshot just taken, saved
+ * as a PNG for /paste to send like any other file. It goes to a temporary
+ * directory of its own, under a name with the time it was pasted, which is
+ * what the other side sees; it is deleted when the client exits.
+ */
+final class ClipboardImage {
+
+    private static final DateTimeFormatter NAME = DateTimeFormatter.ofPattern("'captura-'yyyyMMdd-HHmmss'.png'");
+
+    private ClipboardImage() {}
+
+    /** Saves the clipboard's image and returns its path, or null if the clipboard holds no image. */
+    static Path save() throws IOException {
+        Image image;
+        try {
+            Clipboard clipboard = Toolkit.getDefaultToolkit().getSystemClipboard();
+            if (!clipboard.isDataFlavorAvailable(DataFlavor.imageFlavor)) return null;
+            image = (Image) clipboard.getData(DataFlavor.imageFlavor);
+        } catch (HeadlessException e) {
+            throw new IOException(tr("clipboard.headless"));
+        } catch (UnsupportedFlavorException | IllegalStateException e) {
+            return null; // changed or taken by another program meanwhile
+        }
+        Path dir = Files.createTempDirectory("elochat-paste");
+        Path file = dir.resolve(LocalDateTime.now().format(NAME));
+        if (!ImageIO.write(toBuffered(image), "png", file.toFile())) throw new IOException(tr("clipboard.no_png_writer"));
+        file.toFile().deleteOnExit();
+        dir.toFile().deleteOnExit(); // registered last, so it is deleted after the file
+        return file;
+    }
+
+    private static BufferedImage toBuffered(Image image) {
+        if (image instanceof BufferedImage) return (BufferedImage) image;
+        BufferedImage copy = new BufferedImage(image.getWidth(null), image.getHeight(null), BufferedImage.TYPE_INT_ARGB);
+        Graphics2D g = copy.createGraphics();
+        g.drawImage(image, 0, 0, null);
+        g.dispose();
+        return copy;
+    }
+}
@@ -0,0 +1,71 @@
+package com.conference.client;
+
+import java.util.ArrayList;
+import java.util.Collection;
+import java.util.List;
+import java.util.Map;
+import java.util.TreeMap;
+
+/**
+ * Shortcuts the user defines in the config. "alias.u: /upload" makes /u the
+ * same as /upload, with whatever follows passed along; the alias may carry
+ * arguments of its own ("alias.ana: /msg ana"). "macro.standup: /mic on; Buenos
+ * días" runs each part in turn, as a command or as a message. Built-in
+ * commands can't be redefined, and aliases are expanded inside macros but
+ * macros are not, so nothing can loop.
+ */
+final class CommandAliases {
+
+    private final Map<String, String> aliases = new TreeMap<>(); // "/u" -> "/upload"
+    private final Map<String, List<String>> macros = new TreeMap<>();
+
+    /** Reads the alias.* and macro.* keys of config, leaving out names taken by builtins. */
+    CommandAliases(ClientConfig config, Collection<String> builtins) {
+        config.withPrefix("alias.").forEach((name, value) -> {
+            String command = "/" + name.toLowerCase();
+            if (!builtins.contains(command) && !value.trim().isEmpty()) aliases.put(command, value.trim());
+        });
+        config.withPrefix("macro.").forEach((name, value) -> {
+            String command = "/" + name.toLowerCase();
+            if (builtins.contains(command) || aliases.containsKey(command)) return;
+            List<String> steps = new ArrayList<>();
+            for (String step : value.split(";")) {
+                if (!step.trim().isEmpty()) steps.add(step.trim());
+            }
+            if (!steps.isEmpty()) macros.put(command, steps);
+        });
+    }
+
+    /** The names defined, with their slash, for tab completion. */
+    List<String> names() {
+        List<String> names = new ArrayList<>(aliases.keySet());
+        names.addAll(macros.keySet());
+        return names;
+    }
+
+    /** One "/name → expansion" line per alias and macro, for /alias. */
+    List<String> describe() {
+        List<String> lines = new ArrayList<>();
+        aliases.forEach((name, value) -> lines.add(name + " → " + value));
+        macros.forEach((name, steps) -> lines.add(name + " → " + String.join("; ", steps)));
+        return lines;
+    }
+
+    /** What to run for line, in order: line itself unless it starts with an alias or a macro. */
+    List<String> expand(String line) {
+        int space = line.indexOf(' ');
+        String name = (space < 0 ? line : line.substring(0, space)).toLowerCase();
+        List<String> steps = macros.get(name);
+        if (steps == null) return List.of(expandAlias(line));
+        List<String> lines = new ArrayList<>();
+        for (String step : steps) lines.add(expandAlias(step));
+        return lines;
+    }
+
+    private String expandAlias(String line) {
+        int space = line.indexOf(' ');
+        String alias = aliases.get((space < 0 ? line : line.substring(0, space)).toLowerCase());
+        if (alias == null) return line;
+        return space < 0 ? alias : alias + line.substring(space);
+    }
+}
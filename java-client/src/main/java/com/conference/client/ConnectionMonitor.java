@@ -0,0 +1,87 @@
+package com.conference.client;
+
+import com.conference.grpc.ConferenceServiceGrpc;
+import com.conference.grpc.PingRequest;
+import io.grpc.ManagedChannel;
+import io.grpc.Status;
+import io.grpc.StatusRuntimeException;
+
+import java.util.concurrent.Executors;
+import java.util.concurrent.ScheduledExecutorService;
+import java.util.concurrent.TimeUnit;
+import java.util.function.Consumer;
+
+/**
+ * Pings the server every few seconds during a session, so a quiet room can be
+ * told apart from a dead link. Keeps the last round trip time and a state:
+ * CONNECTED while pings come back, RECONNECTING after one goes unanswered
+ * (gRPC is already retrying the connection underneath), OFFLINE once
+ * OFFLINE_AFTER in a row have. Servers without the Ping RPC answer
+ * UNIMPLEMENTED, which still proves they are there.
+ */
+final class ConnectionMonitor {
+
+    enum State { CONNECTED, RECONNECTING, OFFLINE }
+
+    static final int DEFAULT_INTERVAL_SECONDS = 5;
+    private static final int OFFLINE_AFTER = 3;
+    private static final long TIMEOUT_MS = 3000;
+
+    private final ConferenceServiceGrpc.ConferenceServiceBlockingStub stub;
+    private final Consumer<State> listener;
+    private final ScheduledExecutorService scheduler = Executors.newSingleThreadScheduledExecutor(r -> {
+        Thread t = new Thread(r, "ping");
+        t.setDaemon(true);
+        return t;
+    });
+    private volatile State state = State.CONNECTED;
+    private volatile long latencyMs = -1; // -1 until a ping comes back
+    private int failures; // in a row, only touched by ping()
+
+    /** listener is told every change of state, from the pinging thread. */
+    ConnectionMonitor(ManagedChannel channel, Consumer<State> listener) {
+        this.stub = ConferenceServiceGrpc.newBlockingStub(channel);
+        this.listener = listener;
+    }
+
+    /** Pings every intervalSeconds from now on; 0 or less only pings when asked. */
+    void start(int intervalSeconds) {
+        if (intervalSeconds <= 0) return;
+        scheduler.scheduleWithFixedDelay(this::ping, 0, intervalSeconds, TimeUnit.SECONDS);
+    }
+
+    void stop() {
+        scheduler.shutdownNow();
+    }
+
+    State getState() { return state; }
+
+    /** The last round trip time in milliseconds, or -1 if no ping has come back yet. */
+    long getLatencyMs() { return latencyMs; }
+
+    /** Pings now and returns the round trip time in milliseconds, or -1 if there was no answer. */
+    synchronized long ping() {
+        long sent = System.currentTimeMillis();
+        try {
+            stub.withDeadlineAfter(TIMEOUT_MS, TimeUnit.MILLISECONDS)
+                    .ping(PingRequest.newBuilder().setClientTimeMs(sent).build());
+        } catch (StatusRuntimeException e) {
+            if (e.getStatus().getCode() == Status.Code.CANCELLED) return -1; // stopped, not a lost link
+            if (e.getStatus().getCode() != Status.Code.UNIMPLEMENTED) {
+                failures++;
+                setState(failures >= OFFLINE_AFTER ? State.OFFLINE : State.RECONNECTING);
+                return -1;
+            }
+        }
+        failures = 0;
+        latencyMs = System.currentTimeMillis() - sent;
+        setState(State.CONNECTED);
+        return latencyMs;
+    }
+
+    private void setState(State next) {
+        if (state == next) return;
+        state = next;
+        listener.accept(next);
+    }
+}
@@ -0,0 +1,88 @@
+package com.conference.client;
+
+import java.util.ArrayList;
+import java.util.LinkedHashMap;
+import java.util.List;
+import java.util.Map;
+import java.util.function.Supplier;
+
+/**
+ * The one place the chat writes to the terminal from. Chat messages, transfer
+ * progress and audio notices come in on gRPC and worker threads while the
+ * user is typing; everything goes through here, one write at a time, so
+ * nothing lands in the middle of the input line. With line editing
+ * (LineInput) messages are printed above the line being typed, which keeps
+ * its text and cursor, and progress is shown in a status line below it.
+ * Without it (input piped in) the line is cleared, the message printed, and
+ * the progress or prompt drawn again; where the terminal can't erase a line
+ * (see TerminalOutput) it is overwritten with spaces instead.
+ */
+final class Console {
+
+    private final Map<String, String> statuses = new LinkedHashMap<>(); // progress lines by transfer, in start order
+    private LineInput input;
+    private Supplier<String> prompt = () -> "";
+    private int drawn; // cells taken by the prompt or progress on the current line, without a line editor
+
+    /** Routes output through input's line editor from now on. */
+    synchronized void attach(LineInput input) {
+        this.input = input;
+    }
+
+    synchronized void setPrompt(Supplier<String> prompt) {
+        this.prompt = prompt;
+    }
+
+    /** Prints a line of output; it may contain newlines. */
+    synchronized void message(String text) {
+        if (input != null) {
+            input.printAbove(text);
+            return;
+        }
+        clearLine();
+        System.out.println(TerminalOutput.forTerminal(text));
+        if (!statuses.isEmpty()) drawStatus();
+    }
+
+    /** Shows the prompt again after output, when there is no line editor to keep it. */
+    synchronized void prompt() {
+        if (input != null || !statuses.isEmpty()) return;
+        clearLine();
+        draw(prompt.get());
+    }
+
+    /** Sets the progress line for key, replacing its last one; null removes it. */
+    synchronized void status(String key, String text) {
+        boolean changed = text == null ? statuses.remove(key) != null : !text.equals(statuses.put(key, text));
+        if (!changed) return;
+        if (input != null) {
+            input.setStatus(new ArrayList<>(statuses.values()));
+        } else if (statuses.isEmpty()) {
+            clearLine();
+            System.out.flush();
+            prompt();
+        } else {
+            drawStatus();
+        }
+    }
+
+    // Without a status bar every progress line shares the current line
+    private void drawStatus() {
+        List<String> lines = new ArrayList<>(statuses.values());
+        clearLine();
+        draw(String.join("  ", lines));
+    }
+
+    private void draw(String text) {
+        text = TerminalOutput.forTerminal(text);
+        System.out.print(text);
+        System.out.flush();
+        drawn = Emoji.width(text);
+    }
+
+    private void clearLine() {
+        if (TerminalOutput.ansi()) System.out.print("\r\u001b[2K");
+        else if (drawn > 0) System.out.print("\r" + " ".repeat(drawn) + "\r");
+        drawn = 0;
+    }
+}
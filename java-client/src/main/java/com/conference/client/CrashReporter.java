@@ -0,0 +1,147 @@
+package com.conference.client;
+
+import java.io.ByteArrayOutputStream;
+import java.io.IOException;
+import java.io.OutputStream;
+import java.io.PrintStream;
+import java.io.PrintWriter;
+import java.io.StringWriter;
+import java.net.URI;
+import java.net.http.HttpClient;
+import java.net.http.HttpRequest;
+import java.net.http.HttpResponse;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.Paths;
+import java.time.Duration;
+import java.time.LocalDateTime;
+import java.time.format.DateTimeFormatter;
+import java.util.ArrayDeque;
+import java.util.ArrayList;
+import java.util.Deque;
+import java.util.List;
+
+import static com.conference.client.I18n.tr;
+
+/**
+ * Opt-in crash reporter. When ELOCHAT_CRASH_REPORTS=1 it tees stdout/stderr
+ * into a ring buffer and, on an uncaught exception, writes the stack trace,
+ * the recent output and the client version to ~/.config/elochat/crash-reports.
+ * If ELOCHAT_CRASH_URL is set the report is also POSTed there.
+ */
+public class CrashReporter {
+
+    public static final String CLIENT_VERSION = "1.0-SNAPSHOT";
+
+    private static final int MAX_RECENT_LINES = 200;
+    private static final DateTimeFormatter FILE_FORMATTER = DateTimeFormatter.ofPattern("yyyyMMdd-HHmmss");
+
+    private static final Deque<String> recentLines = new ArrayDeque<>();
+
+    private CrashReporter() {}
+
+    public static void installIfEnabled() {
+        if (!"1".equals(System.getenv("ELOCHAT_CRASH_REPORTS"))) {
+            return;
+        }
+        System.setOut(new PrintStream(new TeeOutputStream(System.out), true));
+        System.setErr(new PrintStream(new TeeOutputStream(System.err), true));
+        Thread.setDefaultUncaughtExceptionHandler((thread, error) -> {
+            Path report = writeReport(thread, error);
+            System.err.println(tr("crash.header"));
+            if (report != null) {
+                System.err.println(tr("crash.saved", report));
+            }
+            error.printStackTrace();
+        });
+    }
+
+    private static Path writeReport(Thread thread, Throwable error) {
+        StringWriter stack = new StringWriter();
+        error.printStackTrace(new PrintWriter(stack));
+
+        StringBuilder report = new StringBuilder();
+        report.append("Client version: ").append(CLIENT_VERSION).append('\n');
+        report.append("Java: ").append(System.getProperty("java.version")).append('\n');
+        report.append("OS: ").append(System.getProperty("os.name")).append(' ').append(System.getProperty("os.version")).append('\n');
+        report.append("Time: ").append(LocalDateTime.now()).append('\n');
+        report.append("Thread: ").append(thread.getName()).append("\n\n");
+        report.append("--- Stack trace ---\n").append(stack).append('\n');
+        report.append("--- Recent output ---\n");
+        for (String line : snapshotRecentLines()) {
+            report.append(line).append('\n');
+        }
+
+        Path path = null;
+        try {
+            Path dir = Paths.get(System.getProperty("user.home"), ".config", "elochat", "crash-reports");
+            Files.createDirectories(dir);
+            path = dir.resolve("crash-" + LocalDateTime.now().format(FILE_FORMATTER) + ".txt");
+            Files.writeString(path, report.toString());
+        } catch (IOException e) {
+            System.err.println(tr("crash.save_error", e.getMessage()));
+        }
+
+        String url = System.getenv("ELOCHAT_CRASH_URL");
+        if (url != null && !url.isBlank()) {
+            upload(url, report.toString());
+        }
+        return path;
+    }
+
+    private static void upload(String url, String report) {
+        try {
+            HttpClient client = HttpClient.newBuilder().connectTimeout(Duration.ofSeconds(5)).build();
+            HttpRequest request = HttpRequest.newBuilder(URI.create(url))
+                    .timeout(Duration.ofSeconds(10))
+                    .header("Content-Type", "text/plain; charset=utf-8")
+                    .POST(HttpRequest.BodyPublishers.ofString(report))
+                    .build();
+            client.send(request, HttpResponse.BodyHandlers.discarding());
+        } catch (Exception e) {
+            System.err.println(tr("crash.send_error", e.getMessage()));
+        }
+    }
+
+    private static List<String> snapshotRecentLines() {
+        synchronized (recentLines) {
+            return new ArrayList<>(recentLines);
+        }
+    }
+
+    private static void recordLine(String line) {
+        synchronized (recentLines) {
+            recentLines.addLast(line);
+            while (recentLines.size() > MAX_RECENT_LINES) {
+                recentLines.removeFirst();
+            }
+        }
+    }
+
+    /** Forwards everything to the original stream and remembers completed lines. */
+    private static class TeeOutputStream extends OutputStream {
+        private final OutputStream target;
+        private final ByteArrayOutputStream line = new ByteArrayOutputStream();
+
+        TeeOutputStream(OutputStream target) {
+            this.target = target;
+        }
+
+        @Override
+        public synchronized void write(int b) throws IOException {
+            target.write(b);
+            if (b == '\n') {
+                recordLine(line.toString(StandardCharsets.UTF_8).replaceAll("\u001b\\[[0-9;]*[A-Za-z]|\r", ""));
+                line.reset();
+            } else {
+                line.write(b);
+            }
+        }
+
+        @Override
+        public void flush() throws IOException {
+            target.flush();
+        }
+    }
+}
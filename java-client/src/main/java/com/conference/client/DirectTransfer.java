@@ -0,0 +1,129 @@
+package com.conference.client;
+
+import com.conference.grpc.FileChunk;
+import io.grpc.stub.StreamObserver;
+
+import java.io.BufferedInputStream;
+import java.io.BufferedOutputStream;
+import java.io.IOException;
+import java.io.InputStream;
+import java.io.OutputStream;
+import java.io.UncheckedIOException;
+import java.net.Inet6Address;
+import java.net.InetAddress;
+import java.net.InetSocketAddress;
+import java.net.NetworkInterface;
+import java.net.ServerSocket;
+import java.net.Socket;
+import java.net.SocketException;
+import java.util.ArrayList;
+import java.util.Collections;
+import java.util.List;
+
+import static com.conference.client.I18n.tr;
+
+/**
+ * Direct 1:1 file transfers. The receiver listens on an ephemeral TCP port
+ * and sends its addresses ("candidates") in the FileTransferResponse; the
+ * server adds the one it sees the receiver at. The sender tries them in order
+ * and, if one connects, writes the same FileChunk messages it would send to
+ * TransferFile, length-delimited, straight to the receiver.
+ */
+final class DirectTransfer {
+
+    /** How long the receiver waits for the sender; longer than it spends trying every candidate. */
+    static final int ACCEPT_TIMEOUT_MS = 10_000;
+    private static final int CONNECT_TIMEOUT_MS = 1500;
+    private static final int MAX_ATTEMPTS = ACCEPT_TIMEOUT_MS / CONNECT_TIMEOUT_MS; // give up before the receiver does
+
+    private DirectTransfer() {}
+
+    /** Opens the receiver's listening socket, or returns null if it can't. */
+    static ServerSocket listen() {
+        try {
+            ServerSocket listener = new ServerSocket(0);
+            listener.setSoTimeout(ACCEPT_TIMEOUT_MS);
+            return listener;
+        } catch (IOException e) {
+            return null;
+        }
+    }
+
+    /** host:port for every address of every interface that is up, loopback and link-local excluded. */
+    static List<String> candidates(int port) {
+        List<String> out = new ArrayList<>();
+        try {
+            for (NetworkInterface ni : Collections.list(NetworkInterface.getNetworkInterfaces())) {
+                if (!ni.isUp() || ni.isLoopback()) continue;
+                for (InetAddress addr : Collections.list(ni.getInetAddresses())) {
+                    if (addr.isLinkLocalAddress()) continue;
+                    String host = addr.getHostAddress();
+                    out.add(addr instanceof Inet6Address ? "[" + host + "]:" + port : host + ":" + port);
+                }
+            }
+        } catch (SocketException e) {
+            // No candidates: the sender falls back to the relay
+        }
+        return out;
+    }
+
+    /** Connects to the first candidate that answers, or returns null. */
+    static Socket connect(List<String> candidates) {
+        for (String candidate : candidates.subList(0, Math.min(candidates.size(), MAX_ATTEMPTS))) {
+            int colon = candidate.lastIndexOf(':');
+            if (colon <= 0) continue;
+            String host = candidate.substring(0, colon).replace("[", "").replace("]", "");
+            Socket socket = new Socket();
+            try {
+                socket.connect(new InetSocketAddress(host, Integer.parseInt(candidate.substring(colon + 1))), CONNECT_TIMEOUT_MS);
+                return socket;
+            } catch (IOException | NumberFormatException e) {
+                try { socket.close(); } catch (IOException ignored) {}
+            }
+        }
+        return null;
+    }
+
+    /** Writes chunks to the socket; completing or failing the observer closes it. */
+    static StreamObserver<FileChunk> writer(Socket socket) throws IOException {
+        OutputStream out = new BufferedOutputStream(socket.getOutputStream());
+        return new StreamObserver<>() {
+            @Override public void onNext(FileChunk chunk) {
+                try {
+                    chunk.writeDelimitedTo(out);
+                } catch (IOException e) {
+                    throw new UncheckedIOException(e);
+                }
+            }
+            @Override public void onError(Throwable t) {
+                try { socket.close(); } catch (IOException ignored) {}
+            }
+            @Override public void onCompleted() {
+                try {
+                    out.flush();
+                    socket.close();
+                } catch (IOException ignored) {}
+            }
+        };
+    }
+
+    /**
+     * Feeds the chunks read from socket to sink until the last one, then
+     * completes it. Chunks for another transfer end the connection.
+     */
+    static void read(Socket socket, String transferId, StreamObserver<FileChunk> sink) {
+        try (socket; InputStream in = new BufferedInputStream(socket.getInputStream())) {
+            FileChunk chunk;
+            while ((chunk = FileChunk.parseDelimitedFrom(in)) != null) {
+                if (!chunk.getTransferId().equals(transferId)) {
+                    throw new IOException(tr("transfer.direct_wrong_transfer"));
+                }
+                sink.onNext(chunk);
+                if (chunk.getIsLast()) break;
+            }
+            sink.onCompleted();
+        } catch (IOException | RuntimeException e) {
+            sink.onError(e);
+        }
+    }
+}
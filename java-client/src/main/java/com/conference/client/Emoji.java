@@ -0,0 +1,86 @@
+package com.conference.client;
+
+import org.jline.utils.WCWidth;
+
+import java.util.Map;
+import java.util.Set;
+import java.util.TreeMap;
+import java.util.regex.Matcher;
+import java.util.regex.Pattern;
+
+/**
+ * :shortcode: to emoji for outgoing messages, using the names Slack and
+ * GitHub use for the common ones; unknown codes are sent as typed. Also the
+ * terminal width of text, for lining up columns that hold names and messages:
+ * most emoji and CJK characters take two cells, which String.length() and
+ * "%-16s" don't know.
+ */
+public final class Emoji {
+
+    private static final Pattern SHORTCODE = Pattern.compile(":([a-z0-9_+-]+):");
+    private static final Pattern CODE = Pattern.compile("```[\\s\\S]*?(```|$)|`[^`\n]*`"); // see Markdown
+    private static final Pattern ANSI = Pattern.compile("\u001b\\[[0-9;]*[A-Za-z]");
+    private static final Map<String, String> CODES = new TreeMap<>();
+
+    static {
+        String[] pairs = {
+                "smile", "😄", "grin", "😁", "joy", "😂", "laughing", "😆", "wink", "😉", "blush", "😊",
+                "slightly_smiling_face", "🙂", "upside_down", "🙃", "heart_eyes", "😍", "sweat_smile", "😅",
+                "thinking", "🤔", "neutral_face", "😐", "confused", "😕", "open_mouth", "😮", "scream", "😱",
+                "cry", "😢", "sob", "😭", "angry", "😠", "rage", "😡", "sunglasses", "😎", "sleeping", "😴",
+                "see_no_evil", "🙈", "shrug", "🤷", "facepalm", "🤦", "skull", "💀", "ghost", "👻", "robot", "🤖",
+                "wave", "👋", "+1", "👍", "thumbsup", "👍", "-1", "👎", "thumbsdown", "👎", "clap", "👏",
+                "pray", "🙏", "ok_hand", "👌", "raised_hands", "🙌", "raised_hand", "✋", "muscle", "💪", "eyes", "👀",
+                "heart", "❤️", "broken_heart", "💔", "fire", "🔥", "star", "⭐", "sparkles", "✨", "tada", "🎉",
+                "rocket", "🚀", "100", "💯", "white_check_mark", "✅", "x", "❌", "warning", "⚠️", "question", "❓",
+                "exclamation", "❗", "bulb", "💡", "zap", "⚡", "coffee", "☕", "beer", "🍺", "pizza", "🍕",
+                "cake", "🎂", "sunny", "☀️", "cloud", "☁️", "snowflake", "❄️", "bug", "🐛", "computer", "💻",
+                "iphone", "📱", "email", "📧", "calendar", "📅", "lock", "🔒", "key", "🔑", "memo", "📝",
+                "link", "🔗", "microphone", "🎤", "headphones", "🎧", "mute", "🔇", "cat", "🐱", "dog", "🐶",
+        };
+        for (int i = 0; i < pairs.length; i += 2) CODES.put(pairs[i], pairs[i + 1]);
+    }
+
+    private Emoji() {}
+
+    /** The shortcodes known, without colons, sorted. */
+    public static Set<String> codes() {
+        return CODES.keySet();
+    }
+
+    /** text with every known :shortcode: replaced by its emoji, except in `code`. */
+    public static String expand(String text) {
+        if (text.indexOf(':') < 0) return text;
+        StringBuilder out = new StringBuilder();
+        Matcher code = CODE.matcher(text);
+        int at = 0;
+        while (code.find()) {
+            out.append(expandPlain(text.substring(at, code.start()))).append(code.group());
+            at = code.end();
+        }
+        return out.append(expandPlain(text.substring(at))).toString();
+    }
+
+    private static String expandPlain(String text) {
+        Matcher m = SHORTCODE.matcher(text);
+        return m.replaceAll(r -> Matcher.quoteReplacement(CODES.getOrDefault(r.group(1), r.group())));
+    }
+
+    /** How many terminal cells text takes, ignoring color codes. */
+    public static int width(String text) {
+        String plain = ANSI.matcher(text).replaceAll("");
+        int cells = 0;
+        for (int i = 0; i < plain.length(); ) {
+            int cp = plain.codePointAt(i);
+            cells += Math.max(0, WCWidth.wcwidth(cp)); // combining marks and variation selectors take none
+            i += Character.charCount(cp);
+        }
+        return cells;
+    }
+
+    /** text followed by enough spaces to take at least cells cells, like "%-Ns" for what the terminal shows. */
+    public static String padRight(String text, int cells) {
+        int width = width(text);
+        return width >= cells ? text : text + " ".repeat(cells - width);
+    }
+}
@@ -0,0 +1,126 @@
+package com.conference.client;
+
+import javax.sound.sampled.AudioFormat;
+import javax.sound.sampled.AudioInputStream;
+import javax.sound.sampled.AudioSystem;
+import java.io.BufferedInputStream;
+import java.io.IOException;
+import java.io.InputStream;
+import java.io.OutputStream;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.util.Arrays;
+import java.util.List;
+
+import static com.conference.client.I18n.tr;
+
+/**
+ * Audio backend without hardware. Capture loops over a WAV file (or yields
+ * silence) and playback appends raw PCM to a file (or discards it). Both sides
+ * are paced to real time so the streaming path behaves as with a sound card.
+ */
+public class FileAudioBackend implements AudioBackend {
+
+    private final Path inputFile;
+    private final Path outputFile;
+
+    private AudioFormat format;
+    private AudioInputStream input;
+    private OutputStream output;
+    private long readClockNanos;
+    private long writeClockNanos;
+
+    public FileAudioBackend(Path inputFile, Path outputFile) {
+        this.inputFile = inputFile;
+        this.outputFile = outputFile;
+    }
+
+    @Override
+    public List<String> listInputDevices() {
+        return List.of(inputFile == null ? "null (silencio)" : "archivo: " + inputFile);
+    }
+
+    @Override
+    public List<String> listOutputDevices() {
+        return List.of(outputFile == null ? "null (descartar)" : "archivo: " + outputFile);
+    }
+
+    @Override
+    public void open(AudioFormat format, String inputDevice, String outputDevice) {
+        this.format = format;
+        try {
+            if (inputFile != null) input = openInput();
+            if (outputFile != null) output = Files.newOutputStream(outputFile);
+        } catch (Exception e) {
+            System.err.println(tr("audio.file_backend_error", e.getMessage()));
+        }
+        readClockNanos = writeClockNanos = System.nanoTime();
+    }
+
+    private AudioInputStream openInput() throws Exception {
+        InputStream raw = new BufferedInputStream(Files.newInputStream(inputFile));
+        return AudioSystem.getAudioInputStream(format, AudioSystem.getAudioInputStream(raw));
+    }
+
+    @Override
+    public int readFrame(byte[] buffer, int offset, int length) {
+        int read = 0;
+        if (input != null) {
+            try {
+                read = input.read(buffer, offset, length);
+                if (read <= 0) { // Loop the file
+                    input.close();
+                    input = openInput();
+                    read = input.read(buffer, offset, length);
+                }
+            } catch (Exception e) {
+                read = 0;
+            }
+        }
+        if (read <= 0) {
+            Arrays.fill(buffer, offset, offset + length, (byte) 0);
+            read = length;
+        }
+        readClockNanos = pace(readClockNanos, read);
+        return read;
+    }
+
+    @Override
+    public void writeFrame(byte[] data, int offset, int length) {
+        if (output != null) {
+            try {
+                output.write(data, offset, length);
+            } catch (IOException e) {
+                System.err.println(tr("audio.file_backend_error", e.getMessage()));
+            }
+        }
+        writeClockNanos = pace(writeClockNanos, length);
+    }
+
+    // Sleeps until the audio clock catches up with the bytes processed so far
+    private long pace(long clockNanos, int bytes) {
+        long frameNanos = (long) (bytes / (double) format.getFrameSize() / format.getSampleRate() * 1_000_000_000L);
+        long next = Math.max(clockNanos, System.nanoTime() - 200_000_000L) + frameNanos;
+        long wait = next - System.nanoTime();
+        if (wait > 0) {
+            try {
+                Thread.sleep(wait / 1_000_000, (int) (wait % 1_000_000));
+            } catch (InterruptedException e) {
+                Thread.currentThread().interrupt();
+            }
+        }
+        return next;
+    }
+
+    @Override
+    public void close() {
+        try {
+            if (input != null) input.close();
+            if (output != null) output.close();
+        } catch (IOException e) {
+            System.err.println(tr("audio.file_backend_error", e.getMessage()));
+        }
+        input = null;
+        output = null;
+    }
+}
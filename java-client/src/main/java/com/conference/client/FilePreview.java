@@ -0,0 +1,105 @@
+package com.conference.client;
+
+import javax.imageio.ImageIO;
+import java.awt.image.BufferedImage;
+import java.io.BufferedReader;
+import java.io.IOException;
+import java.io.InputStream;
+import java.io.InputStreamReader;
+import java.nio.charset.CharacterCodingException;
+import java.nio.charset.CodingErrorAction;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.util.ArrayList;
+import java.util.List;
+import java.util.Locale;
+import java.util.Set;
+
+/**
+ * Inline previews of received files for the terminal: images become a small
+ * ASCII thumbnail and text files show their first lines. Anything else, or
+ * anything over the size limit, gets only the link to the saved file.
+ */
+final class FilePreview {
+
+    private static final int TEXT_LINES = 8;
+    private static final int THUMB_WIDTH = 48;
+    private static final int MAX_LINE = 120;
+    private static final String RAMP = " .:-=+*#%@"; // light to dark
+    private static final Set<String> IMAGE_EXTS = Set.of("png", "jpg", "jpeg", "gif", "bmp");
+    private static final Set<String> TEXT_EXTS = Set.of("txt", "md", "csv", "log", "json", "xml", "yaml", "yml",
+            "java", "go", "py", "c", "h", "cpp", "js", "ts", "html", "css", "sh", "proto", "properties", "ini", "toml");
+
+    private FilePreview() {}
+
+    /** Lines to print after a file is saved: the preview, if any, then the path as a terminal hyperlink. */
+    static List<String> render(Path file, long maxBytes) {
+        List<String> out = new ArrayList<>();
+        try {
+            if (Files.size(file) <= maxBytes) {
+                String ext = extension(file);
+                if (IMAGE_EXTS.contains(ext)) out.addAll(thumbnail(file));
+                else if (TEXT_EXTS.contains(ext)) out.addAll(head(file));
+            }
+        } catch (IOException e) {
+            // No preview; the link is still useful
+        }
+        out.add("   📎 " + link(file));
+        return out;
+    }
+
+    /** OSC 8 hyperlink to the file; terminals without support just show the path. */
+    static String link(Path file) {
+        Path abs = file.toAbsolutePath();
+        return "\u001b]8;;" + abs.toUri() + "\u001b\\" + abs + "\u001b]8;;\u001b\\";
+    }
+
+    private static String extension(Path file) {
+        String name = file.getFileName().toString();
+        int dot = name.lastIndexOf('.');
+        return dot < 0 ? "" : name.substring(dot + 1).toLowerCase(Locale.ROOT);
+    }
+
+    // Each character covers a cell twice as tall as it is wide, about the shape of a terminal cell
+    private static List<String> thumbnail(Path file) throws IOException {
+        BufferedImage img = ImageIO.read(file.toFile());
+        List<String> out = new ArrayList<>();
+        if (img == null) return out; // not a format ImageIO reads
+        int cols = Math.min(THUMB_WIDTH, img.getWidth());
+        double cell = (double) img.getWidth() / cols;
+        int rows = Math.max(1, (int) (img.getHeight() / (cell * 2)));
+        for (int r = 0; r < rows; r++) {
+            StringBuilder line = new StringBuilder("   ");
+            for (int c = 0; c < cols; c++) {
+                int rgb = img.getRGB((int) (c * cell), Math.min(img.getHeight() - 1, (int) (r * cell * 2)));
+                int alpha = rgb >>> 24;
+                double luma = (0.299 * ((rgb >> 16) & 0xff) + 0.587 * ((rgb >> 8) & 0xff) + 0.114 * (rgb & 0xff)) / 255;
+                if (img.getColorModel().hasAlpha() && alpha < 128) luma = 1; // transparent shows as background
+                line.append(RAMP.charAt((int) Math.round((1 - luma) * (RAMP.length() - 1))));
+            }
+            out.add(line.toString().stripTrailing());
+        }
+        return out;
+    }
+
+    // First lines of a UTF-8 text file; files that don't decode aren't previewed
+    private static List<String> head(Path file) throws IOException {
+        List<String> out = new ArrayList<>();
+        var decoder = StandardCharsets.UTF_8.newDecoder()
+                .onMalformedInput(CodingErrorAction.REPORT).onUnmappableCharacter(CodingErrorAction.REPORT);
+        try (InputStream in = Files.newInputStream(file);
+             BufferedReader reader = new BufferedReader(new InputStreamReader(in, decoder))) {
+            String line;
+            while (out.size() < TEXT_LINES && (line = reader.readLine()) != null) {
+                if (line.indexOf('\0') >= 0) return List.of();
+                line = line.replace("\t", "    ").replaceAll("\\p{Cntrl}", "");
+                out.add("   │ " + (line.length() > MAX_LINE ? line.substring(0, MAX_LINE) + "…" : line));
+            }
+            if (reader.readLine() != null) out.add("   │ …");
+        } catch (CharacterCodingException e) {
+            return List.of();
+        }
+        return out;
+    }
+}
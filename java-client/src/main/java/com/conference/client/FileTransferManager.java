@@ -3,69 +3,104 @@ package com.conference.client;
 import com.conference.grpc.*;
 import com.google.protobuf.ByteString;
 import io.grpc.Metadata;
+import io.grpc.Status;
+import io.grpc.stub.ClientCallStreamObserver;
 import io.grpc.stub.MetadataUtils;
 import io.grpc.stub.StreamObserver;
 
+import java.io.ByteArrayInputStream;
+import java.io.ByteArrayOutputStream;
 import java.io.FileOutputStream;
 import java.io.IOException;
 import java.io.InputStream;
+import java.net.ServerSocket;
+import java.net.Socket;
+import java.nio.channels.Channels;
+import java.nio.channels.SeekableByteChannel;
 import java.nio.file.Files;
 import java.nio.file.Path;
 import java.nio.file.Paths;
+import java.security.MessageDigest;
+import java.security.NoSuchAlgorithmException;
 import java.time.Instant;
+import java.util.Set;
 import java.util.UUID;
+import java.util.concurrent.CompletableFuture;
+import java.util.concurrent.ConcurrentHashMap;
+import java.util.concurrent.TimeUnit;
 import java.util.concurrent.atomic.AtomicBoolean;
+import java.util.concurrent.atomic.AtomicInteger;
 import java.util.concurrent.atomic.AtomicLong;
+import java.util.concurrent.atomic.AtomicReference;
+import java.util.zip.CRC32;
+import java.util.zip.GZIPInputStream;
+import java.util.zip.GZIPOutputStream;
+
+import static com.conference.client.I18n.tr;
 
 public class FileTransferManager {
     private final ConferenceServiceGrpc.ConferenceServiceStub asyncStub;
     private final StreamObserver<ConferenceData> requestObserver; // Observer for main channel
     private final String senderName;
+    private final Console console;
     private static final int CHUNK_SIZE = 1024 * 64; // 64KB chunks
-    private static final java.time.format.DateTimeFormatter TIME_FORMATTER = java.time.format.DateTimeFormatter.ofPattern("HH:mm");
+    private static final String GZIP = "gzip"; // the only compression this client implements
+    private static final int MAX_RESUMES = 5; // reconnections of a broken 1:1 relay, as many as the server allows
 
     private static class PendingTransfer {
         final String originalSender;
+        final String filename;
         final long fileSize;
-        PendingTransfer(String originalSender, long fileSize) {
+        final String sha256; // empty if the sender predates checksums
+        final String compression; // agreed for this transfer; "" = none
+        boolean direct; // 1:1 only: the sender can connect to us directly
+        PendingTransfer(String originalSender, String filename, long fileSize, String sha256, String compression) {
             this.originalSender = originalSender;
+            this.filename = filename;
             this.fileSize = fileSize;
+            this.sha256 = sha256;
+            this.compression = compression;
         }
     }
 
     // State for P2P and broadcast transfers
     private final java.util.Map<String, PendingTransfer> pendingP2PTransfers = new java.util.concurrent.ConcurrentHashMap<>();
-    private final java.util.Map<String, Long> pendingBroadcasts = new java.util.concurrent.ConcurrentHashMap<>();
+    private final java.util.Map<String, PendingTransfer> pendingBroadcasts = new java.util.concurrent.ConcurrentHashMap<>();
+    private final java.util.Map<String, ClientCallStreamObserver<FileChunk>> activeDownloads = new ConcurrentHashMap<>();
+    private final Set<String> cancelled = ConcurrentHashMap.newKeySet(); // transfers we cancelled with /abort
+    private volatile int uploadLimitKiB = 0; // /limit; 0 = unlimited
+    private volatile boolean overwrite = false; // /overwrite; otherwise existing files are kept and the new one renamed
+    private volatile Path downloadDir = Paths.get(System.getProperty("user.home"), "Descargas", "chat-downloads");
+    private volatile String downloadSort = "none";
+    private volatile long previewMaxBytes = 1024 * 1024; // /preview; 0 = off
+    private final java.util.Map<String, RoomFile> roomFiles = new ConcurrentHashMap<>(); // announced files stored on the server
+    private final java.util.Map<String, java.util.List<String>> broadcastReceipts = new ConcurrentHashMap<>(); // our broadcasts -> who got them intact
 
 
-    public FileTransferManager(ConferenceServiceGrpc.ConferenceServiceStub asyncStub, StreamObserver<ConferenceData> requestObserver, String senderName) {
+    public FileTransferManager(ConferenceServiceGrpc.ConferenceServiceStub asyncStub, StreamObserver<ConferenceData> requestObserver,
+                               String senderName, Console console) {
         this.asyncStub = asyncStub;
         this.requestObserver = requestObserver;
         this.senderName = senderName;
+        this.console = console;
     }
 
     // --- Message Printing ---
     private void printMessage(String message) {
-        System.out.print("\r\u001b[2K"); // Clear line
-        System.out.println(message);
-        printPrompt();
-    }
-
-    private void printPrompt() {
-        System.out.print("[" + java.time.LocalDateTime.now().format(TIME_FORMATTER) + "] Tú: ");
-        System.out.flush();
+        console.message(message);
+        console.prompt();
     }
     
     // --- Broadcast File Logic ---
 
-    public void registerBroadcastTransfer(String transferId, long fileSize) {
-        pendingBroadcasts.put(transferId, fileSize);
+    public void registerBroadcastTransfer(String transferId, String announcer, String filename, long fileSize, String sha256, String compression) {
+        pendingBroadcasts.put(transferId, new PendingTransfer(announcer, filename, fileSize, sha256, compression));
     }
 
     public void broadcastFile(String filePath, String roomId) {
         Path path = Paths.get(filePath);
         if (!Files.exists(path)) {
-            printMessage("❌ Error: El archivo no existe: " + filePath);
+            printMessage(tr("transfer.no_such_file", filePath));
             return;
         }
         try {
@@ -73,13 +108,15 @@ public class FileTransferManager {
             String filename = path.getFileName().toString();
             String transferId = UUID.randomUUID().toString();
 
-            printMessage("📢 Anunciando archivo a la sala: '" + filename + "'...");
+            printMessage(tr("transfer.announcing", filename, transferId));
 
             // 1. Announce the file on the main channel
             BroadcastFileAnnouncement announcement = BroadcastFileAnnouncement.newBuilder()
                 .setFilename(filename)
                 .setFileSize(fileSize)
                 .setTransferId(transferId)
+                .setSha256(sha256Hex(path))
+                .setCompression(GZIP)
                 .build();
             
             ConferenceData data = ConferenceData.newBuilder()
@@ -89,87 +126,336 @@ public class FileTransferManager {
                 .build();
             
             requestObserver.onNext(data);
+            broadcastReceipts.put(transferId, new java.util.concurrent.CopyOnWriteArrayList<>());
 
             // 2. Immediately start the sender stream
-            startFileStreamSender(path, transferId);
+            startFileStreamSender(path, transferId, GZIP);
 
         } catch (IOException e) {
-            printMessage("❌ Error al leer el archivo: " + e.getMessage());
+            printMessage(tr("transfer.read_error", e.getMessage()));
         }
     }
 
-    public void downloadBroadcastFile(String transferId, String savePath) {
-        Long fileSize = pendingBroadcasts.get(transferId);
-        if (fileSize == null) {
-            printMessage("❌ Error: No se encontró anuncio para la transferencia " + transferId);
+    public void downloadBroadcastFile(String transferId, String destination, String roomId) {
+        PendingTransfer pending = pendingBroadcasts.get(transferId);
+        if (pending == null) {
+            printMessage(tr("transfer.no_announcement", transferId));
+            return;
+        }
+        String savePath = resolveSavePath(destination, pending.filename, roomId, pending.originalSender);
+        if (!pending.compression.isEmpty() && !pending.compression.equals(GZIP)) {
+            printMessage(tr("transfer.unsupported_compression", pending.compression));
             return;
         }
-        printMessage("📥 Preparando para descargar archivo " + transferId + "...");
-        startFileStreamReceiver(transferId, savePath, fileSize);
+        printMessage(tr("transfer.preparing_download", transferId));
+        startFileStreamReceiver(transferId, savePath, pending, roomId);
+    }
+
+    // --- Where Received Files Go ---
+
+    public void setOverwrite(boolean overwrite) { this.overwrite = overwrite; }
+    public boolean isOverwrite() { return overwrite; }
+
+    public void setPreviewMaxBytes(long max) { this.previewMaxBytes = max; }
+    public long getPreviewMaxBytes() { return previewMaxBytes; }
+
+    public void setDownloadDir(Path dir) { this.downloadDir = dir; }
+    public Path getDownloadDir() { return downloadDir; }
+
+    // "none", "room" or "sender": files received without a destination go into a subfolder per room or sender
+    public void setDownloadSort(String sort) { this.downloadSort = sort; }
+    public String getDownloadSort() { return downloadSort; }
+
+    private Path defaultFolder(String roomId, String sender) {
+        switch (downloadSort) {
+            case "room": return downloadDir.resolve(safeFilename(roomId));
+            case "sender": return downloadDir.resolve(safeFilename(sender));
+            default: return downloadDir;
+        }
+    }
+
+    // destination is what the user typed, or null for the download folder; if it names a folder, the file
+    // keeps the sender's name inside it. Names come from the other side, so they are cut down to a bare
+    // file name first.
+    private String resolveSavePath(String destination, String filename, String roomId, String sender) {
+        if (destination == null) destination = defaultFolder(roomId, sender) + java.io.File.separator;
+        Path target = Paths.get(destination);
+        if (Files.isDirectory(target) || destination.endsWith("/") || destination.endsWith(java.io.File.separator)) {
+            target = target.resolve(safeFilename(filename));
+        }
+        if (target.getParent() != null) {
+            try { Files.createDirectories(target.getParent()); } catch (IOException ignored) {} // reported when the file is opened
+        }
+        if (!overwrite && Files.exists(target)) {
+            Path free = freeName(target);
+            printMessage(tr("transfer.renamed", target.getFileName(), free.getFileName()));
+            target = free;
+        }
+        return target.toString();
+    }
+
+    // Drops any directory part ("../../x" is just "x") and characters Windows won't accept
+    private static String safeFilename(String filename) {
+        String name = filename.substring(Math.max(filename.lastIndexOf('/'), filename.lastIndexOf('\\')) + 1);
+        name = name.replaceAll("[\\p{Cntrl}<>:\"|?*]", "_").replaceAll("[. ]+$", "").trim();
+        return name.isEmpty() ? "archivo" : name;
+    }
+
+    // "informe.pdf" -> "informe (1).pdf", "informe (2).pdf", ... whichever is free first
+    private static Path freeName(Path target) {
+        String name = target.getFileName().toString();
+        int dot = name.lastIndexOf('.');
+        String stem = dot > 0 ? name.substring(0, dot) : name;
+        String ext = dot > 0 ? name.substring(dot) : "";
+        for (int i = 1; ; i++) {
+            Path candidate = target.resolveSibling(stem + " (" + i + ")" + ext);
+            if (!Files.exists(candidate)) return candidate;
+        }
+    }
+
+    // --- Server-Stored Files ---
+
+    public void registerRoomFile(RoomFile file) {
+        roomFiles.put(file.getFileId(), file);
+    }
+
+    // The server keeps stored files for a while only; value is "<file_id>:<unix time it goes>"
+    public void handleFileExpiring(String value) {
+        int i = value.lastIndexOf(':');
+        if (i <= 0) return;
+        String fileId = value.substring(0, i), when;
+        try {
+            when = java.time.Instant.ofEpochSecond(Long.parseLong(value.substring(i + 1))).atZone(java.time.ZoneId.systemDefault())
+                    .format(java.time.format.DateTimeFormatter.ofPattern("dd/MM HH:mm"));
+        } catch (NumberFormatException e) {
+            return;
+        }
+        RoomFile file = roomFiles.get(fileId);
+        printMessage(tr("transfer.stored_file_expiring", file != null ? file.getFilename() : "?", fileId, when, fileId));
+    }
+
+    public void handleFileExpired(String fileId) {
+        RoomFile file = roomFiles.remove(fileId);
+        printMessage(tr("transfer.stored_file_expired", file != null ? file.getFilename() : "?", fileId));
+    }
+
+    // Files in our inbox we haven't fetched yet, oldest first
+    public java.util.List<RoomFile> inboxFiles() {
+        java.util.List<RoomFile> inbox = new java.util.ArrayList<>();
+        for (RoomFile file : roomFiles.values()) {
+            if (file.getRecipient().equals(senderName)) inbox.add(file);
+        }
+        inbox.sort(java.util.Comparator.comparingLong(RoomFile::getTimestamp));
+        return inbox;
+    }
+
+    public void uploadToRoom(String filePath, String roomId) {
+        uploadToRoom(filePath, roomId, "");
+    }
+
+    // Leaves the file on the server; the room is told with a RoomFile once it's stored, or only
+    // recipient is, wherever they are, if there is one
+    public void uploadToRoom(String filePath, String roomId, String recipient) {
+        Path path = Paths.get(filePath);
+        if (!Files.exists(path)) {
+            printMessage(tr("transfer.no_such_file", filePath));
+            return;
+        }
+        AtomicBoolean stopped = new AtomicBoolean(false);
+        String progressKey = "upload:" + path;
+        StreamObserver<RoomFileUpload> upload = asyncStub.uploadToRoom(new StreamObserver<RoomFile>() {
+            @Override public void onNext(RoomFile stored) {
+                endProgress(progressKey);
+                if (recipient.isEmpty()) {
+                    printMessage(tr("transfer.stored", stored.getFilename(), stored.getFileId()));
+                } else {
+                    printMessage(tr("transfer.left_in_inbox", stored.getFilename(), recipient));
+                }
+            }
+            @Override public void onError(Throwable t) {
+                stopped.set(true);
+                endProgress(progressKey);
+                printMessage(tr("transfer.store_failed", Status.fromThrowable(t).getDescription()));
+            }
+            @Override public void onCompleted() {}
+        });
+        Thread uploader = new Thread(() -> {
+            try (InputStream stream = Files.newInputStream(path)) {
+                long fileSize = Files.size(path);
+                upload.onNext(RoomFileUpload.newBuilder().setInfo(RoomFile.newBuilder()
+                        .setRoomId(roomId).setSender(senderName).setRecipient(recipient).setFilename(path.getFileName().toString())
+                        .setFileSize(fileSize).setSha256(sha256Hex(path))).build());
+                byte[] buffer = new byte[CHUNK_SIZE];
+                long totalBytesSent = 0;
+                int chunkNumber = 0, bytesRead;
+                CRC32 crc = new CRC32();
+                long startNanos = System.nanoTime();
+                while ((bytesRead = stream.read(buffer)) != -1) {
+                    if (stopped.get()) return;
+                    crc.reset();
+                    crc.update(buffer, 0, bytesRead);
+                    upload.onNext(RoomFileUpload.newBuilder().setChunk(FileChunk.newBuilder()
+                            .setData(ByteString.copyFrom(buffer, 0, bytesRead)).setChunkNumber(chunkNumber++)
+                            .setCrc32((int) crc.getValue())).build());
+                    totalBytesSent += bytesRead;
+                    updateProgress(progressKey, tr("transfer.uploading"), totalBytesSent, fileSize);
+                    paceUpload(totalBytesSent, startNanos);
+                }
+                upload.onNext(RoomFileUpload.newBuilder().setChunk(FileChunk.newBuilder()
+                        .setChunkNumber(chunkNumber).setIsLast(true)).build());
+                upload.onCompleted();
+            } catch (Exception e) {
+                endProgress(progressKey);
+                printMessage(tr("transfer.local_read_error", e.getMessage()));
+                upload.onError(e);
+            }
+        }, "room-upload-" + path.getFileName());
+        uploader.setDaemon(true);
+        uploader.start();
+    }
+
+    public void fetchRoomFile(String fileId, String destination, String roomId) {
+        RoomFile file = roomFiles.get(fileId);
+        if (file == null) {
+            printMessage(tr("transfer.no_stored_file", fileId));
+            return;
+        }
+        String savePath = resolveSavePath(destination, file.getFilename(), roomId, file.getSender());
+        printMessage(tr("transfer.downloading_stored", file.getFilename()));
+        DownloadFileRequest request = DownloadFileRequest.newBuilder()
+                .setFileId(fileId).setRoomId(roomId).setRequester(senderName).build();
+        MessageDigest digest = newSha256();
+        CRC32 crc = new CRC32();
+        AtomicLong received = new AtomicLong(0);
+        AtomicReference<String> corruption = new AtomicReference<>();
+        asyncStub.downloadFile(request, new StreamObserver<FileChunk>() {
+            FileOutputStream out = null;
+            @Override public void onNext(FileChunk chunk) {
+                try {
+                    if (out == null) out = new FileOutputStream(savePath);
+                    if (chunk.getData().isEmpty()) return;
+                    byte[] data = chunk.getData().toByteArray();
+                    crc.reset();
+                    crc.update(data);
+                    if ((int) crc.getValue() != chunk.getCrc32()) {
+                        corruption.compareAndSet(null, tr("transfer.bad_crc", chunk.getChunkNumber()));
+                    }
+                    digest.update(data);
+                    out.write(data);
+                    updateProgress(fileId, tr("transfer.downloading"), received.addAndGet(data.length), file.getFileSize());
+                } catch (IOException e) {
+                    corruption.compareAndSet(null, tr("transfer.write_error", e.getMessage()));
+                }
+            }
+            @Override public void onError(Throwable t) {
+                close();
+                try { Files.deleteIfExists(Paths.get(savePath)); } catch (IOException ignored) {}
+                endProgress(fileId);
+                printMessage(tr("transfer.download_failed", file.getFilename(), Status.fromThrowable(t).getDescription()));
+            }
+            @Override public void onCompleted() {
+                close();
+                endProgress(fileId);
+                String problem = corruption.get();
+                if (problem == null && received.get() != file.getFileSize()) {
+                    problem = tr("transfer.size_mismatch", received.get(), file.getFileSize());
+                } else if (problem == null && !file.getSha256().equalsIgnoreCase(toHex(digest.digest()))) {
+                    problem = tr("transfer.sha_mismatch");
+                }
+                if (problem != null) {
+                    try { Files.deleteIfExists(Paths.get(savePath)); } catch (IOException ignored) {}
+                    printMessage(tr("transfer.damaged_fetch_again", problem));
+                } else {
+                    printMessage(tr("transfer.downloaded", savePath));
+                    showPreview(savePath);
+                    if (!file.getRecipient().isEmpty()) roomFiles.remove(fileId); // the server deleted its copy
+                }
+            }
+            private void close() {
+                if (out != null) try { out.close(); } catch (IOException e) { e.printStackTrace(); }
+            }
+        });
     }
 
     // --- P2P File Transfer Logic ---
 
-    public void registerPendingP2PTransfer(String transferId, String originalSender, long fileSize) {
-        pendingP2PTransfers.put(transferId, new PendingTransfer(originalSender, fileSize));
+    public void registerPendingP2PTransfer(String transferId, String originalSender, String filename, long fileSize, String sha256,
+                                           java.util.List<String> offeredCompression, boolean direct) {
+        String compression = offeredCompression.contains(GZIP) ? GZIP : "";
+        PendingTransfer pending = new PendingTransfer(originalSender, filename, fileSize, sha256, compression);
+        pending.direct = direct;
+        pendingP2PTransfers.put(transferId, pending);
     }
 
     public void uploadFile(String recipient, String filePath, String roomId) {
         Path path = Paths.get(filePath);
         if (!Files.exists(path)) {
-            printMessage("❌ Error: El archivo no existe: " + filePath);
+            printMessage(tr("transfer.no_such_file", filePath));
             return;
         }
         try {
             long fileSize = Files.size(path);
             String filename = path.getFileName().toString();
             String transferId = UUID.randomUUID().toString();
-            printMessage("⏳ Solicitando enviar '" + filename + "' a " + recipient + "...");
+            printMessage(tr("transfer.requesting", filename, recipient, transferId));
             FileTransferRequest request = FileTransferRequest.newBuilder()
                     .setSender(senderName).setRecipient(recipient).setRoomId(roomId)
                     .setFilename(filename).setFileSize(fileSize).setTransferId(transferId)
-                    .setTimestamp(Instant.now().getEpochSecond()).build();
+                    .setTimestamp(Instant.now().getEpochSecond()).setSha256(sha256Hex(path)).addCompression(GZIP).setDirect(true).build();
 
             asyncStub.requestFileTransfer(request, new StreamObserver<FileTransferResponse>() {
                 @Override
                 public void onNext(FileTransferResponse response) {
                     if (response.getAccepted()) {
-                        printMessage("✅ " + recipient + " aceptó el archivo. Iniciando transferencia...");
-                        startFileStreamSender(path, transferId);
+                        printMessage(tr("transfer.accepted", recipient));
+                        if (response.getCandidatesCount() > 0) startDirectSender(path, transferId, response);
+                        else startFileStreamSender(path, transferId, response.getCompression());
+                    } else if (cancelled.remove(transferId)) {
+                        printMessage(tr("transfer.you_cancelled", filename));
+                    } else if (!response.getRejectCode().isEmpty()) {
+                        printMessage(tr("transfer.server_refused_file", filename, response.getRejectReason()));
                     } else {
-                        printMessage("⛔ " + recipient + " rechazó el archivo.");
+                        printMessage(tr("transfer.rejected", recipient));
                     }
                 }
                 @Override
-                public void onError(Throwable t) { printMessage("❌ Error en la solicitud de transferencia: " + t.getMessage()); }
+                public void onError(Throwable t) { printMessage(tr("transfer.request_error", t.getMessage())); }
                 @Override
                 public void onCompleted() {}
             });
         } catch (IOException e) {
-            printMessage("❌ Error al leer el archivo: " + e.getMessage());
+            printMessage(tr("transfer.read_error", e.getMessage()));
         }
     }
 
-    public void acceptFile(String transferId, String savePath, String roomId) {
+    public void acceptFile(String transferId, String destination, String roomId) {
         PendingTransfer pending = pendingP2PTransfers.get(transferId);
         if (pending == null) {
-            printMessage("❌ Error: No se encontró información para la transferencia " + transferId);
+            printMessage(tr("transfer.no_pending", transferId));
             return;
         }
-        printMessage("👍 Aceptando archivo " + transferId + " de " + pending.originalSender + "...");
+        String savePath = resolveSavePath(destination, pending.filename, roomId, pending.originalSender);
+        printMessage(tr("transfer.accepting", transferId, pending.originalSender));
+        ServerSocket listener = pending.direct ? DirectTransfer.listen() : null;
         FileTransferResponse response = FileTransferResponse.newBuilder()
                 .setTransferId(transferId).setAccepted(true).setSender(senderName)
-                .setRecipient(pending.originalSender).setRoomId(roomId).build();
+                .setRecipient(pending.originalSender).setRoomId(roomId).setCompression(pending.compression)
+                .addAllCandidates(listener != null ? DirectTransfer.candidates(listener.getLocalPort()) : java.util.List.of())
+                .build();
 
         asyncStub.respondFileTransfer(response, new StreamObserver<FileTransferResponse>() {
             @Override
             public void onNext(FileTransferResponse value) {}
             @Override
-            public void onError(Throwable t) { printMessage("❌ Error al enviar aceptación: " + t.getMessage()); }
+            public void onError(Throwable t) {
+                if (listener != null) try { listener.close(); } catch (IOException ignored) {}
+                printMessage(tr("transfer.accept_error", t.getMessage()));
+            }
             @Override
             public void onCompleted() {
-                printMessage("📥 Conectando para recibir archivo...");
-                startFileStreamReceiver(transferId, savePath, pending.fileSize);
+                printMessage(tr("transfer.connecting"));
+                if (listener != null) startDirectReceiver(listener, transferId, savePath, pending, roomId);
+                else startFileStreamReceiver(transferId, savePath, pending, roomId);
                 pendingP2PTransfers.remove(transferId);
             }
         });
@@ -178,112 +464,470 @@ public class FileTransferManager {
     public void rejectFile(String transferId, String roomId) {
         PendingTransfer pending = pendingP2PTransfers.get(transferId);
         if (pending == null) { return; }
-        printMessage("👎 Rechazando archivo " + transferId + " de " + pending.originalSender + "...");
+        printMessage(tr("transfer.rejecting", transferId, pending.originalSender));
         FileTransferResponse response = FileTransferResponse.newBuilder()
                 .setTransferId(transferId).setAccepted(false).setSender(senderName)
                 .setRecipient(pending.originalSender).setRoomId(roomId).build();
         asyncStub.respondFileTransfer(response, new StreamObserver<FileTransferResponse>() {
             @Override public void onNext(FileTransferResponse v) {}
-            @Override public void onError(Throwable t) { printMessage("❌ Error al enviar rechazo: " + t.getMessage());}
+            @Override public void onError(Throwable t) { printMessage(tr("transfer.reject_error", t.getMessage()));}
             @Override public void onCompleted() {
-                printMessage("Archivo rechazado correctamente.");
+                printMessage(tr("transfer.reject_sent"));
                 pendingP2PTransfers.remove(transferId);
             }
         });
     }
 
+    // --- Bandwidth ---
+
+    // Caps how fast our own uploads go, so they don't crowd out the call's audio
+    public void setUploadLimit(int kibPerSecond) {
+        uploadLimitKiB = Math.max(0, kibPerSecond);
+    }
+
+    public int getUploadLimit() {
+        return uploadLimitKiB;
+    }
+
+    // Sleeps until sending totalBytes since startNanos fits under the /limit rate
+    private void paceUpload(long totalBytes, long startNanos) throws InterruptedException {
+        int limit = uploadLimitKiB;
+        if (limit <= 0) return;
+        long dueNanos = startNanos + totalBytes * 1_000_000_000L / (limit * 1024L);
+        long waitMillis = (dueNanos - System.nanoTime()) / 1_000_000;
+        if (waitMillis > 0) Thread.sleep(waitMillis);
+    }
+
+    // --- Cancelling ---
+
+    // The server refused a room-wide file: "<id>:<code>:<reason>"
+    public void handleFileDenied(String value) {
+        String[] parts = value.split(":", 3);
+        String reason = parts.length == 3 ? parts[2] : value;
+        cancelled.add(parts[0]); // our sender stream will be refused too; don't report that twice
+        printMessage(tr("transfer.server_refused", reason));
+    }
+
+    // The server dropped a transfer nobody started streaming in time
+    public void handleTransferExpired(String transferId) {
+        PendingTransfer p2p = pendingP2PTransfers.remove(transferId);
+        PendingTransfer broadcast = pendingBroadcasts.remove(transferId);
+        PendingTransfer pending = p2p != null ? p2p : broadcast;
+        if (pending != null) {
+            printMessage(tr("transfer.file_expired", pending.filename, transferId));
+        } else {
+            printMessage(tr("transfer.transfer_expired", transferId));
+        }
+    }
+
+    public void cancelTransfer(String transferId) {
+        if (pendingP2PTransfers.containsKey(transferId)) {
+            printMessage(tr("transfer.not_accepted_yet", transferId));
+            return;
+        }
+        cancelled.add(transferId);
+        ClientCallStreamObserver<FileChunk> download = activeDownloads.get(transferId);
+        if (download != null && pendingBroadcasts.containsKey(transferId)) {
+            // Someone else's broadcast: only our own download stops
+            download.cancel("cancelada con /abort", null);
+            return;
+        }
+        CancelTransferRequest request = CancelTransferRequest.newBuilder()
+                .setTransferId(transferId).setSender(senderName).build();
+        asyncStub.cancelTransfer(request, new StreamObserver<CancelTransferRequest>() {
+            @Override public void onNext(CancelTransferRequest v) { printMessage(tr("transfer.cancelled", transferId)); }
+            @Override public void onError(Throwable t) {
+                cancelled.remove(transferId);
+                printMessage(tr("transfer.cancel_failed", Status.fromThrowable(t).getDescription()));
+            }
+            @Override public void onCompleted() {}
+        });
+    }
+
     // --- Stream Workers (reused for P2P and broadcast) ---
 
-    private void updateProgress(String action, long current, long total) {
+    // Progress goes in the console's status line, one entry per transfer (key) until endProgress
+    private void updateProgress(String key, String action, long current, long total) {
         if (total <= 0) return;
         int percentage = (int) ((current * 100) / total);
-        StringBuilder bar = new StringBuilder(60);
-        bar.append("\r\u001b[2K");
+        StringBuilder bar = new StringBuilder(40);
         bar.append(String.format("%s %d%% [", action, percentage));
-        for (int i = 0; i < 50; i++) {
-            if (i < percentage / 2) bar.append("=");
+        for (int i = 0; i < 25; i++) {
+            if (i < percentage / 4) bar.append("=");
             else bar.append(" ");
         }
         bar.append("]");
-        System.out.print(bar.toString());
-        System.out.flush();
+        console.status(key, bar.toString());
+    }
+
+    private void endProgress(String key) {
+        console.status(key, null);
+    }
+
+    private void startFileStreamSender(Path path, String transferId, String compression) {
+        startFileStreamSender(path, transferId, compression, 0, 0);
     }
 
-    private void startFileStreamSender(Path path, String transferId) {
+    // from is how much the receiver had acked when the relay broke; attempt counts the reconnections so far
+    private void startFileStreamSender(Path path, String transferId, String compression, long from, int attempt) {
         Metadata metadata = new Metadata();
         metadata.put(Metadata.Key.of("role", Metadata.ASCII_STRING_MARSHALLER), "sender");
         metadata.put(Metadata.Key.of("transfer-id", Metadata.ASCII_STRING_MARSHALLER), transferId);
         var stubWithMetadata = asyncStub.withInterceptors(MetadataUtils.newAttachHeadersInterceptor(metadata));
+        AtomicBoolean stopped = new AtomicBoolean(false); // the server ended the stream early
+        AtomicBoolean acked = new AtomicBoolean(false); // the receiver reports what it saved; show that instead
+        AtomicLong delivered = new AtomicLong(from);
+        long expectedSize = path.toFile().length();
+        boolean resumable = !broadcastReceipts.containsKey(transferId); // room-wide relays aren't resumed
         StreamObserver<FileChunk> requestObserver = stubWithMetadata.transferFile(new StreamObserver<>() {
-            @Override public void onNext(FileChunk v) {}
+            @Override public void onNext(FileChunk ack) {
+                if (ack.getDeliveredBytes() <= 0) return;
+                acked.set(true);
+                delivered.set(ack.getDeliveredBytes());
+                updateProgress(transferId, tr("transfer.delivered"), ack.getDeliveredBytes(), expectedSize);
+            }
             @Override public void onError(Throwable t) {
-                System.out.println();
-                printMessage("❌ Error durante el envío del archivo: " + t.getMessage());
+                stopped.set(true);
+                endProgress(transferId);
+                Status status = Status.fromThrowable(t);
+                if (resumable && status.getCode() == Status.Code.UNAVAILABLE && attempt < MAX_RESUMES && !cancelled.contains(transferId)) {
+                    printMessage(tr("transfer.upload_resuming", (1 << attempt), delivered.get()));
+                    retryLater(attempt, () -> startFileStreamSender(path, transferId, compression, delivered.get(), attempt + 1));
+                } else if (status.getCode() == Status.Code.ABORTED) {
+                    cancelled.remove(transferId);
+                    printMessage(tr("transfer.upload_stopped", status.getDescription()));
+                } else if (!cancelled.remove(transferId)) { // a refused broadcast was already reported
+                    printMessage(tr("transfer.send_error", t.getMessage()));
+                }
             }
             @Override public void onCompleted() {
-                System.out.println();
-                printMessage("✅ Archivo enviado exitosamente.");
+                endProgress(transferId);
+                printMessage(tr("transfer.sent"));
             }
         });
-        try (InputStream stream = Files.newInputStream(path)) {
-            long fileSize = Files.size(path);
-            byte[] buffer = new byte[CHUNK_SIZE];
-            long totalBytesSent = 0;
-            int chunkNumber = 0, bytesRead;
-            while ((bytesRead = stream.read(buffer)) != -1) {
-                totalBytesSent += bytesRead;
+        startUploader(path, transferId, compression, requestObserver, stopped, acked, from, () -> {});
+    }
+
+    // Reconnects after 1, 2, 4... seconds, giving a flaky network time to come back
+    private static void retryLater(int attempt, Runnable reconnect) {
+        CompletableFuture.delayedExecutor(1L << attempt, TimeUnit.SECONDS).execute(reconnect);
+    }
+
+    // Tries the receiver's candidates and streams straight to it, or through the server if none answers
+    private void startDirectSender(Path path, String transferId, FileTransferResponse response) {
+        Thread connector = new Thread(() -> {
+            Socket socket = DirectTransfer.connect(response.getCandidatesList());
+            if (socket == null) {
+                printMessage(tr("transfer.direct_fallback_sender"));
+                startFileStreamSender(path, transferId, response.getCompression());
+                return;
+            }
+            printMessage(tr("transfer.direct_to_receiver"));
+            // The server is still holding a relay for it
+            asyncStub.cancelTransfer(CancelTransferRequest.newBuilder().setTransferId(transferId)
+                    .setSender(senderName).setReason("conexión directa").build(), new StreamObserver<>() {
+                @Override public void onNext(CancelTransferRequest v) {}
+                @Override public void onError(Throwable t) {}
+                @Override public void onCompleted() {}
+            });
+            try {
+                startUploader(path, transferId, response.getCompression(), DirectTransfer.writer(socket),
+                        new AtomicBoolean(false), new AtomicBoolean(false), 0, () -> {
+                            endProgress(transferId);
+                            printMessage(tr("transfer.sent_direct"));
+                        });
+            } catch (IOException e) {
+                try { socket.close(); } catch (IOException ignored) {}
+                printMessage(tr("transfer.direct_error", e.getMessage()));
+            }
+        }, "file-direct-" + transferId);
+        connector.setDaemon(true);
+        connector.start();
+    }
+
+    // Reads path from byte from on in chunks and writes them to out, off the caller's thread: /limit may pace
+    // the upload for minutes. from is a multiple of CHUNK_SIZE, so chunks keep the numbers they first had.
+    private void startUploader(Path path, String transferId, String compression, StreamObserver<FileChunk> requestObserver,
+                               AtomicBoolean stopped, AtomicBoolean acked, long from, Runnable sent) {
+        Thread uploader = new Thread(() -> {
+            try (SeekableByteChannel channel = Files.newByteChannel(path); InputStream stream = Channels.newInputStream(channel.position(from))) {
+                long fileSize = Files.size(path);
+                byte[] buffer = new byte[CHUNK_SIZE];
+                long totalBytesSent = from, wireBytes = 0;
+                int chunkNumber = (int) (from / CHUNK_SIZE), bytesRead;
+                CRC32 crc = new CRC32();
+                long startNanos = System.nanoTime();
+                while ((bytesRead = stream.readNBytes(buffer, 0, CHUNK_SIZE)) > 0) {
+                    if (stopped.get() || cancelled.contains(transferId)) return; // the server aborts the stream
+                    long offset = totalBytesSent;
+                    totalBytesSent += bytesRead;
+                    byte[] data = java.util.Arrays.copyOf(buffer, bytesRead);
+                    boolean compressed = false;
+                    if (compression.equals(GZIP)) {
+                        byte[] packed = gzip(data);
+                        if (packed.length < data.length) { // already-compressed files go as they are
+                            data = packed;
+                            compressed = true;
+                        }
+                    }
+                    wireBytes += data.length;
+                    crc.reset();
+                    crc.update(data);
+                    requestObserver.onNext(FileChunk.newBuilder().setTransferId(transferId)
+                        .setData(ByteString.copyFrom(data)).setChunkNumber(chunkNumber++).setOffset(offset)
+                        .setCrc32((int) crc.getValue()).setCompressed(compressed).setIsLast(false).build());
+                    if (!acked.get()) updateProgress(transferId, tr("transfer.sending"), totalBytesSent, fileSize);
+                    paceUpload(wireBytes, startNanos); // the limit is on what goes over the network
+                }
                 requestObserver.onNext(FileChunk.newBuilder().setTransferId(transferId)
-                    .setData(ByteString.copyFrom(buffer, 0, bytesRead)).setChunkNumber(chunkNumber++).setIsLast(false).build());
-                updateProgress("Enviando", totalBytesSent, fileSize);
+                    .setData(ByteString.EMPTY).setChunkNumber(chunkNumber).setOffset(totalBytesSent).setIsLast(true).build());
+                requestObserver.onCompleted();
+                sent.run();
+                if (!compression.isEmpty()) {
+                    endProgress(transferId);
+                    printMessage("🗜️ " + compressionReport(compression, totalBytesSent, wireBytes));
+                }
+            } catch (Exception e) {
+                if (stopped.get()) return; // the stream broke under us; its observer already said so
+                endProgress(transferId);
+                printMessage(tr("transfer.local_read_error", e.getMessage()));
+                requestObserver.onError(e);
             }
-            requestObserver.onNext(FileChunk.newBuilder().setTransferId(transferId)
-                .setData(ByteString.EMPTY).setChunkNumber(chunkNumber).setIsLast(true).build());
-            requestObserver.onCompleted();
-        } catch (Exception e) {
-            System.out.println();
-            printMessage("❌ Error leyendo archivo local: " + e.getMessage());
-            requestObserver.onError(e);
-        }
+        }, "file-upload-" + transferId);
+        uploader.setDaemon(true);
+        uploader.start();
+    }
+
+    private void startFileStreamReceiver(String transferId, String savePath, PendingTransfer pending, String roomId) {
+        AtomicReference<StreamObserver<FileChunk>> acks = new AtomicReference<>();
+        openReceiverStream(transferId, newChunkReceiver(transferId, savePath, pending, roomId, acks), acks);
     }
 
-    private void startFileStreamReceiver(String transferId, String savePath, long fileSize) {
+    // Opens the relay stream receiver reads from, again when a broken 1:1 relay resumes
+    private void openReceiverStream(String transferId, StreamObserver<FileChunk> receiver, AtomicReference<StreamObserver<FileChunk>> acks) {
         Metadata metadata = new Metadata();
         metadata.put(Metadata.Key.of("role", Metadata.ASCII_STRING_MARSHALLER), "receiver");
         metadata.put(Metadata.Key.of("transfer-id", Metadata.ASCII_STRING_MARSHALLER), transferId);
         var stubWithMetadata = asyncStub.withInterceptors(MetadataUtils.newAttachHeadersInterceptor(metadata));
+        StreamObserver<FileChunk> call = stubWithMetadata.transferFile(receiver);
+        acks.set(call);
+        activeDownloads.put(transferId, (ClientCallStreamObserver<FileChunk>) call);
+    }
+
+    // Waits for the sender to connect directly, falling back to the relay if it doesn't
+    private void startDirectReceiver(ServerSocket listener, String transferId, String savePath, PendingTransfer pending, String roomId) {
+        Thread receiver = new Thread(() -> {
+            Socket socket;
+            try (listener) {
+                socket = listener.accept();
+            } catch (IOException e) {
+                printMessage(tr("transfer.direct_fallback_receiver"));
+                startFileStreamReceiver(transferId, savePath, pending, roomId);
+                return;
+            }
+            printMessage(tr("transfer.direct", pending.originalSender));
+            // No acks: they travel through the server, which isn't involved
+            DirectTransfer.read(socket, transferId, newChunkReceiver(transferId, savePath, pending, roomId, new AtomicReference<>()));
+        }, "file-direct-" + transferId);
+        receiver.setDaemon(true);
+        receiver.start();
+    }
+
+    // Writes, verifies and reports a received file; acks carries the stream delivery acks go back on, if any
+    private StreamObserver<FileChunk> newChunkReceiver(String transferId, String savePath, PendingTransfer pending, String roomId,
+                                                       AtomicReference<StreamObserver<FileChunk>> acks) {
         AtomicBoolean success = new AtomicBoolean(false);
         AtomicLong totalBytesReceived = new AtomicLong(0);
-        stubWithMetadata.transferFile(new StreamObserver<>() {
+        AtomicLong wireBytesReceived = new AtomicLong(0);
+        AtomicReference<String> corruption = new AtomicReference<>(); // first problem found, if any
+        MessageDigest digest = newSha256();
+        CRC32 crc = new CRC32();
+        boolean acking = !pendingBroadcasts.containsKey(transferId); // only 1:1 senders get our acks
+        AtomicInteger resumes = new AtomicInteger();
+        return new StreamObserver<>() {
             FileOutputStream fileOutputStream = null;
             @Override public void onNext(FileChunk chunk) {
                 try {
                     if (fileOutputStream == null) fileOutputStream = new FileOutputStream(savePath);
+                    // Senders that predate offsets leave them all at 0
+                    boolean positioned = chunk.getOffset() > 0 || chunk.getChunkNumber() == 0;
+                    if (!chunk.getData().isEmpty() && positioned && chunk.getOffset() < totalBytesReceived.get()) {
+                        return; // sent again after the relay resumed; we have it
+                    }
+                    if (positioned && chunk.getOffset() > totalBytesReceived.get()) {
+                        corruption.compareAndSet(null, tr("transfer.missing_bytes", chunk.getChunkNumber()));
+                    }
                     if (!chunk.getData().isEmpty()) {
                         byte[] data = chunk.getData().toByteArray();
+                        wireBytesReceived.addAndGet(data.length);
+                        // Senders that send a SHA-256 also send a CRC with every chunk, over the bytes as sent
+                        crc.reset();
+                        crc.update(data);
+                        if (!pending.sha256.isEmpty() && (int) crc.getValue() != chunk.getCrc32()) {
+                            corruption.compareAndSet(null, tr("transfer.bad_crc", chunk.getChunkNumber()));
+                        }
+                        if (chunk.getCompressed()) {
+                            try {
+                                data = gunzip(data);
+                            } catch (IOException e) {
+                                corruption.compareAndSet(null, tr("transfer.gunzip_failed", chunk.getChunkNumber()));
+                                return;
+                            }
+                        }
+                        digest.update(data);
                         fileOutputStream.write(data);
-                        updateProgress("Recibiendo", totalBytesReceived.addAndGet(data.length), fileSize);
+                        long saved = totalBytesReceived.addAndGet(data.length);
+                        updateProgress(transferId, tr("transfer.receiving"), saved, pending.fileSize);
+                        if (acking && acks.get() != null) {
+                            acks.get().onNext(FileChunk.newBuilder().setTransferId(transferId).setDeliveredBytes(saved).build());
+                        }
                     }
                     if (chunk.getIsLast()) success.set(true);
                 } catch (IOException e) {
-                    System.out.println();
-                    printMessage("❌ Error escribiendo archivo: " + e.getMessage());
+                    endProgress(transferId);
+                    printMessage(tr("transfer.file_write_error", e.getMessage()));
                     throw new RuntimeException(e);
                 }
             }
             @Override public void onError(Throwable t) {
-                System.out.println();
-                printMessage("❌ Error recibiendo archivo: " + t.getMessage());
+                activeDownloads.remove(transferId);
+                int attempt = resumes.get();
+                if (acking && acks.get() != null && Status.fromThrowable(t).getCode() == Status.Code.UNAVAILABLE
+                        && attempt < MAX_RESUMES && !cancelled.contains(transferId)) {
+                    // Keep what we have; the sender carries on from the last ack
+                    resumes.incrementAndGet();
+                    endProgress(transferId);
+                    printMessage(tr("transfer.download_resuming", (1 << attempt)));
+                    StreamObserver<FileChunk> self = this;
+                    retryLater(attempt, () -> openReceiverStream(transferId, self, acks));
+                    return;
+                }
                 closeFile();
+                // A partial file is of no use; don't leave it looking like a complete one
+                try { Files.deleteIfExists(Paths.get(savePath)); } catch (IOException ignored) {}
+                endProgress(transferId);
+                Status status = Status.fromThrowable(t);
+                if (cancelled.remove(transferId)) {
+                    printMessage(tr("transfer.download_cancelled"));
+                } else if (status.getCode() == Status.Code.ABORTED) {
+                    printMessage(tr("transfer.stopped_partial_deleted", status.getDescription()));
+                } else {
+                    printMessage(tr("transfer.receive_error", t.getMessage()));
+                    reportCompletion(transferId, pending, roomId, tr("transfer.connection_error", t.getMessage()));
+                }
             }
             @Override public void onCompleted() {
+                activeDownloads.remove(transferId);
                 closeFile();
-                System.out.println();
-                if (success.get()) printMessage("✅ Archivo recibido y guardado en: " + savePath);
-                else printMessage("⚠️ Transferencia finalizada pero sin confirmación de éxito total.");
+                endProgress(transferId);
+                String problem = corruption.get();
+                if (problem == null && !success.get()) {
+                    problem = tr("transfer.ended_early");
+                } else if (problem == null && totalBytesReceived.get() != pending.fileSize) {
+                    problem = tr("transfer.size_mismatch", totalBytesReceived.get(), pending.fileSize);
+                } else if (problem == null && !pending.sha256.isEmpty() && !pending.sha256.equalsIgnoreCase(toHex(digest.digest()))) {
+                    problem = tr("transfer.sha_mismatch");
+                }
+                if (problem != null) {
+                    // Don't leave a damaged file behind looking like a good one
+                    try { Files.deleteIfExists(Paths.get(savePath)); } catch (IOException ignored) {}
+                    printMessage(tr("transfer.damaged_ask_again", problem));
+                } else {
+                    if (wireBytesReceived.get() < totalBytesReceived.get()) {
+                        printMessage("🗜️ " + compressionReport(pending.compression, totalBytesReceived.get(), wireBytesReceived.get()));
+                    }
+                    if (pending.sha256.isEmpty()) {
+                        printMessage(tr("transfer.received_unverified", savePath));
+                    } else {
+                        printMessage(tr("transfer.received", savePath));
+                    }
+                    showPreview(savePath);
+                }
+                reportCompletion(transferId, pending, roomId, problem);
             }
             private void closeFile() {
                 if (fileOutputStream != null) try { fileOutputStream.close(); } catch (IOException e) { e.printStackTrace(); }
             }
+        };
+    }
+
+    // Shows what just arrived: a thumbnail or the first lines, and a link to open it
+    private void showPreview(String savePath) {
+        if (previewMaxBytes <= 0) return;
+        printMessage(String.join("\n", FilePreview.render(Paths.get(savePath), previewMaxBytes)));
+    }
+
+    // Tells the file's sender how the transfer ended; problem is null when it arrived intact
+    private void reportCompletion(String transferId, PendingTransfer pending, String roomId, String problem) {
+        TransferComplete report = TransferComplete.newBuilder()
+                .setTransferId(transferId).setSender(senderName).setRecipient(pending.originalSender)
+                .setRoomId(roomId).setFilename(pending.filename).setOk(problem == null)
+                .setError(problem == null ? "" : problem).build();
+        asyncStub.completeTransfer(report, new StreamObserver<TransferComplete>() {
+            @Override public void onNext(TransferComplete v) {}
+            @Override public void onError(Throwable t) {} // servers without CompleteTransfer, or the sender already left
+            @Override public void onCompleted() {}
         });
     }
-}
\ No newline at end of file
+
+    // Shows the receiver's verdict on a file we sent
+    public void handleTransferComplete(TransferComplete report) {
+        java.util.List<String> receipts = broadcastReceipts.get(report.getTransferId());
+        if (report.getOk() && receipts != null) {
+            receipts.add(report.getSender());
+            printMessage(tr("transfer.broadcast_received", report.getSender(), report.getFilename(), receipts.size(), String.join(", ", receipts)));
+        } else if (report.getOk()) {
+            printMessage(tr("transfer.received_intact", report.getSender(), report.getFilename()));
+        } else {
+            printMessage(tr("transfer.received_damaged", report.getFilename(), report.getSender(), report.getError()));
+        }
+    }
+
+    // --- Compression ---
+
+    private static byte[] gzip(byte[] data) throws IOException {
+        ByteArrayOutputStream out = new ByteArrayOutputStream(data.length / 2);
+        try (GZIPOutputStream gz = new GZIPOutputStream(out)) {
+            gz.write(data);
+        }
+        return out.toByteArray();
+    }
+
+    private static byte[] gunzip(byte[] data) throws IOException {
+        try (GZIPInputStream gz = new GZIPInputStream(new ByteArrayInputStream(data))) {
+            return gz.readAllBytes();
+        }
+    }
+
+    private static String compressionReport(String compression, long rawBytes, long wireBytes) {
+        double saved = rawBytes > 0 ? 100.0 * (rawBytes - wireBytes) / rawBytes : 0;
+        return tr("transfer.compression_report",
+                compression, rawBytes / 1024.0, wireBytes / 1024.0, saved);
+    }
+
+    // --- Checksums ---
+
+    private static String sha256Hex(Path path) throws IOException {
+        MessageDigest digest = newSha256();
+        try (InputStream stream = Files.newInputStream(path)) {
+            byte[] buffer = new byte[CHUNK_SIZE];
+            int bytesRead;
+            while ((bytesRead = stream.read(buffer)) != -1) digest.update(buffer, 0, bytesRead);
+        }
+        return toHex(digest.digest());
+    }
+
+    private static MessageDigest newSha256() {
+        try {
+            return MessageDigest.getInstance("SHA-256");
+        } catch (NoSuchAlgorithmException e) {
+            throw new IllegalStateException("SHA-256 is required by every Java runtime", e);
+        }
+    }
+
+    private static String toHex(byte[] bytes) {
+        StringBuilder hex = new StringBuilder(bytes.length * 2);
+        for (byte b : bytes) hex.append(String.format("%02x", b));
+        return hex.toString();
+    }
+}
@@ -0,0 +1,114 @@
+package com.conference.client;
+
+import java.io.IOException;
+import java.net.Inet6Address;
+import java.net.InetAddress;
+import java.net.InetSocketAddress;
+import java.net.Socket;
+import java.net.UnknownHostException;
+import java.util.ArrayList;
+import java.util.List;
+import java.util.concurrent.CompletionService;
+import java.util.concurrent.ExecutionException;
+import java.util.concurrent.ExecutorCompletionService;
+import java.util.concurrent.ExecutorService;
+import java.util.concurrent.Executors;
+import java.util.concurrent.Future;
+import java.util.concurrent.TimeUnit;
+
+import static com.conference.client.I18n.tr;
+
+/**
+ * Picks a reachable address for a host with a Happy Eyeballs (RFC 8305) style
+ * race: resolved addresses are interleaved IPv6/IPv4 and TCP connection
+ * attempts are started 250 ms apart; the first one to connect wins.
+ */
+public final class HappyEyeballs {
+
+    private static final long ATTEMPT_DELAY_MS = 250;
+    private static final int CONNECT_TIMEOUT_MS = 3000;
+
+    private HappyEyeballs() {}
+
+    /**
+     * Returns the literal address to dial, or the original host if resolution
+     * or every attempt failed (so gRPC reports the error itself).
+     */
+    public static String pickAddress(String host, int port) {
+        List<InetAddress> candidates;
+        try {
+            candidates = interleave(InetAddress.getAllByName(host));
+        } catch (UnknownHostException e) {
+            return host;
+        }
+        if (candidates.size() <= 1) {
+            return candidates.isEmpty() ? host : candidates.get(0).getHostAddress();
+        }
+
+        ExecutorService pool = Executors.newFixedThreadPool(candidates.size(), r -> {
+            Thread t = new Thread(r, "happy-eyeballs");
+            t.setDaemon(true);
+            return t;
+        });
+        CompletionService<InetAddress> race = new ExecutorCompletionService<>(pool);
+        List<Future<InetAddress>> attempts = new ArrayList<>();
+        try {
+            int failed = 0;
+            for (InetAddress candidate : candidates) {
+                attempts.add(race.submit(() -> {
+                    try (Socket socket = new Socket()) {
+                        socket.connect(new InetSocketAddress(candidate, port), CONNECT_TIMEOUT_MS);
+                    }
+                    return candidate;
+                }));
+                // Give the attempts in flight a head start before opening the next one
+                Future<InetAddress> done = race.poll(ATTEMPT_DELAY_MS, TimeUnit.MILLISECONDS);
+                if (done != null) {
+                    InetAddress winner = winner(done);
+                    if (winner != null) return winner.getHostAddress();
+                    failed++;
+                }
+            }
+            while (failed < attempts.size()) {
+                Future<InetAddress> done = race.poll(CONNECT_TIMEOUT_MS, TimeUnit.MILLISECONDS);
+                if (done == null) break;
+                InetAddress winner = winner(done);
+                if (winner != null) return winner.getHostAddress();
+                failed++;
+            }
+        } catch (InterruptedException e) {
+            Thread.currentThread().interrupt();
+        } finally {
+            for (Future<InetAddress> attempt : attempts) attempt.cancel(true);
+            pool.shutdownNow();
+        }
+        return host;
+    }
+
+    private static InetAddress winner(Future<InetAddress> done) throws InterruptedException {
+        try {
+            return done.get();
+        } catch (ExecutionException e) {
+            if (!(e.getCause() instanceof IOException)) {
+                System.err.println(tr("net.probe_error", e.getCause()));
+            }
+            return null;
+        }
+    }
+
+    // Alternates address families, starting with IPv6 as RFC 8305 recommends
+    private static List<InetAddress> interleave(InetAddress[] resolved) {
+        List<InetAddress> v6 = new ArrayList<>();
+        List<InetAddress> v4 = new ArrayList<>();
+        for (InetAddress addr : resolved) {
+            if (addr instanceof Inet6Address) v6.add(addr);
+            else v4.add(addr);
+        }
+        List<InetAddress> result = new ArrayList<>();
+        for (int i = 0; i < Math.max(v6.size(), v4.size()); i++) {
+            if (i < v6.size()) result.add(v6.get(i));
+            if (i < v4.size()) result.add(v4.get(i));
+        }
+        return result;
+    }
+}
@@ -0,0 +1,63 @@
+package com.conference.client;
+
+import java.util.List;
+import java.util.Locale;
+import java.util.ResourceBundle;
+
+/**
+ * The client's messages, looked up by key in messages.properties (Spanish,
+ * the default) or messages_<lang>.properties, and filled in with
+ * String.format. The language is picked once at startup, from --lang, the
+ * lang config key or the environment (LC_ALL, LC_MESSAGES, LANG).
+ */
+final class I18n {
+
+    static final List<String> LANGUAGES = List.of("es", "en");
+
+    private static ResourceBundle bundle = load("es");
+
+    private I18n() {}
+
+    /** Shows messages in lang from now on ("en", or a locale like en_US.UTF-8); false if it isn't in LANGUAGES. */
+    static boolean use(String lang) {
+        String code = language(lang);
+        if (!LANGUAGES.contains(code)) return false;
+        bundle = load(code);
+        return true;
+    }
+
+    /** The language the environment asks for, if it is one of LANGUAGES; es otherwise. */
+    static String fromEnvironment() {
+        for (String name : List.of("LC_ALL", "LC_MESSAGES", "LANG")) {
+            String value = System.getenv(name);
+            if (value == null || value.isEmpty()) continue;
+            String code = language(value);
+            return LANGUAGES.contains(code) ? code : "es"; // the first one set wins, as in POSIX
+        }
+        return "es";
+    }
+
+    /** The message for key, with args put in its placeholders. */
+    static String tr(String key, Object... args) {
+        String pattern = bundle.getString(key);
+        return args.length == 0 ? pattern : String.format(pattern, args);
+    }
+
+    // "en_US.UTF-8" -> "en"; "C" and "POSIX" come out as themselves and match nothing
+    private static String language(String locale) {
+        String code = locale.trim();
+        int end = code.length();
+        for (char c : new char[] {'_', '-', '.', '@'}) {
+            int at = code.indexOf(c);
+            if (at >= 0 && at < end) end = at;
+        }
+        return code.substring(0, end).toLowerCase(Locale.ROOT);
+    }
+
+    // No fallback to the JVM's locale: a language we don't have means the Spanish base file
+    private static ResourceBundle load(String code) {
+        Locale locale = code.equals("es") ? Locale.ROOT : new Locale(code);
+        return ResourceBundle.getBundle("messages", locale,
+                ResourceBundle.Control.getNoFallbackControl(ResourceBundle.Control.FORMAT_PROPERTIES));
+    }
+}
@@ -0,0 +1,94 @@
+package com.conference.client;
+
+import javax.sound.sampled.AudioFormat;
+import javax.sound.sampled.AudioSystem;
+import javax.sound.sampled.DataLine;
+import javax.sound.sampled.LineUnavailableException;
+import javax.sound.sampled.Mixer;
+import javax.sound.sampled.SourceDataLine;
+import javax.sound.sampled.TargetDataLine;
+import java.util.ArrayList;
+import java.util.List;
+
+/** Audio backend on top of the sound card via Java Sound. */
+public class JavaSoundBackend implements AudioBackend {
+
+    private static final AudioFormat PROBE_FORMAT = new AudioFormat(44100, 16, 1, true, false);
+
+    private TargetDataLine microphone;
+    private SourceDataLine speakers;
+
+    @Override
+    public List<String> listInputDevices() {
+        return listDevices(TargetDataLine.class);
+    }
+
+    @Override
+    public List<String> listOutputDevices() {
+        return listDevices(SourceDataLine.class);
+    }
+
+    private static List<String> listDevices(Class<? extends DataLine> lineClass) {
+        DataLine.Info lineInfo = new DataLine.Info(lineClass, PROBE_FORMAT);
+        List<String> devices = new ArrayList<>();
+        for (Mixer.Info info : AudioSystem.getMixerInfo()) {
+            if (AudioSystem.getMixer(info).isLineSupported(lineInfo)) {
+                devices.add(info.getName());
+            }
+        }
+        return devices;
+    }
+
+    private static Mixer.Info findMixer(String name) {
+        if (name == null) return null;
+        for (Mixer.Info info : AudioSystem.getMixerInfo()) {
+            if (info.getName().equals(name)) return info;
+        }
+        return null;
+    }
+
+    @Override
+    public void open(AudioFormat format, String inputDevice, String outputDevice) throws LineUnavailableException {
+        Mixer.Info input = findMixer(inputDevice);
+        if (input != null) {
+            microphone = AudioSystem.getTargetDataLine(format, input);
+        } else {
+            microphone = (TargetDataLine) AudioSystem.getLine(new DataLine.Info(TargetDataLine.class, format));
+        }
+        microphone.open(format);
+        microphone.start();
+
+        Mixer.Info output = findMixer(outputDevice);
+        if (output != null) {
+            speakers = AudioSystem.getSourceDataLine(format, output);
+        } else {
+            speakers = (SourceDataLine) AudioSystem.getLine(new DataLine.Info(SourceDataLine.class, format));
+        }
+        speakers.open(format);
+        speakers.start();
+    }
+
+    @Override
+    public int readFrame(byte[] buffer, int offset, int length) {
+        return microphone.read(buffer, offset, length);
+    }
+
+    @Override
+    public void writeFrame(byte[] data, int offset, int length) {
+        if (speakers != null && speakers.isOpen()) {
+            speakers.write(data, offset, length);
+        }
+    }
+
+    @Override
+    public void close() {
+        if (microphone != null && microphone.isOpen()) {
+            microphone.stop();
+            microphone.close();
+        }
+        if (speakers != null && speakers.isOpen()) {
+            speakers.drain();
+            speakers.close();
+        }
+    }
+}
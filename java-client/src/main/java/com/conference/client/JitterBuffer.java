@@ -0,0 +1,202 @@
+package com.conference.client;
+
+import java.util.Map;
+import java.util.TreeMap;
+import java.util.concurrent.ConcurrentHashMap;
+import java.util.concurrent.LinkedBlockingDeque;
+import java.util.concurrent.TimeUnit;
+import java.util.function.Consumer;
+
+/**
+ * Adaptive jitter buffer that sits between the network and the speakers.
+ * Incoming chunks are queued and played out by a dedicated thread once
+ * targetDepth chunks are buffered. Every underrun grows the target by one
+ * chunk; a long run without underruns shrinks it back towards the base depth.
+ *
+ * Chunks that carry a sequence number are put back in order per speaker
+ * first. A gap that is still open after REORDER_WINDOW later chunks counts as
+ * lost and, if concealment is on, is filled with a fading repeat of the last
+ * chunk so the dropout is less jarring than silence.
+ */
+public class JitterBuffer {
+
+    public static final int DEFAULT_DEPTH = 4; // ~46 ms with 1024-byte chunks at 44.1 kHz
+    public static final int MIN_DEPTH = 1;
+    public static final int MAX_DEPTH = 50;
+
+    private static final int SHRINK_AFTER_CHUNKS = 500;
+    private static final long UNDERRUN_TIMEOUT_MS = 50;
+    private static final int REORDER_WINDOW = 2;
+    private static final int MAX_CONCEALED_CHUNKS = 3; // longer gaps stay silent
+
+    // Per-speaker ordering state
+    private static final class SpeakerSequence {
+        long expected; // next seq to release; 0 = not seen yet
+        byte[] last;
+        final TreeMap<Long, byte[]> pending = new TreeMap<>();
+    }
+
+    private final Map<String, SpeakerSequence> sequences = new ConcurrentHashMap<>();
+    private volatile boolean concealment = true;
+    private volatile long lost = 0;
+    private volatile long concealed = 0;
+    private volatile long late = 0;
+
+    private final LinkedBlockingDeque<byte[]> queue = new LinkedBlockingDeque<>();
+    private final Consumer<byte[]> sink;
+
+    private volatile int baseDepth;
+    private volatile int targetDepth;
+    private volatile boolean running = false;
+    private volatile long underruns = 0;
+    private volatile long dropped = 0;
+    private Thread playoutThread;
+
+    public JitterBuffer(Consumer<byte[]> sink, int baseDepth) {
+        this.sink = sink;
+        setBaseDepth(baseDepth);
+    }
+
+    public void start() {
+        if (running) return;
+        running = true;
+        playoutThread = new Thread(this::playoutLoop, "jitter-playout");
+        playoutThread.setDaemon(true);
+        playoutThread.start();
+    }
+
+    public void stop() {
+        running = false;
+        if (playoutThread != null) {
+            playoutThread.interrupt();
+        }
+        queue.clear();
+        sequences.clear();
+    }
+
+    /**
+     * Queues a chunk from speaker. seq 0 means the sender doesn't number its
+     * chunks; those are queued as they come.
+     */
+    public void push(String speaker, long seq, byte[] chunk) {
+        if (seq == 0) {
+            push(chunk);
+            return;
+        }
+        SpeakerSequence s = sequences.computeIfAbsent(speaker, k -> new SpeakerSequence());
+        synchronized (s) {
+            if (s.expected == 0 || seq == 1) {
+                // First chunk from this speaker, or they restarted their mic
+                s.expected = seq;
+                s.pending.clear();
+            } else if (seq < s.expected) {
+                late++; // its slot was already given up on
+                return;
+            }
+            s.pending.put(seq, chunk);
+            release(s);
+            if (s.pending.size() > REORDER_WINDOW) {
+                long next = s.pending.firstKey();
+                long missing = next - s.expected;
+                lost += missing;
+                if (concealment && missing <= MAX_CONCEALED_CHUNKS && s.last != null) {
+                    double gain = 1.0;
+                    for (long i = 0; i < missing; i++) {
+                        gain *= 0.5;
+                        push(scaled(s.last, gain));
+                        concealed++;
+                    }
+                }
+                s.expected = next;
+                release(s);
+            }
+        }
+    }
+
+    // Queues every pending chunk that is next in line
+    private void release(SpeakerSequence s) {
+        byte[] next;
+        while ((next = s.pending.remove(s.expected)) != null) {
+            push(next);
+            s.last = next;
+            s.expected++;
+        }
+    }
+
+    private static byte[] scaled(byte[] pcm, double gain) {
+        byte[] out = new byte[pcm.length];
+        for (int i = 0; i + 1 < pcm.length; i += 2) {
+            int v = (int) Math.round((short) ((pcm[i] & 0xff) | (pcm[i + 1] << 8)) * gain);
+            out[i] = (byte) v;
+            out[i + 1] = (byte) (v >> 8);
+        }
+        return out;
+    }
+
+    public void push(byte[] chunk) {
+        queue.offerLast(chunk);
+        // Hard cap so a stalled playout thread can't grow memory without bound
+        while (queue.size() > MAX_DEPTH * 2) {
+            queue.pollFirst();
+            dropped++;
+        }
+    }
+
+    public void setBaseDepth(int depth) {
+        int clamped = Math.max(MIN_DEPTH, Math.min(MAX_DEPTH, depth));
+        this.baseDepth = clamped;
+        this.targetDepth = clamped;
+    }
+
+    public int getBaseDepth() { return baseDepth; }
+    public int getTargetDepth() { return targetDepth; }
+    public int getQueuedChunks() { return queue.size(); }
+    public long getUnderruns() { return underruns; }
+    public long getDropped() { return dropped; }
+    public long getLost() { return lost; }
+    public long getConcealed() { return concealed; }
+    public long getLate() { return late; }
+    public boolean isConcealment() { return concealment; }
+    public void setConcealment(boolean concealment) { this.concealment = concealment; }
+
+    private void playoutLoop() {
+        boolean buffering = true;
+        int stableChunks = 0;
+        while (running) {
+            try {
+                if (buffering) {
+                    if (queue.size() < targetDepth) {
+                        Thread.sleep(2);
+                        continue;
+                    }
+                    buffering = false;
+                }
+
+                byte[] chunk = queue.pollFirst(UNDERRUN_TIMEOUT_MS, TimeUnit.MILLISECONDS);
+                if (chunk == null) {
+                    // Underrun: rebuffer with a deeper target
+                    underruns++;
+                    targetDepth = Math.min(MAX_DEPTH, targetDepth + 1);
+                    stableChunks = 0;
+                    buffering = true;
+                    continue;
+                }
+
+                // Latency crept up (burst after a stall): drop the excess instead of lagging behind
+                while (queue.size() > targetDepth * 2) {
+                    queue.pollFirst();
+                    dropped++;
+                }
+
+                sink.accept(chunk);
+
+                if (++stableChunks >= SHRINK_AFTER_CHUNKS && targetDepth > baseDepth) {
+                    targetDepth--;
+                    stableChunks = 0;
+                }
+            } catch (InterruptedException e) {
+                break;
+            }
+        }
+    }
+}
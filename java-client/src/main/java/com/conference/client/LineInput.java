@@ -0,0 +1,160 @@
+package com.conference.client;
+
+import org.jline.builtins.Completers;
+import org.jline.keymap.KeyMap;
+import org.jline.reader.Candidate;
+import org.jline.reader.Completer;
+import org.jline.reader.EndOfFileException;
+import org.jline.reader.LineReader;
+import org.jline.reader.LineReaderBuilder;
+import org.jline.reader.ParsedLine;
+import org.jline.reader.Reference;
+import org.jline.reader.UserInterruptException;
+import org.jline.terminal.Terminal;
+import org.jline.terminal.TerminalBuilder;
+import org.jline.utils.AttributedString;
+import org.jline.utils.Status;
+
+import java.io.IOError;
+import java.io.IOException;
+import java.nio.file.Path;
+import java.util.ArrayList;
+import java.util.Collection;
+import java.util.List;
+import java.util.Set;
+import java.util.function.Supplier;
+
+/**
+ * Line editing for the chat prompt, on JLine: history kept across runs
+ * (arrows to walk it, Ctrl-R to search it) and tab completion of commands,
+ * of the people in the room for commands that take a user or after an @,
+ * of paths for commands that take a file, and of :emoji: shortcodes.
+ * Messages printed while the user types go above the input line, which is
+ * redrawn as it was. Alt-1 to Alt-9 enter "/switch <n>" to change tabs,
+ * keeping what was being typed for the next prompt.
+ */
+final class LineInput implements AutoCloseable {
+
+    private static final Set<String> USER_FIRST = Set.of("/msg", "/upload", "/send", "/volume", "/mute", "/kick", "/role",
+            "/floor", "/trust", "/untrust");
+    private static final Set<String> FILE_FIRST = Set.of("/upload-all", "/store", "/play");
+    private static final Set<String> FILE_SECOND = Set.of("/upload", "/send");
+
+    private final Terminal terminal;
+    private final LineReader reader;
+    private String pending; // typed before an Alt-<n>, put back on the next line
+
+    private LineInput(Terminal terminal, LineReader reader) {
+        this.terminal = terminal;
+        this.reader = reader;
+    }
+
+    /**
+     * Takes over the terminal, or returns null when there is none (input
+     * piped in) and the caller should read System.in as plain lines.
+     */
+    static LineInput open(Path historyFile, List<String> commands, Supplier<Collection<String>> users) {
+        if (System.console() == null) return null;
+        try {
+            Terminal terminal = TerminalBuilder.builder().system(true).build();
+            LineReader reader = LineReaderBuilder.builder()
+                    .terminal(terminal)
+                    .completer(new ChatCompleter(commands, users))
+                    .variable(LineReader.HISTORY_FILE, historyFile)
+                    .variable(LineReader.HISTORY_SIZE, 1000)
+                    .option(LineReader.Option.HISTORY_IGNORE_SPACE, true)
+                    .option(LineReader.Option.HISTORY_IGNORE_DUPS, true)
+                    .variable(LineReader.HISTORY_IGNORE, "/room password*|/register*|/login*") // passwords stay out of the file
+                    .build();
+            LineInput input = new LineInput(terminal, reader);
+            for (int n = 1; n <= 9; n++) {
+                String widget = "switch-tab-" + n, command = "/switch " + n;
+                reader.getWidgets().put(widget, () -> {
+                    input.pending = reader.getBuffer().toString();
+                    reader.getBuffer().clear();
+                    reader.getBuffer().write(command);
+                    reader.callWidget(LineReader.ACCEPT_LINE);
+                    return true;
+                });
+                reader.getKeyMaps().get(LineReader.MAIN).bind(new Reference(widget), KeyMap.alt(Character.forDigit(n, 10)));
+            }
+            return input;
+        } catch (IOException e) {
+            return null;
+        }
+    }
+
+    /** The next line; null at end of input (Ctrl-D) or if the reading thread is interrupted. Ctrl-C is /quit. */
+    String readLine(String prompt) {
+        try {
+            String buffer = pending;
+            pending = null;
+            return reader.readLine(prompt, null, (Character) null, buffer);
+        } catch (UserInterruptException e) {
+            return "/quit";
+        } catch (EndOfFileException | IOError e) {
+            return null;
+        }
+    }
+
+    /** Prints message above the line being typed, from any thread. */
+    void printAbove(String message) {
+        reader.printAbove(message);
+    }
+
+    /** Shows lines in a status bar at the bottom of the terminal; none removes it. Ignored if the terminal can't. */
+    void setStatus(List<String> lines) {
+        Status status = Status.getStatus(terminal, !lines.isEmpty());
+        if (status == null) return;
+        List<AttributedString> styled = new ArrayList<>();
+        for (String line : lines) styled.add(AttributedString.fromAnsi(line));
+        status.update(styled);
+    }
+
+    @Override
+    public void close() {
+        try {
+            setStatus(List.of());
+            reader.getHistory().save();
+            terminal.close();
+        } catch (IOException ignored) {}
+    }
+
+    private static final class ChatCompleter implements Completer {
+        private final List<String> commands;
+        private final Supplier<Collection<String>> users;
+        private final Completer files = new Completers.FileNameCompleter();
+
+        ChatCompleter(List<String> commands, Supplier<Collection<String>> users) {
+            this.commands = commands;
+            this.users = users;
+        }
+
+        @Override
+        public void complete(LineReader reader, ParsedLine line, List<Candidate> candidates) {
+            String word = line.word();
+            if (word.startsWith("@")) {
+                for (String user : users.get()) candidates.add(new Candidate("@" + user));
+                return;
+            }
+            if (word.startsWith(":")) {
+                for (String code : Emoji.codes()) {
+                    String shortcode = ":" + code + ":";
+                    candidates.add(new Candidate(shortcode, shortcode + " " + Emoji.expand(shortcode), null, null, null, null, true));
+                }
+                return;
+            }
+            String command = line.words().get(0).toLowerCase();
+            int index = line.wordIndex();
+            if (index == 0) {
+                if (word.isEmpty() || word.startsWith("/")) {
+                    for (String c : commands) candidates.add(new Candidate(c));
+                }
+            } else if (index == 1 && USER_FIRST.contains(command)) {
+                for (String user : users.get()) candidates.add(new Candidate(user));
+            } else if ((index == 1 && FILE_FIRST.contains(command)) || (index == 2 && FILE_SECOND.contains(command))) {
+                files.complete(reader, line, candidates);
+            }
+        }
+    }
+}
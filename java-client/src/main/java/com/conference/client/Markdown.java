@@ -0,0 +1,50 @@
+package com.conference.client;
+
+import java.util.ArrayList;
+import java.util.List;
+import java.util.regex.Matcher;
+import java.util.regex.Pattern;
+
+/**
+ * Renders the bit of markdown people type in chat for the terminal: **bold**,
+ * *italics* or _italics_, `inline code` and ``` fenced blocks ```, which are
+ * shown indented and untouched. Anything else is left as written.
+ */
+public final class Markdown {
+
+    private static final String INDENT = "    ";
+    // Code spans first, so nothing inside them is taken for emphasis
+    private static final Pattern INLINE = Pattern.compile(
+            "`([^`]+)`|\\*\\*(?=\\S)(.+?)(?<=\\S)\\*\\*|(?<![\\w*])\\*(?=\\S)(.+?)(?<=\\S)\\*(?![\\w*])|(?<!\\w)_(?=\\S)(.+?)(?<=\\S)_(?!\\w)");
+
+    private Markdown() {}
+
+    /** text as the terminal should show it; color false leaves code uncolored, with its backticks. */
+    public static String render(String text, boolean color) {
+        if (text.indexOf('`') < 0 && text.indexOf('*') < 0 && text.indexOf('_') < 0) return text;
+        List<String> out = new ArrayList<>();
+        boolean inBlock = false;
+        for (String line : text.split("\n", -1)) {
+            if (line.trim().startsWith("```")) {
+                // An opening fence at the very start puts the block under the sender's name
+                if (!inBlock && out.isEmpty()) out.add("");
+                inBlock = !inBlock;
+                continue;
+            }
+            if (inBlock) out.add(INDENT + (color ? "\u001b[36m" + line + "\u001b[39m" : line));
+            else out.add(inline(line, color));
+        }
+        return String.join("\n", out);
+    }
+
+    private static String inline(String line, boolean color) {
+        Matcher m = INLINE.matcher(line);
+        return m.replaceAll(r -> {
+            String styled;
+            if (r.group(1) != null) styled = color ? "\u001b[36m" + r.group(1) + "\u001b[39m" : r.group();
+            else if (r.group(2) != null) styled = "\u001b[1m" + r.group(2) + "\u001b[22m";
+            else styled = "\u001b[3m" + (r.group(3) != null ? r.group(3) : r.group(4)) + "\u001b[23m";
+            return Matcher.quoteReplacement(styled);
+        });
+    }
+}
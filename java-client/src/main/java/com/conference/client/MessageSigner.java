@@ -0,0 +1,164 @@
+package com.conference.client;
+
+import com.conference.grpc.ChatMessage;
+import com.google.protobuf.ByteString;
+
+import java.io.ByteArrayOutputStream;
+import java.io.DataOutputStream;
+import java.io.IOException;
+import java.io.UncheckedIOException;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.attribute.PosixFilePermissions;
+import java.security.GeneralSecurityException;
+import java.security.KeyFactory;
+import java.security.KeyPair;
+import java.security.KeyPairGenerator;
+import java.security.PrivateKey;
+import java.security.PublicKey;
+import java.security.Signature;
+import java.security.spec.ECGenParameterSpec;
+import java.security.spec.PKCS8EncodedKeySpec;
+import java.security.spec.X509EncodedKeySpec;
+import java.util.ArrayList;
+import java.util.Arrays;
+import java.util.Base64;
+import java.util.List;
+import java.util.Map;
+import java.util.TreeMap;
+
+/**
+ * Signs our text and checks others'. Each install has an ECDSA P-256 key pair, kept next to the config like
+ * the E2E one; its public half goes in the Hello, and the server pins it to our name while we use it. The
+ * keys the server tells us about are remembered in a known-signers file, so messages from people who have
+ * left, in the history or in other rooms, can still be checked, and a name that turns up with a new key is
+ * noticed. What is signed is laid out in conference.proto, next to SigningKey.
+ */
+final class MessageSigner {
+
+    /** How a message's signature checked out. */
+    enum Check { VALID, INVALID, UNSIGNED, UNKNOWN_SIGNER }
+
+    private static final byte[] PREFIX = "conference signed text v1".getBytes(StandardCharsets.UTF_8);
+
+    private final KeyPair own;
+    private final Path knownFile;
+    private final Map<String, byte[]> known = new TreeMap<>(); // name -> X.509 public key
+
+    private MessageSigner(KeyPair own, Path knownFile) {
+        this.own = own;
+        this.knownFile = knownFile;
+    }
+
+    /** Loads the key pair kept in keyFile, or makes one and saves it there, and the signers in knownFile. */
+    static MessageSigner load(Path keyFile, Path knownFile) throws IOException, GeneralSecurityException {
+        KeyFactory factory = KeyFactory.getInstance("EC");
+        KeyPair pair = null;
+        if (Files.exists(keyFile)) {
+            List<String> lines = Files.readAllLines(keyFile);
+            if (lines.size() >= 2) {
+                PrivateKey priv = factory.generatePrivate(new PKCS8EncodedKeySpec(Base64.getDecoder().decode(lines.get(0))));
+                PublicKey pub = factory.generatePublic(new X509EncodedKeySpec(Base64.getDecoder().decode(lines.get(1))));
+                pair = new KeyPair(pub, priv);
+            }
+        }
+        if (pair == null) {
+            KeyPairGenerator generator = KeyPairGenerator.getInstance("EC");
+            generator.initialize(new ECGenParameterSpec("secp256r1"));
+            pair = generator.generateKeyPair();
+            Files.createDirectories(keyFile.getParent());
+            Files.write(keyFile, List.of(Base64.getEncoder().encodeToString(pair.getPrivate().getEncoded()),
+                    Base64.getEncoder().encodeToString(pair.getPublic().getEncoded())));
+            try {
+                Files.setPosixFilePermissions(keyFile, PosixFilePermissions.fromString("rw-------"));
+            } catch (UnsupportedOperationException e) {
+                // Windows: the file stays in the user's profile
+            }
+        }
+        MessageSigner signer = new MessageSigner(pair, knownFile);
+        if (Files.exists(knownFile)) {
+            // "<base64 key> <name>": the name last, since it may have spaces
+            for (String line : Files.readAllLines(knownFile)) {
+                String[] fields = line.trim().split(" ", 2);
+                if (fields.length == 2) signer.known.put(fields[1], Base64.getDecoder().decode(fields[0]));
+            }
+        }
+        return signer;
+    }
+
+    byte[] publicKey() {
+        return own.getPublic().getEncoded();
+    }
+
+    /** chat with our signature, over its fields as they are. */
+    ChatMessage sign(ChatMessage chat) throws GeneralSecurityException {
+        Signature signature = Signature.getInstance("SHA256withECDSA");
+        signature.initSign(own.getPrivate());
+        signature.update(signedBytes(chat));
+        return chat.toBuilder().setSignature(ByteString.copyFrom(signature.sign())).build();
+    }
+
+    /**
+     * Remembers the key the server pinned to name. Returns false if we knew another one for it: either its
+     * owner moved to another install, or someone else has the name now.
+     */
+    synchronized boolean learn(String name, byte[] publicKey) {
+        byte[] before = known.put(name, publicKey);
+        if (before != null && Arrays.equals(before, publicKey)) return true;
+        save();
+        return before == null;
+    }
+
+    synchronized boolean knows(String name) {
+        return known.containsKey(name);
+    }
+
+    /** Whether from signed chat. A message naming another sender than the one it came from is INVALID. */
+    Check check(String from, ChatMessage chat) {
+        if (chat.getSignature().isEmpty()) return Check.UNSIGNED;
+        byte[] key;
+        synchronized (this) {
+            key = known.get(from);
+        }
+        if (key == null) return Check.UNKNOWN_SIGNER;
+        if (!chat.getSender().equals(from)) return Check.INVALID;
+        try {
+            Signature signature = Signature.getInstance("SHA256withECDSA");
+            signature.initVerify(KeyFactory.getInstance("EC").generatePublic(new X509EncodedKeySpec(key)));
+            signature.update(signedBytes(chat));
+            return signature.verify(chat.getSignature().toByteArray()) ? Check.VALID : Check.INVALID;
+        } catch (GeneralSecurityException e) {
+            return Check.INVALID; // a malformed signature or key
+        }
+    }
+
+    private void save() {
+        List<String> lines = new ArrayList<>();
+        known.forEach((name, key) -> lines.add(Base64.getEncoder().encodeToString(key) + " " + name));
+        try {
+            Files.createDirectories(knownFile.getParent());
+            Files.write(knownFile, lines);
+        } catch (IOException e) {
+            // Kept in memory for this session; we'll try again on the next change
+        }
+    }
+
+    private static byte[] signedBytes(ChatMessage chat) {
+        ByteString body = chat.hasEncrypted() ? chat.getEncrypted().getCiphertext() : chat.getContentBytes();
+        ByteArrayOutputStream buf = new ByteArrayOutputStream();
+        try (DataOutputStream out = new DataOutputStream(buf)) {
+            out.write(PREFIX);
+            for (byte[] field : new byte[][]{chat.getRoomIdBytes().toByteArray(), chat.getSenderBytes().toByteArray(),
+                    chat.getTraceIdBytes().toByteArray(), body.toByteArray()}) {
+                out.writeInt(field.length);
+                out.write(field);
+            }
+            out.writeLong(chat.getTimestamp());
+            out.writeInt(chat.getTtlSeconds());
+        } catch (IOException e) {
+            throw new UncheckedIOException(e); // not from a byte array
+        }
+        return buf.toByteArray();
+    }
+}
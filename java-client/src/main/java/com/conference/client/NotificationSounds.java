@@ -0,0 +1,111 @@
+package com.conference.client;
+
+import java.time.LocalTime;
+import java.time.format.DateTimeParseException;
+import java.util.concurrent.ExecutorService;
+import java.util.concurrent.Executors;
+import java.util.concurrent.atomic.AtomicBoolean;
+
+import static com.conference.client.I18n.tr;
+
+/**
+ * Short tones for new messages and incoming files, played through the
+ * speakers like any other speaker (see AudioStreamer.playLocal). Each event
+ * can be turned on or off, and a quiet-hours window ("22:00-07:00", may wrap
+ * past midnight) silences them all. The tones are generated, so there are no
+ * sound files to ship; one that arrives while another plays is skipped.
+ */
+public class NotificationSounds {
+
+    public static final String SPEAKER = "sounds"; // name under which the tones are played
+    private static final int SAMPLE_RATE = 22050;
+
+    public enum Event {
+        MESSAGE(new double[]{880}),
+        FILE(new double[]{660, 990});
+
+        private final double[] tones; // Hz, played one after the other
+
+        Event(double[] tones) { this.tones = tones; }
+    }
+
+    private final AudioStreamer audioStreamer;
+    private final AtomicBoolean playing = new AtomicBoolean(false);
+    private final ExecutorService worker = Executors.newSingleThreadExecutor(r -> {
+        Thread t = new Thread(r, "sounds");
+        t.setDaemon(true);
+        return t;
+    });
+    private volatile boolean message = false;
+    private volatile boolean file = true;
+    private volatile LocalTime quietFrom, quietTo; // null: no quiet hours
+
+    public NotificationSounds(AudioStreamer audioStreamer) {
+        this.audioStreamer = audioStreamer;
+    }
+
+    public boolean isEnabled(Event event) {
+        return event == Event.MESSAGE ? message : file;
+    }
+
+    public void setEnabled(Event event, boolean enabled) {
+        if (event == Event.MESSAGE) message = enabled;
+        else file = enabled;
+    }
+
+    /** Sets quiet hours from "HH:mm-HH:mm"; "" clears them. Throws DateTimeParseException on anything else. */
+    public void setQuietHours(String window) {
+        if (window.isEmpty()) {
+            quietFrom = quietTo = null;
+            return;
+        }
+        String[] ends = window.split("-", 2);
+        if (ends.length != 2) throw new DateTimeParseException(tr("sounds.quiet_format"), window, 0);
+        LocalTime from = LocalTime.parse(ends[0].trim()), to = LocalTime.parse(ends[1].trim());
+        quietFrom = from;
+        quietTo = to;
+    }
+
+    public String getQuietHours() {
+        LocalTime from = quietFrom, to = quietTo;
+        return from == null ? "" : from + "-" + to;
+    }
+
+    private boolean quietNow() {
+        LocalTime from = quietFrom, to = quietTo;
+        if (from == null) return false;
+        LocalTime now = LocalTime.now();
+        return from.isBefore(to) ? !now.isBefore(from) && now.isBefore(to) : !now.isBefore(from) || now.isBefore(to);
+    }
+
+    /** Plays the event's tone unless it is off, it is quiet hours, or the speakers are off. */
+    public void play(Event event) {
+        if (!isEnabled(event) || quietNow() || !audioStreamer.isSpeakersActive()) return;
+        if (!playing.compareAndSet(false, true)) return;
+        worker.execute(() -> {
+            try {
+                audioStreamer.playLocal(SPEAKER, tones(event.tones), SAMPLE_RATE, 1);
+            } catch (InterruptedException e) {
+                Thread.currentThread().interrupt();
+            } finally {
+                playing.set(false);
+            }
+        });
+    }
+
+    // 16-bit mono PCM: 120 ms per tone with 10 ms fades, so there is no click at either end
+    private static byte[] tones(double[] frequencies) {
+        int perTone = SAMPLE_RATE * 120 / 1000, fade = SAMPLE_RATE / 100;
+        byte[] pcm = new byte[frequencies.length * perTone * 2];
+        for (int t = 0; t < frequencies.length; t++) {
+            for (int i = 0; i < perTone; i++) {
+                double envelope = Math.min(1.0, Math.min(i, perTone - 1 - i) / (double) fade);
+                short sample = (short) (Math.sin(2 * Math.PI * frequencies[t] * i / SAMPLE_RATE) * envelope * 0.3 * Short.MAX_VALUE);
+                int at = (t * perTone + i) * 2;
+                pcm[at] = (byte) sample;
+                pcm[at + 1] = (byte) (sample >> 8);
+            }
+        }
+        return pcm;
+    }
+}
@@ -0,0 +1,51 @@
+package com.conference.client;
+
+/**
+ * Converts 16-bit little-endian PCM between sample rates and channel counts so
+ * clients capturing in different formats can still hear each other.
+ * Resampling is linear interpolation, which is plenty for speech.
+ */
+public final class PcmConverter {
+
+    private PcmConverter() {}
+
+    public static byte[] convert(byte[] pcm, int srcRate, int srcChannels, int dstRate, int dstChannels) {
+        if (srcRate == dstRate && srcChannels == dstChannels) return pcm;
+        int srcFrames = pcm.length / (2 * srcChannels);
+        if (srcFrames == 0) return new byte[0];
+
+        int dstFrames = (int) ((long) srcFrames * dstRate / srcRate);
+        byte[] out = new byte[dstFrames * 2 * dstChannels];
+        double step = (double) srcRate / dstRate;
+        for (int f = 0; f < dstFrames; f++) {
+            double pos = f * step;
+            int i0 = (int) pos;
+            int i1 = Math.min(i0 + 1, srcFrames - 1);
+            double frac = pos - i0;
+            for (int c = 0; c < dstChannels; c++) {
+                double a = mixedSample(pcm, i0, srcChannels, c, dstChannels);
+                double b = mixedSample(pcm, i1, srcChannels, c, dstChannels);
+                int v = (int) Math.round(a + (b - a) * frac);
+                v = Math.max(Short.MIN_VALUE, Math.min(Short.MAX_VALUE, v));
+                int o = (f * dstChannels + c) * 2;
+                out[o] = (byte) v;
+                out[o + 1] = (byte) (v >> 8);
+            }
+        }
+        return out;
+    }
+
+    // Sample for output channel c of frame: downmixing averages every source
+    // channel, upmixing copies mono out, and equal counts map channel to channel.
+    private static double mixedSample(byte[] pcm, int frame, int srcChannels, int c, int dstChannels) {
+        if (srcChannels == dstChannels) return sample(pcm, frame * srcChannels + c);
+        if (srcChannels == 1) return sample(pcm, frame);
+        double sum = 0;
+        for (int s = 0; s < srcChannels; s++) sum += sample(pcm, frame * srcChannels + s);
+        return sum / srcChannels;
+    }
+
+    private static short sample(byte[] pcm, int index) {
+        return (short) ((pcm[2 * index] & 0xff) | (pcm[2 * index + 1] << 8));
+    }
+}
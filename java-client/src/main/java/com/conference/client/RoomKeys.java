@@ -0,0 +1,238 @@
+package com.conference.client;
+
+import com.conference.grpc.EncryptedText;
+import com.conference.grpc.KeyEnvelope;
+import com.google.protobuf.ByteString;
+
+import javax.crypto.Cipher;
+import javax.crypto.KeyAgreement;
+import javax.crypto.Mac;
+import javax.crypto.spec.GCMParameterSpec;
+import javax.crypto.spec.SecretKeySpec;
+import java.io.IOException;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.nio.file.Path;
+import java.nio.file.attribute.PosixFilePermissions;
+import java.security.GeneralSecurityException;
+import java.security.KeyFactory;
+import java.security.KeyPair;
+import java.security.KeyPairGenerator;
+import java.security.MessageDigest;
+import java.security.PrivateKey;
+import java.security.PublicKey;
+import java.security.SecureRandom;
+import java.security.spec.PKCS8EncodedKeySpec;
+import java.security.spec.X509EncodedKeySpec;
+import java.util.ArrayList;
+import java.util.Base64;
+import java.util.LinkedHashMap;
+import java.util.List;
+import java.util.Map;
+
+/**
+ * End-to-end encryption of the session room's text. Each install has an X25519 key pair, kept next to the
+ * config so its fingerprint stays the same and can be checked once with the other person. Members who
+ * turn encryption on publish their public key; the server lists them in the order they did, and the first
+ * one, the keeper, makes a random AES-256 room key and sends it to each of the others wrapped with the key
+ * the two of them share (X25519, then HKDF-SHA256). Whenever someone leaves, the keeper makes a new one
+ * with the next epoch, so they can't read what comes after. Older epochs are kept to read earlier messages.
+ * The server only ever sees ciphertext, but it could still swap a public key for its own: that is what
+ * checking fingerprints is for.
+ */
+final class RoomKeys {
+
+    private static final int NONCE_BYTES = 12;
+    private static final int TAG_BITS = 128;
+    private static final byte[] ENVELOPE_INFO = "conference e2e room key".getBytes(StandardCharsets.UTF_8);
+
+    private final KeyPair own;
+    private final SecureRandom random = new SecureRandom();
+    private String self = "";
+    private final Map<String, PublicKey> members = new LinkedHashMap<>(); // in the order the server lists them
+    private final Map<Integer, byte[]> roomKeys = new LinkedHashMap<>(); // by epoch
+    private int epoch; // of the key we encrypt with; 0 until we have one
+    private int newestEpoch; // the highest seen, so a new keeper goes past it
+
+    private RoomKeys(KeyPair own) {
+        this.own = own;
+    }
+
+    /** Loads the key pair kept in file, or makes one and saves it there. */
+    static RoomKeys load(Path file) throws IOException, GeneralSecurityException {
+        KeyFactory factory = KeyFactory.getInstance("X25519");
+        if (Files.exists(file)) {
+            List<String> lines = Files.readAllLines(file);
+            if (lines.size() >= 2) {
+                PrivateKey priv = factory.generatePrivate(new PKCS8EncodedKeySpec(Base64.getDecoder().decode(lines.get(0))));
+                PublicKey pub = factory.generatePublic(new X509EncodedKeySpec(Base64.getDecoder().decode(lines.get(1))));
+                return new RoomKeys(new KeyPair(pub, priv));
+            }
+        }
+        KeyPair pair = KeyPairGenerator.getInstance("X25519").generateKeyPair();
+        Files.createDirectories(file.getParent());
+        Files.write(file, List.of(Base64.getEncoder().encodeToString(pair.getPrivate().getEncoded()),
+                Base64.getEncoder().encodeToString(pair.getPublic().getEncoded())));
+        try {
+            Files.setPosixFilePermissions(file, PosixFilePermissions.fromString("rw-------"));
+        } catch (UnsupportedOperationException e) {
+            // Windows: the file stays in the user's profile
+        }
+        return new RoomKeys(pair);
+    }
+
+    byte[] publicKey() {
+        return own.getPublic().getEncoded();
+    }
+
+    /** "3fa1 09bc 77d2 e410": the first bytes of the key's SHA-256, to compare out loud or by another channel. */
+    static String fingerprint(byte[] publicKey) {
+        try {
+            byte[] hash = MessageDigest.getInstance("SHA-256").digest(publicKey);
+            StringBuilder sb = new StringBuilder();
+            for (int i = 0; i < 8; i++) {
+                if (i > 0 && i % 2 == 0) sb.append(' ');
+                sb.append(String.format("%02x", hash[i]));
+            }
+            return sb.toString();
+        } catch (GeneralSecurityException e) {
+            throw new IllegalStateException(e);
+        }
+    }
+
+    String ownFingerprint() {
+        return fingerprint(publicKey());
+    }
+
+    /** Forgets the room: its members and keys. The server lists the keys again on every join. */
+    synchronized void reset(String self) {
+        this.self = self;
+        members.clear();
+        roomKeys.clear();
+        epoch = 0;
+        newestEpoch = 0;
+    }
+
+    /** Adds or replaces name's key; a replaced one moves to the end of the list, as on the server. */
+    synchronized void addMember(String name, byte[] publicKey) throws GeneralSecurityException {
+        PublicKey key = KeyFactory.getInstance("X25519").generatePublic(new X509EncodedKeySpec(publicKey));
+        members.remove(name);
+        members.put(name, key);
+    }
+
+    /** Returns true if name had published a key. */
+    synchronized boolean removeMember(String name) {
+        return members.remove(name) != null;
+    }
+
+    synchronized List<String> members() {
+        return new ArrayList<>(members.keySet());
+    }
+
+    synchronized byte[] memberKey(String name) {
+        PublicKey key = members.get(name);
+        return key == null ? null : key.getEncoded();
+    }
+
+    synchronized String keeper() {
+        return members.isEmpty() ? null : members.keySet().iterator().next();
+    }
+
+    synchronized boolean isKeeper() {
+        return self.equals(keeper());
+    }
+
+    synchronized boolean hasRoomKey() {
+        return epoch > 0;
+    }
+
+    synchronized int epoch() {
+        return epoch;
+    }
+
+    /** Makes a new room key with an epoch past any seen so far; the keeper then sends it to everyone. */
+    synchronized void newRoomKey() {
+        byte[] key = new byte[32];
+        random.nextBytes(key);
+        epoch = ++newestEpoch;
+        roomKeys.put(epoch, key);
+    }
+
+    /** The current room key, wrapped for name. */
+    synchronized KeyEnvelope wrapFor(String name) throws GeneralSecurityException {
+        PublicKey theirs = members.get(name);
+        if (theirs == null || epoch == 0) throw new GeneralSecurityException(name + " has no key");
+        byte[] nonce = new byte[NONCE_BYTES];
+        random.nextBytes(nonce);
+        Cipher cipher = Cipher.getInstance("AES/GCM/NoPadding");
+        cipher.init(Cipher.ENCRYPT_MODE, sharedKey(theirs), new GCMParameterSpec(TAG_BITS, nonce));
+        cipher.updateAAD(envelopeAad(self, name, epoch));
+        return KeyEnvelope.newBuilder().setRecipient(name).setEpoch(epoch).setNonce(ByteString.copyFrom(nonce))
+                .setWrappedKey(ByteString.copyFrom(cipher.doFinal(roomKeys.get(epoch)))).build();
+    }
+
+    /**
+     * Takes the room key in env, if the keeper sent it. Returns false for envelopes from anyone else,
+     * which a member could send to split the room.
+     */
+    synchronized boolean accept(KeyEnvelope env) throws GeneralSecurityException {
+        if (!env.getSender().equals(keeper()) || env.getSender().equals(self)) return false;
+        Cipher cipher = Cipher.getInstance("AES/GCM/NoPadding");
+        cipher.init(Cipher.DECRYPT_MODE, sharedKey(members.get(env.getSender())),
+                new GCMParameterSpec(TAG_BITS, env.getNonce().toByteArray()));
+        cipher.updateAAD(envelopeAad(env.getSender(), self, env.getEpoch()));
+        byte[] key = cipher.doFinal(env.getWrappedKey().toByteArray());
+        roomKeys.put(env.getEpoch(), key);
+        newestEpoch = Math.max(newestEpoch, env.getEpoch());
+        if (env.getEpoch() >= epoch) epoch = env.getEpoch();
+        return true;
+    }
+
+    synchronized EncryptedText encrypt(String roomId, String text) throws GeneralSecurityException {
+        if (epoch == 0) throw new GeneralSecurityException("no room key yet");
+        byte[] nonce = new byte[NONCE_BYTES];
+        random.nextBytes(nonce);
+        Cipher cipher = Cipher.getInstance("AES/GCM/NoPadding");
+        cipher.init(Cipher.ENCRYPT_MODE, new SecretKeySpec(roomKeys.get(epoch), "AES"), new GCMParameterSpec(TAG_BITS, nonce));
+        cipher.updateAAD(messageAad(roomId, self, epoch));
+        return EncryptedText.newBuilder().setEpoch(epoch).setNonce(ByteString.copyFrom(nonce))
+                .setCiphertext(ByteString.copyFrom(cipher.doFinal(text.getBytes(StandardCharsets.UTF_8)))).build();
+    }
+
+    /** The text of a message sender encrypted; fails if we lack its epoch or it was altered or re-attributed. */
+    synchronized String decrypt(String roomId, String sender, EncryptedText enc) throws GeneralSecurityException {
+        byte[] key = roomKeys.get(enc.getEpoch());
+        if (key == null) throw new GeneralSecurityException("no key for epoch " + enc.getEpoch());
+        Cipher cipher = Cipher.getInstance("AES/GCM/NoPadding");
+        cipher.init(Cipher.DECRYPT_MODE, new SecretKeySpec(key, "AES"), new GCMParameterSpec(TAG_BITS, enc.getNonce().toByteArray()));
+        cipher.updateAAD(messageAad(roomId, sender, enc.getEpoch()));
+        return new String(cipher.doFinal(enc.getCiphertext().toByteArray()), StandardCharsets.UTF_8);
+    }
+
+    // The AES key both ends of an envelope derive from their X25519 agreement
+    private SecretKeySpec sharedKey(PublicKey theirs) throws GeneralSecurityException {
+        KeyAgreement agreement = KeyAgreement.getInstance("X25519");
+        agreement.init(own.getPrivate());
+        agreement.doPhase(theirs, true);
+        return new SecretKeySpec(hkdf(agreement.generateSecret(), ENVELOPE_INFO), "AES");
+    }
+
+    // HKDF-SHA256 with an empty salt, 32 bytes out (RFC 5869)
+    private static byte[] hkdf(byte[] secret, byte[] info) throws GeneralSecurityException {
+        Mac mac = Mac.getInstance("HmacSHA256");
+        mac.init(new SecretKeySpec(new byte[32], "HmacSHA256"));
+        byte[] prk = mac.doFinal(secret);
+        mac.init(new SecretKeySpec(prk, "HmacSHA256"));
+        mac.update(info);
+        mac.update((byte) 1);
+        return mac.doFinal();
+    }
+
+    private static byte[] envelopeAad(String from, String to, int epoch) {
+        return ("envelope\0" + from + "\0" + to + "\0" + epoch).getBytes(StandardCharsets.UTF_8);
+    }
+
+    private static byte[] messageAad(String roomId, String sender, int epoch) {
+        return ("message\0" + roomId + "\0" + sender + "\0" + epoch).getBytes(StandardCharsets.UTF_8);
+    }
+}
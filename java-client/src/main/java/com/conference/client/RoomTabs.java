@@ -0,0 +1,222 @@
+package com.conference.client;
+
+import com.conference.grpc.ChatMessage;
+import com.conference.grpc.Command;
+import com.conference.grpc.ConferenceData;
+import com.conference.grpc.ConferenceServiceGrpc;
+import io.grpc.Metadata;
+import io.grpc.stub.MetadataUtils;
+import io.grpc.stub.StreamObserver;
+
+import java.time.Instant;
+import java.util.ArrayDeque;
+import java.util.ArrayList;
+import java.util.Deque;
+import java.util.List;
+import java.util.UUID;
+import java.util.function.Function;
+
+import static com.conference.client.I18n.tr;
+
+/**
+ * The rooms open in tabs. Tab 1 is the room the session joined, with
+ * everything (audio, files, moderation); /join opens more, each with a
+ * text-only JoinConference stream of its own, since the server lets a name
+ * be in several rooms with one stream each. One tab is shown at a time:
+ * what the others receive is kept (the last BUFFER lines of each) and
+ * counted as unread in the status line, and printed on switching to them.
+ */
+final class RoomTabs {
+
+    static final int BUFFER = 200;
+
+    private static final class Tab {
+        final String room;
+        final Deque<String> buffer = new ArrayDeque<>();
+        int unread;
+        StreamObserver<ConferenceData> stream; // null for the session's room
+
+        Tab(String room) {
+            this.room = room;
+        }
+    }
+
+    private final ConferenceServiceGrpc.ConferenceServiceStub stub;
+    private final Console console;
+    private final Function<ConferenceData, String> format; // how a text message is shown; null to skip it
+    private final List<Tab> tabs = new ArrayList<>();
+    private Tab active;
+    private String sender;
+    private String accountToken; // the session's, so tabs can use a registered name too
+
+    RoomTabs(ConferenceServiceGrpc.ConferenceServiceStub stub, Console console, Function<ConferenceData, String> format) {
+        this.stub = stub;
+        this.console = console;
+        this.format = format;
+    }
+
+    /** Starts over with the session's room as the only tab. */
+    synchronized void reset(String sender, String room) {
+        closeAll();
+        this.sender = sender;
+        active = new Tab(room);
+        tabs.add(active);
+    }
+
+    /** Joins new tabs logged in with token, from /register or /login. */
+    synchronized void useAccount(String token) {
+        accountToken = token;
+    }
+
+    /** Leaves the rooms opened with join; the session's room is left by the session. */
+    synchronized void closeAll() {
+        for (Tab tab : tabs) {
+            if (tab.stream != null) tab.stream.onCompleted();
+        }
+        tabs.clear();
+        active = null;
+        console.status("tabs", null);
+    }
+
+    synchronized int size() {
+        return tabs.size();
+    }
+
+    /** The tab index for a room name or a 1-based number, or -1. */
+    synchronized int find(String roomOrNumber) {
+        for (int i = 0; i < tabs.size(); i++) {
+            if (tabs.get(i).room.equals(roomOrNumber)) return i;
+        }
+        try {
+            int n = Integer.parseInt(roomOrNumber);
+            return n >= 1 && n <= tabs.size() ? n - 1 : -1;
+        } catch (NumberFormatException e) {
+            return -1;
+        }
+    }
+
+    synchronized boolean sessionRoomShown() {
+        return active == null || active.stream == null;
+    }
+
+    synchronized String shownRoom() {
+        return active == null ? "" : active.room;
+    }
+
+    /** Joins room in a new tab and shows it; false if it is open already. */
+    synchronized boolean join(String room) {
+        for (Tab open : tabs) {
+            if (open.room.equals(room)) return false;
+        }
+        Tab tab = new Tab(room);
+        ConferenceServiceGrpc.ConferenceServiceStub joinStub = stub;
+        if (accountToken != null) {
+            Metadata metadata = new Metadata();
+            metadata.put(Metadata.Key.of("account-token", Metadata.ASCII_STRING_MARSHALLER), accountToken);
+            joinStub = stub.withInterceptors(MetadataUtils.newAttachHeadersInterceptor(metadata));
+        }
+        tab.stream = joinStub.joinConference(new StreamObserver<>() {
+            @Override
+            public void onNext(ConferenceData data) {
+                if (data.getPayloadCase() == ConferenceData.PayloadCase.COMMAND) {
+                    Command cmd = data.getCommand();
+                    if (cmd.getType().equals("ERROR")) drop(tab, "❌ #" + room + ": " + cmd.getValue());
+                    return;
+                }
+                if (data.getPayloadCase() != ConferenceData.PayloadCase.TEXT_MESSAGE || data.getSender().equals(sender)) return;
+                String line = format.apply(data);
+                if (line != null) show(tab, line);
+            }
+
+            @Override
+            public void onError(Throwable t) {
+                drop(tab, tr("tabs.closed_error", room, t.getMessage()));
+            }
+
+            @Override
+            public void onCompleted() {
+                drop(tab, tr("tabs.closed", room));
+            }
+        });
+        tab.stream.onNext(ConferenceData.newBuilder().setSender(sender).setRoomId(room)
+                .setCommand(Command.newBuilder().setType("JOIN")).build());
+        tabs.add(tab);
+        switchTo(tabs.size() - 1);
+        return true;
+    }
+
+    /** Leaves the room in tab index, which can't be the session's, and shows the session's. */
+    synchronized boolean close(int index) {
+        if (index <= 0 || index >= tabs.size()) return false;
+        Tab tab = tabs.remove(index);
+        tab.stream.onCompleted();
+        tab.stream = null; // its onCompleted has nothing left to drop
+        if (tab == active) switchTo(0);
+        else updateStatus();
+        return true;
+    }
+
+    /** Shows tab index: prints what came in while it was hidden. */
+    synchronized void switchTo(int index) {
+        active = tabs.get(index);
+        console.message(tr("tabs.header", active.room, active.unread > 0 ? tr("tabs.unread", active.unread) : ""));
+        for (String line : active.buffer) console.message(line);
+        active.buffer.clear();
+        active.unread = 0;
+        updateStatus();
+    }
+
+    /** Prints line for the session's room, or keeps it for later if another tab is shown. */
+    void showSessionRoom(String line) {
+        Tab first;
+        synchronized (this) {
+            first = tabs.isEmpty() ? null : tabs.get(0);
+        }
+        if (first == null) console.message(line);
+        else show(first, line);
+    }
+
+    /** Sends text to the room shown, which must not be the session's. */
+    synchronized void send(String text) {
+        if (active == null || active.stream == null) return;
+        ChatMessage chat = ChatMessage.newBuilder().setSender(sender).setContent(text).setRoomId(active.room)
+                .setTimestamp(Instant.now().getEpochSecond()).setTraceId(UUID.randomUUID().toString()).build();
+        active.stream.onNext(ConferenceData.newBuilder().setSender(sender).setRoomId(active.room).setTextMessage(chat).build());
+    }
+
+    private synchronized void show(Tab tab, String line) {
+        if (tab == active) {
+            console.message(line);
+            console.prompt();
+            return;
+        }
+        if (!tabs.contains(tab)) return;
+        if (tab.buffer.size() == BUFFER) tab.buffer.removeFirst();
+        tab.buffer.addLast(line);
+        tab.unread++;
+        updateStatus();
+    }
+
+    private synchronized void drop(Tab tab, String why) {
+        if (tab.stream == null || !tabs.remove(tab)) return;
+        console.message(why);
+        if (tab == active) switchTo(0);
+        else updateStatus();
+        console.prompt();
+    }
+
+    // 📑 [1 general]  2 dev (3)  3 random
+    private void updateStatus() {
+        if (tabs.size() < 2) {
+            console.status("tabs", null);
+            return;
+        }
+        StringBuilder line = new StringBuilder("📑");
+        for (int i = 0; i < tabs.size(); i++) {
+            Tab tab = tabs.get(i);
+            String label = (i + 1) + " " + tab.room + (tab.unread > 0 ? " (" + tab.unread + ")" : "");
+            line.append("  ").append(tab == active ? "\u001b[1m[" + label + "]\u001b[22m" : label);
+        }
+        console.status("tabs", line.toString());
+    }
+}
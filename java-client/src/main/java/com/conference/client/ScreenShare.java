@@ -0,0 +1,125 @@
+package com.conference.client;
+
+import com.conference.grpc.ConferenceData;
+import com.conference.grpc.VideoFrame;
+import com.conference.grpc.VideoSource;
+import com.google.protobuf.ByteString;
+import io.grpc.stub.StreamObserver;
+
+import javax.imageio.ImageIO;
+import java.awt.AWTException;
+import java.awt.Graphics2D;
+import java.awt.Rectangle;
+import java.awt.RenderingHints;
+import java.awt.Robot;
+import java.awt.Toolkit;
+import java.awt.image.BufferedImage;
+import java.io.ByteArrayOutputStream;
+import java.io.IOException;
+
+import static com.conference.client.I18n.tr;
+
+/**
+ * Captures the screen and sends it to the room as MJPEG screen frames. Every
+ * frame is a standalone JPEG, so each one is a keyframe and receivers that
+ * fall behind recover on the very next frame. The server only relays frames
+ * while it has granted us the room's share (SHARE_STARTED).
+ *
+ * <p>Each capture is sent twice, as simulcast layer 0 and as a half-size
+ * layer 1; the server forwards the light layer to congested receivers.
+ */
+public class ScreenShare {
+
+    public static final int DEFAULT_FPS = 2;
+    public static final int MAX_FPS = 15;
+    private static final int MAX_WIDTH = 1280; // larger screens are scaled down
+    private static final int LOW_LAYER = 1;
+
+    private final StreamObserver<ConferenceData> requestObserver;
+    private final String sender;
+    private volatile String roomId;
+    private volatile Thread captureThread;
+    private int seq;
+
+    public ScreenShare(StreamObserver<ConferenceData> requestObserver, String sender, String roomId) {
+        this.requestObserver = requestObserver;
+        this.sender = sender;
+        this.roomId = roomId;
+    }
+
+    public void setRoomId(String roomId) {
+        this.roomId = roomId;
+    }
+
+    public boolean isSharing() {
+        return captureThread != null;
+    }
+
+    /** Starts capturing; fails right away on headless systems or without screen access. */
+    public synchronized void start(int fps) throws AWTException {
+        if (captureThread != null) return;
+        Robot robot = new Robot(); // throws in headless environments
+        Rectangle area = new Rectangle(Toolkit.getDefaultToolkit().getScreenSize());
+        long intervalMs = 1000L / Math.max(1, Math.min(MAX_FPS, fps));
+        seq = 0;
+        captureThread = new Thread(() -> {
+            while (!Thread.currentThread().isInterrupted()) {
+                long started = System.currentTimeMillis();
+                try {
+                    BufferedImage image = scaled(robot.createScreenCapture(area), MAX_WIDTH);
+                    seq++;
+                    sendFrame(image, 0, started, intervalMs);
+                    sendFrame(scaled(image, image.getWidth() / 2), LOW_LAYER, started, intervalMs);
+                    Thread.sleep(Math.max(0, intervalMs - (System.currentTimeMillis() - started)));
+                } catch (InterruptedException e) {
+                    break;
+                } catch (Exception e) {
+                    System.err.println(tr("screen.share_error", e.getMessage()));
+                    break;
+                }
+            }
+        }, "screen-share");
+        captureThread.setDaemon(true);
+        captureThread.start();
+    }
+
+    public synchronized void stop() {
+        if (captureThread != null) {
+            captureThread.interrupt();
+            captureThread = null;
+        }
+    }
+
+    private static BufferedImage scaled(BufferedImage image, int maxWidth) {
+        if (image.getWidth() <= maxWidth) return image;
+        int height = image.getHeight() * maxWidth / image.getWidth();
+        BufferedImage out = new BufferedImage(maxWidth, height, BufferedImage.TYPE_INT_RGB);
+        Graphics2D g = out.createGraphics();
+        g.setRenderingHint(RenderingHints.KEY_INTERPOLATION, RenderingHints.VALUE_INTERPOLATION_BILINEAR);
+        g.drawImage(image, 0, 0, maxWidth, height, null);
+        g.dispose();
+        return out;
+    }
+
+    private void sendFrame(BufferedImage image, int layer, long capturedAt, long intervalMs) throws IOException {
+        ByteArrayOutputStream jpeg = new ByteArrayOutputStream();
+        ImageIO.write(image, "jpg", jpeg);
+        VideoFrame frame = VideoFrame.newBuilder()
+                .setData(ByteString.copyFrom(jpeg.toByteArray()))
+                .setCodec("mjpeg")
+                .setWidth(image.getWidth())
+                .setHeight(image.getHeight())
+                .setBitrateKbps((int) (jpeg.size() * 8L / intervalMs)) // bits per ms = kbps
+                .setKeyframe(true)
+                .setSeq(seq) // both layers of a capture share it
+                .setCaptureTimeMs(capturedAt)
+                .setSource(VideoSource.VIDEO_SCREEN)
+                .setLayer(layer)
+                .build();
+        requestObserver.onNext(ConferenceData.newBuilder()
+                .setSender(sender)
+                .setRoomId(roomId)
+                .setVideoFrame(frame)
+                .build());
+    }
+}
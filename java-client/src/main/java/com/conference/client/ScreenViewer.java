@@ -0,0 +1,91 @@
+package com.conference.client;
+
+import com.conference.grpc.VideoFrame;
+
+import java.io.File;
+import java.io.IOException;
+import java.io.OutputStream;
+import java.nio.file.Files;
+import java.util.List;
+
+import static com.conference.client.I18n.tr;
+
+/**
+ * Receives the room's screen share. There is no built-in video window:
+ * frames are either saved one file per frame, or written back to back to the
+ * stdin of an external viewer, e.g. "ffplay -f mjpeg -i -".
+ */
+public class ScreenViewer {
+
+    private File saveDir;
+    private Process viewer;
+    private OutputStream viewerInput;
+    private long frames = 0;
+
+    /** Saves every incoming frame into dir. */
+    public synchronized void saveTo(File dir) throws IOException {
+        close();
+        Files.createDirectories(dir.toPath());
+        saveDir = dir;
+    }
+
+    /** Starts command (split on spaces) and streams frames to its stdin. */
+    public synchronized void pipeTo(String command) throws IOException {
+        close();
+        viewer = new ProcessBuilder(List.of(command.trim().split("\\s+")))
+                .redirectOutput(ProcessBuilder.Redirect.DISCARD)
+                .redirectError(ProcessBuilder.Redirect.DISCARD)
+                .start();
+        viewerInput = viewer.getOutputStream();
+    }
+
+    public synchronized boolean isActive() {
+        return saveDir != null || viewer != null;
+    }
+
+    public synchronized long getFrames() {
+        return frames;
+    }
+
+    public synchronized void accept(String sharer, VideoFrame frame) {
+        try {
+            if (saveDir != null) {
+                String name = String.format("%s-%06d.%s", sharer, frame.getSeq(), extension(frame.getCodec()));
+                Files.write(new File(saveDir, name).toPath(), frame.getData().toByteArray());
+                frames++;
+            } else if (viewer != null) {
+                frame.getData().writeTo(viewerInput);
+                viewerInput.flush();
+                frames++;
+            }
+        } catch (IOException e) {
+            // The viewer was closed or the disk is full: stop instead of failing on every frame
+            System.err.println(tr("screen.view_error", e.getMessage()));
+            close();
+        }
+    }
+
+    private static String extension(String codec) {
+        switch (codec) {
+            case "mjpeg": return "jpg";
+            case "h264": return "h264";
+            case "vp8": return "vp8";
+            default: return "bin";
+        }
+    }
+
+    public synchronized void close() {
+        saveDir = null;
+        if (viewer != null) {
+            try {
+                viewerInput.close();
+            } catch (IOException ignored) {
+                // the viewer already exited
+            }
+            viewer.destroy();
+            viewer = null;
+            viewerInput = null;
+        }
+        frames = 0;
+    }
+}
@@ -0,0 +1,96 @@
+package com.conference.client;
+
+import com.conference.grpc.ChatMessage;
+import com.conference.grpc.Command;
+import com.conference.grpc.ConferenceData;
+import com.conference.grpc.ConferenceServiceGrpc;
+import io.grpc.Metadata;
+import io.grpc.stub.MetadataUtils;
+import io.grpc.stub.StreamObserver;
+
+import java.time.Instant;
+import java.util.List;
+import java.util.UUID;
+import java.util.concurrent.CountDownLatch;
+import java.util.concurrent.TimeUnit;
+import java.util.concurrent.atomic.AtomicBoolean;
+import java.util.concurrent.atomic.AtomicReference;
+
+/**
+ * Joins a room, posts some messages and leaves, with nothing on stdout: what
+ * --message and --stdin do for shell scripts and cron jobs. Failures go to
+ * stderr and the exit code.
+ */
+final class ScriptedPost {
+
+    private static final long JOIN_TIMEOUT_SECONDS = 10;
+    private static final long LEAVE_TIMEOUT_SECONDS = 10;
+
+    private ScriptedPost() {}
+
+    /** Returns the process exit code: 0 unless the join failed or the server turned a message away. */
+    static int run(ConferenceServiceGrpc.ConferenceServiceStub stub, String sender, String roomId, List<String> messages)
+            throws InterruptedException {
+        CountDownLatch welcomed = new CountDownLatch(1);
+        CountDownLatch closed = new CountDownLatch(1);
+        AtomicReference<String> failure = new AtomicReference<>();
+        AtomicBoolean replaying = new AtomicBoolean(false); // the room's history repeats old ROOM_FROZENs
+
+        StreamObserver<ConferenceData> responseObserver = new StreamObserver<>() {
+            @Override public void onNext(ConferenceData data) {
+                if (!data.hasCommand()) return;
+                Command cmd = data.getCommand();
+                if (cmd.getType().equals("WELCOME")) {
+                    welcomed.countDown();
+                } else if (cmd.getType().equals("HISTORY_BEGIN") || cmd.getType().equals("HISTORY_END")) {
+                    replaying.set(cmd.getType().equals("HISTORY_BEGIN"));
+                } else if (!replaying.get() && (cmd.getType().equals("ERROR") || cmd.getType().equals("ROOM_FROZEN"))) {
+                    failure.compareAndSet(null, cmd.getType() + ": " + cmd.getValue());
+                }
+            }
+            @Override public void onError(Throwable t) {
+                failure.compareAndSet(null, t.getMessage());
+                welcomed.countDown();
+                closed.countDown();
+            }
+            @Override public void onCompleted() {
+                welcomed.countDown();
+                closed.countDown();
+            }
+        };
+
+        Metadata metadata = new Metadata();
+        String adminToken = System.getenv("CONFERENCE_ADMIN_TOKEN"); // lets moderators post in frozen rooms
+        if (adminToken != null && !adminToken.isEmpty()) {
+            metadata.put(Metadata.Key.of("admin-token", Metadata.ASCII_STRING_MARSHALLER), adminToken);
+        }
+        StreamObserver<ConferenceData> requestObserver = stub
+                .withInterceptors(MetadataUtils.newAttachHeadersInterceptor(metadata))
+                .joinConference(responseObserver);
+        requestObserver.onNext(ConferenceData.newBuilder().setSender(sender).setRoomId(roomId)
+                .setCommand(Command.newBuilder().setType("JOIN")).build());
+
+        if (!welcomed.await(JOIN_TIMEOUT_SECONDS, TimeUnit.SECONDS)) {
+            failure.compareAndSet(null, "el servidor no respondió al unirse a la sala");
+        }
+        if (failure.get() == null && closed.getCount() > 0) {
+            for (String content : messages) {
+                ChatMessage chat = ChatMessage.newBuilder().setSender(sender).setContent(content).setRoomId(roomId)
+                        .setTimestamp(Instant.now().getEpochSecond()).setTraceId(UUID.randomUUID().toString()).build();
+                requestObserver.onNext(ConferenceData.newBuilder().setSender(sender).setRoomId(roomId)
+                        .setTextMessage(chat).build());
+            }
+        }
+        if (closed.getCount() > 0) {
+            requestObserver.onCompleted(); // a clean leave; the server hangs up once it has read everything
+            if (!closed.await(LEAVE_TIMEOUT_SECONDS, TimeUnit.SECONDS)) {
+                failure.compareAndSet(null, "el servidor no cerró la conexión");
+            }
+        }
+        if (failure.get() != null) {
+            System.err.println("❌ " + failure.get());
+            return 1;
+        }
+        return 0;
+    }
+}
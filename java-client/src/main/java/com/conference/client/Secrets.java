@@ -0,0 +1,27 @@
+package com.conference.client;
+
+import java.util.Arrays;
+
+/**
+ * Secrets the client needs from the user, such as the admin token. Scripts
+ * pass them in an environment variable; otherwise they are asked for on the
+ * terminal with echo off, so they don't end up on screen or in a recording
+ * of the session.
+ */
+final class Secrets {
+
+    private Secrets() {}
+
+    /** The value of env if set, else what the user types after prompt without echo; null if neither. */
+    static String read(String env, String prompt) {
+        String value = System.getenv(env);
+        if (value != null && !value.isEmpty()) return value;
+        java.io.Console console = System.console(); // not our Console, which only writes
+        if (console == null) return null; // no terminal to ask on: scripts must set env
+        char[] typed = console.readPassword("%s", prompt);
+        if (typed == null || typed.length == 0) return null;
+        String secret = new String(typed);
+        Arrays.fill(typed, ' ');
+        return secret;
+    }
+}
@@ -0,0 +1,46 @@
+package com.conference.client;
+
+import com.conference.grpc.ConferenceData;
+import io.grpc.stub.StreamObserver;
+
+/**
+ * The sending half of a session's JoinConference stream, as handed to
+ * everything that sends on it (audio, screen share, transfers). When the
+ * stream breaks the client opens a new one and points the relay at it, so
+ * none of them have to be rebuilt; in between, what they send is dropped.
+ * Sends are serialized, which the gRPC observer itself does not do.
+ */
+final class StreamRelay implements StreamObserver<ConferenceData> {
+
+    private StreamObserver<ConferenceData> call; // null while there is no stream
+
+    synchronized void attach(StreamObserver<ConferenceData> call) {
+        this.call = call;
+    }
+
+    /** Forgets the broken stream; it is already closed, so nothing is sent on it. */
+    synchronized void detach() {
+        this.call = null;
+    }
+
+    synchronized boolean isAttached() {
+        return call != null;
+    }
+
+    @Override
+    public synchronized void onNext(ConferenceData data) {
+        if (call != null) call.onNext(data);
+    }
+
+    @Override
+    public synchronized void onError(Throwable t) {
+        if (call != null) call.onError(t);
+        call = null;
+    }
+
+    @Override
+    public synchronized void onCompleted() {
+        if (call != null) call.onCompleted();
+        call = null;
+    }
+}
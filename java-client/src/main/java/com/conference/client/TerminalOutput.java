@@ -0,0 +1,51 @@
+package com.conference.client;
+
+import org.jline.nativ.Kernel32;
+
+import java.util.regex.Pattern;
+
+/**
+ * Whether the terminal we print to understands escape sequences (colors,
+ * erasing a line, links). Everywhere but Windows they just work. The Windows
+ * console only follows them with virtual terminal processing on, which is
+ * switched on here when the console allows it (Windows 10 and later);
+ * terminals that do it themselves (Windows Terminal, ConEmu, mintty) are
+ * taken at their word. Anywhere else, like the legacy console or output
+ * redirected to a file, ansi() is false: Console then reprints lines instead
+ * of erasing them and leaves the sequences out.
+ */
+final class TerminalOutput {
+
+    private static final int ENABLE_VIRTUAL_TERMINAL_PROCESSING = 0x0004;
+    // CSI sequences (colors, erase) and OSC 8 links, ended by BEL or ESC \
+    private static final Pattern ESCAPES = Pattern.compile("\u001b\\[[0-9;]*[A-Za-z]|\u001b\\][^\u0007\u001b]*(\u0007|\u001b\\\\)");
+    private static final boolean ANSI = detect();
+
+    private TerminalOutput() {}
+
+    static boolean ansi() {
+        return ANSI;
+    }
+
+    /** text as the terminal should get it: as is, or without escape sequences if it would print them raw. */
+    static String forTerminal(String text) {
+        return ANSI ? text : ESCAPES.matcher(text).replaceAll("");
+    }
+
+    private static boolean detect() {
+        if (!System.getProperty("os.name", "").toLowerCase().startsWith("windows")) return true;
+        if (System.getenv("WT_SESSION") != null || System.getenv("TERM") != null
+                || System.getenv("ANSICON") != null || "ON".equals(System.getenv("ConEmuANSI"))) {
+            return true;
+        }
+        try {
+            long out = Kernel32.GetStdHandle(Kernel32.STD_OUTPUT_HANDLE);
+            int[] mode = new int[1];
+            if (Kernel32.GetConsoleMode(out, mode) == 0) return false; // not a console
+            return (mode[0] & ENABLE_VIRTUAL_TERMINAL_PROCESSING) != 0
+                    || Kernel32.SetConsoleMode(out, mode[0] | ENABLE_VIRTUAL_TERMINAL_PROCESSING) != 0;
+        } catch (LinkageError e) {
+            return false; // JLine has no native library for this machine
+        }
+    }
+}
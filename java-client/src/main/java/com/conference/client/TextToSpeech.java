@@ -0,0 +1,133 @@
+package com.conference.client;
+
+import javax.sound.sampled.AudioFormat;
+import javax.sound.sampled.AudioInputStream;
+import javax.sound.sampled.AudioSystem;
+import java.io.File;
+import java.io.IOException;
+import java.io.OutputStream;
+import java.nio.charset.StandardCharsets;
+import java.nio.file.Files;
+import java.util.List;
+import java.util.concurrent.ExecutorService;
+import java.util.concurrent.Executors;
+import java.util.concurrent.atomic.AtomicInteger;
+
+import static com.conference.client.I18n.tr;
+
+/**
+ * Reads chat messages aloud through the local speakers. Speech is produced by
+ * the platform's synthesizer (espeak-ng/espeak, macOS "say", or the .NET
+ * SpeechSynthesizer via PowerShell) into a temporary WAV that is then played
+ * like any other speaker. Messages are spoken one at a time; if they arrive
+ * faster than they can be read, the excess is skipped.
+ */
+public class TextToSpeech {
+
+    public static final String SPEAKER = "tts"; // name under which speech is played
+    private static final int MAX_PENDING = 3;
+    private static final int MAX_CHARS = 300;
+
+    private final AudioStreamer audioStreamer;
+    private final String engine;
+    private final AtomicInteger pending = new AtomicInteger();
+    private final ExecutorService worker = Executors.newSingleThreadExecutor(r -> {
+        Thread t = new Thread(r, "tts");
+        t.setDaemon(true);
+        return t;
+    });
+    private volatile boolean enabled = false;
+    private volatile boolean failed = false;
+
+    /** engine is espeak-ng, espeak, say, powershell, or "auto" to pick one for this OS. */
+    public TextToSpeech(AudioStreamer audioStreamer, String engine) {
+        this.audioStreamer = audioStreamer;
+        this.engine = engine.equals("auto") ? defaultEngine() : engine;
+    }
+
+    private static String defaultEngine() {
+        String os = System.getProperty("os.name").toLowerCase();
+        if (os.contains("win")) return "powershell";
+        if (os.contains("mac")) return "say";
+        return "espeak-ng";
+    }
+
+    public boolean isEnabled() { return enabled; }
+    public String getEngine() { return engine; }
+
+    public void setEnabled(boolean enabled) {
+        this.enabled = enabled;
+        this.failed = false;
+    }
+
+    /** Queues text to be spoken; does nothing while disabled or with the speakers off. */
+    public void speak(String text) {
+        if (!enabled || failed || !audioStreamer.isSpeakersActive()) return;
+        if (pending.incrementAndGet() > MAX_PENDING) {
+            pending.decrementAndGet();
+            return;
+        }
+        String clipped = text.length() > MAX_CHARS ? text.substring(0, MAX_CHARS) : text;
+        worker.execute(() -> {
+            try {
+                play(clipped);
+            } finally {
+                pending.decrementAndGet();
+            }
+        });
+    }
+
+    private void play(String text) {
+        File wav = null;
+        try {
+            wav = File.createTempFile("elochat-tts", ".wav");
+            synthesize(text, wav);
+            try (AudioInputStream in = AudioSystem.getAudioInputStream(wav)) {
+                AudioFormat src = in.getFormat();
+                AudioFormat pcm = new AudioFormat(src.getSampleRate(), 16, src.getChannels(), true, false);
+                try (AudioInputStream converted = AudioSystem.getAudioInputStream(pcm, in)) {
+                    audioStreamer.playLocal(SPEAKER, converted.readAllBytes(), (int) pcm.getSampleRate(), pcm.getChannels());
+                }
+            }
+        } catch (Exception e) {
+            // Most likely the synthesizer isn't installed; don't retry for every message
+            failed = true;
+            System.err.println(tr("audio.tts_unavailable", engine, e.getMessage()));
+        } finally {
+            if (wav != null) wav.delete();
+        }
+    }
+
+    // The text goes in on stdin so it is never parsed as options or shell syntax
+    private void synthesize(String text, File wav) throws IOException, InterruptedException {
+        List<String> command;
+        switch (engine) {
+            case "espeak-ng":
+            case "espeak":
+                command = List.of(engine, "-v", "es", "--stdin", "-w", wav.getPath());
+                break;
+            case "say":
+                command = List.of("say", "--data-format=LEI16@22050", "-o", wav.getPath(), "-f", "-");
+                break;
+            case "powershell":
+                command = List.of("powershell", "-NoProfile", "-Command",
+                        "Add-Type -AssemblyName System.Speech; "
+                                + "$s = New-Object System.Speech.Synthesis.SpeechSynthesizer; "
+                                + "$s.SetOutputToWaveFile($env:ELOCHAT_TTS_WAV); "
+                                + "$s.Speak([Console]::In.ReadToEnd()); $s.Dispose()");
+                break;
+            default:
+                throw new IOException("motor desconocido '" + engine + "'");
+        }
+        ProcessBuilder pb = new ProcessBuilder(command).redirectErrorStream(true);
+        pb.environment().put("ELOCHAT_TTS_WAV", wav.getPath());
+        Process p = pb.start();
+        try (OutputStream stdin = p.getOutputStream()) {
+            stdin.write(text.getBytes(StandardCharsets.UTF_8));
+        }
+        String output = new String(p.getInputStream().readAllBytes(), StandardCharsets.UTF_8).trim();
+        if (p.waitFor() != 0 || Files.size(wav.toPath()) == 0) {
+            throw new IOException(output.isEmpty() ? tr("audio.tts_failed") : output);
+        }
+    }
+}
@@ -0,0 +1,59 @@
+package com.conference.client;
+
+import java.util.List;
+import java.util.regex.Matcher;
+import java.util.regex.Pattern;
+
+/**
+ * Colors for the chat: every user gets a color of their own, picked from
+ * their name so it is the same in every session and for everyone, and
+ * mentions of us stand out. "dark" and "light" are palettes readable on that
+ * kind of background; "none" prints no colors, and is what you get whenever
+ * NO_COLOR is set (https://no-color.org).
+ */
+public final class Theme {
+
+    public static final List<String> NAMES = List.of("dark", "light", "none");
+
+    // xterm-256 colors, chosen to tell apart on the background and from each other
+    private static final int[] DARK = {203, 114, 221, 75, 177, 80, 215, 147};
+    private static final int[] LIGHT = {124, 28, 130, 25, 90, 30, 166, 54};
+    private static final String MENTION = "\u001b[30;43m"; // black on yellow, on either background
+
+    private final String name;
+    private final int[] palette; // null: no colors
+
+    private Theme(String name, int[] palette) {
+        this.name = name;
+        this.palette = palette;
+    }
+
+    /** The named theme, or none when NO_COLOR is set; throws IllegalArgumentException for unknown names. */
+    public static Theme named(String name) {
+        String noColor = System.getenv("NO_COLOR");
+        if (noColor != null && !noColor.isEmpty()) return new Theme("none", null);
+        switch (name) {
+            case "dark": return new Theme(name, DARK);
+            case "light": return new Theme(name, LIGHT);
+            case "none": return new Theme(name, null);
+            default: throw new IllegalArgumentException("tema desconocido: " + name);
+        }
+    }
+
+    public String getName() { return name; }
+
+    public boolean hasColors() { return palette != null; }
+
+    /** user in their color. Only the foreground is reset, so it can sit inside bold or dim text. */
+    public String user(String user) {
+        if (palette == null || user.isEmpty()) return user;
+        return "\u001b[38;5;" + palette[Math.floorMod(user.hashCode(), palette.length)] + "m" + user + "\u001b[39m";
+    }
+
+    /** text with every @me highlighted. */
+    public String mentions(String text, String me) {
+        if (palette == null || me == null || me.isEmpty()) return text;
+        Matcher m = Pattern.compile("@" + Pattern.quote(me) + "(?![\\w.-])", Pattern.CASE_INSENSITIVE).matcher(text);
+        return m.replaceAll(r -> MENTION + Matcher.quoteReplacement(r.group()) + "\u001b[39;49m");
+    }
+}
@@ -0,0 +1,71 @@
+package com.conference.client;
+
+import java.time.DateTimeException;
+import java.time.Duration;
+import java.time.Instant;
+import java.time.ZoneId;
+import java.time.ZonedDateTime;
+import java.time.format.DateTimeFormatter;
+import java.util.Locale;
+
+/**
+ * How the time in front of each message is shown: 24 or 12 hour clock, in
+ * the system's time zone or another one, either as the time of day or
+ * relative to now ("hace 5 min"), and taken from the message's server
+ * timestamp or from when it arrived here. The prompt always shows the clock.
+ */
+public final class Timestamps {
+
+    private final DateTimeFormatter clock, withDate;
+    private final ZoneId zone;
+    private final boolean relative;
+    private final boolean local; // the time the message arrived rather than the server's timestamp
+
+    /**
+     * clock is "24h" or "12h", zone a zone id or "" for the system's, style
+     * "absolute" or "relative", source "server" or "local". Throws
+     * IllegalArgumentException for anything else.
+     */
+    public Timestamps(String clock, String zone, String style, String source) {
+        if (!clock.equals("24h") && !clock.equals("12h")) throw new IllegalArgumentException("time.clock: " + clock);
+        if (!style.equals("absolute") && !style.equals("relative")) throw new IllegalArgumentException("time.style: " + style);
+        if (!source.equals("server") && !source.equals("local")) throw new IllegalArgumentException("time.source: " + source);
+        try {
+            this.zone = zone.isEmpty() ? ZoneId.systemDefault() : ZoneId.of(zone);
+        } catch (DateTimeException e) {
+            throw new IllegalArgumentException("time.zone: " + zone);
+        }
+        String pattern = clock.equals("24h") ? "HH:mm" : "h:mm a";
+        this.clock = DateTimeFormatter.ofPattern(pattern, Locale.US);
+        this.withDate = DateTimeFormatter.ofPattern("dd/MM " + pattern, Locale.US);
+        this.relative = style.equals("relative");
+        this.local = source.equals("local");
+    }
+
+    /** The default: the system's zone, 24 hours, as the server stamped it. */
+    public static Timestamps standard() {
+        return new Timestamps("24h", "", "absolute", "server");
+    }
+
+    /** The time of a message stamped epochSeconds by the server (0 if it didn't). */
+    public String message(long epochSeconds) {
+        Instant at = local || epochSeconds == 0 ? Instant.now() : Instant.ofEpochSecond(epochSeconds);
+        if (!relative) return format(at);
+        long seconds = Duration.between(at, Instant.now()).getSeconds();
+        if (seconds < 60) return "ahora";
+        if (seconds < 3600) return "hace " + seconds / 60 + " min";
+        if (seconds < 86400) return "hace " + seconds / 3600 + " h";
+        return format(at);
+    }
+
+    /** The time of day now, for the prompt. */
+    public String now() {
+        return ZonedDateTime.now(zone).format(clock);
+    }
+
+    // Messages from another day get the date as well
+    private String format(Instant at) {
+        ZonedDateTime t = at.atZone(zone);
+        return t.toLocalDate().equals(ZonedDateTime.now(zone).toLocalDate()) ? t.format(clock) : t.format(withDate);
+    }
+}
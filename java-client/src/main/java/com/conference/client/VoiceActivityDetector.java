@@ -0,0 +1,52 @@
+package com.conference.client;
+
+/**
+ * Energy-based voice activity detector for 16-bit little-endian PCM.
+ * A chunk counts as speech when its RMS is above the threshold; after speech
+ * stops, chunks keep flowing for a hangover window so word endings aren't cut.
+ */
+public class VoiceActivityDetector {
+
+    public static final double DEFAULT_THRESHOLD = 500.0; // RMS on the 16-bit scale
+    public static final int DEFAULT_HANGOVER_CHUNKS = 25;  // ~290 ms with 1024-byte chunks at 44.1 kHz
+
+    private volatile boolean enabled = true;
+    private volatile double threshold;
+    private final int hangoverChunks;
+    private int hangoverLeft = 0;
+
+    public VoiceActivityDetector(double threshold, int hangoverChunks) {
+        this.threshold = threshold;
+        this.hangoverChunks = hangoverChunks;
+    }
+
+    /** Returns true if the chunk should be sent. */
+    public boolean shouldSend(byte[] pcm, int length) {
+        if (!enabled) return true;
+        if (rms(pcm, length) >= threshold) {
+            hangoverLeft = hangoverChunks;
+            return true;
+        }
+        if (hangoverLeft > 0) {
+            hangoverLeft--;
+            return true;
+        }
+        return false;
+    }
+
+    public static double rms(byte[] pcm, int length) {
+        int samples = length / 2;
+        if (samples == 0) return 0;
+        double sum = 0;
+        for (int i = 0; i + 1 < length; i += 2) {
+            short sample = (short) ((pcm[i] & 0xff) | (pcm[i + 1] << 8));
+            sum += (double) sample * sample;
+        }
+        return Math.sqrt(sum / samples);
+    }
+
+    public boolean isEnabled() { return enabled; }
+    public void setEnabled(boolean enabled) { this.enabled = enabled; }
+    public double getThreshold() { return threshold; }
+    public void setThreshold(double threshold) { this.threshold = threshold; }
+}